@@ -49,6 +49,13 @@ func main() {
 	flag.DurationVar(&cfg.PollInterval.Duration, "p", time.Second*2, "polling metrics interval in the format 2s")
 	flag.StringVar(&cfg.SecretKey, "k", "", "key for hash metrics")
 	flag.StringVar(&cfg.CryptoKey, "crypto-key", "", "public agent crypto key")
+	flag.StringVar(&cfg.Token, "token", "", "agent bearer token")
+	flag.BoolVar(&cfg.TLS, "tls", false, "connect to server over tls")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "agent tls client certificate file")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "agent tls client private key file")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "server CA file, empty uses system CAs")
+	flag.StringVar(&cfg.TLSServerName, "tls-server-name", "", "server name for certificate verification")
+	flag.StringVar(&cfg.Compress, "compress", "", "batch compression gzip or zstd, empty disables compression")
 
 	// Сначала аргументы командной строки
 	flag.Parse()
@@ -0,0 +1,291 @@
+// keytool - утилита для ключей шифрования метрик агента и сервера:
+// создает пару ключей, конвертирует приватный ключ между PKCS#1 и PKCS#8,
+// печатает идентификаторы и отпечатки ключей, проверяет, что публичный ключ соответствует приватному
+package main
+
+import (
+	"crypto/rand"
+	cryptorsa "crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ncyellow/devops/internal/crypto/rsa"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	buildVersion = "N/A"
+	buildDate    = "N/A"
+	buildCommit  = "N/A"
+)
+
+// minKeyBits минимальный размер ключа rsa
+const minKeyBits = 2048
+
+const usage = `usage: keytool <command> [flags]
+
+commands:
+  generate     create a key pair: private key for the server (-crypto-key), public key for the agent
+  convert      convert a private key between pkcs1 and pkcs8, encrypt or decrypt it with a password
+  fingerprint  print key id and sha256 fingerprint of public or private key files
+  verify       check that a public key matches a private key
+  version      print build version
+
+run "keytool <command> -h" for command flags
+`
+
+// errMismatch публичный ключ не соответствует приватному
+var errMismatch = errors.New("public key does not match private key")
+
+func main() {
+	//! Утилита командной строки - ошибки печатаем текстом, а не json
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: true, PartsExclude: []string{zerolog.TimestampFieldName}})
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	// справка по -h уже напечатана флагами
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Fatal().Msgf("keytool: %s", err.Error())
+	}
+}
+
+// run выполняет команду args[0] с флагами args[1:], результат пишет в stdout, справку - в stderr
+func run(args []string, stdout io.Writer, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errors.New("no command")
+	}
+	flags := flag.NewFlagSet("keytool "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	switch args[0] {
+	case "generate":
+		return generate(flags, args[1:], stdout)
+	case "convert":
+		return convert(flags, args[1:], stdout)
+	case "fingerprint":
+		return fingerprint(flags, args[1:], stdout)
+	case "verify":
+		return verify(flags, args[1:], stdout)
+	case "version":
+		fmt.Fprintf(stdout, "Build version: %s\nBuild date: %s\nBuild commit: %s\n", buildVersion, buildDate, buildCommit)
+		return nil
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stderr, usage)
+		return nil
+	}
+	fmt.Fprint(stderr, usage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// generate создает пару ключей rsa
+func generate(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	bits := flags.Int("bits", 3072, "key size in bits")
+	privateFile := flags.String("private", "rsa.private", "private key file")
+	publicFile := flags.String("public", "rsa.public", "public key file")
+	format := flags.String("format", string(rsa.PKCS1), "private key format: pkcs1 or pkcs8")
+	passwordFile := flags.String("password-file", "", "file with a password to encrypt the private key, implies pkcs8")
+	force := flags.Bool("force", false, "overwrite existing files")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bits < minKeyBits {
+		return fmt.Errorf("key size %d is less than %d bits", *bits, minKeyBits)
+	}
+	password, err := readPassword(*passwordFile)
+	if err != nil {
+		return err
+	}
+	keyFormat := rsa.KeyFormat(*format)
+	if len(password) > 0 {
+		keyFormat = rsa.PKCS8
+	}
+
+	key, err := cryptorsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return err
+	}
+	privatePEM, err := rsa.MarshalPrivateKeyPEM(key, keyFormat, password)
+	if err != nil {
+		return err
+	}
+	publicPEM, err := rsa.MarshalPublicKeyPEM(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	//! Проверяем оба файла до записи, чтобы не оставить приватный ключ без пары
+	if !*force {
+		for _, fileName := range []string{*privateFile, *publicFile} {
+			if _, err := os.Stat(fileName); err == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite", fileName)
+			}
+		}
+	}
+	if err := writeFile(*privateFile, privatePEM, 0600, *force); err != nil {
+		return err
+	}
+	if err := writeFile(*publicFile, publicPEM, 0644, *force); err != nil {
+		// приватный ключ без публичного агенту не передать, удаляем его
+		if removeErr := os.Remove(*privateFile); removeErr != nil {
+			return fmt.Errorf("%w, remove %s: %s", err, *privateFile, removeErr.Error())
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "key id %s\nprivate key %s\npublic key %s\n", rsa.KeyID(&key.PublicKey), *privateFile, *publicFile)
+	return nil
+}
+
+// convert перезаписывает приватный ключ в другом формате
+func convert(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	in := flags.String("in", "", "source private key file")
+	out := flags.String("out", "", "destination private key file")
+	format := flags.String("format", string(rsa.PKCS8), "destination format: pkcs1 or pkcs8")
+	inPasswordFile := flags.String("in-password-file", "", "file with a password of the encrypted source key")
+	outPasswordFile := flags.String("out-password-file", "", "file with a password to encrypt the destination key, implies pkcs8")
+	force := flags.Bool("force", false, "overwrite existing destination file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" || *out == "" {
+		return errors.New("-in and -out are required")
+	}
+	key, err := readPrivateKey(*in, *inPasswordFile)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(*outPasswordFile)
+	if err != nil {
+		return err
+	}
+	keyFormat := rsa.KeyFormat(*format)
+	if len(password) > 0 {
+		keyFormat = rsa.PKCS8
+	}
+	data, err := rsa.MarshalPrivateKeyPEM(key, keyFormat, password)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(*out, data, 0600, *force); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "key id %s\nprivate key %s (%s)\n", rsa.KeyID(&key.PublicKey), *out, keyFormat)
+	return nil
+}
+
+// fingerprint печатает идентификатор и отпечаток каждого ключа: файл, key id, sha256
+func fingerprint(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	passwordFile := flags.String("password-file", "", "file with a password of encrypted private keys")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("no key files")
+	}
+	for _, fileName := range flags.Args() {
+		publicKey, err := readAnyKey(fileName, *passwordFile)
+		if err != nil {
+			return err
+		}
+		sum := rsa.Fingerprint(publicKey)
+		fmt.Fprintf(stdout, "%s\t%s\tSHA256:%s\n", fileName, rsa.KeyID(publicKey), hex.EncodeToString(sum[:]))
+	}
+	return nil
+}
+
+// verify проверяет, что публичный ключ агента соответствует приватному ключу сервера
+func verify(flags *flag.FlagSet, args []string, stdout io.Writer) error {
+	publicFile := flags.String("public", "", "public key file")
+	privateFile := flags.String("private", "", "private key file")
+	passwordFile := flags.String("password-file", "", "file with a password of the encrypted private key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *publicFile == "" || *privateFile == "" {
+		return errors.New("-public and -private are required")
+	}
+	publicKey, err := rsa.ReadRSAPublicKey(*publicFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *publicFile, err)
+	}
+	privateKey, err := readPrivateKey(*privateFile, *passwordFile)
+	if err != nil {
+		return err
+	}
+	if !publicKey.Equal(&privateKey.PublicKey) {
+		return fmt.Errorf("%w: %s has key id %s, %s has key id %s", errMismatch,
+			*publicFile, rsa.KeyID(publicKey), *privateFile, rsa.KeyID(&privateKey.PublicKey))
+	}
+	fmt.Fprintf(stdout, "ok, key id %s\n", rsa.KeyID(publicKey))
+	return nil
+}
+
+// readPassword читает пароль из файла, перевод строки в конце файла отбрасывается. Пустое имя - без пароля
+func readPassword(fileName string) ([]byte, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return nil, fmt.Errorf("%s: empty password", fileName)
+	}
+	return []byte(password), nil
+}
+
+// readPrivateKey читает приватный ключ, зашифрованный ключ - паролем из passwordFile
+func readPrivateKey(fileName string, passwordFile string) (*cryptorsa.PrivateKey, error) {
+	password, err := readPassword(passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.ReadRSAPrivateKeyWithPassword(fileName, password)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return key, nil
+}
+
+// readAnyKey публичный ключ из файла публичного или приватного ключа
+func readAnyKey(fileName string, passwordFile string) (*cryptorsa.PublicKey, error) {
+	if publicKey, err := rsa.ReadRSAPublicKey(fileName); err == nil {
+		return publicKey, nil
+	}
+	privateKey, err := readPrivateKey(fileName, passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	return &privateKey.PublicKey, nil
+}
+
+// writeFile записывает файл, существующий файл перезаписывается только с force
+func writeFile(fileName string, data []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(fileName, flags, perm)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists, use -force to overwrite", fileName)
+		}
+		return err
+	}
+	//! Перезаписываемый файл сохраняет свои права, поэтому выставляем perm до записи ключа
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
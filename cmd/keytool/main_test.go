@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/crypto/rsa"
+)
+
+// runKeytool выполняет команду keytool и возвращает ее вывод
+func runKeytool(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+// pemType тип первого блока PEM файла
+func pemType(t *testing.T, fileName string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(fileName)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	return block.Type
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		password string
+		pemType  string
+	}{
+		{name: "pkcs1", format: "pkcs1", pemType: "RSA PRIVATE KEY"},
+		{name: "pkcs8", format: "pkcs8", pemType: "PRIVATE KEY"},
+		{name: "pkcs8 with password", format: "pkcs1", password: "secret", pemType: "ENCRYPTED PRIVATE KEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			privateFile := filepath.Join(dir, "rsa.private")
+			publicFile := filepath.Join(dir, "rsa.public")
+			args := []string{"generate", "-bits", "2048", "-format", tt.format, "-private", privateFile, "-public", publicFile}
+			if tt.password != "" {
+				passwordFile := filepath.Join(dir, "password.txt")
+				require.NoError(t, ioutil.WriteFile(passwordFile, []byte(tt.password+"\n"), 0600))
+				args = append(args, "-password-file", passwordFile)
+			}
+			out, err := runKeytool(t, args...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.pemType, pemType(t, privateFile))
+
+			privateKey, err := rsa.ReadRSAPrivateKeyWithPassword(privateFile, []byte(tt.password))
+			require.NoError(t, err)
+			publicKey, err := rsa.ReadRSAPublicKey(publicFile)
+			require.NoError(t, err)
+			assert.True(t, publicKey.Equal(&privateKey.PublicKey))
+			assert.True(t, strings.HasPrefix(out, "key id "+rsa.KeyID(publicKey)+"\n"), out)
+
+			info, err := os.Stat(privateFile)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		})
+	}
+}
+
+func TestGenerateExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	privateFile := filepath.Join(dir, "rsa.private")
+	publicFile := filepath.Join(dir, "rsa.public")
+	require.NoError(t, ioutil.WriteFile(publicFile, []byte("existing"), 0644))
+
+	// существующий файл без -force не перезаписывается, приватный ключ без пары не создается
+	_, err := runKeytool(t, "generate", "-bits", "2048", "-private", privateFile, "-public", publicFile)
+	assert.ErrorContains(t, err, "use -force to overwrite")
+	assert.NoFileExists(t, privateFile)
+	data, err := ioutil.ReadFile(publicFile)
+	require.NoError(t, err)
+	assert.Equal(t, "existing", string(data))
+
+	// перезаписанный приватный ключ не наследует права существующего файла
+	require.NoError(t, ioutil.WriteFile(privateFile, []byte("existing"), 0644))
+	require.NoError(t, os.Chmod(privateFile, 0644))
+	_, err = runKeytool(t, "generate", "-bits", "2048", "-private", privateFile, "-public", publicFile, "-force")
+	require.NoError(t, err)
+	_, err = rsa.ReadRSAPublicKey(publicFile)
+	assert.NoError(t, err)
+	info, err := os.Stat(privateFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// если публичный ключ записать не удалось, приватный удаляется
+	otherPrivate := filepath.Join(dir, "other.private")
+	_, err = runKeytool(t, "generate", "-bits", "2048", "-private", otherPrivate, "-public", filepath.Join(dir, "nodir", "other.public"))
+	assert.Error(t, err)
+	assert.NoFileExists(t, otherPrivate)
+
+	_, err = runKeytool(t, "generate", "-bits", "1024")
+	assert.ErrorContains(t, err, "less than 2048 bits")
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	want, err := rsa.ReadRSAPrivateKey("../../internal/crypto/rsa/test_data/rsa.private")
+	require.NoError(t, err)
+
+	pkcs8File := filepath.Join(dir, "rsa8.private")
+	out, err := runKeytool(t, "convert", "-in", "../../internal/crypto/rsa/test_data/rsa.private", "-out", pkcs8File, "-format", "pkcs8")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("key id %s\nprivate key %s (pkcs8)\n", rsa.KeyID(&want.PublicKey), pkcs8File), out)
+	assert.Equal(t, "PRIVATE KEY", pemType(t, pkcs8File))
+
+	pkcs1File := filepath.Join(dir, "rsa1.private")
+	_, err = runKeytool(t, "convert", "-in", pkcs8File, "-out", pkcs1File, "-format", "pkcs1")
+	require.NoError(t, err)
+	assert.Equal(t, "RSA PRIVATE KEY", pemType(t, pkcs1File))
+	key, err := rsa.ReadRSAPrivateKey(pkcs1File)
+	require.NoError(t, err)
+	assert.True(t, want.Equal(key))
+
+	// зашифрованный ключ расшифровывается паролем
+	passwordFile := filepath.Join(dir, "password.txt")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte("secret"), 0600))
+	decryptedFile := filepath.Join(dir, "decrypted.private")
+	_, err = runKeytool(t, "convert", "-in", "../../internal/crypto/rsa/test_data/formats/rsa_encrypted.private",
+		"-in-password-file", passwordFile, "-out", decryptedFile, "-format", "pkcs1")
+	require.NoError(t, err)
+	key, err = rsa.ReadRSAPrivateKey(decryptedFile)
+	require.NoError(t, err)
+	assert.True(t, want.Equal(key))
+
+	// существующий файл без -force не перезаписывается
+	_, err = runKeytool(t, "convert", "-in", pkcs8File, "-out", pkcs1File, "-format", "pkcs1")
+	assert.ErrorContains(t, err, "use -force to overwrite")
+	_, err = runKeytool(t, "convert", "-in", pkcs8File)
+	assert.Error(t, err)
+}
+
+func TestFingerprint(t *testing.T) {
+	publicFile := "../../internal/crypto/rsa/test_data/rsa.public"
+	privateFile := "../../internal/crypto/rsa/test_data/rsa.private"
+	publicKey, err := rsa.ReadRSAPublicKey(publicFile)
+	require.NoError(t, err)
+	sum := rsa.Fingerprint(publicKey)
+
+	out, err := runKeytool(t, "fingerprint", publicFile, privateFile)
+	require.NoError(t, err)
+	want := fmt.Sprintf("%[1]s\t%[3]s\tSHA256:%[4]s\n%[2]s\t%[3]s\tSHA256:%[4]s\n",
+		publicFile, privateFile, rsa.KeyID(publicKey), hex.EncodeToString(sum[:]))
+	assert.Equal(t, want, out)
+
+	_, err = runKeytool(t, "fingerprint")
+	assert.Error(t, err)
+	_, err = runKeytool(t, "fingerprint", "../../internal/crypto/rsa/test_data/formats/rsa_encrypted.private")
+	assert.ErrorIs(t, err, rsa.ErrPasswordRequired)
+}
+
+func TestVerify(t *testing.T) {
+	out, err := runKeytool(t, "verify",
+		"-public", "../../internal/crypto/rsa/test_data/rsa.public",
+		"-private", "../../internal/crypto/rsa/test_data/rsa.private")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "ok, key id "), out)
+
+	_, err = runKeytool(t, "verify",
+		"-public", "../../internal/crypto/rsa/test_data/rsa2.public",
+		"-private", "../../internal/crypto/rsa/test_data/rsa.private")
+	assert.ErrorIs(t, err, errMismatch)
+
+	_, err = runKeytool(t, "verify", "-public", "../../internal/crypto/rsa/test_data/rsa.public")
+	assert.Error(t, err)
+}
+
+func TestRunCommands(t *testing.T) {
+	_, err := runKeytool(t)
+	assert.Error(t, err)
+	_, err = runKeytool(t, "unknown")
+	assert.ErrorContains(t, err, "unknown command")
+	out, err := runKeytool(t, "version")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Build version: N/A")
+	_, err = runKeytool(t, "help")
+	assert.NoError(t, err)
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -11,6 +12,7 @@ import (
 	"github.com/caarlos0/env/v6"
 	"github.com/ncyellow/devops/internal/server"
 	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/middlewares"
 )
 
 var (
@@ -46,13 +48,36 @@ func main() {
 
 	flag.StringVar(&cfg.GRPCAddress, "grpc", "", "grpc endpoint")
 	flag.StringVar(&cfg.Address, "a", "localhost:8080", "address in the format host:port")
+	flag.StringVar(&cfg.StatsDAddress, "statsd", "", "statsd udp and tcp address in the format host:port")
+	flag.DurationVar(&cfg.StatsDFlushInterval.Duration, "statsd-flush", time.Second*10, "statsd aggregation interval")
+	flag.StringVar(&cfg.GraphiteAddress, "graphite", "", "graphite plaintext tcp address in the format host:port")
 	flag.DurationVar(&cfg.StoreInterval.Duration, "i", time.Second*300, "store interval in the format 300s")
 	flag.BoolVar(&cfg.Restore, "r", true, "restore from file. true if needed")
 	flag.StringVar(&cfg.StoreFile, "f", "/tmp/devops-metrics-db.json", "filename that used for save metrics state")
 	flag.StringVar(&cfg.SecretKey, "k", "", "key for hash metrics")
 	flag.StringVar(&cfg.CryptoKey, "crypto-key", "", "private server crypto key")
+	flag.Func("crypto-keys", "additional private key files or directories separated by comma, for key rotation", func(value string) error {
+		cfg.CryptoKeys = strings.Split(value, ",")
+		return nil
+	})
+	flag.Func("stream-origins", "origins allowed to open /api/ws besides the server itself, separated by comma", func(value string) error {
+		cfg.StreamOrigins = strings.Split(value, ",")
+		return nil
+	})
 	flag.StringVar(&cfg.DatabaseConn, "d", "", "connection string to postgresql")
 	flag.StringVar(&cfg.TrustedSubNet, "t", "", "trusted subnet cidr")
+	flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "proxies cidr whose X-Real-IP identifies the client for rate limiting")
+	flag.Float64Var(&cfg.RateLimit, "rate-limit", 0, "max write requests per second per client, 0 disables rate limiting")
+	flag.IntVar(&cfg.RateBurst, "rate-burst", 10, "write requests burst per client")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "server tls certificate file, empty disables tls")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "server tls private key file")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "client CA file, enables client certificate authentication")
+	flag.StringVar(&cfg.TokensFile, "tokens", "", "agent tokens file, empty disables authentication")
+	flag.Int64Var(&cfg.MaxBodySize, "max-body-size", middlewares.DefaultMaxBodySize, "max decompressed request body size in bytes")
+	flag.DurationVar(&cfg.HistoryRetention.Duration, "history-retention", time.Hour, "metric history retention in the format 1h, 0 disables history")
+	flag.IntVar(&cfg.HistorySize, "history-size", 1000, "max history samples per metric series")
+	flag.DurationVar(&cfg.MetricTTL.Duration, "metric-ttl", 0, "metric expiry after last update in the format 24h, 0 disables expiry")
+	flag.IntVar(&cfg.RepositoryShards, "repo-shards", 0, "number of metric repository shards, 0 disables sharding")
 
 	// Сначала парсим командную строку
 	flag.Parse()
@@ -43,6 +43,7 @@ func (collector *Agent) Run() error {
 	runtimeCol := &Collector{
 		Conf:   collector.Conf.GeneralCfg(),
 		Source: &RuntimeSource{},
+		Labels: collector.Conf.Labels,
 	}
 	wg.Add(1)
 	go RunCollector(ctx, collector.Conf, runtimeCol, metricChannel, &wg)
@@ -51,6 +52,7 @@ func (collector *Agent) Run() error {
 	psUtilCol := &Collector{
 		Conf:   collector.Conf.GeneralCfg(),
 		Source: NewPSUtilSource(),
+		Labels: collector.Conf.Labels,
 	}
 	wg.Add(1)
 	go RunCollector(ctx, collector.Conf, psUtilCol, metricChannel, &wg)
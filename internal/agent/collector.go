@@ -21,6 +21,8 @@ import (
 type Collector struct {
 	Conf   *genconfig.GeneralConfig
 	Source MetricSource
+	// Labels метки, которые добавляются ко всем метрикам источника, например host агента
+	Labels repository.Labels
 }
 
 func (c *Collector) Update() {
@@ -30,8 +32,8 @@ func (c *Collector) Update() {
 }
 
 func (c *Collector) ToMetrics() []repository.Metrics {
-	allMetrics := prepareGauges(c.Source.Gauges(), c.Conf.SecretKey)
-	counters := prepareCounters(c.Source.Counters(), c.Conf.SecretKey)
+	allMetrics := prepareGauges(c.Source.Gauges(), c.Labels, c.Conf.SecretKey)
+	counters := prepareCounters(c.Source.Counters(), c.Labels, c.Conf.SecretKey)
 	allMetrics = append(allMetrics, counters...)
 	return allMetrics
 }
@@ -57,16 +59,17 @@ func RunCollector(ctx context.Context, conf *config.Config, collector *Collector
 }
 
 // prepareGauges - преобразование метрик Gauge в []repository.Metrics
-func prepareGauges(gauges map[string]float64, secretKey string) []repository.Metrics {
+func prepareGauges(gauges map[string]float64, labels repository.Labels, secretKey string) []repository.Metrics {
 	hashFunc := hash.CreateEncodeFunc(secretKey)
 	result := make([]repository.Metrics, 0, len(gauges))
 	for name, value := range gauges {
 		// Если пользоваться value, то все значения будут ссылаться на одну и ту же переменную - последнюю
 		gaugeValue := value
 		metric := repository.Metrics{
-			ID:    name,
-			MType: repository.Gauge,
-			Value: &gaugeValue,
+			ID:     name,
+			Labels: labels,
+			MType:  repository.Gauge,
+			Value:  &gaugeValue,
 		}
 		metric.Hash = metric.CalcHash(hashFunc)
 		result = append(result, metric)
@@ -75,16 +78,17 @@ func prepareGauges(gauges map[string]float64, secretKey string) []repository.Met
 }
 
 // prepareCounters - преобразование метрик Counter в []repository.Metrics
-func prepareCounters(counters map[string]int64, secretKey string) []repository.Metrics {
+func prepareCounters(counters map[string]int64, labels repository.Labels, secretKey string) []repository.Metrics {
 	hashFunc := hash.CreateEncodeFunc(secretKey)
 	result := make([]repository.Metrics, 0, len(counters))
 	for name, value := range counters {
 		// Если пользоваться value, то все значения будут ссылаться на одну и ту же переменную - последнюю
 		counterValue := value
 		metric := repository.Metrics{
-			ID:    name,
-			MType: repository.Counter,
-			Delta: &counterValue,
+			ID:     name,
+			Labels: labels,
+			MType:  repository.Counter,
+			Delta:  &counterValue,
 		}
 		metric.Hash = metric.CalcHash(hashFunc)
 		result = append(result, metric)
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressGZIP сжатие пачек метрик gzip
+	CompressGZIP = "gzip"
+	// CompressZSTD сжатие пачек метрик zstd, по grpc поддерживается только для зашифрованных пачек
+	CompressZSTD = "zstd"
+)
+
+// compressBody сжимает data алгоритмом encoding, значение encoding передается серверу в Content-Encoding
+// либо в конверте зашифрованного сообщения
+func compressBody(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case CompressGZIP:
+		gz, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	case CompressZSTD:
+		zw, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %s", encoding)
+	}
+	return buf.Bytes(), nil
+}
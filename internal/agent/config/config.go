@@ -3,6 +3,7 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 
 	"github.com/ncyellow/devops/internal/genconfig"
@@ -14,6 +15,18 @@ type Config struct {
 	genconfig.GeneralConfig
 	ReportInterval genconfig.Duration `env:"REPORT_INTERVAL" json:"report_interval"`
 	PollInterval   genconfig.Duration `env:"POLL_INTERVAL" json:"poll_interval"`
+	// Labels метки агента, добавляются ко всем метрикам. В env задаются как LABELS=host:web1,region:eu
+	Labels map[string]string `env:"LABELS" json:"labels"`
+	// Compress сжатие пачек метрик gzip или zstd, пусто - без сжатия. Если включено шифрование,
+	// пачка сжимается до шифрования и кодировка передается в конверте. По grpc без шифрования
+	// поддерживается только gzip
+	Compress string `env:"COMPRESS" json:"compress"`
+	// Token токен агента, передается серверу в заголовке Authorization: Bearer, пусто - без токена
+	Token string `env:"TOKEN" json:"token"`
+	// TLS подключение к серверу по tls. Включается и без этого флага, если задан TLSCA или TLSCert
+	TLS bool `env:"TLS" json:"tls"`
+	// TLSServerName имя сервера для проверки его сертификата, пусто - имя из адреса
+	TLSServerName string `env:"TLS_SERVER_NAME" json:"tls_server_name"`
 }
 
 func ReadConfig(fileName string) Config {
@@ -31,3 +44,19 @@ func ReadConfig(fileName string) Config {
 	}
 	return cfg
 }
+
+// TLSEnabled подключается ли агент к серверу по tls
+func (c *Config) TLSEnabled() bool {
+	return c.TLS || c.TLSCA != "" || c.TLSCert != ""
+}
+
+// GoString вывод настроек через %#v для журнала запуска. Токен агента скрыт
+func (c Config) GoString() string {
+	// config без методов, иначе %#v снова вызовет GoString
+	type config Config
+	safe := config(c)
+	if safe.Token != "" {
+		safe.Token = "***"
+	}
+	return fmt.Sprintf("%#v", safe)
+}
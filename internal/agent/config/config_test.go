@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -54,3 +55,11 @@ func TestReadConfig(t *testing.T) {
 		})
 	}
 }
+
+// TestGoString проверяем что токен агента не попадает в журнал запуска
+func TestGoString(t *testing.T) {
+	conf := Config{Token: "agent-token"}
+	out := fmt.Sprintf("%#v", conf)
+	assert.NotContains(t, out, "agent-token")
+	assert.Contains(t, out, `Token:"***"`)
+}
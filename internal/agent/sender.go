@@ -2,17 +2,21 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/ncyellow/devops/internal/agent/config"
 	"github.com/ncyellow/devops/internal/crypto/rsa"
-	pb "github.com/ncyellow/devops/internal/grpc/proto"
+	"github.com/ncyellow/devops/internal/crypto/tlsconfig"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
 )
 
 // Sender интерфейс отправки данных на сервер
@@ -25,30 +29,69 @@ type Sender interface {
 // CreateSender - factory функция для выбора реализации отправки по конфигурации
 func CreateSender(conf *config.Config) Sender {
 	// По дефолту у нас http, только если задан GRPCAddress entrypoint, мы переходим на grpc
+	var tlsConf *tls.Config
+	if conf.TLSEnabled() {
+		var err error
+		tlsConf, err = tlsconfig.Client(conf.TLSCert, conf.TLSKey, conf.TLSCA, conf.TLSServerName)
+		if err != nil {
+			log.Fatal().Msgf("не удалось загрузить настройки tls %s", err.Error())
+		}
+	}
+	if conf.Compress != "" && conf.Compress != CompressGZIP && conf.Compress != CompressZSTD {
+		log.Info().Msgf("неизвестный алгоритм сжатия %s, отправляем без сжатия", conf.Compress)
+		conf.Compress = ""
+	}
 	if conf.GRPCAddress != "" {
 		// устанавливаем соединение с сервером
-		conn, err := grpc.Dial(conf.GRPCAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		creds := insecure.NewCredentials()
+		if tlsConf != nil {
+			creds = credentials.NewTLS(tlsConf)
+		}
+		options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+		//! Зашифрованные пачки сжимаются до шифрования в encryptBatch, сжатие grpc их не уменьшит
+		if conf.Compress != "" && conf.CryptoKey == "" {
+			if conf.Compress != CompressGZIP {
+				log.Info().Msgf("grpc поддерживает только сжатие gzip, используем его вместо %s", conf.Compress)
+			}
+			options = append(options, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+		}
+		if conf.Token != "" {
+			options = append(options, grpc.WithPerRPCCredentials(tokenCredentials{token: conf.Token, secure: tlsConf != nil}))
+		}
+		conn, err := grpc.Dial(conf.GRPCAddress, options...)
 		if err != nil {
 			log.Fatal().Err(err)
 		}
-		client := pb.NewMetricsClient(conn)
-		return &GRPCSender{
-			conf:   conf,
-			conn:   conn,
-			client: client,
-		}
+		return NewGRPCSender(conf, conn)
 	}
-	encoder, err := rsa.NewEncoder(conf.CryptoKey)
-	if err != nil {
-		log.Info().Err(err)
-	}
-	return &HTTPSender{
+	encoder := newEncoder(conf)
+	sender := &HTTPSender{
 		conf:      conf,
 		urlBatch:  fmt.Sprintf("http://%s/updates/", conf.Address),
 		urlSingle: fmt.Sprintf("http://%s/update/", conf.Address),
 		encoder:   encoder,
+		agentID:   newAgentID(),
+	}
+	if tlsConf != nil {
+		sender.urlBatch = fmt.Sprintf("https://%s/updates/", conf.Address)
+		sender.urlSingle = fmt.Sprintf("https://%s/update/", conf.Address)
+		sender.transport = &http.Transport{TLSClientConfig: tlsConf}
 	}
+	return sender
+
+}
 
+// newEncoder шифрование пачек публичным ключом сервера, nil - ключ не задан и пачки не шифруются.
+// Заданный, но не загруженный ключ - ошибка запуска, иначе агент отправлял бы метрики открытым текстом
+func newEncoder(conf *config.Config) *rsa.Encoder {
+	if conf.CryptoKey == "" {
+		return nil
+	}
+	encoder, err := rsa.NewEncoder(conf.CryptoKey)
+	if err != nil {
+		log.Fatal().Msgf("не удалось загрузить rsa публичный ключ %s", err.Error())
+	}
+	return encoder
 }
 
 // RunSender запускает цикл по обработке таймера отправки метрик из канала out на сервер
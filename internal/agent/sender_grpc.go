@@ -2,30 +2,264 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/ncyellow/devops/internal/agent/config"
+	"github.com/ncyellow/devops/internal/apierror"
+	"github.com/ncyellow/devops/internal/crypto/rsa"
 	"github.com/ncyellow/devops/internal/grpc/proto"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
 )
 
-// GRPCSender структура для отправки на сервер по grpc
+const (
+	// agentIDHeader заголовок http и ключ метадаты grpc с идентификатором агента
+	agentIDHeader = "X-Agent-ID"
+	// maxPendingBatches сколько неподтвержденных пачек агент хранит для повторной отправки после переподключения
+	maxPendingBatches = 10
+	// closeAckTimeout сколько Close ждет подтверждений уже отправленных пачек
+	closeAckTimeout = time.Second
+)
+
+// GRPCSender структура для отправки на сервер по grpc.
+// Пачки отправляются в долгоживущий поток StreamMetrics. Сервер подтверждает каждую пачку после сохранения,
+// неподтвержденные пачки хранятся и повторяются после переподключения, которое происходит при следующей отправке
 type GRPCSender struct {
 	conf   *config.Config
 	conn   *grpc.ClientConn
 	client proto.MetricsClient
+
+	// agentID случайный идентификатор агента, по нему сервер отбрасывает повторы пачек
+	agentID string
+	// encoder шифрование пачек публичным ключом сервера, nil - пачки не шифруются
+	encoder *rsa.Encoder
+
+	lock        *sync.Mutex
+	stream      proto.Metrics_StreamMetricsClient
+	cancel      context.CancelFunc
+	recvDone    chan struct{}
+	lastBatchID uint64
+	// pending отправленные, но не подтвержденные пачки по возрастанию batch_id
+	pending []*proto.StreamMetricsRequest
+}
+
+// NewGRPCSender конструктор, соединение conn закрывается в Close
+func NewGRPCSender(conf *config.Config, conn *grpc.ClientConn) *GRPCSender {
+	encoder := newEncoder(conf)
+	return &GRPCSender{
+		conf:    conf,
+		conn:    conn,
+		client:  proto.NewMetricsClient(conn),
+		agentID: newAgentID(),
+		encoder: encoder,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// encryptBatch шифрует пачку в поле encrypted, если задан ключ сервера. Если задано сжатие,
+// пачка сжимается до шифрования, а кодировка передается серверу в конверте
+func (g *GRPCSender) encryptBatch(batch *proto.AddMetricRequest) (*proto.AddMetricRequest, error) {
+	if g.encoder == nil {
+		return batch, nil
+	}
+	data, err := protobuf.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	if g.conf.Compress != "" {
+		if data, err = compressBody(g.conf.Compress, data); err != nil {
+			return nil, err
+		}
+	}
+	encrypted, err := g.encoder.EncodeWithEncoding(data, g.conf.Compress)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.AddMetricRequest{Encrypted: encrypted}, nil
+}
+
+// tokenCredentials передает токен агента в метадате authorization каждого вызова
+type tokenCredentials struct {
+	token  string
+	secure bool
 }
 
-// SendMetricsBatch отправляет все метрики одной пачкой на указанный url
+// GetRequestMetadata реализация credentials.PerRPCCredentials
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+// RequireTransportSecurity реализация credentials.PerRPCCredentials. С настроенным tls grpc не отправит токен
+// по соединению без шифрования. Без tls токен передается открытым текстом
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// newAgentID случайный идентификатор агента
+func newAgentID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Info().Msgf("не удалось создать идентификатор агента %s", err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+// SendMetricsBatch отправляет все метрики одной пачкой в поток StreamMetrics.
+// Как и Close, вызывается из одной горутины: Send в поток grpc не потокобезопасен
 func (g *GRPCSender) SendMetricsBatch(dataSource []repository.Metrics) {
 	// Если метрик данных нет сразу на выход
 	if len(dataSource) == 0 {
 		return
 	}
 
+	batch, err := g.encryptBatch(addMetricRequest(dataSource))
+	if err != nil {
+		log.Error().Msgf("проблемы с шифрованием отправлять не будем. %s", err.Error())
+		return
+	}
+
+	g.lock.Lock()
+	g.lastBatchID++
+	req := &proto.StreamMetricsRequest{
+		AgentId: g.agentID,
+		BatchId: g.lastBatchID,
+		Batch:   batch,
+	}
+	g.pending = append(g.pending, req)
+	if len(g.pending) > maxPendingBatches {
+		log.Info().Msgf("сервер недоступен, отброшено неподтвержденных пачек - %d", len(g.pending)-maxPendingBatches)
+		g.pending = g.pending[len(g.pending)-maxPendingBatches:]
+	}
+
+	batches := []*proto.StreamMetricsRequest{req}
+	if g.stream == nil {
+		if err := g.openStream(); err != nil {
+			g.lock.Unlock()
+			log.Info().Msgf("%s", err.Error())
+			return
+		}
+		// новый поток - повторяем все неподтвержденные пачки, включая текущую
+		batches = append([]*proto.StreamMetricsRequest(nil), g.pending...)
+	}
+	stream := g.stream
+	g.lock.Unlock()
+
+	// Send может ждать, пока сервер прочитает поток, поэтому отправка идет без блокировки,
+	// иначе чтение подтверждений в receiveAcks остановилось бы на ней
+	for _, batch := range batches {
+		if err := stream.Send(batch); err != nil {
+			log.Info().Msgf("%s", err.Error())
+			g.lock.Lock()
+			if g.stream == stream {
+				g.resetStream()
+			}
+			g.lock.Unlock()
+			return
+		}
+	}
+}
+
+// openStream открывает поток StreamMetrics и запускает чтение подтверждений. Вызывается под блокировкой
+func (g *GRPCSender) openStream() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	// по идентификатору агента сервер ограничивает частоту записи
+	ctx = metadata.AppendToOutgoingContext(ctx, agentIDHeader, g.agentID)
+	stream, err := g.client.StreamMetrics(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	g.stream = stream
+	g.cancel = cancel
+	g.recvDone = make(chan struct{})
+	go g.receiveAcks(stream, g.recvDone)
+	return nil
+}
+
+// resetStream закрывает текущий поток, следующая отправка откроет новый. Вызывается под блокировкой
+func (g *GRPCSender) resetStream() {
+	g.cancel()
+	g.stream = nil
+}
+
+// receiveAcks читает подтверждения потока stream до его закрытия
+func (g *GRPCSender) receiveAcks(stream proto.Metrics_StreamMetricsClient, done chan struct{}) {
+	defer close(done)
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				log.Info().Msgf("поток метрик закрыт - %s", err.Error())
+			}
+			g.lock.Lock()
+			if g.stream == stream {
+				g.resetStream()
+			}
+			g.lock.Unlock()
+			return
+		}
+		if resp.GetStatus() != nil || resp.GetError() != "" {
+			// отклоненную пачку повторять бесполезно, она удаляется так же как сохраненная
+			log.Info().Msgf("пачка %d отклонена сервером - %s", resp.GetBatchId(), rejectReason(resp))
+		}
+		g.ack(resp.GetBatchId())
+	}
+}
+
+// rejectReason описание отклонения пачки из статуса подтверждения: код, сообщение, причина и нарушения полей.
+// Сервер без поля status передает только сообщение error
+func rejectReason(resp *proto.StreamMetricsResponse) string {
+	if resp.GetStatus() == nil {
+		return resp.GetError()
+	}
+	st := status.FromProto(resp.GetStatus())
+	reason := fmt.Sprintf("%s: %s", st.Code(), st.Message())
+	if code := apierror.Reason(st.Err()); code != "" {
+		reason += " (" + code + ")"
+	}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				reason += fmt.Sprintf("; %s: %s", violation.GetField(), violation.GetDescription())
+			}
+		}
+	}
+	return reason
+}
+
+// ack удаляет из неподтвержденных пачки до batchID включительно, сервер подтверждает пачки по порядку
+func (g *GRPCSender) ack(batchID uint64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	i := 0
+	for i < len(g.pending) && g.pending[i].GetBatchId() <= batchID {
+		i++
+	}
+	g.pending = g.pending[i:]
+}
+
+// pendingBatches число неподтвержденных пачек
+func (g *GRPCSender) pendingBatches() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.pending)
+}
+
+// addMetricRequest конвертация метрик в пачку proto.AddMetricRequest
+func addMetricRequest(dataSource []repository.Metrics) *proto.AddMetricRequest {
 	var counters []*proto.CounterMetric
 	var gauges []*proto.GaugeMetric
+	var histograms []*proto.HistogramMetric
 	for _, metric := range dataSource {
 		// делаем так потому что hash опциональное поле и мы будем передавать указатель и потому отдельная переменная
 		var hash string
@@ -36,34 +270,46 @@ func (g *GRPCSender) SendMetricsBatch(dataSource []repository.Metrics) {
 		switch metric.MType {
 		case repository.Counter:
 			counters = append(counters, &proto.CounterMetric{
-				Name:  metric.ID,
-				Value: *metric.Delta,
-				Hash:  &hash,
+				Name:   metric.ID,
+				Value:  *metric.Delta,
+				Hash:   &hash,
+				Labels: metric.Labels,
 			})
 		case repository.Gauge:
 			gauges = append(gauges, &proto.GaugeMetric{
-				Name:  metric.ID,
-				Value: *metric.Value,
-				Hash:  &hash,
+				Name:   metric.ID,
+				Value:  *metric.Value,
+				Hash:   &hash,
+				Labels: metric.Labels,
+			})
+		case repository.Histogram:
+			buckets := make([]*proto.Bucket, 0, len(metric.Buckets))
+			for _, bucket := range metric.Buckets {
+				buckets = append(buckets, &proto.Bucket{
+					UpperBound: bucket.UpperBound,
+					Count:      bucket.Count,
+				})
+			}
+			histograms = append(histograms, &proto.HistogramMetric{
+				Name:    metric.ID,
+				Buckets: buckets,
+				Count:   *metric.Count,
+				Sum:     *metric.Sum,
+				Hash:    &hash,
+				Labels:  metric.Labels,
 			})
 		}
 	}
 
-	resp, err := g.client.AddMetric(context.Background(), &proto.AddMetricRequest{
-		Counters: counters,
-		Gauges:   gauges,
-	})
-	if err != nil {
-		log.Info().Msgf("%s", err.Error())
-		return
-	}
-	if resp.Error != "" {
-		log.Info().Msg(resp.Error)
+	return &proto.AddMetricRequest{
+		Counters:   counters,
+		Gauges:     gauges,
+		Histograms: histograms,
 	}
 }
 
-// SendMetrics отправляет все метрики одной пачкой на указанный url,
-// это мы делаем только http для совместимости со старыми автотестами
+// SendMetrics отправка по одной метрике нужна только http для совместимости со старыми автотестами,
+// по grpc все метрики уходят через поток в SendMetricsBatch
 func (g *GRPCSender) SendMetrics(dataSource []repository.Metrics) {
 	// Если метрик данных нет сразу на выход
 	if len(dataSource) == 0 {
@@ -71,7 +317,26 @@ func (g *GRPCSender) SendMetrics(dataSource []repository.Metrics) {
 	}
 }
 
-// Close общая функция очистки ресурсов. Для http не требуется
+// Close закрывает поток, дождавшись подтверждений отправленных пачек не дольше closeAckTimeout, и соединение
 func (g *GRPCSender) Close() {
+	g.lock.Lock()
+	stream, done := g.stream, g.recvDone
+	if stream != nil {
+		stream.CloseSend()
+	}
+	g.lock.Unlock()
+
+	if stream != nil {
+		select {
+		case <-done:
+		case <-time.After(closeAckTimeout):
+		}
+	}
+
+	g.lock.Lock()
+	if g.stream != nil {
+		g.resetStream()
+	}
+	g.lock.Unlock()
 	g.conn.Close()
 }
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/ncyellow/devops/internal/agent/config"
+	"github.com/ncyellow/devops/internal/apierror"
+	"github.com/ncyellow/devops/internal/crypto/tlsconfig"
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/ncyellow/devops/internal/grpc/api"
+	"github.com/ncyellow/devops/internal/grpc/proto"
+	"github.com/ncyellow/devops/internal/repository"
+	serverconfig "github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/middlewares"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+// startTestGRPCServer запускает grpc сервер метрик на address
+func startTestGRPCServer(t *testing.T, address string, repo repository.Repository) (*grpc.Server, string) {
+	listener, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+
+	conf := serverconfig.Config{}
+	store, err := storage.CreateStorage(&conf, repo)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	proto.RegisterMetricsServer(server, api.NewMetricServer(repo, &conf, store))
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+// TestGRPCSenderStream проверяем отправку пачек через поток, подтверждения и повтор пачек после переподключения
+func TestGRPCSenderStream(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	server, address := startTestGRPCServer(t, "127.0.0.1:0", repo)
+
+	// короткий backoff, чтобы соединение восстановилось сразу после перезапуска сервера
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 10 * time.Millisecond, Multiplier: 1, MaxDelay: 50 * time.Millisecond},
+			MinConnectTimeout: time.Second,
+		}))
+	require.NoError(t, err)
+	sender := NewGRPCSender(&config.Config{}, conn)
+
+	value := 1.5
+	delta := int64(10)
+	sender.SendMetricsBatch([]repository.Metrics{
+		{ID: "testGauge", MType: repository.Gauge, Value: &value},
+		{ID: "testCounter", MType: repository.Counter, Delta: &delta},
+	})
+	assert.Eventually(t, func() bool { return sender.pendingBatches() == 0 }, 5*time.Second, 10*time.Millisecond)
+	counter, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), counter)
+
+	// Сервер недоступен - пачки копятся неподтвержденными
+	server.Stop()
+	assert.Eventually(t, func() bool {
+		sender.SendMetricsBatch([]repository.Metrics{{ID: "testCounter", MType: repository.Counter, Delta: &delta}})
+		return sender.pendingBatches() >= 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// После перезапуска сервера следующая отправка переподключается и повторяет все неподтвержденные пачки
+	pending := sender.pendingBatches()
+	server, _ = startTestGRPCServer(t, address, repo)
+	defer server.Stop()
+	assert.Eventually(t, func() bool {
+		if sender.pendingBatches() == 0 {
+			return true
+		}
+		sender.SendMetricsBatch([]repository.Metrics{{ID: "testGauge", MType: repository.Gauge, Value: &value}})
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+
+	counter, _ = repo.Counter("testCounter")
+	assert.Equal(t, int64(10)+int64(pending)*delta, counter)
+	sender.Close()
+}
+
+// TestGRPCSenderMutualTLS проверяем отправку по grpc со взаимным tls, сервер узнает агента по сертификату
+func TestGRPCSenderMutualTLS(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, ioutil.WriteFile(tokensFile, []byte(`{"tokens": [{"certificate": "agent1", "agent": "agent1", "scopes": ["ingest"]}]}`), 0600))
+	auth, err := middlewares.NewAuthenticator(tokensFile)
+	require.NoError(t, err)
+	tlsConf, err := tlsconfig.Server(testCertsDir+"server.pem", testCertsDir+"server.key", testCertsDir+"ca.pem")
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	serverConf := serverconfig.Config{}
+	store, err := storage.CreateStorage(&serverConf, repo)
+	require.NoError(t, err)
+	scopes := map[string]middlewares.Scope{"StreamMetrics": middlewares.ScopeIngest}
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsConf)),
+		grpc.ChainStreamInterceptor(middlewares.ClientCertStreamInterceptor, middlewares.AuthStreamInterceptor(auth, scopes)),
+	)
+	proto.RegisterMetricsServer(server, api.NewMetricServer(repo, &serverConf, store))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conf := &config.Config{}
+	conf.GRPCAddress = listener.Addr().String()
+	conf.TLSCA = testCertsDir + "ca.pem"
+	conf.TLSCert = testCertsDir + "client.pem"
+	conf.TLSKey = testCertsDir + "client.key"
+	sender := CreateSender(conf).(*GRPCSender)
+	defer sender.Close()
+
+	delta := int64(10)
+	sender.SendMetricsBatch([]repository.Metrics{{ID: "testCounter", MType: repository.Counter, Delta: &delta}})
+	assert.Eventually(t, func() bool { return sender.pendingBatches() == 0 }, 5*time.Second, 10*time.Millisecond)
+	counter, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, delta, counter)
+}
+
+// TestGRPCSenderEncrypted проверяем отправку зашифрованных пачек по grpc, сжатые пачки сжимаются до шифрования
+func TestGRPCSenderEncrypted(t *testing.T) {
+	for _, compress := range []string{"", CompressGZIP, CompressZSTD} {
+		t.Run("compress "+compress, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			repo := repository.NewRepository(&genconfig.GeneralConfig{})
+			serverConf := serverconfig.Config{}
+			serverConf.CryptoKey = "../crypto/rsa/test_data/rsa.private"
+			store, err := storage.CreateStorage(&serverConf, repo)
+			require.NoError(t, err)
+			server := grpc.NewServer()
+			proto.RegisterMetricsServer(server, api.NewMetricServer(repo, &serverConf, store))
+			go server.Serve(listener)
+			defer server.Stop()
+
+			conf := &config.Config{Compress: compress}
+			conf.GRPCAddress = listener.Addr().String()
+			conf.CryptoKey = "../crypto/rsa/test_data/rsa.public"
+			sender := CreateSender(conf).(*GRPCSender)
+			defer sender.Close()
+
+			metrics := make([]repository.Metrics, 0, 100)
+			for i := 0; i < 100; i++ {
+				delta := int64(i)
+				metrics = append(metrics, repository.Metrics{ID: fmt.Sprintf("testCounter%d", i), MType: repository.Counter, Delta: &delta})
+			}
+			sender.SendMetricsBatch(metrics)
+			assert.Eventually(t, func() bool { return sender.pendingBatches() == 0 }, 5*time.Second, 10*time.Millisecond)
+			counter, ok := repo.Counter("testCounter99")
+			assert.True(t, ok)
+			assert.Equal(t, int64(99), counter)
+		})
+	}
+}
+
+// TestTokenCredentialsTransportSecurity с настроенным tls токен не отправляется по соединению без шифрования
+func TestTokenCredentialsTransportSecurity(t *testing.T) {
+	assert.False(t, tokenCredentials{token: "token"}.RequireTransportSecurity())
+	assert.True(t, tokenCredentials{token: "token", secure: true}.RequireTransportSecurity())
+
+	_, err := grpc.Dial("localhost:0", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(tokenCredentials{token: "token", secure: true}))
+	assert.Error(t, err)
+}
+
+// TestRejectReason проверяем описание отклоненной пачки из полного статуса и из одного сообщения старого сервера
+func TestRejectReason(t *testing.T) {
+	err := apierror.MetricsStatus("incorrect metric sign", []apierror.MetricError{
+		{Index: 0, ID: "testCounter", Code: apierror.CodeInvalidSign, Detail: "hash mismatch"},
+	}, []string{"counters[0]"})
+	resp := &proto.StreamMetricsResponse{BatchId: 1, Error: "incorrect metric sign", Status: status.Convert(err).Proto()}
+	assert.Equal(t, "InvalidArgument: incorrect metric sign (INVALID_METRICS); counters[0]: "+
+		apierror.CodeInvalidSign.Reason()+": hash mismatch", rejectReason(resp))
+
+	assert.Equal(t, "incorrect metric sign", rejectReason(&proto.StreamMetricsResponse{BatchId: 1, Error: "incorrect metric sign"}))
+}
@@ -18,6 +18,10 @@ type HTTPSender struct {
 	urlBatch  string
 	urlSingle string
 	encoder   *rsa.Encoder
+	// agentID идентификатор агента, по нему сервер ограничивает частоту записи
+	agentID string
+	// transport транспорт запросов к серверу, nil - http.DefaultTransport. Задается для подключения по tls
+	transport http.RoundTripper
 }
 
 // SendMetricsBatch отправляет все метрики одной пачкой на указанный url
@@ -31,15 +35,34 @@ func (s *HTTPSender) SendMetricsBatch(dataSource []repository.Metrics) {
 	if err != nil {
 		log.Fatal().Err(err)
 	}
+	//! Зашифрованные данные не сжимаются, поэтому сжимаем до шифрования. С шифрованием кодировка передается
+	//! в конверте и сервер распаковывает тело после расшифровки, без шифрования - в заголовке Content-Encoding
+	if s.conf.Compress != "" {
+		buf, err = compressBody(s.conf.Compress, buf)
+		if err != nil {
+			log.Info().Msgf("проблемы со сжатием отправлять не будем. %s", err.Error())
+			return
+		}
+	}
 	if s.encoder != nil {
-		buf, err = s.encoder.Encode(buf)
+		buf, err = s.encoder.EncodeWithEncoding(buf, s.conf.Compress)
 		if err != nil {
-			log.Info().Msgf("проблемы с шифрованием отправлять не будем. %s", err.Error())
+			log.Error().Msgf("проблемы с шифрованием отправлять не будем. %s", err.Error())
 			return
 		}
 	}
 
-	resp, err := http.Post(s.urlBatch, "application/json", bytes.NewBuffer(buf))
+	req, err := http.NewRequest(http.MethodPost, s.urlBatch, bytes.NewBuffer(buf))
+	if err != nil {
+		log.Info().Msgf("%s", err.Error())
+		return
+	}
+	s.setHeaders(req)
+	if s.conf.Compress != "" && s.encoder == nil {
+		req.Header.Set("Content-Encoding", s.conf.Compress)
+	}
+	client := http.Client{Transport: s.transport}
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Info().Msgf("%s", err.Error())
 		return
@@ -47,15 +70,30 @@ func (s *HTTPSender) SendMetricsBatch(dataSource []repository.Metrics) {
 	resp.Body.Close()
 }
 
+// setHeaders общие заголовки запросов агента
+func (s *HTTPSender) setHeaders(req *http.Request) {
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(agentIDHeader, s.agentID)
+	if s.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.conf.Token)
+	}
+}
+
 // SendMetrics отправляет метрики на указанный url
 func (s *HTTPSender) SendMetrics(dataSource []repository.Metrics) {
-	client := http.Client{Timeout: 100 * time.Millisecond}
+	client := http.Client{Timeout: 100 * time.Millisecond, Transport: s.transport}
 	for _, metric := range dataSource {
 		buf, err := json.Marshal(metric)
 		if err != nil {
 			log.Fatal().Err(err)
 		}
-		resp, err := client.Post(s.urlSingle, "application/json", bytes.NewBuffer(buf))
+		req, err := http.NewRequest(http.MethodPost, s.urlSingle, bytes.NewBuffer(buf))
+		if err != nil {
+			log.Info().Msgf("%s", err.Error())
+			continue
+		}
+		s.setHeaders(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			log.Info().Msgf("%s", err.Error())
 			continue
@@ -3,15 +3,30 @@ package agent
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/ncyellow/devops/internal/agent/config"
+	"github.com/ncyellow/devops/internal/crypto/tlsconfig"
 	"github.com/ncyellow/devops/internal/genconfig"
 	"github.com/ncyellow/devops/internal/repository"
+	serverconfig "github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/handlers"
+	"github.com/ncyellow/devops/internal/server/storage"
 )
 
+// testCertsDir тестовые сертификаты сервера и агента
+const testCertsDir = "../crypto/tlsconfig/test_data/"
+
 // BenchmarkSendMetricsBatch бенчмарк на отправку метрик на сервис пачкой
 func BenchmarkSendMetricsBatch(b *testing.B) {
 	b.StopTimer()
@@ -56,7 +71,7 @@ func TestRunSender(t *testing.T) {
 	conf := &config.Config{
 		GeneralConfig: genconfig.GeneralConfig{
 			Address:   "localhost:8080",
-			CryptoKey: "/path/to/key.pem",
+			CryptoKey: "../crypto/rsa/test_data/rsa.public",
 		},
 		ReportInterval: genconfig.Duration{Duration: time.Second * 3},
 		PollInterval:   genconfig.Duration{Duration: time.Second * 32},
@@ -65,7 +80,7 @@ func TestRunSender(t *testing.T) {
 	grpcConf := &config.Config{
 		GeneralConfig: genconfig.GeneralConfig{
 			GRPCAddress: "localhost:8080",
-			CryptoKey:   "/path/to/key.pem",
+			CryptoKey:   "../crypto/rsa/test_data/rsa.public",
 		},
 		ReportInterval: genconfig.Duration{Duration: time.Second * 3},
 		PollInterval:   genconfig.Duration{Duration: time.Second * 32},
@@ -79,12 +94,12 @@ func TestRunSender(t *testing.T) {
 	go RunSender(ctx, grpcConf, grpcMetricChannel, &wg)
 
 	// Отправляем данные для отправки.
-	metricChannel <- prepareGauges(source.Gauges(), "")
-	metricChannel <- prepareCounters(source.Counters(), "")
+	metricChannel <- prepareGauges(source.Gauges(), nil, "")
+	metricChannel <- prepareCounters(source.Counters(), nil, "")
 
 	// Отправляем данные для отправки.
-	grpcMetricChannel <- prepareGauges(source.Gauges(), "")
-	grpcMetricChannel <- prepareCounters(source.Counters(), "")
+	grpcMetricChannel <- prepareGauges(source.Gauges(), nil, "")
+	grpcMetricChannel <- prepareCounters(source.Counters(), nil, "")
 
 	time.Sleep(time.Second * 5)
 	close(metricChannel)
@@ -96,3 +111,120 @@ func TestRunSender(t *testing.T) {
 	// и сюда мы не попадем
 
 }
+
+// TestHTTPSenderCompress проверяем отправку сжатых пачек, сервер распаковывает их в middleware
+func TestHTTPSenderCompress(t *testing.T) {
+	for _, compress := range []string{"", CompressGZIP, CompressZSTD} {
+		t.Run("compress "+compress, func(t *testing.T) {
+			serverConf := serverconfig.Config{}
+			repo := repository.NewRepository(serverConf.GeneralCfg())
+			pStore, _ := storage.NewFakeStorage()
+			ts := httptest.NewServer(handlers.NewRouter(repo, &serverConf, pStore))
+			defer ts.Close()
+
+			conf := &config.Config{Compress: compress}
+			conf.Address = strings.TrimPrefix(ts.URL, "http://")
+			sender := CreateSender(conf)
+			defer sender.Close()
+
+			delta := int64(5)
+			sender.SendMetricsBatch([]repository.Metrics{{ID: "testCounter", MType: repository.Counter, Delta: &delta}})
+			counter, ok := repo.Counter("testCounter")
+			assert.True(t, ok)
+			assert.Equal(t, delta, counter)
+		})
+	}
+}
+
+// TestHTTPSenderToken проверяем, что сервер с проверкой токенов принимает метрики только с токеном агента
+func TestHTTPSenderToken(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	assert.NoError(t, ioutil.WriteFile(tokensFile, []byte(`{"tokens": [{"token": "agent-token", "agent": "agent1", "scopes": ["ingest"]}]}`), 0600))
+
+	for _, token := range []string{"", "agent-token"} {
+		t.Run("token "+token, func(t *testing.T) {
+			serverConf := serverconfig.Config{TokensFile: tokensFile}
+			repo := repository.NewRepository(serverConf.GeneralCfg())
+			pStore, _ := storage.NewFakeStorage()
+			ts := httptest.NewServer(handlers.NewRouter(repo, &serverConf, pStore))
+			defer ts.Close()
+
+			conf := &config.Config{Token: token}
+			conf.Address = strings.TrimPrefix(ts.URL, "http://")
+			sender := CreateSender(conf)
+			defer sender.Close()
+
+			delta := int64(5)
+			sender.SendMetricsBatch([]repository.Metrics{{ID: "testCounter", MType: repository.Counter, Delta: &delta}})
+			_, ok := repo.Counter("testCounter")
+			assert.Equal(t, token != "", ok)
+		})
+	}
+}
+
+// TestHTTPSenderMutualTLS проверяем отправку по взаимному tls, сервер узнает агента по сертификату без токена
+func TestHTTPSenderMutualTLS(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	assert.NoError(t, ioutil.WriteFile(tokensFile, []byte(`{"tokens": [{"certificate": "agent1", "agent": "agent1", "scopes": ["ingest"]}]}`), 0600))
+
+	serverConf := serverconfig.Config{TokensFile: tokensFile}
+	repo := repository.NewRepository(serverConf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewUnstartedServer(handlers.NewRouter(repo, &serverConf, pStore))
+	tlsConf, err := tlsconfig.Server(testCertsDir+"server.pem", testCertsDir+"server.key", testCertsDir+"ca.pem")
+	require.NoError(t, err)
+	ts.TLS = tlsConf
+	ts.StartTLS()
+	defer ts.Close()
+
+	conf := &config.Config{}
+	conf.Address = strings.TrimPrefix(ts.URL, "https://")
+	conf.TLSCA = testCertsDir + "ca.pem"
+	conf.TLSCert = testCertsDir + "client.pem"
+	conf.TLSKey = testCertsDir + "client.key"
+	sender := CreateSender(conf)
+	defer sender.Close()
+
+	delta := int64(5)
+	sender.SendMetricsBatch([]repository.Metrics{{ID: "testCounter", MType: repository.Counter, Delta: &delta}})
+	counter, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, delta, counter)
+}
+
+// TestHTTPSenderEncrypted проверяем отправку зашифрованной пачки намного больше размера ключа rsa.
+// Сжатая пачка сжимается до шифрования и передается без Content-Encoding, кодировка - в конверте
+func TestHTTPSenderEncrypted(t *testing.T) {
+	for _, compress := range []string{"", CompressGZIP, CompressZSTD} {
+		t.Run("compress "+compress, func(t *testing.T) {
+			serverConf := serverconfig.Config{}
+			serverConf.CryptoKey = "../crypto/rsa/test_data/rsa.private"
+			repo := repository.NewRepository(serverConf.GeneralCfg())
+			pStore, _ := storage.NewFakeStorage()
+			router := handlers.NewRouter(repo, &serverConf, pStore)
+			var contentEncoding string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contentEncoding = r.Header.Get("Content-Encoding")
+				router.ServeHTTP(w, r)
+			}))
+			defer ts.Close()
+
+			conf := &config.Config{Compress: compress}
+			conf.Address = strings.TrimPrefix(ts.URL, "http://")
+			conf.CryptoKey = "../crypto/rsa/test_data/rsa.public"
+			sender := CreateSender(conf)
+			defer sender.Close()
+
+			metrics := make([]repository.Metrics, 0, 100)
+			for i := 0; i < 100; i++ {
+				delta := int64(i)
+				metrics = append(metrics, repository.Metrics{ID: fmt.Sprintf("testCounter%d", i), MType: repository.Counter, Delta: &delta})
+			}
+			sender.SendMetricsBatch(metrics)
+			counter, ok := repo.Counter("testCounter99")
+			assert.True(t, ok)
+			assert.Equal(t, int64(99), counter)
+			assert.Empty(t, contentEncoding)
+		})
+	}
+}
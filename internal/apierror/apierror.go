@@ -0,0 +1,112 @@
+// Package apierror содержит общую модель ошибок API: коды ошибок, ошибки отдельных метрик пачки
+// и их представление в виде problem+json (RFC 7807) для http и status с деталями для grpc
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// Code машиночитаемый код ошибки. Один и тот же код используется в type ответа problem+json
+// и в причине ErrorInfo ответа grpc
+type Code string
+
+const (
+	// CodeInvalidRequest некорректные параметры запроса
+	CodeInvalidRequest Code = "invalid-request"
+	// CodeUnsupportedMediaType неподдерживаемый Content-Type тела запроса
+	CodeUnsupportedMediaType Code = "unsupported-media-type"
+	// CodeInvalidBody тело запроса не прочитано, не расшифровано или не разобрано
+	CodeInvalidBody Code = "invalid-body"
+	// CodeInvalidMetrics метрики запроса не прошли проверку, подробности в ошибках метрик
+	CodeInvalidMetrics Code = "invalid-metrics"
+	// CodeUnauthorized токен не передан, неизвестен или отозван
+	CodeUnauthorized Code = "unauthorized"
+	// CodeForbidden у токена нет права на операцию
+	CodeForbidden Code = "forbidden"
+	// CodeNotFound метрика не найдена
+	CodeNotFound Code = "not-found"
+	// CodeRateLimited клиент превысил ограничение частоты запросов
+	CodeRateLimited Code = "rate-limited"
+	// CodeStorage ошибка сохранения в хранилище
+	CodeStorage Code = "storage-error"
+	// CodeInternal внутренняя ошибка сервера
+	CodeInternal Code = "internal"
+)
+
+// Коды ошибок отдельных метрик
+const (
+	// CodeInvalidMetric пустое имя, неизвестный тип или нет значения
+	CodeInvalidMetric Code = "invalid-metric"
+	// CodeInvalidHistogram некорректная гистограмма или несовпадение корзин с сохраненными
+	CodeInvalidHistogram Code = "invalid-histogram"
+	// CodeInvalidSign подпись метрики не совпала
+	CodeInvalidSign Code = "invalid-sign"
+)
+
+// TypeURI значение type для problem+json
+func (c Code) TypeURI() string {
+	return "urn:devops:problem:" + string(c)
+}
+
+// Reason значение reason для grpc ErrorInfo в принятом для grpc виде UPPER_SNAKE_CASE
+func (c Code) Reason() string {
+	return strings.ToUpper(strings.ReplaceAll(string(c), "-", "_"))
+}
+
+// MetricError ошибка отдельной метрики пачки. Index - позиция метрики в запросе
+type MetricError struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	MType  string `json:"type"`
+	Code   Code   `json:"code"`
+	Detail string `json:"detail"`
+}
+
+// Error реализация интерфейса error
+func (e MetricError) Error() string {
+	return fmt.Sprintf("metric %d %s: %s", e.Index, e.ID, e.Detail)
+}
+
+// NewMetricError ошибка метрики index по ошибке репозитория err
+func NewMetricError(index int, metric repository.Metrics, err error) MetricError {
+	code := CodeInvalidMetric
+	if errors.Is(err, repository.ErrInvalidHistogram) {
+		code = CodeInvalidHistogram
+	}
+	return MetricError{
+		Index:  index,
+		ID:     metric.ID,
+		MType:  metric.MType,
+		Code:   code,
+		Detail: err.Error(),
+	}
+}
+
+// CheckMetrics проверяет все метрики пачки: корректность и подпись ключом secretKey.
+// Возвращает ошибки всех некорректных метрик, а не только первой, nil если все метрики корректны
+func CheckMetrics(secretKey string, metrics []repository.Metrics) []MetricError {
+	var errs []MetricError
+	encodeFunc := hash.CreateEncodeFunc(secretKey)
+	for i, metric := range metrics {
+		if err := repository.ValidateMetric(metric); err != nil {
+			errs = append(errs, NewMetricError(i, metric, err))
+			continue
+		}
+		//! Подпись считаем только после проверки, у метрики без значения ее не посчитать
+		if !hash.CheckSign(secretKey, metric.Hash, metric.CalcHash(encodeFunc)) {
+			errs = append(errs, MetricError{
+				Index:  i,
+				ID:     metric.ID,
+				MType:  metric.MType,
+				Code:   CodeInvalidSign,
+				Detail: "incorrect metric sign",
+			})
+		}
+	}
+	return errs
+}
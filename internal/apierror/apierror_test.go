@@ -0,0 +1,82 @@
+package apierror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+func TestCheckMetrics(t *testing.T) {
+	secretKey := "secret"
+	value := 1.5
+	count := uint64(1)
+	signed := repository.Metrics{ID: "testGauge", MType: repository.Gauge, Value: &value}
+	signed.Hash = signed.CalcHash(hash.CreateEncodeFunc(secretKey))
+
+	errs := CheckMetrics(secretKey, []repository.Metrics{
+		signed,
+		{ID: "testGauge", MType: repository.Gauge, Value: &value, Hash: "bad"},
+		{ID: "testCounter", MType: repository.Counter},
+		{ID: "testHistogram", MType: repository.Histogram, Count: &count},
+	})
+	require.Len(t, errs, 3)
+	assert.Equal(t, []int{1, 2, 3}, []int{errs[0].Index, errs[1].Index, errs[2].Index})
+	assert.Equal(t, []Code{CodeInvalidSign, CodeInvalidMetric, CodeInvalidHistogram}, []Code{errs[0].Code, errs[1].Code, errs[2].Code})
+
+	assert.Nil(t, CheckMetrics(secretKey, []repository.Metrics{signed}))
+	assert.Nil(t, CheckMetrics("", []repository.Metrics{{ID: "testGauge", MType: repository.Gauge, Value: &value}}))
+}
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, "urn:devops:problem:invalid-metrics", CodeInvalidMetrics.TypeURI())
+	assert.Equal(t, "INVALID_METRICS", CodeInvalidMetrics.Reason())
+}
+
+func TestProblemWrite(t *testing.T) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v2/updates?x=1", nil)
+	NewProblem(http.StatusUnprocessableEntity, CodeInvalidMetrics, "1 of 1 metrics are invalid").
+		WithErrors([]MetricError{{Index: 0, ID: "test", MType: "gauge", Code: CodeInvalidSign, Detail: "incorrect metric sign"}}).
+		Write(rw, r)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rw.Code)
+	assert.Equal(t, ProblemContentType, rw.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"urn:devops:problem:invalid-metrics","title":"Unprocessable Entity","status":422,
+		"detail":"1 of 1 metrics are invalid","instance":"/api/v2/updates","code":"invalid-metrics",
+		"errors":[{"index":0,"id":"test","type":"gauge","code":"invalid-sign","detail":"incorrect metric sign"}]}`,
+		rw.Body.String())
+}
+
+func TestMetricsStatus(t *testing.T) {
+	err := MetricsStatus("incorrect metric sign", []MetricError{
+		{Index: 1, ID: "test", Code: CodeInvalidSign, Detail: "incorrect metric sign"},
+	}, []string{"counters[0]", "gauges[0]"})
+
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, "incorrect metric sign", st.Message())
+	assert.Equal(t, "INVALID_METRICS", Reason(err))
+
+	var badRequest *errdetails.BadRequest
+	for _, detail := range st.Details() {
+		if value, ok := detail.(*errdetails.BadRequest); ok {
+			badRequest = value
+		}
+	}
+	require.NotNil(t, badRequest)
+	require.Len(t, badRequest.GetFieldViolations(), 1)
+	assert.Equal(t, "gauges[0]", badRequest.GetFieldViolations()[0].GetField())
+	assert.Equal(t, "INVALID_SIGN: incorrect metric sign", badRequest.GetFieldViolations()[0].GetDescription())
+
+	assert.Equal(t, "NOT_FOUND", Reason(Status(codes.NotFound, CodeNotFound, "not found")))
+	assert.Equal(t, "", Reason(status.Error(codes.Internal, "plain")))
+}
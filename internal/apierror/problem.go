@@ -0,0 +1,56 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ProblemContentType тип содержимого ответа с ошибкой по RFC 7807
+const ProblemContentType = "application/problem+json"
+
+// Problem описание ошибки по RFC 7807. Errors - расширение с ошибками отдельных метрик пачки
+type Problem struct {
+	Type     string        `json:"type"`
+	Title    string        `json:"title"`
+	Status   int           `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Instance string        `json:"instance,omitempty"`
+	Code     Code          `json:"code"`
+	Errors   []MetricError `json:"errors,omitempty"`
+}
+
+// NewProblem ошибка с кодом code и http статусом status
+func NewProblem(status int, code Code, detail string) *Problem {
+	return &Problem{
+		Type:   code.TypeURI(),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// WithErrors добавляет ошибки отдельных метрик
+func (p *Problem) WithErrors(errs []MetricError) *Problem {
+	p.Errors = errs
+	return p
+}
+
+// Error реализация интерфейса error
+func (p *Problem) Error() string {
+	return p.Detail
+}
+
+// Write отправляет ошибку клиенту, instance - путь запроса r
+func (p *Problem) Write(rw http.ResponseWriter, r *http.Request) {
+	p.Instance = r.URL.Path
+	body, err := json.Marshal(p)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("invalid serialization"))
+		return
+	}
+	rw.Header().Set("Content-Type", ProblemContentType)
+	rw.WriteHeader(p.Status)
+	rw.Write(body)
+}
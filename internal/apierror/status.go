@@ -0,0 +1,55 @@
+package apierror
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Domain домен ошибок в grpc ErrorInfo
+const Domain = "devops"
+
+// Status grpc ошибка с кодом grpcCode, сообщением detail и деталью ErrorInfo с причиной code
+func Status(grpcCode codes.Code, code Code, detail string) error {
+	return newStatus(grpcCode, code, detail).Err()
+}
+
+// MetricsStatus ошибка InvalidArgument для некорректных метрик пачки. Каждая ошибка метрики передается
+// нарушением поля BadRequest, fields - имена полей запроса по индексу метрики, например gauges[0]
+func MetricsStatus(detail string, errs []MetricError, fields []string) error {
+	st := newStatus(codes.InvalidArgument, CodeInvalidMetrics, detail)
+	violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(errs))
+	for _, metricErr := range errs {
+		field := metricErr.ID
+		if metricErr.Index < len(fields) {
+			field = fields[metricErr.Index]
+		}
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: metricErr.Code.Reason() + ": " + metricErr.Detail,
+		})
+	}
+	if withDetails, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// Reason причина ошибки err из детали ErrorInfo, пустая строка если детали нет
+func Reason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.GetReason()
+		}
+	}
+	return ""
+}
+
+func newStatus(grpcCode codes.Code, code Code, detail string) *status.Status {
+	st := status.New(grpcCode, detail)
+	//! WithDetails возвращает ошибку только если деталь не сериализуется, тогда отдаем статус без деталей
+	if withDetails, err := st.WithDetails(&errdetails.ErrorInfo{Reason: code.Reason(), Domain: Domain}); err == nil {
+		return withDetails
+	}
+	return st
+}
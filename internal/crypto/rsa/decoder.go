@@ -4,30 +4,241 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+var (
+	// ErrUnknownKey конверт зашифрован ключом, которого нет среди ключей декодера
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrNoKeys не загружено ни одного приватного ключа
+	ErrNoKeys = errors.New("no private keys")
+)
+
+// Format формат зашифрованного сообщения
+type Format string
+
+const (
+	// FormatEnvelope конверт с идентификатором ключа
+	FormatEnvelope Format = "envelope"
+	// FormatEnvelopeNoKeyID конверт версии 1 без идентификатора ключа, ключ подбирается перебором
+	FormatEnvelopeNoKeyID Format = "envelope-v1"
+	// FormatOAEP сообщение целиком зашифровано RSA-OAEP, так шифровали агенты до появления конвертов
+	FormatOAEP Format = "oaep"
+)
+
+// DecodeInfo каким ключом и в каком формате было зашифровано сообщение
+type DecodeInfo struct {
+	KeyID  string
+	Format Format
+	// Encoding чем сжато сообщение до шифрования, пусто - не сжато. Распаковывает сообщение вызывающий
+	Encoding string
+}
+
+// privateKey приватный ключ с идентификатором его публичного ключа
+type privateKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+// Decoder расшифровка приватными ключами. Ключей может быть несколько: при ротации сервер расшифровывает
+// сообщения и новым ключом, и старым, пока все агенты не перейдут на новый
 type Decoder struct {
-	privateKey *rsa.PrivateKey
-	label      []byte
+	keys     []privateKey
+	byID     map[string]*rsa.PrivateKey
+	label    []byte
+	password []byte
 }
 
-func NewDecoder(privateFileName string) (*Decoder, error) {
-	privateKey, err := ReadRSAPrivateKey(privateFileName)
-	if err != nil {
-		return nil, err
+// NewDecoder - конструктор, paths - файлы приватных ключей или директории с ними.
+// Из директории загружаются все файлы с приватным ключом rsa. Пропускаются только скрытые файлы
+// и PEM без приватного ключа (публичные ключи, сертификаты), любой другой файл, который не удалось
+// прочитать как приватный ключ, - ошибка
+func NewDecoder(paths ...string) (*Decoder, error) {
+	return NewDecoderWithPassword(nil, paths...)
+}
+
+// NewDecoderWithPassword - конструктор для зашифрованных приватных ключей, все ключи расшифровываются паролем password
+func NewDecoderWithPassword(password []byte, paths ...string) (*Decoder, error) {
+	d := &Decoder{
+		byID:     make(map[string]*rsa.PrivateKey),
+		label:    []byte(""),
+		password: password,
+	}
+	for _, path := range paths {
+		if err := d.load(path); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.keys) == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoKeys, strings.Join(paths, ", "))
 	}
-	return &Decoder{
-		privateKey: privateKey,
-		label:      []byte(""),
-	}, nil
+	return d, nil
 }
 
-func (e Decoder) Decode(message []byte) ([]byte, error) {
-	hash := sha256.New()
-	plainText, err := rsa.DecryptOAEP(hash, rand.Reader, e.privateKey, message, e.label)
+// load загружает ключ из файла path либо все ключи из директории path
+func (d *Decoder) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		key, err := ReadRSAPrivateKeyWithPassword(path, d.password)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		d.add(key)
+		return nil
+	}
 
+	files, err := ioutil.ReadDir(path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		//! Рядом с приватными ключами могут лежать публичные ключи и сертификаты, их пропускаем.
+		//! Поврежденный или зашифрованный без пароля ключ не пропускаем, иначе сервер молча
+		//! не расшифрует сообщения агентов этого ключа
+		fileName := filepath.Join(path, file.Name())
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(data); block != nil && !isPrivateKeyPEM(block.Type) {
+			continue
+		}
+		key, err := ParsePrivateKeyPEM(data, d.password)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+		d.add(key)
 	}
+	return nil
+}
+
+// isPrivateKeyPEM тип блока PEM с приватным ключом, в том числе не rsa
+func isPrivateKeyPEM(blockType string) bool {
+	return strings.HasSuffix(blockType, "PRIVATE KEY")
+}
+
+// add добавляет ключ, повторно загруженный ключ пропускается
+func (d *Decoder) add(key *rsa.PrivateKey) {
+	id := KeyID(&key.PublicKey)
+	if _, ok := d.byID[id]; ok {
+		return
+	}
+	d.byID[id] = key
+	d.keys = append(d.keys, privateKey{id: id, key: key})
+}
+
+// KeyIDs идентификаторы загруженных ключей в порядке загрузки
+func (d *Decoder) KeyIDs() []string {
+	ids := make([]string, 0, len(d.keys))
+	for _, key := range d.keys {
+		ids = append(ids, key.id)
+	}
+	return ids
+}
+
+// Decode расшифровывает сообщение Encoder
+func (d *Decoder) Decode(message []byte) ([]byte, error) {
+	plainText, _, err := d.DecodeKey(message)
 	return plainText, err
 }
+
+// DecodeKey расшифровывает сообщение и возвращает, каким ключом и в каком формате оно было зашифровано.
+// Успешная расшифровка учитывается в статистике Usage
+func (d *Decoder) DecodeKey(message []byte) ([]byte, DecodeInfo, error) {
+	plainText, info, err := d.decodeKey(message)
+	if err == nil {
+		recordUsage(info, time.Now())
+	}
+	return plainText, info, err
+}
+
+// decodeKey конверт с идентификатором ключа расшифровывает этим ключом, остальные форматы - перебором ключей.
+// Сообщения без заголовка конверта расшифровываются как RSA-OAEP целиком - так шифровали агенты предыдущих версий
+func (d *Decoder) decodeKey(message []byte) ([]byte, DecodeInfo, error) {
+	if !IsEnvelope(message) {
+		return d.decodeOAEP(message)
+	}
+	plainText, info, err := d.decodeEnvelope(message)
+	//! Шифротекст RSA случайный и с малой вероятностью тоже может начинаться с magic
+	if err != nil {
+		if legacy, legacyInfo, legacyErr := d.decodeOAEP(message); legacyErr == nil {
+			return legacy, legacyInfo, nil
+		}
+	}
+	return plainText, info, err
+}
+
+// decodeEnvelope расшифровывает ключ сообщения приватным ключом RSA, а им - само сообщение
+func (d *Decoder) decodeEnvelope(message []byte) ([]byte, DecodeInfo, error) {
+	env, err := parseEnvelope(message)
+	if err != nil {
+		return nil, DecodeInfo{}, err
+	}
+	keys := d.keys
+	info := DecodeInfo{Format: FormatEnvelopeNoKeyID, Encoding: env.encoding}
+	if env.keyID != nil {
+		id := hex.EncodeToString(env.keyID)
+		key, ok := d.byID[id]
+		if !ok {
+			return nil, DecodeInfo{}, fmt.Errorf("%w %s", ErrUnknownKey, id)
+		}
+		keys = []privateKey{{id: id, key: key}}
+		info.Format = FormatEnvelope
+	}
+
+	var dataKey []byte
+	for _, key := range keys {
+		dataKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key.key, env.wrappedKey, d.label)
+		if err == nil {
+			info.KeyID = key.id
+			break
+		}
+	}
+	if err != nil {
+		return nil, DecodeInfo{}, err
+	}
+	if len(dataKey) != dataKeySize {
+		return nil, DecodeInfo{}, ErrInvalidEnvelope
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, DecodeInfo{}, err
+	}
+	plainText, err := gcm.Open(nil, env.nonce, env.cipherText, env.aad)
+	if err != nil {
+		return nil, DecodeInfo{}, err
+	}
+	return plainText, info, nil
+}
+
+// decodeOAEP расшифровывает message целиком RSA-OAEP ключом подходящего размера
+func (d *Decoder) decodeOAEP(message []byte) ([]byte, DecodeInfo, error) {
+	err := ErrUnknownKey
+	for _, key := range d.keys {
+		if len(message) != key.key.Size() {
+			continue
+		}
+		var plainText []byte
+		plainText, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key.key, message, d.label)
+		if err == nil {
+			return plainText, DecodeInfo{KeyID: key.id, Format: FormatOAEP}, nil
+		}
+	}
+	return nil, DecodeInfo{}, err
+}
@@ -4,10 +4,12 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"io"
 )
 
 type Encoder struct {
 	publicKey *rsa.PublicKey
+	keyID     []byte
 	label     []byte
 }
 
@@ -18,16 +20,49 @@ func NewEncoder(publicFileName string) (*Encoder, error) {
 	}
 	return &Encoder{
 		publicKey: publicKey,
+		keyID:     keyIDBytes(publicKey),
 		label:     []byte(""),
 	}, nil
 }
 
+// KeyID идентификатор публичного ключа, которым шифрует Encoder
+func (e Encoder) KeyID() string {
+	return KeyID(e.publicKey)
+}
+
+// Encode шифрует message в конверт: сообщение шифруется случайным ключом AES-GCM, ключ - публичным ключом RSA.
+// Размер сообщения не ограничен размером ключа RSA. В заголовке конверта указывается идентификатор ключа
 func (e Encoder) Encode(message []byte) ([]byte, error) {
-	hash := sha256.New()
-	cipherText, err := rsa.EncryptOAEP(hash, rand.Reader, e.publicKey, message, e.label)
+	return e.EncodeWithEncoding(message, "")
+}
 
+// EncodeWithEncoding шифрует в конверт сообщение message, сжатое алгоритмом encoding.
+// Кодировка записывается в заголовок конверта, получатель распаковывает сообщение после расшифровки
+func (e Encoder) EncodeWithEncoding(message []byte, encoding string) ([]byte, error) {
+	if len(encoding) > maxEncodingSize {
+		return nil, ErrEncodingTooLong
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, e.publicKey, dataKey, e.label)
 	if err != nil {
 		return nil, err
 	}
-	return cipherText, nil
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	aad := append(envelopeHeader(e.keyID, encoding, len(wrappedKey)), wrappedKey...)
+	result := make([]byte, 0, len(aad)+len(nonce)+len(message)+gcm.Overhead())
+	result = append(result, aad...)
+	result = append(result, nonce...)
+	return gcm.Seal(result, nonce, message, aad), nil
 }
@@ -0,0 +1,139 @@
+package rsa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Формат конверта. RSA-OAEP шифрует только сообщения меньше размера ключа (около 190 байт для 2048 бит),
+// поэтому сообщение шифруется случайным ключом AES-256-GCM, а RSA-OAEP шифрует только этот ключ:
+//
+//	magic "DVE" | версия 1 байт | идентификатор ключа 8 байт (с версии 2) |
+//	длина кодировки 1 байт | кодировка (с версии 3) |
+//	длина зашифрованного ключа uint16 big endian | зашифрованный ключ | nonce 12 байт | шифротекст AES-GCM с тегом
+//
+// Идентификатор ключа (KeyID) позволяет серверу с несколькими ключами сразу выбрать нужный при ротации.
+// Кодировка - чем сжато сообщение до шифрования (gzip, zstd), пусто - не сжато. Зашифрованные данные
+// не сжимаются, поэтому сообщение сжимается до шифрования, а получатель распаковывает его после расшифровки.
+// Все до nonce передается в AES-GCM как дополнительные данные, поэтому подмена версии, идентификатора,
+// кодировки или ключа обнаруживается при расшифровке
+const (
+	// envelopeMagic начало конверта
+	envelopeMagic = "DVE"
+	// EnvelopeVersion текущая версия формата конверта
+	EnvelopeVersion byte = 3
+	// envelopeVersionNoKeyID версия конверта без идентификатора ключа
+	envelopeVersionNoKeyID byte = 1
+	// envelopeVersionNoEncoding версия конверта без кодировки сообщения
+	envelopeVersionNoEncoding byte = 2
+	// maxEncodingSize максимальная длина кодировки
+	maxEncodingSize = 255
+	// dataKeySize размер ключа AES-256
+	dataKeySize = 32
+	// envelopePrefixSize magic и версия
+	envelopePrefixSize = len(envelopeMagic) + 1
+	// gcmNonceSize и gcmTagSize размеры nonce и тега AES-GCM по умолчанию
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+var (
+	// ErrInvalidEnvelope конверт обрезан или поврежден
+	ErrInvalidEnvelope = errors.New("invalid encrypted envelope")
+	// ErrUnsupportedVersion неизвестная версия формата конверта
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+	// ErrEncodingTooLong кодировка сообщения не помещается в заголовок конверта
+	ErrEncodingTooLong = errors.New("envelope encoding too long")
+)
+
+// IsEnvelope начинается ли message с заголовка конверта
+func IsEnvelope(message []byte) bool {
+	return len(message) >= envelopePrefixSize && string(message[:len(envelopeMagic)]) == envelopeMagic
+}
+
+// envelopeHeader заголовок конверта текущей версии для ключа keyID, кодировки сообщения encoding
+// и зашифрованного ключа длиной keySize
+func envelopeHeader(keyID []byte, encoding string, keySize int) []byte {
+	header := make([]byte, 0, envelopePrefixSize+keyIDSize+1+len(encoding)+2)
+	header = append(header, envelopeMagic...)
+	header = append(header, EnvelopeVersion)
+	header = append(header, keyID...)
+	header = append(header, byte(len(encoding)))
+	header = append(header, encoding...)
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(keySize))
+	return append(header, size[:]...)
+}
+
+// envelope разобранный конверт
+type envelope struct {
+	version byte
+	// keyID идентификатор ключа, nil для версии 1
+	keyID []byte
+	// encoding чем сжато сообщение до шифрования, пусто для версий 1 и 2
+	encoding string
+	// aad заголовок и зашифрованный ключ - дополнительные данные AES-GCM
+	aad        []byte
+	wrappedKey []byte
+	nonce      []byte
+	cipherText []byte
+}
+
+// parseEnvelope разбирает конверт на части, не расшифровывая их
+func parseEnvelope(message []byte) (envelope, error) {
+	if !IsEnvelope(message) {
+		return envelope{}, ErrInvalidEnvelope
+	}
+	env := envelope{version: message[len(envelopeMagic)]}
+	offset := envelopePrefixSize
+	switch env.version {
+	case envelopeVersionNoKeyID:
+	case envelopeVersionNoEncoding, EnvelopeVersion:
+		if len(message) < offset+keyIDSize {
+			return envelope{}, ErrInvalidEnvelope
+		}
+		env.keyID = message[offset : offset+keyIDSize]
+		offset += keyIDSize
+		if env.version == envelopeVersionNoEncoding {
+			break
+		}
+		if len(message) < offset+1 {
+			return envelope{}, ErrInvalidEnvelope
+		}
+		encodingEnd := offset + 1 + int(message[offset])
+		if len(message) < encodingEnd {
+			return envelope{}, ErrInvalidEnvelope
+		}
+		env.encoding = string(message[offset+1 : encodingEnd])
+		offset = encodingEnd
+	default:
+		return envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.version)
+	}
+	if len(message) < offset+2 {
+		return envelope{}, ErrInvalidEnvelope
+	}
+	keySize := int(binary.BigEndian.Uint16(message[offset:]))
+	offset += 2
+	keyEnd := offset + keySize
+	// после ключа должны быть nonce и хотя бы тег AES-GCM
+	if len(message) < keyEnd+gcmNonceSize+gcmTagSize {
+		return envelope{}, ErrInvalidEnvelope
+	}
+	env.aad = message[:keyEnd]
+	env.wrappedKey = message[offset:keyEnd]
+	env.nonce = message[keyEnd : keyEnd+gcmNonceSize]
+	env.cipherText = message[keyEnd+gcmNonceSize:]
+	return env, nil
+}
+
+// newGCM AES-256-GCM с ключом key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
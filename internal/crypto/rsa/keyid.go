@@ -0,0 +1,33 @@
+package rsa
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+)
+
+// keyIDSize размер идентификатора ключа в байтах
+const keyIDSize = 8
+
+// Fingerprint отпечаток публичного ключа: sha256 от ключа в формате PKIX DER
+func Fingerprint(publicKey *rsa.PublicKey) [sha256.Size]byte {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		// MarshalPKIXPublicKey возвращает ошибку только для неподдерживаемых типов ключей
+		panic(err)
+	}
+	return sha256.Sum256(der)
+}
+
+// KeyID идентификатор ключа - первые 8 байт отпечатка Fingerprint в hex. Агент указывает его в конверте,
+// а сервер по нему выбирает приватный ключ из нескольких загруженных
+func KeyID(publicKey *rsa.PublicKey) string {
+	return hex.EncodeToString(keyIDBytes(publicKey))
+}
+
+// keyIDBytes идентификатор ключа в виде байт для заголовка конверта
+func keyIDBytes(publicKey *rsa.PublicKey) []byte {
+	fingerprint := Fingerprint(publicKey)
+	return fingerprint[:keyIDSize]
+}
@@ -0,0 +1,186 @@
+package rsa
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Зашифрованный приватный ключ PKCS#8 (блок PEM "ENCRYPTED PRIVATE KEY", RFC 5958 и RFC 8018).
+// Поддерживается схема PBES2, которую по умолчанию использует OpenSSL 3:
+// ключ шифрования выводится из пароля PBKDF2 (HMAC-SHA1 или HMAC-SHA256), ключ шифруется AES-CBC
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+const (
+	// pbkdf2Iterations число итераций PBKDF2 для новых зашифрованных ключей
+	pbkdf2Iterations = 100000
+	// pbkdf2SaltSize размер соли PBKDF2
+	pbkdf2SaltSize = 16
+)
+
+var (
+	// ErrPasswordRequired приватный ключ зашифрован, а пароль не задан
+	ErrPasswordRequired = errors.New("private key is encrypted, password required")
+	// ErrIncorrectPassword не удалось расшифровать приватный ключ паролем
+	ErrIncorrectPassword = errors.New("incorrect private key password")
+	// ErrUnsupportedEncryption ключ зашифрован неподдерживаемым алгоритмом
+	ErrUnsupportedEncryption = errors.New("unsupported private key encryption")
+	// ErrInvalidEncryptedKey зашифрованный ключ поврежден
+	ErrInvalidEncryptedKey = errors.New("invalid encrypted private key")
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// aesKeySize размер ключа AES по идентификатору схемы шифрования
+func aesKeySize(oid asn1.ObjectIdentifier) (int, bool) {
+	switch {
+	case oid.Equal(oidAES128CBC):
+		return 16, true
+	case oid.Equal(oidAES192CBC):
+		return 24, true
+	case oid.Equal(oidAES256CBC):
+		return 32, true
+	}
+	return 0, false
+}
+
+// prfHash хеш-функция HMAC для PBKDF2, по умолчанию HMAC-SHA1
+func prfHash(prf pkix.AlgorithmIdentifier) (func() hash.Hash, bool) {
+	switch {
+	case len(prf.Algorithm) == 0 || prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, true
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, true
+	}
+	return nil, false
+}
+
+// decryptPKCS8 расшифровывает EncryptedPrivateKeyInfo паролем и возвращает PKCS#8 DER приватного ключа
+func decryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	h, ok := prfHash(kdf.PRF)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, kdf.PRF.Algorithm)
+	}
+	keySize, ok := aesKeySize(params.EncryptionScheme.Algorithm)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if kdf.IterationCount <= 0 || len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, ErrInvalidEncryptedKey
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(password, kdf.Salt, kdf.IterationCount, keySize, h))
+	if err != nil {
+		return nil, err
+	}
+	plainText := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plainText, info.EncryptedData)
+	//! Неверный пароль почти всегда дает некорректное дополнение PKCS#7
+	padding := int(plainText[len(plainText)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		!bytes.Equal(plainText[len(plainText)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, ErrIncorrectPassword
+	}
+	return plainText[:len(plainText)-padding], nil
+}
+
+// encryptPKCS8 шифрует PKCS#8 DER приватного ключа паролем: PBES2, PBKDF2 HMAC-SHA256, AES-256-CBC
+func encryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	salt := make([]byte, pbkdf2SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(password, salt, pbkdf2Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	plainText := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plainText))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plainText)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+}
@@ -1,4 +1,6 @@
-// Package rsa реализовывает возможность шифрования и дешифрования rsa через публичные и приватные ключи
+// Package rsa реализовывает возможность шифрования и дешифрования rsa через публичные и приватные ключи.
+// Сообщение шифруется случайным ключом AES-GCM, а публичным ключом rsa - только этот ключ (формат в envelope.go),
+// поэтому размер сообщения не ограничен размером ключа
 // Основные варианты использования:
 // 1. Шифрование публичным ключом
 // encoder, err := NewEncoder("test_data/rsa.public")
@@ -6,6 +8,10 @@
 // 2. Дешифрация приватным ключом
 // decoder, err := NewDecoder("test_data/rsa.private")
 // decodeMsg, err := decoder.Decode(cipherText)
+//
+// Приватные ключи читаются в форматах PKCS#1 ("RSA PRIVATE KEY") и PKCS#8 ("PRIVATE KEY"),
+// в том числе зашифрованные паролем в PKCS#8 PBES2 ("ENCRYPTED PRIVATE KEY").
+// Создавать и конвертировать ключи можно утилитой cmd/keytool
 package rsa
 
 import (
@@ -13,20 +19,78 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"strings"
 )
 
-func parseRSAPrivateKeyFromPEM(privateKeyPEM string) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode([]byte(privateKeyPEM))
+// Типы блоков PEM ключей
+const (
+	pemPKCS1PrivateKey   = "RSA PRIVATE KEY"
+	pemPKCS8PrivateKey   = "PRIVATE KEY"
+	pemEncryptedPKCS8Key = "ENCRYPTED PRIVATE KEY"
+	pemPKCS1PublicKey    = "RSA PUBLIC KEY"
+	pemPKIXPublicKey     = "PUBLIC KEY"
+)
+
+// KeyFormat формат записи приватного ключа
+type KeyFormat string
+
+const (
+	// PKCS1 приватный ключ rsa в формате PKCS#1, блок "RSA PRIVATE KEY"
+	PKCS1 KeyFormat = "pkcs1"
+	// PKCS8 приватный ключ в формате PKCS#8, блок "PRIVATE KEY" или "ENCRYPTED PRIVATE KEY" с паролем
+	PKCS8 KeyFormat = "pkcs8"
+)
+
+// ErrEncryptedPKCS1 запись зашифрованных ключей поддерживается только в формате PKCS#8
+var ErrEncryptedPKCS1 = errors.New("encrypted private keys are written only in pkcs8 format")
+
+// ParsePrivateKeyPEM разбирает приватный ключ rsa из PEM. password нужен только для зашифрованных ключей
+func ParsePrivateKeyPEM(data []byte, password []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errors.New("failed to parse PEM block containing the private key")
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	der := block.Bytes
+	switch block.Type {
+	case pemEncryptedPKCS8Key:
+		if len(password) == 0 {
+			return nil, ErrPasswordRequired
+		}
+		var err error
+		if der, err = decryptPKCS8(der, password); err != nil {
+			return nil, err
+		}
+		key, err := parsePKCS8PrivateKey(der)
+		if err != nil {
+			//! Неверный пароль с небольшой вероятностью дает корректное дополнение, тогда ломается сам ключ
+			return nil, fmt.Errorf("%w: %s", ErrIncorrectPassword, err.Error())
+		}
+		return key, nil
+	case pemPKCS8PrivateKey:
+		return parsePKCS8PrivateKey(der)
+	}
+
+	//! Шифрование PEM заголовком Proc-Type (openssl -traditional) небезопасно и устарело в stdlib.
+	//! Такой ключ нужно перешифровать в PKCS#8: openssl pkcs8 -topk8 -v2 aes-256-cbc
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return nil, fmt.Errorf("%w: legacy PEM encryption, convert the key to encrypted pkcs8", ErrUnsupportedEncryption)
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// parsePKCS8PrivateKey разбирает PKCS#8 DER и проверяет, что это ключ rsa
+func parsePKCS8PrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
 	if err != nil {
 		return nil, err
 	}
-
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key type is not rsa.PrivateKey")
+	}
 	return privateKey, nil
 }
 
@@ -35,6 +99,9 @@ func parseRSAPublicKeyFromPEM(publicKeyPEM string) (*rsa.PublicKey, error) {
 	if block == nil {
 		return nil, errors.New("failed to parse PEM block containing the public key")
 	}
+	if block.Type == pemPKCS1PublicKey {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
 
 	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
@@ -49,6 +116,41 @@ func parseRSAPublicKeyFromPEM(publicKeyPEM string) (*rsa.PublicKey, error) {
 	}
 }
 
+// MarshalPrivateKeyPEM записывает приватный ключ в PEM в формате format.
+// Если задан password, ключ шифруется паролем, это возможно только в формате PKCS#8
+func MarshalPrivateKeyPEM(key *rsa.PrivateKey, format KeyFormat, password []byte) ([]byte, error) {
+	switch format {
+	case PKCS1:
+		if len(password) > 0 {
+			return nil, ErrEncryptedPKCS1
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemPKCS1PrivateKey, Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case PKCS8:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(password) == 0 {
+			return pem.EncodeToMemory(&pem.Block{Type: pemPKCS8PrivateKey, Bytes: der}), nil
+		}
+		encrypted, err := encryptPKCS8(der, password)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemEncryptedPKCS8Key, Bytes: encrypted}), nil
+	}
+	return nil, fmt.Errorf("unknown private key format %q", format)
+}
+
+// MarshalPublicKeyPEM записывает публичный ключ в PEM в формате PKIX - его читает ReadRSAPublicKey
+func MarshalPublicKeyPEM(key *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemPKIXPublicKey, Bytes: der}), nil
+}
+
 func ReadRSAPublicKey(rsaPrivateKeyLocation string) (*rsa.PublicKey, error) {
 	public, err := ioutil.ReadFile(rsaPrivateKeyLocation)
 	if err != nil {
@@ -58,9 +160,14 @@ func ReadRSAPublicKey(rsaPrivateKeyLocation string) (*rsa.PublicKey, error) {
 }
 
 func ReadRSAPrivateKey(rsaPrivateKeyLocation string) (*rsa.PrivateKey, error) {
+	return ReadRSAPrivateKeyWithPassword(rsaPrivateKeyLocation, nil)
+}
+
+// ReadRSAPrivateKeyWithPassword читает приватный ключ из файла, зашифрованный ключ расшифровывается паролем password
+func ReadRSAPrivateKeyWithPassword(rsaPrivateKeyLocation string, password []byte) (*rsa.PrivateKey, error) {
 	priv, err := ioutil.ReadFile(rsaPrivateKeyLocation)
 	if err != nil {
 		return nil, err
 	}
-	return parseRSAPrivateKeyFromPEM(string(priv))
+	return ParsePrivateKeyPEM(priv, password)
 }
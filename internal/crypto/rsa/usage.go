@@ -0,0 +1,56 @@
+package rsa
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyUsage сколько сообщений в формате Format расшифровано ключом KeyID и когда последнее.
+// По ним видно, какие ключи еще нужны агентам и когда старый ключ можно удалить после ротации
+type KeyUsage struct {
+	KeyID    string
+	Format   Format
+	Decrypts int64
+	LastUsed time.Time
+}
+
+// keyUsage статистика расшифровок всех декодеров процесса. Http и grpc серверы загружают ключи
+// в свои декодеры, а статистика у сервера одна
+var keyUsage = struct {
+	lock  sync.Mutex
+	usage map[DecodeInfo]*KeyUsage
+}{usage: make(map[DecodeInfo]*KeyUsage)}
+
+// recordUsage учитывает расшифровку сообщения ключом и в формате info в момент now
+func recordUsage(info DecodeInfo, now time.Time) {
+	// кодировка сжатия к ключу не относится
+	info.Encoding = ""
+	keyUsage.lock.Lock()
+	defer keyUsage.lock.Unlock()
+	usage, ok := keyUsage.usage[info]
+	if !ok {
+		usage = &KeyUsage{KeyID: info.KeyID, Format: info.Format}
+		keyUsage.usage[info] = usage
+	}
+	usage.Decrypts++
+	usage.LastUsed = now
+}
+
+// Usage статистика расшифровок всех декодеров процесса по ключам и форматам, отсортирована по ключу и формату
+func Usage() []KeyUsage {
+	keyUsage.lock.Lock()
+	result := make([]KeyUsage, 0, len(keyUsage.usage))
+	for _, usage := range keyUsage.usage {
+		result = append(result, *usage)
+	}
+	keyUsage.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].KeyID != result[j].KeyID {
+			return result[i].KeyID < result[j].KeyID
+		}
+		return result[i].Format < result[j].Format
+	})
+	return result
+}
@@ -0,0 +1,51 @@
+package rsa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	recordUsage(DecodeInfo{KeyID: "test-usage-1", Format: FormatEnvelope, Encoding: "gzip"}, now)
+	recordUsage(DecodeInfo{KeyID: "test-usage-1", Format: FormatEnvelope}, now.Add(time.Minute))
+	recordUsage(DecodeInfo{KeyID: "test-usage-1", Format: FormatOAEP}, now)
+	recordUsage(DecodeInfo{KeyID: "test-usage-0", Format: FormatOAEP}, now)
+
+	var usage []KeyUsage
+	for _, key := range Usage() {
+		if key.KeyID == "test-usage-0" || key.KeyID == "test-usage-1" {
+			usage = append(usage, key)
+		}
+	}
+	assert.Equal(t, []KeyUsage{
+		{KeyID: "test-usage-0", Format: FormatOAEP, Decrypts: 1, LastUsed: now},
+		{KeyID: "test-usage-1", Format: FormatEnvelope, Decrypts: 2, LastUsed: now.Add(time.Minute)},
+		{KeyID: "test-usage-1", Format: FormatOAEP, Decrypts: 1, LastUsed: now},
+	}, usage)
+
+	// расшифровка декодером учитывается, ошибка расшифровки - нет
+	encoder, err := NewEncoder("test_data/rsa2.public")
+	require.NoError(t, err)
+	decoder, err := NewDecoder("test_data/rsa2.private")
+	require.NoError(t, err)
+	decrypts := func() int64 {
+		for _, key := range Usage() {
+			if key.KeyID == encoder.KeyID() && key.Format == FormatEnvelope {
+				return key.Decrypts
+			}
+		}
+		return 0
+	}
+	before := decrypts()
+	cipherText, err := encoder.Encode([]byte("simple test"))
+	require.NoError(t, err)
+	_, err = decoder.Decode(cipherText)
+	require.NoError(t, err)
+	_, err = decoder.Decode(cipherText[:len(cipherText)-1])
+	require.Error(t, err)
+	assert.Equal(t, before+1, decrypts())
+}
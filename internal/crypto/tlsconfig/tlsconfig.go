@@ -0,0 +1,91 @@
+// Package tlsconfig создает настройки tls для сервера и агента из файлов сертификатов в формате PEM
+// и определяет имя клиента по проверенному сертификату
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrNoCertificates в файле CA нет ни одного сертификата
+var ErrNoCertificates = errors.New("no certificates in CA file")
+
+// Server настройки tls сервера с сертификатом certFile и ключом keyFile.
+// Если задан caFile, включается взаимный tls: сервер требует сертификат клиента, подписанный этим CA
+func Server(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if caFile != "" {
+		pool, err := readCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// Client настройки tls агента. caFile - CA для проверки сертификата сервера, пусто - системные CA.
+// certFile и keyFile - сертификат клиента для взаимного tls, пусто - без сертификата.
+// serverName заменяет имя сервера из адреса при проверке сертификата
+func Client(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if caFile != "" {
+		pool, err := readCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// readCertPool читает сертификаты CA из файла PEM
+func readCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: %w", caFile, ErrNoCertificates)
+	}
+	return pool, nil
+}
+
+// ClientName имя клиента из проверенного сертификата соединения state: CommonName, если он пуст, первое DNS имя.
+// false если соединение без tls или клиент не предъявил проверенный сертификат
+func ClientName(state *tls.ConnectionState) (string, bool) {
+	//! VerifiedChains заполняется только после проверки цепочки, PeerCertificates может быть и непроверенным
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, true
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], true
+	}
+	return "", false
+}
@@ -0,0 +1,83 @@
+package tlsconfig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestServer https сервер, который отвечает именем клиента из сертификата
+func startTestServer(t *testing.T, caFile string) *httptest.Server {
+	conf, err := Server("test_data/server.pem", "test_data/server.key", caFile)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := ClientName(r.TLS)
+		w.Write([]byte(name))
+	}))
+	ts.TLS = conf
+	ts.StartTLS()
+	return ts
+}
+
+func request(t *testing.T, ts *httptest.Server, certFile, keyFile, caFile string) (string, error) {
+	conf, err := Client(certFile, keyFile, caFile, "")
+	require.NoError(t, err)
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestTLS(t *testing.T) {
+	ts := startTestServer(t, "")
+	defer ts.Close()
+
+	// без CA клиента сервер не требует сертификат
+	name, err := request(t, ts, "", "", "test_data/ca.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+
+	// сертификат сервера не подписан системными CA
+	_, err = request(t, ts, "", "", "")
+	assert.Error(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ts := startTestServer(t, "test_data/ca.pem")
+	defer ts.Close()
+
+	name, err := request(t, ts, "test_data/client.pem", "test_data/client.key", "test_data/ca.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, "agent1", name)
+
+	// без сертификата и с сертификатом чужого CA соединение не устанавливается
+	_, err = request(t, ts, "", "", "test_data/ca.pem")
+	assert.Error(t, err)
+	_, err = request(t, ts, "test_data/untrusted_client.pem", "test_data/untrusted_client.key", "test_data/ca.pem")
+	assert.Error(t, err)
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := Server("test_data/server.pem", "test_data/client.key", "")
+	assert.Error(t, err)
+	_, err = Server("test_data/server.pem", "test_data/server.key", "test_data/server.key")
+	assert.ErrorIs(t, err, ErrNoCertificates)
+	_, err = Server("test_data/server.pem", "test_data/server.key", "test_data/nofile.pem")
+	assert.Error(t, err)
+
+	_, err = Client("test_data/client.pem", "", "", "")
+	assert.Error(t, err)
+	_, err = Client("", "", "test_data/client.key", "")
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	_, ok := ClientName(nil)
+	assert.False(t, ok)
+}
@@ -7,6 +7,29 @@ type GeneralConfig struct {
 	SecretKey   string `env:"KEY" json:"secret_key"`
 	CryptoKey   string `env:"CRYPTO_KEY" json:"crypto_key"`
 	GRPCAddress string `env:"GRPC_ADDRESS" json:"grpc"`
+	// TLSCert и TLSKey сертификат и ключ в формате PEM: сертификат сервера либо сертификат агента для взаимного tls
+	TLSCert string `env:"TLS_CERT" json:"tls_cert"`
+	TLSKey  string `env:"TLS_KEY" json:"tls_key"`
+	// TLSCA сертификаты CA в формате PEM. На сервере включает проверку сертификатов клиентов,
+	// на агенте используется для проверки сертификата сервера вместо системных CA
+	TLSCA string `env:"TLS_CA" json:"tls_ca"`
+	// HistoryRetention глубина хранения истории значений метрик в памяти, 0 - история не ведется
+	HistoryRetention Duration `env:"HISTORY_RETENTION" json:"history_retention"`
+	// HistorySize максимальное число точек истории на один ряд, 0 - значение по умолчанию
+	HistorySize int `env:"HISTORY_SIZE" json:"history_size"`
+	// RepositoryShards число шардов репозитория метрик, 0 или 1 - репозиторий без шардирования
+	RepositoryShards int `env:"REPOSITORY_SHARDS" json:"repository_shards"`
+	// MetricTTL срок жизни метрики без обновлений, после которого она удаляется, 0 - метрики не устаревают
+	MetricTTL Duration `env:"METRIC_TTL" json:"metric_ttl"`
+	// MetricTTLRules сроки жизни для отдельных метрик, приоритетнее MetricTTL. Применяется первое подходящее правило
+	MetricTTLRules []TTLRule `json:"metric_ttl_rules"`
+}
+
+// TTLRule срок жизни метрик, имя которых подходит под шаблон Pattern в синтаксисе path.Match, например "cpu_*".
+// Нулевой TTL означает что подходящие метрики не устаревают
+type TTLRule struct {
+	Pattern string   `json:"pattern"`
+	TTL     Duration `json:"ttl"`
 }
 
 func (g *GeneralConfig) GeneralCfg() *GeneralConfig {
@@ -0,0 +1,140 @@
+// Package graphite содержит прием метрик по протоколу Graphite plaintext: path value [timestamp]
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+)
+
+// ErrInvalidLine строка не соответствует формату Graphite plaintext
+var ErrInvalidLine = errors.New("invalid graphite line")
+
+// Line разобранная строка Graphite
+type Line struct {
+	Path string
+	// Tags теги формата Graphite 1.1 path;tag=value
+	Tags  repository.Labels
+	Value float64
+	// Timestamp время значения, нулевое если не задано или равно -1
+	Timestamp time.Time
+}
+
+// ParseLine разбор строки path[;tag=value...] value [timestamp]
+func ParseLine(line string) (Line, error) {
+	var result Line
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return result, fmt.Errorf("%w: %s", ErrInvalidLine, line)
+	}
+
+	pathParts := strings.Split(fields[0], ";")
+	result.Path = pathParts[0]
+	if result.Path == "" {
+		return result, fmt.Errorf("%w: empty path", ErrInvalidLine)
+	}
+	for _, tag := range pathParts[1:] {
+		eq := strings.Index(tag, "=")
+		if eq <= 0 {
+			return result, fmt.Errorf("%w: incorrect tag %s", ErrInvalidLine, tag)
+		}
+		if result.Tags == nil {
+			result.Tags = make(repository.Labels)
+		}
+		result.Tags[tag[:eq]] = tag[eq+1:]
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return result, fmt.Errorf("%w: incorrect value %s", ErrInvalidLine, fields[1])
+	}
+	result.Value = value
+
+	if len(fields) == 3 && fields[2] != "-1" {
+		timestamp, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return result, fmt.Errorf("%w: incorrect timestamp %s", ErrInvalidLine, fields[2])
+		}
+		result.Timestamp = time.Unix(int64(timestamp), 0)
+	}
+	return result, nil
+}
+
+// Mapper преобразует пути Graphite в имена метрик и метки по правилам
+type Mapper struct {
+	rules []config.GraphiteRule
+}
+
+// NewMapper конструктор
+func NewMapper(rules []config.GraphiteRule) *Mapper {
+	return &Mapper{rules: rules}
+}
+
+// Map возвращает имя и метки для пути. Если ни одно правило не подошло или в правиле не задано имя,
+// имя совпадает с путем.
+// Теги строки дополняют метки правила и имеют приоритет
+func (m *Mapper) Map(path string, tags repository.Labels) (string, repository.Labels) {
+	segments := strings.Split(path, ".")
+	for _, rule := range m.rules {
+		captures, ok := match(strings.Split(rule.Pattern, "."), segments)
+		if !ok {
+			continue
+		}
+		var labels repository.Labels
+		if len(rule.Labels)+len(tags) > 0 {
+			labels = make(repository.Labels, len(rule.Labels)+len(tags))
+		}
+		for key, value := range rule.Labels {
+			labels[key] = expand(value, captures)
+		}
+		for key, value := range tags {
+			labels[key] = value
+		}
+		name := expand(rule.Name, captures)
+		if name == "" {
+			name = path
+		}
+		return name, labels
+	}
+	return path, tags.Copy()
+}
+
+// Metric конвертация строки в метрику gauge
+func (m *Mapper) Metric(line Line) repository.Metrics {
+	name, labels := m.Map(line.Path, line.Tags)
+	value := line.Value
+	return repository.Metrics{ID: name, Labels: labels, MType: repository.Gauge, Value: &value}
+}
+
+// match сопоставление сегментов пути с шаблоном, возвращает сегменты совпавшие с *
+func match(pattern, segments []string) ([]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	captures := make([]string, 0)
+	for i, part := range pattern {
+		switch part {
+		case "*":
+			captures = append(captures, segments[i])
+		case segments[i]:
+		default:
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// expand замена $1, $2... на захваченные сегменты. Замена идет с конца, чтобы $1 не испортил $10
+func expand(template string, captures []string) string {
+	for i := len(captures); i > 0; i-- {
+		template = strings.ReplaceAll(template, "$"+strconv.Itoa(i), captures[i-1])
+	}
+	return template
+}
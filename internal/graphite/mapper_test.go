@@ -0,0 +1,107 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Line
+		wantErr bool
+	}{
+		{
+			name: "with timestamp",
+			line: "servers.web01.cpu.user 12.5 1668000000",
+			want: Line{Path: "servers.web01.cpu.user", Value: 12.5, Timestamp: time.Unix(1668000000, 0)},
+		},
+		{
+			name: "without timestamp",
+			line: "jobs.backup.duration 320",
+			want: Line{Path: "jobs.backup.duration", Value: 320},
+		},
+		{
+			name: "timestamp -1 means now",
+			line: "jobs.backup.duration 320 -1",
+			want: Line{Path: "jobs.backup.duration", Value: 320},
+		},
+		{
+			name: "tagged",
+			line: "disk.used;host=web01;mount=/ 0.75 1668000000",
+			want: Line{Path: "disk.used", Tags: repository.Labels{"host": "web01", "mount": "/"},
+				Value: 0.75, Timestamp: time.Unix(1668000000, 0)},
+		},
+		{name: "without value", line: "jobs.backup.duration", wantErr: true},
+		{name: "incorrect value", line: "jobs.backup.duration abc", wantErr: true},
+		{name: "incorrect timestamp", line: "jobs.backup.duration 1 yesterday", wantErr: true},
+		{name: "incorrect tag", line: "disk.used;host 1", wantErr: true},
+		{name: "too many fields", line: "disk.used 1 2 3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, line)
+		})
+	}
+}
+
+func TestMapper(t *testing.T) {
+	mapper := NewMapper([]config.GraphiteRule{
+		{Pattern: "servers.*.cpu.*", Name: "cpu_$2", Labels: map[string]string{"host": "$1"}},
+		{Pattern: "jobs.*.duration", Name: "job_duration", Labels: map[string]string{"job": "$1", "source": "cron"}},
+		{Pattern: "legacy.*", Labels: map[string]string{"kind": "$1"}},
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		tags       repository.Labels
+		wantName   string
+		wantLabels repository.Labels
+	}{
+		{
+			name:       "rule with two captures",
+			path:       "servers.web01.cpu.user",
+			wantName:   "cpu_user",
+			wantLabels: repository.Labels{"host": "web01"},
+		},
+		{
+			name:       "tags override rule labels",
+			path:       "jobs.backup.duration",
+			tags:       repository.Labels{"source": "manual"},
+			wantName:   "job_duration",
+			wantLabels: repository.Labels{"job": "backup", "source": "manual"},
+		},
+		{
+			name:       "rule without name keeps path",
+			path:       "legacy.queue",
+			wantName:   "legacy.queue",
+			wantLabels: repository.Labels{"kind": "queue"},
+		},
+		{
+			name:     "no matching rule",
+			path:     "servers.web01.mem.free",
+			wantName: "servers.web01.mem.free",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, labels := mapper.Map(tt.path, tt.tags)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, tt.wantLabels, labels)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package graphite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/middlewares"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+// Server прием Graphite plaintext по TCP. Каждая строка сразу записывается в repo как gauge,
+// метрики сохраняются в pStore после разбора каждой прочитанной из соединения пачки строк, как после запроса http.
+// Протокол plaintext не передает токенов, поэтому прием не проверяет токены и не ограничивает частоту.
+// Доступ ограничивается только сетью trustedSubNet по адресу соединения, без нее порт нужно открывать
+// только в доверенной сети
+type Server struct {
+	address  string
+	mapper   *Mapper
+	repo     repository.Repository
+	pStore   storage.PersistentStorage
+	blocker  *middlewares.IPBlocker
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer конструктор. trustedSubNet - cidr разрешенных клиентов, пусто - без ограничения
+func NewServer(address string, rules []config.GraphiteRule, trustedSubNet string, repo repository.Repository,
+	pStore storage.PersistentStorage) *Server {
+	return &Server{
+		address: address,
+		mapper:  NewMapper(rules),
+		repo:    repo,
+		pStore:  pStore,
+		blocker: middlewares.NewIPBlocker(trustedSubNet),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start открывает TCP порт и запускает прием в фоне
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// Addr адрес на котором принимаются метрики, доступен после Start
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop закрывает порт и открытые соединения и дожидается их обработки
+func (s *Server) Stop() {
+	close(s.done)
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Info().Msgf("graphite: ошибка tcp соединения - %s", err.Error())
+			continue
+		}
+		if !s.blocker.AllowAddr(conn.RemoteAddr()) {
+			log.Info().Msgf("graphite: соединение от %s не из доверенной сети закрыто", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn построчное чтение соединения до его закрытия или остановки сервера
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	updated := 0
+	save := func() {
+		if updated == 0 {
+			return
+		}
+		updated = 0
+		if err := s.pStore.Save(context.Background()); err != nil {
+			log.Info().Msgf("graphite: не удалось сохранить метрики - %s", err.Error())
+		}
+	}
+	//! Сканер читает из соединения, только когда разобрал все полные строки буфера.
+	//! Перед чтением сохраняем уже записанное, иначе долгое соединение не сохранялось бы до закрытия
+	scanner := bufio.NewScanner(batchReader{reader: conn, flush: save})
+	for scanner.Scan() {
+		line, err := ParseLine(scanner.Text())
+		if err != nil {
+			log.Debug().Msgf("graphite: %s", err.Error())
+			continue
+		}
+		if err = s.repo.UpdateMetric(s.mapper.Metric(line)); err != nil {
+			log.Info().Msgf("graphite: не удалось обновить метрику %s - %s", line.Path, err.Error())
+			continue
+		}
+		updated++
+	}
+	save()
+}
+
+// batchReader вызывает flush перед каждым чтением из reader
+type batchReader struct {
+	reader io.Reader
+	flush  func()
+}
+
+func (b batchReader) Read(p []byte) (int, error) {
+	b.flush()
+	return b.reader.Read(p)
+}
@@ -0,0 +1,109 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+func TestServer(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	pStore, _ := storage.NewFakeStorage()
+
+	server := NewServer("127.0.0.1:0", []config.GraphiteRule{
+		{Pattern: "servers.*.cpu", Name: "cpu", Labels: map[string]string{"host": "$1"}},
+	}, "", repo, pStore)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("servers.web01.cpu 12.5 1668000000\nbroken line here now\njobs.backup 3\n"))
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		_, ok := repo.Gauge("jobs.backup")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	metric, ok := repo.Metric("cpu", repository.Gauge, repository.Labels{"host": "web01"})
+	require.True(t, ok)
+	assert.Equal(t, 12.5, *metric.Value)
+	assert.Equal(t, 2, len(repo.ToMetrics()))
+}
+
+// countingStorage считает сохранения хранилища
+type countingStorage struct {
+	storage.FakeStorage
+	saves int32
+}
+
+func (c *countingStorage) Save(context.Context) error {
+	atomic.AddInt32(&c.saves, 1)
+	return nil
+}
+
+// TestServerSavesOpenConnection проверяем что метрики сохраняются, пока соединение еще открыто
+func TestServerSavesOpenConnection(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	pStore := &countingStorage{}
+
+	server := NewServer("127.0.0.1:0", nil, "", repo, pStore)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("jobs.backup 3\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&pStore.saves) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// строки без изменений не приводят к сохранению
+	_, err = conn.Write([]byte("broken line here now\n"))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("jobs.restore 1\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&pStore.saves) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestServerTrustedSubNet проверяем что соединения не из доверенной сети закрываются без записи метрик
+func TestServerTrustedSubNet(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	pStore := &countingStorage{}
+
+	server := NewServer("127.0.0.1:0", nil, "10.0.0.0/8", repo, pStore)
+	require.NoError(t, server.Start())
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("jobs.backup 3\n"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "соединение не закрыто сервером")
+	conn.Close()
+
+	server.Stop()
+	assert.Equal(t, 0, len(repo.ToMetrics()))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&pStore.saves))
+}
@@ -2,16 +2,26 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
 
+	"github.com/ncyellow/devops/internal/apierror"
 	"github.com/ncyellow/devops/internal/crypto/rsa"
 	"github.com/ncyellow/devops/internal/grpc/proto"
-	"github.com/ncyellow/devops/internal/hash"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/middlewares"
 	"github.com/ncyellow/devops/internal/server/storage"
+	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // MetricsServer Реализуем все базовые возможности grpc сервера
@@ -25,92 +35,467 @@ type MetricsServer struct {
 	repo    repository.Repository
 	pStore  storage.PersistentStorage
 	decoder *rsa.Decoder
+	// done закрывается в Stop и завершает открытые потоки
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// committed последняя сохраненная пачка StreamMetrics по agent_id
+	committed *committedBatches
 }
 
 func NewMetricServer(repo repository.Repository, conf *config.Config, pStore storage.PersistentStorage) *MetricsServer {
+	//! Как и в http, заданные, но не загруженные ключи - ошибка запуска, а не прием незашифрованных пачек
+	var decoder *rsa.Decoder
+	if paths := conf.CryptoKeyPaths(); len(paths) > 0 {
+		dec, err := rsa.NewDecoderWithPassword([]byte(conf.CryptoKeyPassword), paths...)
+		if err != nil {
+			log.Fatal().Msgf("не удалось загрузить rsa приватные ключи %s", err.Error())
+		}
+		decoder = dec
+	}
 	return &MetricsServer{
-		repo:   repo,
-		conf:   conf,
-		pStore: pStore,
+		repo:    repo,
+		conf:    conf,
+		pStore:  pStore,
+		decoder: decoder,
+		done:    make(chan struct{}),
+
+		committed: newCommittedBatches(),
 	}
 }
 
+// Stop завершает открытые потоки Watch перед остановкой grpc сервера
+func (ms *MetricsServer) Stop() {
+	ms.stopOnce.Do(func() {
+		close(ms.done)
+	})
+}
+
+// AddMetric записывает пачку метрик и, как http обработчики, сохраняет хранилище после записи
 func (ms *MetricsServer) AddMetric(ctx context.Context, req *proto.AddMetricRequest) (*proto.AddMetricResponse, error) {
 	var response proto.AddMetricResponse
-	encodeFunc := hash.CreateEncodeFunc(ms.conf.SecretKey)
-	counters := req.GetCounters()
-	for _, metric := range counters {
+	if err := ms.addMetrics(req); err != nil {
+		return nil, err
+	}
+	if err := ms.pStore.Save(ctx); err != nil {
+		return nil, apierror.Status(codes.Internal, apierror.CodeStorage, err.Error())
+	}
+	return &response, nil
+}
+
+// addMetrics проверяет все метрики пачки и записывает их в репозиторий. Если хотя бы одна метрика некорректна
+// или гистограмма не совпадает с рядом по границам корзин, пачка не применяется, а ошибка InvalidArgument
+// содержит BadRequest с нарушением для каждой метрики
+func (ms *MetricsServer) addMetrics(req *proto.AddMetricRequest) error {
+	req, err := ms.decryptBatch(req)
+	if err != nil {
+		return err
+	}
+	metrics, fields := metricsFromProto(req)
+	if errs := apierror.CheckMetrics(ms.conf.SecretKey, metrics); errs != nil {
+		return apierror.MetricsStatus(errs[0].Detail, errs, fields)
+	}
+
+	var errs []apierror.MetricError
+	for i, err := range ms.repo.UpdateMetrics(metrics) {
+		if err != nil {
+			errs = append(errs, apierror.NewMetricError(i, metrics[i], err))
+		}
+	}
+	if errs != nil {
+		return apierror.MetricsStatus(errs[0].Detail, errs, fields)
+	}
+	return nil
+}
+
+// decryptBatch расшифровывает пачку из поля encrypted. Как и в http, если задан декодер,
+// сервер принимает только зашифрованные пачки
+func (ms *MetricsServer) decryptBatch(req *proto.AddMetricRequest) (*proto.AddMetricRequest, error) {
+	if ms.decoder == nil {
+		if len(req.GetEncrypted()) > 0 {
+			return nil, apierror.Status(codes.InvalidArgument, apierror.CodeInvalidBody, "server has no crypto key to decrypt batch")
+		}
+		return req, nil
+	}
+	if len(req.GetEncrypted()) == 0 {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.CodeInvalidBody, "batch must be encrypted")
+	}
+	data, info, err := ms.decoder.DecodeKey(req.GetEncrypted())
+	if err != nil {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.CodeInvalidBody, "failed to decrypt batch")
+	}
+	//! Агент сжимает пачку до шифрования, сжатие grpc зашифрованные данные не уменьшает
+	if info.Encoding != "" {
+		data, err = middlewares.DecompressBody(bytes.NewReader(data), info.Encoding, ms.conf.MaxBodySize)
+		if errors.Is(err, middlewares.ErrBodyTooLarge) {
+			return nil, apierror.Status(codes.ResourceExhausted, apierror.CodeInvalidBody, err.Error())
+		}
+		if err != nil {
+			return nil, apierror.Status(codes.InvalidArgument, apierror.CodeInvalidBody, "invalid compressed batch")
+		}
+	}
+	var batch proto.AddMetricRequest
+	if err := protobuf.Unmarshal(data, &batch); err != nil || len(batch.GetEncrypted()) > 0 {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.CodeInvalidBody, "invalid encrypted batch")
+	}
+	return &batch, nil
+}
+
+// metricsFromProto метрики пачки и имена полей запроса для каждой метрики, например gauges[0]
+func metricsFromProto(req *proto.AddMetricRequest) ([]repository.Metrics, []string) {
+	metrics := make([]repository.Metrics, 0, len(req.GetCounters())+len(req.GetGauges())+len(req.GetHistograms()))
+	fields := make([]string, 0, cap(metrics))
+	for i, metric := range req.GetCounters() {
 		value := metric.GetValue()
-		counter := repository.Metrics{
-			ID:    metric.GetName(),
-			MType: repository.Counter,
-			Delta: &value,
+		metrics = append(metrics, repository.Metrics{
+			ID:     metric.GetName(),
+			Labels: metric.GetLabels(),
+			MType:  repository.Counter,
+			Delta:  &value,
+			Hash:   metric.GetHash(),
+		})
+		fields = append(fields, fmt.Sprintf("counters[%d]", i))
+	}
+	for i, metric := range req.GetGauges() {
+		value := metric.GetValue()
+		metrics = append(metrics, repository.Metrics{
+			ID:     metric.GetName(),
+			Labels: metric.GetLabels(),
+			MType:  repository.Gauge,
+			Value:  &value,
+			Hash:   metric.GetHash(),
+		})
+		fields = append(fields, fmt.Sprintf("gauges[%d]", i))
+	}
+	for i, metric := range req.GetHistograms() {
+		metrics = append(metrics, histogramFromProto(metric))
+		fields = append(fields, fmt.Sprintf("histograms[%d]", i))
+	}
+	return metrics, fields
+}
+
+// StreamMetrics принимает пачки метрик из потока агента и подтверждает каждую после сохранения.
+// Пачки с batch_id не больше уже сохраненного для agent_id подтверждаются без повторного применения.
+// Запись агента держится, пока открыт поток, и хранится еще committedTTL после его закрытия
+func (ms *MetricsServer) StreamMetrics(stream proto.Metrics_StreamMetricsServer) error {
+	var agentID string
+	var agent *agentBatches
+	defer func() {
+		if agent != nil {
+			ms.committed.release(agent)
 		}
-		if metric.Hash != nil {
-			counter.Hash = *metric.Hash
+	}()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
 
-		ok := hash.CheckSign(ms.conf.SecretKey, counter.Hash, counter.CalcHash(encodeFunc))
-		if !ok {
-			return nil, status.Error(codes.InvalidArgument, "incorrect metric sign")
+		if req.GetAgentId() != agentID {
+			if agent != nil {
+				ms.committed.release(agent)
+			}
+			agentID, agent = req.GetAgentId(), nil
+			if agentID != "" {
+				agent = ms.committed.acquire(agentID)
+			}
 		}
-		ms.repo.UpdateMetric(counter)
-	}
-	gauges := req.GetGauges()
-	for _, metric := range gauges {
-		delta := metric.GetValue()
-		gauge := repository.Metrics{
-			ID:    metric.GetName(),
-			MType: repository.Gauge,
-			Value: &delta,
+		response := proto.StreamMetricsResponse{BatchId: req.GetBatchId()}
+		if err := ms.commitBatch(stream.Context(), agent, req); err != nil {
+			//! Полный статус с кодом и деталями, как у ошибки AddMetric. Сообщение дублируется в error для старых агентов
+			st := status.Convert(err)
+			response.Error = st.Message()
+			response.Status = st.Proto()
 		}
-		if metric.Hash != nil {
-			gauge.Hash = *metric.Hash
+		if err := stream.Send(&response); err != nil {
+			return err
 		}
+	}
+}
 
-		ok := hash.CheckSign(ms.conf.SecretKey, gauge.Hash, gauge.CalcHash(encodeFunc))
-		if !ok {
-			return nil, status.Error(codes.InvalidArgument, "incorrect metric sign")
+// commitBatch применяет пачку потока, если она еще не была применена, и сохраняет хранилище.
+// Пачка применяется целиком либо не применяется совсем, поэтому отклоненная пачка не считается примененной
+// и ее исправленный повтор с тем же batch_id будет записан.
+// agent - запись агента потока, nil - поток без agent_id, его пачки не проверяются на повтор.
+// Блокировка агента держится на все время применения, чтобы повтор пачки из нового потока не обогнал оригинал,
+// потоки других агентов ее не ждут
+func (ms *MetricsServer) commitBatch(ctx context.Context, agent *agentBatches, req *proto.StreamMetricsRequest) error {
+	if agent != nil {
+		agent.lock.Lock()
+		defer agent.lock.Unlock()
+		if req.GetBatchId() <= agent.committed {
+			return nil
 		}
-		ms.repo.UpdateMetric(gauge)
 	}
-	return &response, nil
+	if err := ms.addMetrics(req.GetBatch()); err != nil {
+		return err
+	}
+	if agent != nil {
+		agent.committed = req.GetBatchId()
+	}
+	return ms.pStore.Save(ctx)
 }
+
 func (ms *MetricsServer) GetMetric(ctx context.Context, req *proto.GetMetricRequest) (*proto.GetMetricResponse, error) {
 	var response proto.GetMetricResponse
 	switch req.GetType() {
 	case proto.Type_Counter:
-		val, ok := ms.repo.Counter(req.GetName())
+		val, ok := ms.repo.Metric(req.GetName(), repository.Counter, req.GetLabels())
 		if !ok {
-			return nil, status.Errorf(codes.NotFound, "not found")
+			return nil, apierror.Status(codes.NotFound, apierror.CodeNotFound, "not found")
 		}
 		response.Counter = &proto.CounterMetric{
-			Name:  req.GetName(),
-			Value: val,
+			Name:   req.GetName(),
+			Value:  *val.Delta,
+			Labels: val.Labels,
 		}
 	case proto.Type_Gauge:
-		val, ok := ms.repo.Gauge(req.GetName())
+		val, ok := ms.repo.Metric(req.GetName(), repository.Gauge, req.GetLabels())
 		if !ok {
-			return nil, status.Errorf(codes.NotFound, "not found")
+			return nil, apierror.Status(codes.NotFound, apierror.CodeNotFound, "not found")
 		}
 		response.Gauge = &proto.GaugeMetric{
-			Name:  req.GetName(),
-			Value: val,
+			Name:   req.GetName(),
+			Value:  *val.Value,
+			Labels: val.Labels,
+		}
+	case proto.Type_Histogram:
+		val, ok := ms.repo.Metric(req.GetName(), repository.Histogram, req.GetLabels())
+		if !ok {
+			return nil, apierror.Status(codes.NotFound, apierror.CodeNotFound, "not found")
 		}
+		response.Histogram = histogramToProto(val)
+	}
+	return &response, nil
+}
+
+// GetHistory возвращает историю значений ряда метрики в интервале from - to
+func (ms *MetricsServer) GetHistory(ctx context.Context, req *proto.GetHistoryRequest) (*proto.GetHistoryResponse, error) {
+	var response proto.GetHistoryResponse
+
+	var from, to time.Time
+	if req.GetFrom() != nil {
+		from = req.GetFrom().AsTime()
+	}
+	if req.GetTo() != nil {
+		to = req.GetTo().AsTime()
+	}
+
+	samples, ok := ms.repo.History(req.GetName(), metricType(req.GetType()), req.GetLabels(), from, to)
+	if !ok {
+		return nil, apierror.Status(codes.NotFound, apierror.CodeNotFound, "not found")
+	}
+	for _, sample := range samples {
+		response.Samples = append(response.Samples, &proto.Sample{
+			Timestamp: timestamppb.New(sample.Timestamp),
+			Delta:     sample.Delta,
+			Value:     sample.Value,
+		})
+	}
+	return &response, nil
+}
+
+// QueryMetrics возвращает страницу метрик с фильтрацией и сортировкой, как GET /api/metrics
+func (ms *MetricsServer) QueryMetrics(ctx context.Context, req *proto.QueryMetricsRequest) (*proto.QueryMetricsResponse, error) {
+	query := repository.Query{
+		Prefix: req.GetPrefix(),
+		Glob:   req.GetGlob(),
+		Regex:  req.GetRegex(),
+		Sort:   req.GetSort(),
+		Limit:  int(req.GetLimit()),
+		Cursor: req.GetCursor(),
+	}
+	for _, mType := range req.GetTypes() {
+		query.Types = append(query.Types, metricType(mType))
+	}
+
+	result, err := repository.QueryMetrics(ms.repo.ToMetrics(), query)
+	if err != nil {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.CodeInvalidRequest, err.Error())
+	}
+
+	response := proto.QueryMetricsResponse{
+		Metrics:    make([]*proto.Metric, 0, len(result.Metrics)),
+		NextCursor: result.NextCursor,
+	}
+	for _, metric := range result.Metrics {
+		response.Metrics = append(response.Metrics, metricToProto(metric))
 	}
 	return &response, nil
 }
 
+// DeleteMetric удаляет ряд метрики из репозитория и сразу из хранилища
+func (ms *MetricsServer) DeleteMetric(ctx context.Context, req *proto.DeleteMetricRequest) (*proto.DeleteMetricResponse, error) {
+	var response proto.DeleteMetricResponse
+	mType := metricType(req.GetType())
+	if !ms.repo.Delete(req.GetName(), mType, req.GetLabels()) {
+		return nil, apierror.Status(codes.NotFound, apierror.CodeNotFound, "not found")
+	}
+	deleted := []repository.Metrics{{ID: req.GetName(), Labels: req.GetLabels(), MType: mType}}
+	if err := ms.pStore.Delete(ctx, deleted); err != nil {
+		return nil, apierror.Status(codes.Internal, apierror.CodeStorage, err.Error())
+	}
+	return &response, nil
+}
+
+// ResetCounter обнуляет ряд counter и сохраняет хранилище
+func (ms *MetricsServer) ResetCounter(ctx context.Context, req *proto.ResetCounterRequest) (*proto.ResetCounterResponse, error) {
+	var response proto.ResetCounterResponse
+	if !ms.repo.ResetCounter(req.GetName(), req.GetLabels()) {
+		return nil, apierror.Status(codes.NotFound, apierror.CodeNotFound, "not found")
+	}
+	if err := ms.pStore.Save(ctx); err != nil {
+		return nil, apierror.Status(codes.Internal, apierror.CodeStorage, err.Error())
+	}
+	return &response, nil
+}
+
+// Watch отправляет текущие значения запрошенных метрик, а затем их изменения до отключения клиента
+func (ms *MetricsServer) Watch(req *proto.WatchRequest, stream proto.Metrics_WatchServer) error {
+	sub := ms.repo.Subscribe(req.GetNames())
+	defer sub.Close()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-ms.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	initial := true
+	metrics := repository.CurrentValues(ms.repo, sub)
+	for {
+		response := proto.WatchResponse{
+			Metrics: make([]*proto.Metric, 0, len(metrics)),
+			Initial: initial,
+		}
+		for _, metric := range metrics {
+			response.Metrics = append(response.Metrics, metricToProto(metric))
+		}
+		if err := stream.Send(&response); err != nil {
+			return err
+		}
+
+		initial = false
+		var err error
+		metrics, err = sub.Next(ctx)
+		if err != nil {
+			select {
+			case <-ms.done:
+				return status.Error(codes.Unavailable, "server is shutting down")
+			default:
+				return status.FromContextError(err).Err()
+			}
+		}
+	}
+}
+
+// metricToProto конвертация repository.Metrics любого типа в proto.Metric
+func metricToProto(metric repository.Metrics) *proto.Metric {
+	result := &proto.Metric{
+		Name:    metric.ID,
+		Labels:  metric.Labels,
+		Delta:   metric.Delta,
+		Value:   metric.Value,
+		Count:   metric.Count,
+		Sum:     metric.Sum,
+		Deleted: metric.Deleted,
+	}
+	switch metric.MType {
+	case repository.Counter:
+		result.Type = proto.Type_Counter
+	case repository.Gauge:
+		result.Type = proto.Type_Gauge
+	case repository.Histogram:
+		result.Type = proto.Type_Histogram
+	}
+	for _, bucket := range metric.Buckets {
+		result.Buckets = append(result.Buckets, &proto.Bucket{
+			UpperBound: bucket.UpperBound,
+			Count:      bucket.Count,
+		})
+	}
+	if metric.Hash != "" {
+		hash := metric.Hash
+		result.Hash = &hash
+	}
+	return result
+}
+
+// metricType конвертация proto.Type в тип метрики репозитория
+func metricType(mType proto.Type) string {
+	switch mType {
+	case proto.Type_Counter:
+		return repository.Counter
+	case proto.Type_Gauge:
+		return repository.Gauge
+	case proto.Type_Histogram:
+		return repository.Histogram
+	default:
+		return ""
+	}
+}
+
+// histogramFromProto конвертация proto.HistogramMetric в repository.Metrics
+func histogramFromProto(metric *proto.HistogramMetric) repository.Metrics {
+	count := metric.GetCount()
+	sum := metric.GetSum()
+	buckets := make([]repository.Bucket, 0, len(metric.GetBuckets()))
+	for _, bucket := range metric.GetBuckets() {
+		buckets = append(buckets, repository.Bucket{
+			UpperBound: bucket.GetUpperBound(),
+			Count:      bucket.GetCount(),
+		})
+	}
+	return repository.Metrics{
+		ID:      metric.GetName(),
+		Labels:  metric.GetLabels(),
+		MType:   repository.Histogram,
+		Buckets: buckets,
+		Count:   &count,
+		Sum:     &sum,
+		Hash:    metric.GetHash(),
+	}
+}
+
+// histogramToProto конвертация repository.Metrics типа histogram в proto.HistogramMetric
+func histogramToProto(metric repository.Metrics) *proto.HistogramMetric {
+	buckets := make([]*proto.Bucket, 0, len(metric.Buckets))
+	for _, bucket := range metric.Buckets {
+		buckets = append(buckets, &proto.Bucket{
+			UpperBound: bucket.UpperBound,
+			Count:      bucket.Count,
+		})
+	}
+	return &proto.HistogramMetric{
+		Name:    metric.ID,
+		Buckets: buckets,
+		Count:   *metric.Count,
+		Sum:     *metric.Sum,
+		Labels:  metric.Labels,
+	}
+}
+
 func (ms *MetricsServer) ListMetrics(context.Context, *proto.ListMetricsRequest) (*proto.ListMetricResponse, error) {
 	var response proto.ListMetricResponse
-	response.Html = repository.RenderHTML(ms.repo.ToMetrics())
+	var page bytes.Buffer
+	if err := repository.RenderDashboard(&page, ms.repo, repository.DashboardOptions{}); err != nil {
+		return nil, apierror.Status(codes.Internal, apierror.CodeInternal, err.Error())
+	}
+	response.Html = page.String()
 	return &response, nil
 }
 func (ms *MetricsServer) Ping(context.Context, *proto.PingRequest) (*proto.PingResponse, error) {
 	var response proto.PingResponse
 	err := ms.pStore.Ping()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+		return nil, apierror.Status(codes.Internal, apierror.CodeStorage, err.Error())
 	}
 	return &response, nil
 }
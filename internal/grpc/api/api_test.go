@@ -2,15 +2,31 @@ package api
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/ncyellow/devops/internal/apierror"
+	"github.com/ncyellow/devops/internal/crypto/rsa"
+	"github.com/ncyellow/devops/internal/genconfig"
 	"github.com/ncyellow/devops/internal/grpc/proto"
+	"github.com/ncyellow/devops/internal/hash"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/ncyellow/devops/internal/server/config"
 	"github.com/ncyellow/devops/internal/server/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestMetricsServer(t *testing.T) {
@@ -65,22 +81,63 @@ func TestMetricsServer(t *testing.T) {
 	listResponse, err := server.ListMetrics(context.Background(), &proto.ListMetricsRequest{})
 	assert.NoError(t, err)
 	assert.NotNil(t, listResponse.Html)
-	assert.Equal(t, listResponse.Html, `
-	<html>
-	<body>
-	<h1>All metrics</h1>
-	<h3>gauges</h3>
-	<ul>
-	  <li>testGauge : 150.000</li>
-
-	</ul>
-	<h3>counters</h3>
-	<ul>
-	  <li>testCounter : 100</li>
-
-	</ul>
-	</body>
-	</html>`)
+	assert.Contains(t, listResponse.Html, `<td>testGauge</td><td class="labels"></td><td>gauge</td><td class="value" data-value="150">150.000</td>`)
+	assert.Contains(t, listResponse.Html, `<td>testCounter</td><td class="labels"></td><td>counter</td><td class="value" data-value="100">100</td>`)
+}
+
+func TestMetricsServer_Histogram(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	server := NewMetricServer(repo, &conf, store)
+	histogram := &proto.HistogramMetric{
+		Name:    "latency",
+		Buckets: []*proto.Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 2}},
+		Count:   2,
+		Sum:     0.7,
+	}
+	// Добавляем гистограмму дважды, значения должны сложиться
+	for i := 0; i < 2; i++ {
+		_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{
+			Histograms: []*proto.HistogramMetric{histogram},
+		})
+		assert.NoError(t, err)
+	}
+
+	getResponse, err := server.GetMetric(context.Background(), &proto.GetMetricRequest{
+		Name: "latency",
+		Type: proto.Type_Histogram,
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, getResponse.Histogram)
+	assert.Equal(t, uint64(4), getResponse.Histogram.Count)
+	assert.Equal(t, uint64(4), getResponse.Histogram.Buckets[1].Count)
+
+	// Корзины с другими границами отклоняются, и остальные метрики пачки не применяются
+	_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{
+		Counters: []*proto.CounterMetric{{Name: "requests", Value: 1}},
+		Histograms: []*proto.HistogramMetric{{
+			Name:    "latency",
+			Buckets: []*proto.Bucket{{UpperBound: 5, Count: 1}},
+			Count:   1,
+			Sum:     1,
+		}},
+	})
+	s, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.InvalidArgument, s.Code())
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, detail := range s.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			violations = badRequest.GetFieldViolations()
+		}
+	}
+	require.Len(t, violations, 1)
+	assert.Equal(t, "histograms[0]", violations[0].GetField())
+	_, ok = repo.Counter("requests")
+	assert.False(t, ok)
 }
 
 func TestMetricsServer_GetMetric(t *testing.T) {
@@ -96,6 +153,7 @@ func TestMetricsServer_GetMetric(t *testing.T) {
 	metricTypes := []proto.Type{
 		proto.Type_Counter,
 		proto.Type_Gauge,
+		proto.Type_Histogram,
 	}
 
 	// Проверяем что для всех типов метрик запрос неизвестных метрик выдает ошибку
@@ -112,3 +170,502 @@ func TestMetricsServer_GetMetric(t *testing.T) {
 		assert.Equal(t, s.Code(), codes.NotFound)
 	}
 }
+
+func TestMetricsServer_GetHistory(t *testing.T) {
+	conf := config.Config{
+		GeneralConfig: genconfig.GeneralConfig{
+			HistoryRetention: genconfig.Duration{Duration: time.Hour},
+		},
+	}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	server := NewMetricServer(repo, &conf, store)
+	repo.UpdateCounter("testCounter", 10)
+	repo.UpdateCounter("testCounter", 5)
+
+	response, err := server.GetHistory(context.Background(), &proto.GetHistoryRequest{
+		Name: "testCounter",
+		Type: proto.Type_Counter,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(response.Samples))
+	assert.Equal(t, int64(15), response.Samples[1].GetDelta())
+	assert.Nil(t, response.Samples[1].Value)
+
+	// Интервал в будущем - точек нет
+	response, err = server.GetHistory(context.Background(), &proto.GetHistoryRequest{
+		Name: "testCounter",
+		Type: proto.Type_Counter,
+		From: timestamppb.New(time.Now().Add(time.Hour)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(response.Samples))
+
+	_, err = server.GetHistory(context.Background(), &proto.GetHistoryRequest{
+		Name: "unknownCounter",
+		Type: proto.Type_Counter,
+	})
+	s, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.NotFound, s.Code())
+}
+
+func TestMetricsServer_QueryMetrics(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	server := NewMetricServer(repo, &conf, store)
+	_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{
+		Counters: []*proto.CounterMetric{{Name: "requests", Value: 5}},
+		Gauges: []*proto.GaugeMetric{
+			{Name: "cpu_user", Value: 1.5},
+			{Name: "cpu_system", Value: 2.5},
+		},
+		Histograms: []*proto.HistogramMetric{
+			{Name: "cpu_latency", Buckets: []*proto.Bucket{{UpperBound: 1, Count: 2}}, Count: 2, Sum: 0.5},
+		},
+	})
+	assert.NoError(t, err)
+
+	// Первая страница из одной метрики, далее по курсору
+	response, err := server.QueryMetrics(context.Background(), &proto.QueryMetricsRequest{
+		Types:  []proto.Type{proto.Type_Gauge, proto.Type_Histogram},
+		Prefix: "cpu_",
+		Limit:  2,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(response.Metrics))
+	assert.Equal(t, "cpu_latency", response.Metrics[0].Name)
+	assert.Equal(t, proto.Type_Histogram, response.Metrics[0].Type)
+	assert.Equal(t, uint64(2), response.Metrics[0].GetCount())
+	assert.Equal(t, 1, len(response.Metrics[0].Buckets))
+	assert.Equal(t, "cpu_system", response.Metrics[1].Name)
+	assert.Equal(t, 2.5, response.Metrics[1].GetValue())
+	assert.NotEqual(t, "", response.NextCursor)
+
+	response, err = server.QueryMetrics(context.Background(), &proto.QueryMetricsRequest{
+		Types:  []proto.Type{proto.Type_Gauge, proto.Type_Histogram},
+		Prefix: "cpu_",
+		Limit:  2,
+		Cursor: response.NextCursor,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(response.Metrics))
+	assert.Equal(t, "cpu_user", response.Metrics[0].Name)
+	assert.Equal(t, "", response.NextCursor)
+
+	response, err = server.QueryMetrics(context.Background(), &proto.QueryMetricsRequest{
+		Types: []proto.Type{proto.Type_Counter},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(response.Metrics))
+	assert.Equal(t, int64(5), response.Metrics[0].GetDelta())
+	assert.Nil(t, response.Metrics[0].Value)
+
+	// Ошибки параметров выборки
+	_, err = server.QueryMetrics(context.Background(), &proto.QueryMetricsRequest{Regex: "("})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = server.QueryMetrics(context.Background(), &proto.QueryMetricsRequest{Cursor: "broken"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMetricsServer_DeleteMetric(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	server := NewMetricServer(repo, &conf, store)
+	_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{
+		Counters: []*proto.CounterMetric{{Name: "testCounter", Value: 100}},
+		Gauges: []*proto.GaugeMetric{
+			{Name: "testGauge", Value: 150},
+			{Name: "testGauge", Value: 10, Labels: map[string]string{"host": "agent1"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	// Удаляется только ряд с указанными метками
+	_, err = server.DeleteMetric(context.Background(), &proto.DeleteMetricRequest{
+		Type:   proto.Type_Gauge,
+		Name:   "testGauge",
+		Labels: map[string]string{"host": "agent1"},
+	})
+	assert.NoError(t, err)
+	_, ok := repo.Metric("testGauge", repository.Gauge, repository.Labels{"host": "agent1"})
+	assert.False(t, ok)
+	_, ok = repo.Gauge("testGauge")
+	assert.True(t, ok)
+
+	_, err = server.DeleteMetric(context.Background(), &proto.DeleteMetricRequest{
+		Type:   proto.Type_Gauge,
+		Name:   "testGauge",
+		Labels: map[string]string{"host": "agent1"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.ResetCounter(context.Background(), &proto.ResetCounterRequest{Name: "testCounter"})
+	assert.NoError(t, err)
+	delta, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), delta)
+
+	_, err = server.ResetCounter(context.Background(), &proto.ResetCounterRequest{Name: "unknownCounter"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// TestMetricsServer_AddMetricErrors проверяем ошибки каждой метрики в деталях status и то, что пачка не применяется
+func TestMetricsServer_AddMetricErrors(t *testing.T) {
+	conf := config.Config{}
+	conf.SecretKey = "secret"
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	server := NewMetricServer(repo, &conf, store)
+	encodeFunc := hash.CreateEncodeFunc(conf.SecretKey)
+	counter := repository.Metrics{ID: "testCounter", MType: repository.Counter, Delta: new(int64)}
+	sign := counter.CalcHash(encodeFunc)
+	badSign := "bad"
+	_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{
+		Counters: []*proto.CounterMetric{{Name: "testCounter", Hash: &sign}},
+		Gauges:   []*proto.GaugeMetric{{Name: "testGauge", Value: 1, Hash: &badSign}},
+	})
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, "incorrect metric sign", st.Message())
+	assert.Equal(t, apierror.CodeInvalidMetrics.Reason(), apierror.Reason(err))
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			violations = badRequest.GetFieldViolations()
+		}
+	}
+	require.Len(t, violations, 1)
+	assert.Equal(t, "gauges[0]", violations[0].GetField())
+	_, ok := repo.Counter("testCounter")
+	assert.False(t, ok)
+
+	_, err = server.GetMetric(context.Background(), &proto.GetMetricRequest{Type: proto.Type_Gauge, Name: "testGauge"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, apierror.CodeNotFound.Reason(), apierror.Reason(err))
+}
+
+// TestMetricsServer_AddMetricSave проверяем что записанная пачка сразу попадает в файл хранилища
+func TestMetricsServer_AddMetricSave(t *testing.T) {
+	conf := config.Config{StoreFile: filepath.Join(t.TempDir(), "metrics.json")}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	require.NoError(t, err)
+
+	server := NewMetricServer(repo, &conf, store)
+	_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{
+		Counters: []*proto.CounterMetric{{Name: "testCounter", Value: 7}},
+	})
+	require.NoError(t, err)
+
+	restored := repository.NewRepository(conf.GeneralCfg())
+	storage.RestoreFromFile(conf.StoreFile, restored)
+	val, ok := restored.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), val)
+}
+
+func TestMetricsServer_Watch(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+	repo.UpdateGauge("testGauge", 1)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	proto.RegisterMetricsServer(server, NewMetricServer(repo, &conf, store))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := proto.NewMetricsClient(conn).Watch(ctx, &proto.WatchRequest{Names: []string{"testGauge", "testCounter"}})
+	require.NoError(t, err)
+
+	// Первое сообщение - текущие значения
+	response, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, response.Initial)
+	require.Equal(t, 1, len(response.Metrics))
+	assert.Equal(t, "testGauge", response.Metrics[0].Name)
+	assert.Equal(t, 1.0, response.Metrics[0].GetValue())
+
+	// Далее только изменения запрошенных метрик
+	repo.UpdateGauge("otherGauge", 10)
+	repo.UpdateCounter("testCounter", 5)
+	response, err = stream.Recv()
+	require.NoError(t, err)
+	assert.False(t, response.Initial)
+	require.Equal(t, 1, len(response.Metrics))
+	assert.Equal(t, "testCounter", response.Metrics[0].Name)
+	assert.Equal(t, proto.Type_Counter, response.Metrics[0].Type)
+	assert.Equal(t, int64(5), response.Metrics[0].GetDelta())
+
+	// Удаление ряда приходит без значения с признаком deleted
+	assert.True(t, repo.Delete("testGauge", repository.Gauge, nil))
+	response, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(response.Metrics))
+	assert.Equal(t, "testGauge", response.Metrics[0].Name)
+	assert.True(t, response.Metrics[0].Deleted)
+	assert.Nil(t, response.Metrics[0].Value)
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+// TestMetricsServer_WatchStop проверяем что Stop завершает открытые потоки Watch
+func TestMetricsServer_WatchStop(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	metricsServer := NewMetricServer(repo, &conf, store)
+	proto.RegisterMetricsServer(server, metricsServer)
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := proto.NewMetricsClient(conn).Watch(context.Background(), &proto.WatchRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	metricsServer.Stop()
+	server.GracefulStop()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestMetricsServer_StreamMetrics(t *testing.T) {
+	conf := config.Config{}
+	conf.SecretKey = "secret"
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	proto.RegisterMetricsServer(server, NewMetricServer(repo, &conf, store))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := proto.NewMetricsClient(conn)
+
+	encodeFunc := hash.CreateEncodeFunc(conf.SecretKey)
+	counterBatch := func(value int64) *proto.AddMetricRequest {
+		metric := repository.Metrics{ID: "testCounter", MType: repository.Counter, Delta: &value}
+		sign := metric.CalcHash(encodeFunc)
+		return &proto.AddMetricRequest{Counters: []*proto.CounterMetric{{Name: "testCounter", Value: value, Hash: &sign}}}
+	}
+
+	stream, err := client.StreamMetrics(context.Background())
+	require.NoError(t, err)
+	for batchID := uint64(1); batchID <= 2; batchID++ {
+		require.NoError(t, stream.Send(&proto.StreamMetricsRequest{AgentId: "agent1", BatchId: batchID, Batch: counterBatch(10)}))
+		ack, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, batchID, ack.BatchId)
+		assert.Equal(t, "", ack.Error)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// После переподключения агент повторяет неподтвержденные пачки - уже сохраненная не применяется второй раз
+	stream, err = client.StreamMetrics(context.Background())
+	require.NoError(t, err)
+	requests := []*proto.StreamMetricsRequest{
+		{AgentId: "agent1", BatchId: 2, Batch: counterBatch(10)},
+		{AgentId: "agent1", BatchId: 3, Batch: counterBatch(10)},
+		{AgentId: "agent1", BatchId: 4, Batch: &proto.AddMetricRequest{Counters: []*proto.CounterMetric{{Name: "testCounter", Value: 1}}}},
+	}
+	for _, req := range requests {
+		require.NoError(t, stream.Send(req))
+	}
+	acks := make([]*proto.StreamMetricsResponse, 0, len(requests))
+	for range requests {
+		ack, err := stream.Recv()
+		require.NoError(t, err)
+		acks = append(acks, ack)
+	}
+	assert.Equal(t, "", acks[0].Error)
+	assert.Equal(t, "", acks[1].Error)
+	assert.Equal(t, uint64(4), acks[2].BatchId)
+	assert.Equal(t, "incorrect metric sign", acks[2].Error)
+	st := status.FromProto(acks[2].Status)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, "incorrect metric sign", st.Message())
+	assert.Equal(t, apierror.CodeInvalidMetrics.Reason(), apierror.Reason(st.Err()))
+	assert.Nil(t, acks[0].Status)
+
+	delta, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, int64(30), delta)
+}
+
+// TestMetricsServer_StreamMetricsRejected проверяем что отклоненная пачка потока не применяется частично,
+// а исправленный повтор с тем же batch_id применяется
+func TestMetricsServer_StreamMetricsRejected(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	assert.NoError(t, err)
+	count, sum := uint64(1), 0.5
+	require.NoError(t, repo.UpdateMetric(repository.Metrics{ID: "latency", MType: repository.Histogram,
+		Buckets: []repository.Bucket{{UpperBound: 1, Count: 1}}, Count: &count, Sum: &sum}))
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	proto.RegisterMetricsServer(server, NewMetricServer(repo, &conf, store))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := proto.NewMetricsClient(conn).StreamMetrics(context.Background())
+	require.NoError(t, err)
+	batch := func(bound float64) *proto.AddMetricRequest {
+		return &proto.AddMetricRequest{
+			Counters:   []*proto.CounterMetric{{Name: "testCounter", Value: 5}},
+			Histograms: []*proto.HistogramMetric{{Name: "latency", Buckets: []*proto.Bucket{{UpperBound: bound, Count: 1}}, Count: 1, Sum: 0.5}},
+		}
+	}
+
+	// Корзины гистограммы не совпадают с рядом, counter из той же пачки не применяется
+	require.NoError(t, stream.Send(&proto.StreamMetricsRequest{AgentId: "agent1", BatchId: 1, Batch: batch(5)}))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.FromProto(ack.Status).Code())
+	_, ok := repo.Counter("testCounter")
+	assert.False(t, ok)
+
+	// Пачка не подтверждена, поэтому исправленный повтор с тем же batch_id применяется
+	require.NoError(t, stream.Send(&proto.StreamMetricsRequest{AgentId: "agent1", BatchId: 1, Batch: batch(1)}))
+	ack, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Nil(t, ack.Status)
+	delta, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), delta)
+	require.NoError(t, stream.CloseSend())
+}
+
+func TestMetricsServer_AddMetricEncrypted(t *testing.T) {
+	conf := config.Config{}
+	conf.CryptoKey = "../../crypto/rsa/test_data/rsa.private"
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	require.NoError(t, err)
+	server := NewMetricServer(repo, &conf, store)
+
+	encoder, err := rsa.NewEncoder("../../crypto/rsa/test_data/rsa.public")
+	require.NoError(t, err)
+	// пачка намного больше размера ключа rsa
+	batch := &proto.AddMetricRequest{}
+	for i := 0; i < 100; i++ {
+		batch.Counters = append(batch.Counters, &proto.CounterMetric{Name: fmt.Sprintf("testCounter%d", i), Value: int64(i)})
+	}
+	data, err := protobuf.Marshal(batch)
+	require.NoError(t, err)
+	encrypted, err := encoder.Encode(data)
+	require.NoError(t, err)
+
+	_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{Encrypted: encrypted})
+	assert.NoError(t, err)
+	counter, ok := repo.Counter("testCounter99")
+	assert.True(t, ok)
+	assert.Equal(t, int64(99), counter)
+
+	// при заданном ключе незашифрованные и поврежденные пачки отклоняются
+	for _, req := range []*proto.AddMetricRequest{batch, {Encrypted: encrypted[:len(encrypted)-1]}} {
+		_, err = server.AddMetric(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, apierror.CodeInvalidBody.Reason(), apierror.Reason(err))
+	}
+
+	// сервер без ключа не может расшифровать пачку
+	plainServer := NewMetricServer(repo, &config.Config{}, store)
+	_, err = plainServer.AddMetric(context.Background(), &proto.AddMetricRequest{Encrypted: encrypted})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestMetricsServer_AddMetricKeyRotation(t *testing.T) {
+	conf := config.Config{}
+	conf.CryptoKey = "../../crypto/rsa/test_data/rsa2.private"
+	conf.CryptoKeys = []string{"../../crypto/rsa/test_data/rsa.private"}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := storage.CreateStorage(&conf, repo)
+	require.NoError(t, err)
+	server := NewMetricServer(repo, &conf, store)
+
+	// статистика расшифровок общая для процесса, поэтому сравниваем с ее значением до отправки
+	decrypts := func(keyID string) int64 {
+		for _, usage := range rsa.Usage() {
+			if usage.KeyID == keyID && usage.Format == rsa.FormatEnvelope {
+				return usage.Decrypts
+			}
+		}
+		return 0
+	}
+	before := make(map[string]int64)
+
+	// агенты со старым и с новым ключом отправляют метрики одновременно
+	keyIDs := make([]string, 0, 2)
+	for _, name := range []string{"rsa.public", "rsa2.public"} {
+		encoder, err := rsa.NewEncoder("../../crypto/rsa/test_data/" + name)
+		require.NoError(t, err)
+		before[encoder.KeyID()] = decrypts(encoder.KeyID())
+		data, err := protobuf.Marshal(&proto.AddMetricRequest{Counters: []*proto.CounterMetric{{Name: "testCounter", Value: 1}}})
+		require.NoError(t, err)
+		encrypted, err := encoder.Encode(data)
+		require.NoError(t, err)
+		_, err = server.AddMetric(context.Background(), &proto.AddMetricRequest{Encrypted: encrypted})
+		assert.NoError(t, err)
+		keyIDs = append(keyIDs, encoder.KeyID())
+	}
+	counter, ok := repo.Counter("testCounter")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), counter)
+
+	for _, keyID := range keyIDs {
+		assert.Equal(t, before[keyID]+1, decrypts(keyID), keyID)
+	}
+	// статистика ключей не попадает в метрики агентов
+	assert.Len(t, repo.ToMetrics(), 1)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// committedTTL сколько хранится последняя сохраненная пачка агента без открытых потоков.
+	// За это время агент успевает переподключиться и повторить неподтвержденные пачки
+	committedTTL = 10 * time.Minute
+	// maxCommittedAgents сколько агентов без открытых потоков хранится не дольше committedTTL.
+	// Агент выбирает agent_id случайно при каждом запуске, поэтому без ограничения записи копились бы
+	maxCommittedAgents = 10000
+)
+
+// agentBatches последняя сохраненная пачка потоков одного агента
+type agentBatches struct {
+	// lock держится на все время применения и сохранения пачки, чтобы повтор пачки
+	// из нового потока агента не обогнал оригинал. Другие агенты его не ждут
+	lock      sync.Mutex
+	committed uint64
+
+	// streams и released защищены committedBatches.lock
+	// streams число открытых потоков агента, пока они есть, запись не удаляется
+	streams int
+	// released время закрытия последнего потока агента
+	released time.Time
+}
+
+// committedBatches последние сохраненные пачки StreamMetrics по agent_id
+type committedBatches struct {
+	lock   sync.Mutex
+	agents map[string]*agentBatches
+	// limit сколько хранится записей агентов без открытых потоков
+	limit int
+	// now источник времени для TTL, подменяется в тестах
+	now func() time.Time
+}
+
+func newCommittedBatches() *committedBatches {
+	return &committedBatches{
+		agents: make(map[string]*agentBatches),
+		limit:  maxCommittedAgents,
+		now:    time.Now,
+	}
+}
+
+// acquire запись агента agentID на время открытого потока, вызывающий обязан вызвать release.
+// Новая запись создается после удаления устаревших записей
+func (c *committedBatches) acquire(agentID string) *agentBatches {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	agent, ok := c.agents[agentID]
+	if !ok {
+		c.expire()
+		agent = &agentBatches{}
+		c.agents[agentID] = agent
+	}
+	agent.streams++
+	return agent
+}
+
+// release отмечает закрытие потока агента, с этого времени отсчитывается committedTTL
+func (c *committedBatches) release(agent *agentBatches) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	agent.streams--
+	agent.released = c.now()
+}
+
+// expire удаляет записи агентов без открытых потоков старше committedTTL, а если их все равно не меньше
+// limit - самые давние, освобождая место для новой записи. Записи агентов с открытыми потоками не удаляются, их число ограничено
+// числом потоков. Вызывается под блокировкой
+func (c *committedBatches) expire() {
+	deadline := c.now().Add(-committedTTL)
+	idle := 0
+	for id, agent := range c.agents {
+		if agent.streams > 0 {
+			continue
+		}
+		if agent.released.Before(deadline) {
+			delete(c.agents, id)
+			continue
+		}
+		idle++
+	}
+	for ; idle >= c.limit; idle-- {
+		var oldestID string
+		var oldest *agentBatches
+		for id, agent := range c.agents {
+			if agent.streams == 0 && (oldest == nil || agent.released.Before(oldest.released)) {
+				oldestID, oldest = id, agent
+			}
+		}
+		delete(c.agents, oldestID)
+	}
+}
+
+// len число записей агентов
+func (c *committedBatches) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.agents)
+}
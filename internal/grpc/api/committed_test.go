@@ -0,0 +1,48 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCommittedBatchesExpire проверяем удаление записей агентов по committedTTL и ограничению числа
+func TestCommittedBatchesExpire(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	committed := newCommittedBatches()
+	committed.now = func() time.Time { return now }
+
+	// запись агента с открытым потоком не удаляется, после закрытия хранится committedTTL
+	active := committed.acquire("active")
+	closed := committed.acquire("closed")
+	closed.committed = 5
+	committed.release(closed)
+	assert.Same(t, closed, committed.acquire("closed"))
+	committed.release(closed)
+
+	now = now.Add(committedTTL + time.Second)
+	committed.release(committed.acquire("new"))
+	assert.Equal(t, 2, committed.len())
+	assert.NotSame(t, closed, committed.acquire("closed"))
+	assert.Same(t, active, committed.acquire("active"))
+
+	// сверх limit удаляются самые давние записи без открытых потоков
+	committed = newCommittedBatches()
+	committed.limit = 10
+	committed.now = func() time.Time { return now }
+	active = committed.acquire("active")
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Millisecond)
+		committed.release(committed.acquire(fmt.Sprintf("agent%d", i)))
+	}
+	assert.Equal(t, 11, committed.len())
+	assert.Same(t, active, committed.acquire("active"))
+	committed.lock.Lock()
+	_, oldest := committed.agents["agent9"]
+	_, newest := committed.agents["agent10"]
+	committed.lock.Unlock()
+	assert.False(t, oldest)
+	assert.True(t, newest)
+}
@@ -0,0 +1,203 @@
+// Package influx содержит разбор текстового протокола InfluxDB line protocol
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMissingMeasurement строка без имени measurement
+	ErrMissingMeasurement = errors.New("missing measurement")
+	// ErrMissingFields строка без полей
+	ErrMissingFields = errors.New("missing fields")
+	// ErrInvalidTag тег не в формате key=value
+	ErrInvalidTag = errors.New("invalid tag")
+	// ErrInvalidField поле не в формате key=value или с некорректным значением
+	ErrInvalidField = errors.New("invalid field")
+	// ErrInvalidTimestamp некорректная метка времени
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+)
+
+// Point разобранная строка line protocol
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	// Timestamp время точки, нулевое если в строке не указано
+	Timestamp time.Time
+	// Line номер строки в пакете, заполняется Parse
+	Line int
+}
+
+// Field поле точки. Value имеет один из типов float64, int64, uint64, bool или string
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// LineError ошибка разбора строки с ее номером, нумерация с единицы
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e LineError) Unwrap() error {
+	return e.Err
+}
+
+// Parse разбирает пакет строк. Ошибочные строки не прерывают разбор, а возвращаются списком ошибок.
+// Пустые строки и комментарии (#) пропускаются
+func Parse(data []byte) ([]Point, []LineError) {
+	points := make([]Point, 0)
+	lineErrors := make([]LineError, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := ParseLine(line)
+		if err != nil {
+			lineErrors = append(lineErrors, LineError{Line: i + 1, Err: err})
+			continue
+		}
+		point.Line = i + 1
+		points = append(points, point)
+	}
+	return points, lineErrors
+}
+
+// ParseLine разбирает одну строку line protocol
+func ParseLine(line string) (Point, error) {
+	var point Point
+
+	keyEnd := indexUnescaped(line, ' ', false)
+	if keyEnd < 0 {
+		return point, ErrMissingFields
+	}
+	key, rest := line[:keyEnd], strings.TrimLeft(line[keyEnd:], " ")
+
+	fieldsEnd := indexUnescaped(rest, ' ', true)
+	fieldsPart, timestampPart := rest, ""
+	if fieldsEnd >= 0 {
+		fieldsPart, timestampPart = rest[:fieldsEnd], strings.TrimSpace(rest[fieldsEnd:])
+	}
+
+	keyParts := splitUnescaped(key, ',', false)
+	point.Measurement = unescape(keyParts[0])
+	if point.Measurement == "" {
+		return point, ErrMissingMeasurement
+	}
+	for _, tag := range keyParts[1:] {
+		eq := indexUnescaped(tag, '=', false)
+		if eq <= 0 || eq == len(tag)-1 {
+			return point, fmt.Errorf("%w: %s", ErrInvalidTag, tag)
+		}
+		if point.Tags == nil {
+			point.Tags = make(map[string]string)
+		}
+		point.Tags[unescape(tag[:eq])] = unescape(tag[eq+1:])
+	}
+
+	if fieldsPart == "" {
+		return point, ErrMissingFields
+	}
+	for _, field := range splitUnescaped(fieldsPart, ',', true) {
+		eq := indexUnescaped(field, '=', false)
+		if eq <= 0 {
+			return point, fmt.Errorf("%w: %s", ErrInvalidField, field)
+		}
+		value, err := parseFieldValue(field[eq+1:])
+		if err != nil {
+			return point, fmt.Errorf("%w: %s: %s", ErrInvalidField, field, err.Error())
+		}
+		point.Fields = append(point.Fields, Field{Key: unescape(field[:eq]), Value: value})
+	}
+
+	if timestampPart != "" {
+		timestamp, err := strconv.ParseInt(timestampPart, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("%w: %s", ErrInvalidTimestamp, timestampPart)
+		}
+		point.Timestamp = time.Unix(0, timestamp)
+	}
+	return point, nil
+}
+
+// parseFieldValue разбор значения поля: "строка", 1i, 1u, t/f, иначе число с плавающей точкой
+func parseFieldValue(value string) (interface{}, error) {
+	switch {
+	case value == "":
+		return nil, errors.New("empty value")
+	case value[0] == '"':
+		if len(value) < 2 || value[len(value)-1] != '"' {
+			return nil, errors.New("unterminated string")
+		}
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1]), nil
+	case value[len(value)-1] == 'i':
+		return strconv.ParseInt(value[:len(value)-1], 10, 64)
+	case value[len(value)-1] == 'u':
+		return strconv.ParseUint(value[:len(value)-1], 10, 64)
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsNaN(floatValue) || math.IsInf(floatValue, 0) {
+		return nil, errors.New("NaN and Inf are not supported")
+	}
+	return floatValue, nil
+}
+
+// indexUnescaped индекс первого символа sep, не экранированного обратным слешем.
+// Если quotes == true, символы внутри двойных кавычек не учитываются
+func indexUnescaped(s string, sep byte, quotes bool) int {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnescaped разбиение строки по неэкранированному символу sep
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	parts := make([]string, 0)
+	for {
+		i := indexUnescaped(s, sep, quotes)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// unescape убирает экранирование запятой, знака равенства и пробела в именах и тегах
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `).Replace(s)
+}
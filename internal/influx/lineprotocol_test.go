@@ -0,0 +1,116 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Point
+		wantErr error
+	}{
+		{
+			name: "measurement with tags, fields and timestamp",
+			line: `cpu,host=server01,region=us-west usage_idle=92.5,procs=12i,running=t 1465839830100400200`,
+			want: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "server01", "region": "us-west"},
+				Fields: []Field{
+					{Key: "usage_idle", Value: 92.5},
+					{Key: "procs", Value: int64(12)},
+					{Key: "running", Value: true},
+				},
+				Timestamp: time.Unix(0, 1465839830100400200),
+			},
+		},
+		{
+			name: "without tags and timestamp",
+			line: `mem free=10u,comment="a \"quoted\", text with spaces"`,
+			want: Point{
+				Measurement: "mem",
+				Fields: []Field{
+					{Key: "free", Value: uint64(10)},
+					{Key: "comment", Value: `a "quoted", text with spaces`},
+				},
+			},
+		},
+		{
+			name: "escaped characters",
+			line: `disk\ io,path=C:\,\ drive\=1 read\ bytes=1e3`,
+			want: Point{
+				Measurement: "disk io",
+				Tags:        map[string]string{"path": "C:, drive=1"},
+				Fields:      []Field{{Key: "read bytes", Value: 1000.0}},
+			},
+		},
+		{
+			name:    "missing fields",
+			line:    `cpu,host=server01`,
+			wantErr: ErrMissingFields,
+		},
+		{
+			name:    "missing measurement",
+			line:    `,host=server01 value=1`,
+			wantErr: ErrMissingMeasurement,
+		},
+		{
+			name:    "invalid tag",
+			line:    `cpu,host value=1`,
+			wantErr: ErrInvalidTag,
+		},
+		{
+			name:    "invalid field value",
+			line:    `cpu value=abc`,
+			wantErr: ErrInvalidField,
+		},
+		{
+			name:    "invalid integer",
+			line:    `cpu value=1.5i`,
+			wantErr: ErrInvalidField,
+		},
+		{
+			name:    "unterminated string",
+			line:    `cpu value="abc`,
+			wantErr: ErrInvalidField,
+		},
+		{
+			name:    "invalid timestamp",
+			line:    `cpu value=1 yesterday`,
+			wantErr: ErrInvalidTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			point, err := ParseLine(tt.line)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, point)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := []byte(`# комментарий
+cpu,host=a usage=1.5
+
+cpu,host=b usage=oops
+mem used=10i
+`)
+	points, lineErrors := Parse(data)
+	require.Equal(t, 2, len(points))
+	assert.Equal(t, 2, points[0].Line)
+	assert.Equal(t, 5, points[1].Line)
+
+	require.Equal(t, 1, len(lineErrors))
+	assert.Equal(t, 4, lineErrors[0].Line)
+	assert.ErrorIs(t, lineErrors[0], ErrInvalidField)
+}
@@ -0,0 +1,88 @@
+package repository
+
+import "fmt"
+
+// UpdateMetrics записывает пачку метрик целиком. Ошибку при записи дают только неизвестный тип и гистограмма,
+// корзины которой не совпадают с рядом, поэтому пачка проверяется под блокировкой гистограмм, и до конца
+// записи параллельный запрос не может создать ряд с другими границами
+func (s *MapRepository) UpdateMetrics(metrics []Metrics) []error {
+	s.histogramsLock.Lock()
+	defer s.histogramsLock.Unlock()
+	return updateBatch(metrics, func(string) *MapRepository { return s })
+}
+
+func (s *ShardedRepository) UpdateMetrics(metrics []Metrics) []error {
+	used := make([]bool, len(s.shards))
+	for _, metric := range metrics {
+		used[s.shardIndex(metric.ID)] = true
+	}
+	// блокировки шардов берутся по возрастанию номера, чтобы параллельные пачки не ждали друг друга по кругу
+	for i, ok := range used {
+		if ok {
+			s.shards[i].histogramsLock.Lock()
+			defer s.shards[i].histogramsLock.Unlock()
+		}
+	}
+	return updateBatch(metrics, s.shard)
+}
+
+// updateBatch проверяет и записывает пачку metrics, shardOf - репозиторий ряда с именем name.
+// Вызывается под блокировкой гистограмм всех репозиториев пачки
+func updateBatch(metrics []Metrics, shardOf func(name string) *MapRepository) []error {
+	var errs []error
+	// границы корзин гистограмм пачки, второе значение ряда в пачке проверяется по первому
+	bounds := make(map[string][]Bucket)
+	for i, metric := range metrics {
+		var err error
+		switch metric.MType {
+		case Gauge, Counter:
+		case Histogram:
+			err = shardOf(metric.ID).checkHistogram(metric, bounds)
+		default:
+			err = fmt.Errorf("metric with type %s doesn't exsist", metric.MType)
+		}
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(metrics))
+			}
+			errs[i] = err
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+
+	for _, metric := range metrics {
+		shard := shardOf(metric.ID)
+		switch metric.MType {
+		case Gauge:
+			shard.updateGauge(metric.ID, metric.Labels, *metric.Value)
+		case Counter:
+			shard.updateCounter(metric.ID, metric.Labels, *metric.Delta)
+		case Histogram:
+			// границы проверены выше под той же блокировкой, ошибки быть не может
+			_ = shard.addHistogram(metric)
+		}
+	}
+	return nil
+}
+
+// checkHistogram проверяет гистограмму metric и ее границы относительно ряда и прошлых значений ряда в пачке bounds,
+// вызывается под блокировкой гистограмм
+func (s *MapRepository) checkHistogram(metric Metrics, bounds map[string][]Bucket) error {
+	if err := validateHistogram(metric); err != nil {
+		return err
+	}
+	key := metric.SeriesKey()
+	stored, ok := bounds[key]
+	if !ok {
+		if entry, found := s.histograms[key]; found {
+			stored, ok = entry.buckets, true
+		}
+	}
+	if ok && !sameBounds(stored, metric.Buckets) {
+		return fmt.Errorf("%w: buckets of %s don't match stored buckets", ErrInvalidHistogram, key)
+	}
+	bounds[key] = metric.Buckets
+	return nil
+}
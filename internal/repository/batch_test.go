@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUpdateMetrics проверяем что пачка с ошибкой не применяется ни в MapRepository, ни в шардированном репозитории
+func TestUpdateMetrics(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		batch   []Metrics
+		wantErr []int
+		want    int64
+	}{
+		{
+			name:  "applied",
+			batch: []Metrics{newCounter("requests", 2), newHistogram("latency", 1, 0.2, Bucket{0.1, 0}, Bucket{0.5, 1})},
+			want:  3,
+		},
+		{
+			name:    "stored bounds mismatch",
+			batch:   []Metrics{newCounter("requests", 2), newHistogram("latency", 1, 0.2, Bucket{1, 1})},
+			wantErr: []int{1},
+			want:    1,
+		},
+		{
+			name: "bounds mismatch inside batch",
+			batch: []Metrics{
+				newHistogram("size", 1, 2, Bucket{5, 1}),
+				newCounter("requests", 2),
+				newHistogram("size", 1, 2, Bucket{10, 1}),
+			},
+			wantErr: []int{2},
+			want:    1,
+		},
+		{
+			name:    "unknown type",
+			batch:   []Metrics{newCounter("requests", 2), {ID: "requests", MType: "summary"}},
+			wantErr: []int{1},
+			want:    1,
+		},
+	}
+	for _, shards := range []int{1, 8} {
+		for _, tt := range tests {
+			shards, tt := shards, tt
+			t.Run(tt.name, func(t *testing.T) {
+				t.Parallel()
+
+				repo := NewRepository(&genconfig.GeneralConfig{RepositoryShards: shards})
+				repo.UpdateCounter("requests", 1)
+				require.NoError(t, repo.UpdateMetric(newHistogram("latency", 1, 0.3, Bucket{0.1, 0}, Bucket{0.5, 1})))
+
+				errs := repo.UpdateMetrics(tt.batch)
+				if tt.wantErr == nil {
+					assert.Nil(t, errs)
+				} else {
+					require.Len(t, errs, len(tt.batch))
+					for _, i := range tt.wantErr {
+						assert.Error(t, errs[i])
+					}
+				}
+				val, ok := repo.Counter("requests")
+				assert.True(t, ok)
+				assert.Equal(t, tt.want, val)
+			})
+		}
+	}
+}
+
+// TestUpdateMetricsHistogramError проверяем что несовпадение корзин возвращает ErrInvalidHistogram, а ряд не меняется
+func TestUpdateMetricsHistogramError(t *testing.T) {
+	t.Parallel()
+
+	repo := NewRepository(&genconfig.GeneralConfig{})
+	require.NoError(t, repo.UpdateMetric(newHistogram("latency", 1, 0.3, Bucket{0.5, 1})))
+
+	errs := repo.UpdateMetrics([]Metrics{newHistogram("latency", 1, 0.2, Bucket{1, 1})})
+	require.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], ErrInvalidHistogram))
+
+	metric, ok := repo.Metric("latency", Histogram, nil)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), *metric.Count)
+}
@@ -0,0 +1,98 @@
+package repository
+
+import "fmt"
+
+// SetCumulative записывает накопленное у источника (Prometheus, OTLP) значение counter или histogram.
+// К ряду прибавляется приращение относительно прошлого значения этого источника, а для первого значения -
+// относительно значения ряда, чтобы после перезапуска сервера ряд не удваивался.
+// Правило сброса одно для обоих типов: если значение источника уменьшилось (у counter - значение,
+// у histogram - число наблюдений или любая корзина), источник перезапустился, и его значение целиком
+// считается приращением. Ряд при этом никогда не уменьшается.
+// Чтение прошлого значения и запись выполняются под одной блокировкой, поэтому параллельные запросы
+// с одним рядом не считают приращение от одного и того же значения
+func (s *MapRepository) SetCumulative(metric Metrics) error {
+	switch metric.MType {
+	case Counter:
+		if metric.Delta == nil {
+			return fmt.Errorf("%w: delta is required for counter", ErrInvalidMetric)
+		}
+		s.setCumulativeCounter(metric.ID, metric.Labels, *metric.Delta)
+		return nil
+	case Histogram:
+		return s.setCumulativeHistogram(metric)
+	default:
+		return fmt.Errorf("cumulative metric with type %s doesn't exsist", metric.MType)
+	}
+}
+
+// setCumulativeCounter записывает накопленное значение value ряда counter
+func (s *MapRepository) setCumulativeCounter(name string, labels Labels, value int64) {
+	key := SeriesKey(name, labels)
+	s.countersLock.Lock()
+	defer s.countersLock.Unlock()
+
+	entry := s.counterEntry(key, name, labels)
+	previous := entry.value
+	if entry.hasSource {
+		previous = entry.source
+	}
+	delta := value - previous
+	if delta < 0 {
+		delta = value
+	}
+	entry.value += delta
+	entry.source = value
+	entry.hasSource = true
+	s.storeCounter(key, entry)
+}
+
+// setCumulativeHistogram записывает накопленное значение metric ряда histogram
+func (s *MapRepository) setCumulativeHistogram(metric Metrics) error {
+	if err := validateHistogram(metric); err != nil {
+		return err
+	}
+	key := metric.SeriesKey()
+	value := histogramValueOf(metric)
+
+	s.histogramsLock.Lock()
+	defer s.histogramsLock.Unlock()
+
+	entry, ok := s.histograms[key]
+	if !ok {
+		entry = newHistogramEntry(metric)
+		entry.source = &value
+		s.storeHistogram(key, entry)
+		return nil
+	}
+	if !sameBounds(entry.buckets, metric.Buckets) {
+		return fmt.Errorf("%w: buckets of %s don't match stored buckets", ErrInvalidHistogram, key)
+	}
+	previous := histogramValue{buckets: entry.buckets, count: entry.count, sum: entry.sum}
+	if entry.source != nil {
+		previous = *entry.source
+	}
+	entry.add(value.since(previous))
+	entry.source = &value
+	s.storeHistogram(key, entry)
+	return nil
+}
+
+// since приращение накопленной гистограммы относительно прошлого значения previous с теми же границами.
+// Если наблюдений стало меньше, источник сбросил гистограмму, и приращение - все значение
+func (v histogramValue) since(previous histogramValue) histogramValue {
+	if v.count < previous.count {
+		return v
+	}
+	buckets := make([]Bucket, len(v.buckets))
+	for i, bucket := range v.buckets {
+		if bucket.Count < previous.buckets[i].Count {
+			return v
+		}
+		buckets[i] = Bucket{UpperBound: bucket.UpperBound, Count: bucket.Count - previous.buckets[i].Count}
+	}
+	return histogramValue{buckets: buckets, count: v.count - previous.count, sum: v.sum - previous.sum}
+}
+
+func (s *ShardedRepository) SetCumulative(metric Metrics) error {
+	return s.shard(metric.ID).SetCumulative(metric)
+}
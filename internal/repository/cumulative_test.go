@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCounter вспомогательная функция создания метрики типа counter
+func newCounter(name string, value int64) Metrics {
+	return Metrics{ID: name, MType: Counter, Delta: &value}
+}
+
+// TestSetCumulativeCounter проверяем приращения накопленного counter и сброс у источника
+func TestSetCumulativeCounter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		stored int64
+		values []int64
+		want   int64
+	}{
+		{name: "new series", values: []int64{100}, want: 100},
+		{name: "growth", values: []int64{100, 150, 150}, want: 150},
+		{name: "first value over stored value", stored: 40, values: []int64{100}, want: 100},
+		{name: "first value under stored value is reset", stored: 40, values: []int64{10}, want: 50},
+		{name: "reset adds whole value", values: []int64{100, 150, 20, 30}, want: 180},
+		{name: "reset to zero", values: []int64{100, 0, 5}, want: 105},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo := NewRepository(&genconfig.GeneralConfig{})
+			if tt.stored != 0 {
+				repo.UpdateCounter("requests", tt.stored)
+			}
+			for _, value := range tt.values {
+				assert.NoError(t, repo.SetCumulative(newCounter("requests", value)))
+			}
+			val, ok := repo.Counter("requests")
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, val)
+		})
+	}
+}
+
+// TestSetCumulativeHistogram проверяем приращения накопленной гистограммы, сброс и несовпадение корзин
+func TestSetCumulativeHistogram(t *testing.T) {
+	t.Parallel()
+
+	repo := NewRepository(&genconfig.GeneralConfig{})
+
+	assert.NoError(t, repo.SetCumulative(newHistogram("latency", 3, 0.6, Bucket{0.1, 1}, Bucket{0.5, 2})))
+	assert.NoError(t, repo.SetCumulative(newHistogram("latency", 5, 1.7, Bucket{0.1, 1}, Bucket{0.5, 3})))
+
+	val, ok := repo.Metric("latency", Histogram, nil)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), *val.Count)
+	assert.InDelta(t, 1.7, *val.Sum, 1e-9)
+	assert.Equal(t, []Bucket{{0.1, 1}, {0.5, 3}}, val.Buckets)
+
+	// Сброс у источника - значение целиком прибавляется, как у counter
+	assert.NoError(t, repo.SetCumulative(newHistogram("latency", 2, 0.3, Bucket{0.1, 1}, Bucket{0.5, 2})))
+	val, _ = repo.Metric("latency", Histogram, nil)
+	assert.Equal(t, uint64(7), *val.Count)
+	assert.InDelta(t, 2.0, *val.Sum, 1e-9)
+	assert.Equal(t, []Bucket{{0.1, 2}, {0.5, 5}}, val.Buckets)
+
+	// Уменьшение одной корзины тоже сброс
+	assert.NoError(t, repo.SetCumulative(newHistogram("latency", 2, 0.3, Bucket{0.1, 0}, Bucket{0.5, 2})))
+	val, _ = repo.Metric("latency", Histogram, nil)
+	assert.Equal(t, uint64(9), *val.Count)
+	assert.Equal(t, []Bucket{{0.1, 2}, {0.5, 7}}, val.Buckets)
+
+	// Корзины с другими границами не записываются
+	err := repo.SetCumulative(newHistogram("latency", 10, 1, Bucket{1, 10}))
+	assert.True(t, errors.Is(err, ErrInvalidHistogram))
+
+	err = repo.SetCumulative(Metrics{ID: "temperature", MType: Gauge})
+	assert.Error(t, err)
+}
+
+// TestSetCumulativeConcurrent параллельные запросы с одним и тем же накопленным значением учитываются один раз
+func TestSetCumulativeConcurrent(t *testing.T) {
+	t.Parallel()
+
+	repos := map[string]Repository{
+		"map":     NewRepository(&genconfig.GeneralConfig{}),
+		"sharded": NewShardedRepository(&genconfig.GeneralConfig{}, 4),
+	}
+	for name, repo := range repos {
+		repo := repo
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			for _, value := range []uint64{100, 150} {
+				var wg sync.WaitGroup
+				for i := 0; i < 50; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						assert.NoError(t, repo.SetCumulative(newCounter("requests", int64(value))))
+						assert.NoError(t, repo.SetCumulative(newHistogram("latency", value, float64(value), Bucket{1, value})))
+					}()
+				}
+				wg.Wait()
+
+				counter, ok := repo.Counter("requests")
+				assert.True(t, ok)
+				assert.Equal(t, int64(value), counter)
+				histogram, ok := repo.Metric("latency", Histogram, nil)
+				assert.True(t, ok)
+				assert.Equal(t, value, *histogram.Count)
+				assert.Equal(t, []Bucket{{1, value}}, histogram.Buckets)
+			}
+		})
+	}
+}
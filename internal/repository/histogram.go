@@ -0,0 +1,69 @@
+// Package repository содержит функционал по работе с метриками типа histogram
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidHistogram ошибка при некорректных данных гистограммы или несовпадении корзин
+var ErrInvalidHistogram = errors.New("invalid histogram")
+
+// Bucket корзина гистограммы. Count - число наблюдений не превышающих UpperBound (накопительно, как в prometheus).
+// Корзина +Inf явно не передается, ее значение равно Count всей гистограммы
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// copyBuckets копия корзин, чтобы репозиторий не зависел от slice вызывающей стороны
+func copyBuckets(buckets []Bucket) []Bucket {
+	if buckets == nil {
+		return nil
+	}
+	result := make([]Bucket, len(buckets))
+	copy(result, buckets)
+	return result
+}
+
+// bucketsString текстовое представление корзин le=0.5:3,le=1:7 используется в подписи и в html
+func bucketsString(buckets []Bucket) string {
+	parts := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		parts = append(parts, fmt.Sprintf("le=%g:%d", bucket.UpperBound, bucket.Count))
+	}
+	return strings.Join(parts, ",")
+}
+
+// validateHistogram проверяет что у метрики заданы count и sum, границы корзин возрастают,
+// а накопительные значения не убывают и не превышают count
+func validateHistogram(metric Metrics) error {
+	if metric.Count == nil || metric.Sum == nil {
+		return fmt.Errorf("%w: count and sum are required", ErrInvalidHistogram)
+	}
+	var prev Bucket
+	for i, bucket := range metric.Buckets {
+		if i > 0 && bucket.UpperBound <= prev.UpperBound {
+			return fmt.Errorf("%w: bucket bounds must be increasing", ErrInvalidHistogram)
+		}
+		if bucket.Count < prev.Count || bucket.Count > *metric.Count {
+			return fmt.Errorf("%w: bucket counts must be cumulative", ErrInvalidHistogram)
+		}
+		prev = bucket
+	}
+	return nil
+}
+
+// sameBounds проверяет что у двух наборов корзин одинаковые границы
+func sameBounds(a, b []Bucket) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].UpperBound != b[i].UpperBound {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+// newHistogram вспомогательная функция создания метрики типа histogram
+func newHistogram(name string, count uint64, sum float64, buckets ...Bucket) Metrics {
+	return Metrics{
+		ID:      name,
+		MType:   Histogram,
+		Buckets: buckets,
+		Count:   &count,
+		Sum:     &sum,
+	}
+}
+
+// TestMapRepositoryHistogram проверяем что гистограммы с одинаковыми корзинами складываются
+func TestMapRepositoryHistogram(t *testing.T) {
+	t.Parallel()
+
+	repo := NewRepository(&genconfig.GeneralConfig{})
+
+	err := repo.UpdateMetric(newHistogram("latency", 3, 0.6, Bucket{0.1, 1}, Bucket{0.5, 2}))
+	assert.NoError(t, err)
+	err = repo.UpdateMetric(newHistogram("latency", 2, 1.1, Bucket{0.1, 0}, Bucket{0.5, 1}))
+	assert.NoError(t, err)
+
+	val, ok := repo.Metric("latency", Histogram, nil)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), *val.Count)
+	assert.InDelta(t, 1.7, *val.Sum, 1e-9)
+	assert.Equal(t, []Bucket{{0.1, 1}, {0.5, 3}}, val.Buckets)
+
+	// Корзины с другими границами не складываются
+	err = repo.UpdateMetric(newHistogram("latency", 1, 1, Bucket{1, 1}))
+	assert.True(t, errors.Is(err, ErrInvalidHistogram))
+
+	// Неизвестная гистограмма
+	_, ok = repo.Metric("unknownHistogram", Histogram, nil)
+	assert.False(t, ok)
+
+	assert.Equal(t, 1, len(repo.ToMetrics()))
+	repo.Clear()
+	assert.Equal(t, 0, len(repo.ToMetrics()))
+}
+
+// TestValidateHistogram проверяем отказ на некорректных гистограммах
+func TestValidateHistogram(t *testing.T) {
+	tests := map[string]struct {
+		metric Metrics
+		valid  bool
+	}{
+		"correct histogram": {
+			metric: newHistogram("h", 3, 1, Bucket{0.1, 1}, Bucket{1, 3}),
+			valid:  true,
+		},
+		"histogram without buckets": {
+			metric: newHistogram("h", 3, 1),
+			valid:  true,
+		},
+		"bounds are not increasing": {
+			metric: newHistogram("h", 3, 1, Bucket{1, 1}, Bucket{0.1, 3}),
+			valid:  false,
+		},
+		"counts are not cumulative": {
+			metric: newHistogram("h", 3, 1, Bucket{0.1, 2}, Bucket{1, 1}),
+			valid:  false,
+		},
+		"bucket count is greater than count": {
+			metric: newHistogram("h", 3, 1, Bucket{0.1, 4}),
+			valid:  false,
+		},
+		"count and sum are missing": {
+			metric: Metrics{ID: "h", MType: Histogram},
+			valid:  false,
+		},
+	}
+	for name, test := range tests {
+		err := validateHistogram(test.metric)
+		if test.valid {
+			assert.NoError(t, err, name)
+		} else {
+			assert.True(t, errors.Is(err, ErrInvalidHistogram), name)
+		}
+	}
+}
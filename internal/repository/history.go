@@ -0,0 +1,76 @@
+// Package repository содержит функционал хранения истории значений метрик в памяти
+package repository
+
+import (
+	"time"
+)
+
+// defaultHistorySize ограничение числа точек истории на ряд, если размер не задан в конфигурации
+const defaultHistorySize = 1000
+
+// Sample точка истории метрики: значение gauge либо накопленное значение counter на момент времени
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Значение counter на момент Timestamp
+	Delta *int64 `json:"delta,omitempty"`
+	// Значение gauge на момент Timestamp
+	Value *float64 `json:"value,omitempty"`
+}
+
+// seriesHistory ограниченная история одного ряда. Точки хранятся по возрастанию времени,
+// устаревшие по retention и лишние сверх size точки отбрасываются при добавлении.
+// Не потокобезопасна, защищается блокировкой соответствующего типа метрик в MapRepository
+type seriesHistory struct {
+	samples   []Sample
+	retention time.Duration
+	size      int
+}
+
+// newSeriesHistory конструктор, size <= 0 означает размер по умолчанию
+func newSeriesHistory(retention time.Duration, size int) *seriesHistory {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return &seriesHistory{
+		retention: retention,
+		size:      size,
+	}
+}
+
+// add добавляет точку и отбрасывает устаревшие. Для nil истории, когда она выключена, ничего не делает
+func (h *seriesHistory) add(sample Sample) {
+	if h == nil {
+		return
+	}
+	h.samples = append(h.samples, sample)
+
+	drop := len(h.samples) - h.size
+	if drop < 0 {
+		drop = 0
+	}
+	border := sample.Timestamp.Add(-h.retention)
+	for drop < len(h.samples) && h.samples[drop].Timestamp.Before(border) {
+		drop++
+	}
+	if drop > 0 {
+		h.samples = h.samples[drop:]
+	}
+}
+
+// between возвращает копию точек в интервале [from, to]. Нулевые from и to означают отсутствие границы
+func (h *seriesHistory) between(from, to time.Time) []Sample {
+	result := make([]Sample, 0)
+	if h == nil {
+		return result
+	}
+	for _, sample := range h.samples {
+		if !from.IsZero() && sample.Timestamp.Before(from) {
+			continue
+		}
+		if !to.IsZero() && sample.Timestamp.After(to) {
+			break
+		}
+		result = append(result, sample)
+	}
+	return result
+}
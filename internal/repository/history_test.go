@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+// newHistoryRepository репозиторий с историей и управляемым временем
+func newHistoryRepository(retention time.Duration, size int, now *time.Time) Repository {
+	repo := NewRepository(&genconfig.GeneralConfig{
+		HistoryRetention: genconfig.Duration{Duration: retention},
+		HistorySize:      size,
+	})
+	repo.(*MapRepository).now = func() time.Time {
+		return *now
+	}
+	return repo
+}
+
+// TestMapRepositoryHistory проверяем выборку истории по интервалу
+func TestMapRepositoryHistory(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	repo := newHistoryRepository(time.Hour, 0, &now)
+
+	for i := 0; i < 5; i++ {
+		repo.UpdateGauge("testGauge", float64(i))
+		repo.UpdateCounter("testCounter", 10)
+		now = now.Add(time.Minute)
+	}
+
+	samples, ok := repo.History("testGauge", Gauge, nil, time.Time{}, time.Time{})
+	assert.True(t, ok)
+	assert.Equal(t, 5, len(samples))
+	assert.Equal(t, 4.0, *samples[4].Value)
+
+	// Интервал с 12:01 по 12:03 включительно
+	from := time.Date(2022, 11, 1, 12, 1, 0, 0, time.UTC)
+	to := time.Date(2022, 11, 1, 12, 3, 0, 0, time.UTC)
+	samples, ok = repo.History("testCounter", Counter, nil, from, to)
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(samples))
+	// Для counter в истории накопленное значение
+	assert.Equal(t, int64(20), *samples[0].Delta)
+	assert.Equal(t, int64(40), *samples[2].Delta)
+	assert.Equal(t, from, samples[0].Timestamp)
+
+	// Неизвестная метрика и тип без истории
+	_, ok = repo.History("unknownGauge", Gauge, nil, time.Time{}, time.Time{})
+	assert.False(t, ok)
+	_, ok = repo.History("testGauge", Histogram, nil, time.Time{}, time.Time{})
+	assert.False(t, ok)
+}
+
+// TestMapRepositoryHistoryBounds проверяем что история ограничена по времени и по числу точек
+func TestMapRepositoryHistoryBounds(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	repo := newHistoryRepository(time.Minute*10, 3, &now)
+
+	for i := 0; i < 5; i++ {
+		repo.UpdateGauge("testGauge", float64(i))
+	}
+	samples, _ := repo.History("testGauge", Gauge, nil, time.Time{}, time.Time{})
+	assert.Equal(t, 3, len(samples))
+	assert.Equal(t, 2.0, *samples[0].Value)
+
+	// Через 11 минут старые точки устаревают
+	now = now.Add(time.Minute * 11)
+	repo.UpdateGauge("testGauge", 100)
+	samples, _ = repo.History("testGauge", Gauge, nil, time.Time{}, time.Time{})
+	assert.Equal(t, 1, len(samples))
+	assert.Equal(t, 100.0, *samples[0].Value)
+}
+
+// TestMapRepositoryHistoryDisabled без retention история не ведется, но ряд известен
+func TestMapRepositoryHistoryDisabled(t *testing.T) {
+	t.Parallel()
+
+	repo := NewRepository(&genconfig.GeneralConfig{})
+	repo.UpdateGauge("testGauge", 1)
+
+	samples, ok := repo.History("testGauge", Gauge, nil, time.Time{}, time.Time{})
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(samples))
+}
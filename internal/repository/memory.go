@@ -5,52 +5,266 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ncyellow/devops/internal/genconfig"
 	"github.com/ncyellow/devops/internal/hash"
 )
 
-// MapRepository структура данных для работы метриками на основе map, реализует интерфейс Repository
+// gaugeEntry значение ряда gauge вместе с именем и метками
+type gaugeEntry struct {
+	name    string
+	labels  Labels
+	value   float64
+	history *seriesHistory
+	updated time.Time
+}
+
+// counterEntry значение ряда counter вместе с именем и метками
+type counterEntry struct {
+	name    string
+	labels  Labels
+	value   int64
+	history *seriesHistory
+	updated time.Time
+	// source последнее накопленное значение источника, записанное через SetCumulative
+	source    int64
+	hasSource bool
+}
+
+// histogramEntry значение ряда histogram вместе с именем и метками
+type histogramEntry struct {
+	name    string
+	labels  Labels
+	buckets []Bucket
+	count   uint64
+	sum     float64
+	updated time.Time
+	// source последнее накопленное значение источника, записанное через SetCumulative
+	source *histogramValue
+}
+
+// histogramValue корзины, число и сумма наблюдений гистограммы
+type histogramValue struct {
+	buckets []Bucket
+	count   uint64
+	sum     float64
+}
+
+// MapRepository структура данных для работы метриками на основе map, реализует интерфейс Repository.
+// Ключ map - SeriesKey, то есть имя метрики вместе с метками
 type MapRepository struct {
-	conf     *genconfig.GeneralConfig
-	gauges   map[string]float64
-	counters map[string]int64
+	conf       *genconfig.GeneralConfig
+	gauges     map[string]gaugeEntry
+	counters   map[string]counterEntry
+	histograms map[string]histogramEntry
 
-	// Мьютекcа два так как обе структуры данных у нас независимы и так мы уменьшаем гранулярность блокировок
-	gaugesLock   *sync.RWMutex
-	countersLock *sync.RWMutex
+	// Мьютекcов по одному на тип так как структуры данных у нас независимы и так мы уменьшаем гранулярность блокировок
+	gaugesLock     *sync.RWMutex
+	countersLock   *sync.RWMutex
+	histogramsLock *sync.RWMutex
+
+	// now источник времени для истории и TTL, подменяется в тестах
+	now func() time.Time
+
+	// notifier подписки на изменения метрик
+	notifier *changeNotifier
 }
 
-// NewRepository конструктор
+// NewRepository конструктор. Если в конфигурации задано больше одного шарда, создается ShardedRepository,
+// иначе MapRepository
 func NewRepository(conf *genconfig.GeneralConfig) Repository {
+	if conf.RepositoryShards > 1 {
+		return NewShardedRepository(conf, conf.RepositoryShards)
+	}
+	return newMapRepository(conf)
+}
+
+// newMapRepository конструктор MapRepository
+func newMapRepository(conf *genconfig.GeneralConfig) *MapRepository {
 	repo := MapRepository{}
 	repo.conf = conf
-	repo.gauges = make(map[string]float64)
-	repo.counters = make(map[string]int64)
+	repo.gauges = make(map[string]gaugeEntry)
+	repo.counters = make(map[string]counterEntry)
+	repo.histograms = make(map[string]histogramEntry)
 
 	repo.gaugesLock = &sync.RWMutex{}
 	repo.countersLock = &sync.RWMutex{}
+	repo.histogramsLock = &sync.RWMutex{}
+	repo.now = time.Now
+	repo.notifier = newChangeNotifier()
 	return &repo
 }
 
+// newHistory создает историю ряда по настройкам, nil если история выключена
+func (s *MapRepository) newHistory() *seriesHistory {
+	if s.conf.HistoryRetention.Duration <= 0 {
+		return nil
+	}
+	return newSeriesHistory(s.conf.HistoryRetention.Duration, s.conf.HistorySize)
+}
+
 func (s *MapRepository) UpdateGauge(name string, value float64) {
+	s.updateGauge(name, nil, value)
+}
+
+func (s *MapRepository) UpdateCounter(name string, value int64) {
+	s.updateCounter(name, nil, value)
+}
+
+// AddGauge прибавляет delta к ряду gauge. Чтение значения и запись выполняются под одной блокировкой,
+// поэтому параллельные приращения одного ряда не теряются
+func (s *MapRepository) AddGauge(name string, labels Labels, delta float64) {
+	key := SeriesKey(name, labels)
 	s.gaugesLock.Lock()
-	s.gauges[name] = value
+	entry := s.gaugeEntry(key, name, labels)
+	entry.value += delta
+	s.storeGauge(key, entry)
 	s.gaugesLock.Unlock()
 }
 
-func (s *MapRepository) UpdateCounter(name string, value int64) {
+// updateGauge перезаписывает значение ряда gauge с именем name и метками labels
+func (s *MapRepository) updateGauge(name string, labels Labels, value float64) {
+	key := SeriesKey(name, labels)
+	s.gaugesLock.Lock()
+	entry := s.gaugeEntry(key, name, labels)
+	entry.value = value
+	s.storeGauge(key, entry)
+	s.gaugesLock.Unlock()
+}
+
+// gaugeEntry существующий либо новый ряд gauge, вызывается под блокировкой gauge
+func (s *MapRepository) gaugeEntry(key string, name string, labels Labels) gaugeEntry {
+	entry, ok := s.gauges[key]
+	if !ok {
+		entry = gaugeEntry{name: name, labels: labels.Copy(), history: s.newHistory()}
+	}
+	return entry
+}
+
+// storeGauge сохраняет новое значение ряда gauge в историю и рассылает подписчикам,
+// вызывается под блокировкой gauge
+func (s *MapRepository) storeGauge(key string, entry gaugeEntry) {
+	entry.updated = s.now()
+	value := entry.value
+	entry.history.add(Sample{Timestamp: entry.updated, Value: &value})
+	s.gauges[key] = entry
+	// рассылка под блокировкой, чтобы подписчики получали значения ряда в порядке записи
+	if s.notifier.active() {
+		s.notifier.publish(Metrics{ID: entry.name, Labels: entry.labels.Copy(), MType: Gauge, Value: &value})
+	}
+}
+
+// updateCounter увеличивает значение ряда counter с именем name и метками labels
+func (s *MapRepository) updateCounter(name string, labels Labels, value int64) {
+	key := SeriesKey(name, labels)
 	s.countersLock.Lock()
-	s.counters[name] = s.counters[name] + value
+	entry := s.counterEntry(key, name, labels)
+	entry.value += value
+	s.storeCounter(key, entry)
 	s.countersLock.Unlock()
 }
 
+// counterEntry существующий либо новый ряд counter, вызывается под блокировкой счетчиков
+func (s *MapRepository) counterEntry(key string, name string, labels Labels) counterEntry {
+	entry, ok := s.counters[key]
+	if !ok {
+		entry = counterEntry{name: name, labels: labels.Copy(), history: s.newHistory()}
+	}
+	return entry
+}
+
+// storeCounter сохраняет новое значение ряда counter в историю и рассылает подписчикам,
+// вызывается под блокировкой счетчиков
+func (s *MapRepository) storeCounter(key string, entry counterEntry) {
+	entry.updated = s.now()
+	total := entry.value
+	entry.history.add(Sample{Timestamp: entry.updated, Delta: &total})
+	s.counters[key] = entry
+	// рассылка под блокировкой, чтобы подписчики получали значения ряда в порядке записи
+	if s.notifier.active() {
+		s.notifier.publish(Metrics{ID: entry.name, Labels: entry.labels.Copy(), MType: Counter, Delta: &total})
+	}
+}
+
+// updateHistogram добавляет наблюдения metric к ряду histogram. Границы корзин у ряда фиксируются первым значением,
+// последующие значения с другими границами отклоняются, так как накопительные корзины нельзя корректно пересчитать
+func (s *MapRepository) updateHistogram(metric Metrics) error {
+	if err := validateHistogram(metric); err != nil {
+		return err
+	}
+
+	s.histogramsLock.Lock()
+	defer s.histogramsLock.Unlock()
+	return s.addHistogram(metric)
+}
+
+// addHistogram добавляет проверенное значение metric к ряду histogram, вызывается под блокировкой гистограмм
+func (s *MapRepository) addHistogram(metric Metrics) error {
+	key := metric.SeriesKey()
+	entry, ok := s.histograms[key]
+	if !ok {
+		s.storeHistogram(key, newHistogramEntry(metric))
+		return nil
+	}
+	if !sameBounds(entry.buckets, metric.Buckets) {
+		return fmt.Errorf("%w: buckets of %s don't match stored buckets", ErrInvalidHistogram, key)
+	}
+	entry.add(histogramValueOf(metric))
+	s.storeHistogram(key, entry)
+	return nil
+}
+
+// newHistogramEntry новый ряд histogram со значением metric
+func newHistogramEntry(metric Metrics) histogramEntry {
+	return histogramEntry{
+		name:    metric.ID,
+		labels:  metric.Labels.Copy(),
+		buckets: copyBuckets(metric.Buckets),
+		count:   *metric.Count,
+		sum:     *metric.Sum,
+	}
+}
+
+// histogramValueOf значение гистограммы metric, корзины копируются
+func histogramValueOf(metric Metrics) histogramValue {
+	return histogramValue{buckets: copyBuckets(metric.Buckets), count: *metric.Count, sum: *metric.Sum}
+}
+
+// add прибавляет к ряду наблюдения value с теми же границами корзин
+func (e *histogramEntry) add(value histogramValue) {
+	// корзины копируем, чтобы не менять slice который мог быть отдан наружу через ToMetrics
+	buckets := copyBuckets(e.buckets)
+	for i := range buckets {
+		buckets[i].Count += value.buckets[i].Count
+	}
+	e.buckets = buckets
+	e.count += value.count
+	e.sum += value.sum
+}
+
+// storeHistogram сохраняет ряд histogram и рассылает его подписчикам, вызывается под блокировкой гистограмм
+func (s *MapRepository) storeHistogram(key string, entry histogramEntry) {
+	entry.updated = s.now()
+	s.histograms[key] = entry
+	s.publishHistogram(entry)
+}
+
+// publishHistogram рассылает подписчикам новое значение ряда histogram, вызывается под блокировкой гистограмм
+func (s *MapRepository) publishHistogram(entry histogramEntry) {
+	if s.notifier.active() {
+		s.notifier.publish(entry.toMetrics())
+	}
+}
+
 func (s *MapRepository) UpdateMetric(metric Metrics) error {
 	switch metric.MType {
 	case Gauge:
-		s.UpdateGauge(metric.ID, *metric.Value)
+		s.updateGauge(metric.ID, metric.Labels, *metric.Value)
 	case Counter:
-		s.UpdateCounter(metric.ID, *metric.Delta)
+		s.updateCounter(metric.ID, metric.Labels, *metric.Delta)
+	case Histogram:
+		return s.updateHistogram(metric)
 	default:
 		return fmt.Errorf("metric with type %s doesn't exsist", metric.MType)
 	}
@@ -58,47 +272,69 @@ func (s *MapRepository) UpdateMetric(metric Metrics) error {
 }
 
 func (s *MapRepository) Gauge(name string) (val float64, ok bool) {
+	return s.gauge(name, nil)
+}
+
+func (s *MapRepository) Counter(name string) (val int64, ok bool) {
+	return s.counter(name, nil)
+}
+
+// gauge возвращает значение ряда gauge с именем name и метками labels
+func (s *MapRepository) gauge(name string, labels Labels) (val float64, ok bool) {
 	s.gaugesLock.RLock()
-	val, ok = s.gauges[name]
+	entry, ok := s.gauges[SeriesKey(name, labels)]
 	s.gaugesLock.RUnlock()
 
-	return
+	return entry.value, ok
 }
 
-func (s *MapRepository) Counter(name string) (val int64, ok bool) {
+// counter возвращает значение ряда counter с именем name и метками labels
+func (s *MapRepository) counter(name string, labels Labels) (val int64, ok bool) {
 	s.countersLock.RLock()
-	val, ok = s.counters[name]
+	entry, ok := s.counters[SeriesKey(name, labels)]
 	s.countersLock.RUnlock()
-	return
+	return entry.value, ok
 }
 
-func (s *MapRepository) Metric(name string, mType string) (val Metrics, ok bool) {
+func (s *MapRepository) Metric(name string, mType string, labels Labels) (val Metrics, ok bool) {
 	encodeFunc := hash.CreateEncodeFunc(s.conf.SecretKey)
 	switch mType {
 	case Gauge:
-		val, ok := s.Gauge(name)
+		val, ok := s.gauge(name, labels)
 		if !ok {
 			return Metrics{}, ok
 		}
 		metric := Metrics{
-			ID:    name,
-			MType: mType,
-			Value: &val,
-			Delta: nil,
+			ID:     name,
+			Labels: labels.Copy(),
+			MType:  mType,
+			Value:  &val,
+			Delta:  nil,
 		}
 		metric.CalcHash(encodeFunc)
 		return metric, ok
 	case Counter:
-		val, ok := s.Counter(name)
+		val, ok := s.counter(name, labels)
 		if !ok {
 			return Metrics{}, ok
 		}
 		metric := Metrics{
-			ID:    name,
-			MType: mType,
-			Value: nil,
-			Delta: &val,
+			ID:     name,
+			Labels: labels.Copy(),
+			MType:  mType,
+			Value:  nil,
+			Delta:  &val,
+		}
+		metric.CalcHash(encodeFunc)
+		return metric, ok
+	case Histogram:
+		s.histogramsLock.RLock()
+		entry, ok := s.histograms[SeriesKey(name, labels)]
+		s.histogramsLock.RUnlock()
+		if !ok {
+			return Metrics{}, ok
 		}
+		metric := entry.toMetrics()
 		metric.CalcHash(encodeFunc)
 		return metric, ok
 	default:
@@ -106,37 +342,187 @@ func (s *MapRepository) Metric(name string, mType string) (val Metrics, ok bool)
 	}
 }
 
-// ToMetrics Конвертация данных MapRepository в []Metrics
+// toMetrics конвертация ряда histogram в Metrics
+func (e histogramEntry) toMetrics() Metrics {
+	count := e.count
+	sum := e.sum
+	return Metrics{
+		ID:      e.name,
+		Labels:  e.labels.Copy(),
+		MType:   Histogram,
+		Buckets: copyBuckets(e.buckets),
+		Count:   &count,
+		Sum:     &sum,
+	}
+}
+
+// History возвращает историю значений ряда gauge или counter в интервале [from, to].
+// Для histogram история не ведется
+func (s *MapRepository) History(name string, mType string, labels Labels, from, to time.Time) (samples []Sample, ok bool) {
+	key := SeriesKey(name, labels)
+	switch mType {
+	case Gauge:
+		s.gaugesLock.RLock()
+		defer s.gaugesLock.RUnlock()
+		entry, ok := s.gauges[key]
+		if !ok {
+			return nil, false
+		}
+		return entry.history.between(from, to), true
+	case Counter:
+		s.countersLock.RLock()
+		defer s.countersLock.RUnlock()
+		entry, ok := s.counters[key]
+		if !ok {
+			return nil, false
+		}
+		return entry.history.between(from, to), true
+	default:
+		return nil, false
+	}
+}
+
+// Expire удаляет ряды, которые не обновлялись дольше своего TTL, и возвращает удаленные ряды без значений.
+// Подписчики получают события удаления рядов
+func (s *MapRepository) Expire(now time.Time) []Metrics {
+	expiredMetrics := make([]Metrics, 0)
+
+	s.gaugesLock.Lock()
+	for key, entry := range s.gauges {
+		if expired(s.conf, entry.name, entry.updated, now) {
+			delete(s.gauges, key)
+			expiredMetrics = append(expiredMetrics, Metrics{ID: entry.name, Labels: entry.labels.Copy(), MType: Gauge})
+			s.publishDeleted(entry.name, entry.labels, Gauge)
+		}
+	}
+	s.gaugesLock.Unlock()
+
+	s.countersLock.Lock()
+	for key, entry := range s.counters {
+		if expired(s.conf, entry.name, entry.updated, now) {
+			delete(s.counters, key)
+			expiredMetrics = append(expiredMetrics, Metrics{ID: entry.name, Labels: entry.labels.Copy(), MType: Counter})
+			s.publishDeleted(entry.name, entry.labels, Counter)
+		}
+	}
+	s.countersLock.Unlock()
+
+	s.histogramsLock.Lock()
+	for key, entry := range s.histograms {
+		if expired(s.conf, entry.name, entry.updated, now) {
+			delete(s.histograms, key)
+			expiredMetrics = append(expiredMetrics, Metrics{ID: entry.name, Labels: entry.labels.Copy(), MType: Histogram})
+			s.publishDeleted(entry.name, entry.labels, Histogram)
+		}
+	}
+	s.histogramsLock.Unlock()
+	return expiredMetrics
+}
+
+// Delete удаляет ряд вместе с его историей. Подписчики получают событие удаления ряда
+func (s *MapRepository) Delete(name string, mType string, labels Labels) bool {
+	key := SeriesKey(name, labels)
+	switch mType {
+	case Gauge:
+		s.gaugesLock.Lock()
+		defer s.gaugesLock.Unlock()
+		entry, ok := s.gauges[key]
+		if ok {
+			delete(s.gauges, key)
+			s.publishDeleted(entry.name, entry.labels, Gauge)
+		}
+		return ok
+	case Counter:
+		s.countersLock.Lock()
+		defer s.countersLock.Unlock()
+		entry, ok := s.counters[key]
+		if ok {
+			delete(s.counters, key)
+			s.publishDeleted(entry.name, entry.labels, Counter)
+		}
+		return ok
+	case Histogram:
+		s.histogramsLock.Lock()
+		defer s.histogramsLock.Unlock()
+		entry, ok := s.histograms[key]
+		if ok {
+			delete(s.histograms, key)
+			s.publishDeleted(entry.name, entry.labels, Histogram)
+		}
+		return ok
+	default:
+		return false
+	}
+}
+
+// publishDeleted рассылает подписчикам удаление ряда. Вызывается под блокировкой типа ряда
+func (s *MapRepository) publishDeleted(name string, labels Labels, mType string) {
+	if s.notifier.active() {
+		s.notifier.publish(Metrics{ID: name, Labels: labels.Copy(), MType: mType, Deleted: true})
+	}
+}
+
+// ResetCounter обнуляет ряд counter. Обнуление попадает в историю как обычная точка со значением 0
+func (s *MapRepository) ResetCounter(name string, labels Labels) bool {
+	key := SeriesKey(name, labels)
+	s.countersLock.Lock()
+	defer s.countersLock.Unlock()
+	entry, ok := s.counters[key]
+	if !ok {
+		return false
+	}
+	entry.value = 0
+	s.storeCounter(key, entry)
+	return true
+}
+
+// Subscribe подписка на изменения рядов метрик с именами names, пустой список - все метрики
+func (s *MapRepository) Subscribe(names []string) *Subscription {
+	return s.notifier.subscribe(names)
+}
+
+// ToMetrics Конвертация данных MapRepository в []Metrics.
+// Под блокировками значения только копируются, хеши считаются уже после их снятия, чтобы не задерживать запись
 func (s *MapRepository) ToMetrics() []Metrics {
-	totalCount := len(s.gauges) + len(s.counters)
-	metrics := make([]Metrics, 0, totalCount)
+	metrics := make([]Metrics, 0)
 	hashFunc := hash.CreateEncodeFunc(s.conf.SecretKey)
 
 	s.gaugesLock.RLock()
-	for name, value := range s.gauges {
-		gaugeValue := value
+	for _, entry := range s.gauges {
+		gaugeValue := entry.value
 		metric := Metrics{
-			ID:    name,
-			MType: Gauge,
-			Value: &gaugeValue,
+			ID:     entry.name,
+			Labels: entry.labels.Copy(),
+			MType:  Gauge,
+			Value:  &gaugeValue,
 		}
-		metric.Hash = metric.CalcHash(hashFunc)
 		metrics = append(metrics, metric)
 	}
 	s.gaugesLock.RUnlock()
 
 	s.countersLock.RLock()
-	for name, value := range s.counters {
-		counterValue := value
+	for _, entry := range s.counters {
+		counterValue := entry.value
 		metric := Metrics{
-			ID:    name,
-			MType: Counter,
-			Delta: &counterValue,
+			ID:     entry.name,
+			Labels: entry.labels.Copy(),
+			MType:  Counter,
+			Delta:  &counterValue,
 		}
-		metric.Hash = metric.CalcHash(hashFunc)
 		metrics = append(metrics, metric)
 	}
 	s.countersLock.RUnlock()
+
+	s.histogramsLock.RLock()
+	for _, entry := range s.histograms {
+		metric := entry.toMetrics()
+		metrics = append(metrics, metric)
+	}
+	s.histogramsLock.RUnlock()
+
+	for i := range metrics {
+		metrics[i].Hash = metrics[i].CalcHash(hashFunc)
+	}
 	return metrics
 }
 
@@ -146,12 +532,15 @@ func (s *MapRepository) FromMetrics(metrics []Metrics) {
 		switch metric.MType {
 		case Gauge:
 			if metric.Value != nil {
-				s.UpdateGauge(metric.ID, *metric.Value)
+				s.updateGauge(metric.ID, metric.Labels, *metric.Value)
 			}
 		case Counter:
 			if metric.Delta != nil {
-				s.UpdateCounter(metric.ID, *metric.Delta)
+				s.updateCounter(metric.ID, metric.Labels, *metric.Delta)
 			}
+		case Histogram:
+			// некорректные гистограммы пропускаем так же, как gauge и counter без значения
+			s.updateHistogram(metric)
 		}
 	}
 }
@@ -159,12 +548,16 @@ func (s *MapRepository) FromMetrics(metrics []Metrics) {
 // Clear - очищаем все метрики репозитория
 func (s *MapRepository) Clear() {
 	s.gaugesLock.Lock()
-	s.gauges = make(map[string]float64)
+	s.gauges = make(map[string]gaugeEntry)
 	s.gaugesLock.Unlock()
 
 	s.countersLock.Lock()
-	s.counters = make(map[string]int64)
+	s.counters = make(map[string]counterEntry)
 	s.countersLock.Unlock()
+
+	s.histogramsLock.Lock()
+	s.histograms = make(map[string]histogramEntry)
+	s.histogramsLock.Unlock()
 }
 
 // MarshalJSON - реализация интерфейса Marshaler
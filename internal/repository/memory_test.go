@@ -1,7 +1,9 @@
 package repository
 
 import (
+	"bytes"
 	"encoding/json"
+	"sync"
 
 	"testing"
 
@@ -36,6 +38,43 @@ func TestMapRepositoryGauge(t *testing.T) {
 	assert.Equal(t, false, ok)
 }
 
+// TestAddGauge проверяем приращения gauge, в том числе параллельные приращения одного ряда
+func TestAddGauge(t *testing.T) {
+	t.Parallel()
+
+	repos := map[string]Repository{
+		"map":     NewRepository(&genconfig.GeneralConfig{}),
+		"sharded": NewShardedRepository(&genconfig.GeneralConfig{}, 4),
+	}
+	for name, repo := range repos {
+		repo := repo
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			// отсутствующий ряд считается нулевым
+			repo.AddGauge("queue", Labels{"host": "web01"}, 5)
+			repo.AddGauge("queue", Labels{"host": "web01"}, -2)
+			metric, ok := repo.Metric("queue", Gauge, Labels{"host": "web01"})
+			assert.True(t, ok)
+			assert.Equal(t, 3.0, *metric.Value)
+
+			repo.UpdateGauge("inflight", 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					repo.AddGauge("inflight", nil, 1)
+				}()
+			}
+			wg.Wait()
+			val, ok := repo.Gauge("inflight")
+			assert.True(t, ok)
+			assert.Equal(t, 60.0, val)
+		})
+	}
+}
+
 // TestMapRepository Тестируем вставку и чтение в MapRepository для counter
 func TestMapRepositoryCounter(t *testing.T) {
 	t.Parallel()
@@ -80,7 +119,7 @@ func TestMapRepositoryMetricsCounter(t *testing.T) {
 	assert.NoError(t, err)
 
 	// чтение
-	val, ok := repo.Metric("testCounterMetric", Counter)
+	val, ok := repo.Metric("testCounterMetric", Counter, nil)
 	assert.Equal(t, updateValue, *val.Delta)
 	assert.Equal(t, true, ok)
 
@@ -93,12 +132,12 @@ func TestMapRepositoryMetricsCounter(t *testing.T) {
 	assert.NoError(t, err)
 
 	// чтение
-	val, ok = repo.Metric("testCounterMetric", Counter)
+	val, ok = repo.Metric("testCounterMetric", Counter, nil)
 	assert.Equal(t, updateValue*2, *val.Delta)
 	assert.Equal(t, true, ok)
 
 	// Проверка чтения неизвестного значения
-	_, ok = repo.Metric("unknownMetricCoutner", Counter)
+	_, ok = repo.Metric("unknownMetricCoutner", Counter, nil)
 	assert.Equal(t, ok, false)
 }
 
@@ -113,24 +152,10 @@ func TestMapRepositoryStringer(t *testing.T) {
 
 	repo.UpdateCounter("testCounter", 100)
 
-	correctHTML := `
-	<html>
-	<body>
-	<h1>All metrics</h1>
-	<h3>gauges</h3>
-	<ul>
-	  <li>testGauge : 100.000</li>
-
-	</ul>
-	<h3>counters</h3>
-	<ul>
-	  <li>testCounter : 100</li>
-
-	</ul>
-	</body>
-	</html>`
-
-	assert.Equal(t, correctHTML, RenderHTML(repo.ToMetrics()))
+	var page bytes.Buffer
+	assert.NoError(t, RenderDashboard(&page, repo, DashboardOptions{}))
+	assert.Contains(t, page.String(), `<td>testGauge</td><td class="labels"></td><td>gauge</td><td class="value" data-value="100">100.000</td>`)
+	assert.Contains(t, page.String(), `<td>testCounter</td><td class="labels"></td><td>counter</td><td class="value" data-value="100">100</td>`)
 
 }
 
@@ -152,7 +177,7 @@ func TestMapRepositoryMetricsGauge(t *testing.T) {
 	assert.NoError(t, err)
 
 	// чтение
-	val, ok := repo.Metric("testGaugeMetric", Gauge)
+	val, ok := repo.Metric("testGaugeMetric", Gauge, nil)
 	assert.Equal(t, updateValue, *val.Value)
 	assert.Equal(t, true, ok)
 
@@ -175,22 +200,22 @@ func TestMapRepositoryMetricsGauge(t *testing.T) {
 	assert.Error(t, err)
 
 	// проверяем что старое значение перезаписалось
-	val, ok = repo.Metric("testGaugeMetric", Gauge)
+	val, ok = repo.Metric("testGaugeMetric", Gauge, nil)
 	assert.Equal(t, updateValue, *val.Value)
 	assert.Equal(t, true, ok)
 
 	// Проверка чтения неизвестной метрики тика Gauge
-	val, ok = repo.Metric("unknownMetricGauge", Gauge)
+	val, ok = repo.Metric("unknownMetricGauge", Gauge, nil)
 	assert.Equal(t, false, ok)
 	assert.Equal(t, val, Metrics{})
 
 	// Проверка чтения неизвестной метрики тика Counter
-	val, ok = repo.Metric("unknownMetricCounter", Counter)
+	val, ok = repo.Metric("unknownMetricCounter", Counter, nil)
 	assert.Equal(t, false, ok)
 	assert.Equal(t, val, Metrics{})
 
 	// Проверка чтения неизвестной метрики тика Counter
-	val, ok = repo.Metric("unknownMetric", "unknownType")
+	val, ok = repo.Metric("unknownMetric", "unknownType", nil)
 	assert.Equal(t, false, ok)
 	assert.Equal(t, val, Metrics{})
 }
@@ -250,3 +275,88 @@ func TestUnmarshalJSON(t *testing.T) {
 	err = json.Unmarshal(brokenData, &brokenRepo)
 	assert.Error(t, err)
 }
+
+// TestMapRepositoryLabels проверяем что ряды с одинаковым именем и разными метками хранятся раздельно
+func TestMapRepositoryLabels(t *testing.T) {
+	t.Parallel()
+
+	repo := NewRepository(&genconfig.GeneralConfig{})
+
+	first := 10.0
+	second := 20.0
+	err := repo.UpdateMetric(Metrics{
+		ID:     "CPUutilization0",
+		Labels: Labels{"host": "agent1"},
+		MType:  Gauge,
+		Value:  &first,
+	})
+	assert.NoError(t, err)
+	err = repo.UpdateMetric(Metrics{
+		ID:     "CPUutilization0",
+		Labels: Labels{"host": "agent2"},
+		MType:  Gauge,
+		Value:  &second,
+	})
+	assert.NoError(t, err)
+
+	val, ok := repo.Metric("CPUutilization0", Gauge, Labels{"host": "agent1"})
+	assert.True(t, ok)
+	assert.Equal(t, first, *val.Value)
+	assert.Equal(t, Labels{"host": "agent1"}, val.Labels)
+
+	val, ok = repo.Metric("CPUutilization0", Gauge, Labels{"host": "agent2"})
+	assert.True(t, ok)
+	assert.Equal(t, second, *val.Value)
+
+	// Ряд без меток это отдельный ряд
+	_, ok = repo.Gauge("CPUutilization0")
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, len(repo.ToMetrics()))
+}
+
+// TestRepositoryDeleteAndReset проверяем удаление рядов и обнуление counter для обеих реализаций
+func TestRepositoryDeleteAndReset(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		repo Repository
+	}{
+		{name: "map", repo: NewRepository(&genconfig.GeneralConfig{})},
+		{name: "sharded", repo: NewRepository(&genconfig.GeneralConfig{RepositoryShards: 4})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.repo
+			value := 1.5
+			repo.UpdateGauge("testGauge", 100)
+			repo.UpdateCounter("testCounter", 120)
+			assert.NoError(t, repo.UpdateMetric(Metrics{ID: "testGauge", Labels: Labels{"host": "a"}, MType: Gauge, Value: &value}))
+
+			// Удаляется только ряд с указанными метками
+			assert.True(t, repo.Delete("testGauge", Gauge, Labels{"host": "a"}))
+			assert.False(t, repo.Delete("testGauge", Gauge, Labels{"host": "a"}))
+			_, ok := repo.Gauge("testGauge")
+			assert.True(t, ok)
+
+			// Тип учитывается при удалении
+			assert.False(t, repo.Delete("testGauge", Counter, nil))
+			assert.False(t, repo.Delete("testGauge", "summary", nil))
+
+			assert.True(t, repo.ResetCounter("testCounter", nil))
+			delta, ok := repo.Counter("testCounter")
+			assert.True(t, ok)
+			assert.Equal(t, int64(0), delta)
+			repo.UpdateCounter("testCounter", 5)
+			delta, _ = repo.Counter("testCounter")
+			assert.Equal(t, int64(5), delta)
+			assert.False(t, repo.ResetCounter("unknownCounter", nil))
+
+			assert.True(t, repo.Delete("testCounter", Counter, nil))
+			_, ok = repo.Counter("testCounter")
+			assert.False(t, ok)
+			assert.Equal(t, 1, len(repo.ToMetrics()))
+		})
+	}
+}
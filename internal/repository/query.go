@@ -0,0 +1,208 @@
+// Package repository содержит выборку метрик с фильтрацией, сортировкой и постраничным выводом
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultQueryLimit размер страницы по умолчанию
+	DefaultQueryLimit = 100
+	// MaxQueryLimit максимальный размер страницы
+	MaxQueryLimit = 1000
+
+	// SortByName сортировка по имени, затем по типу и меткам
+	SortByName = "name"
+	// SortByType сортировка по типу, затем по имени и меткам
+	SortByType = "type"
+)
+
+var (
+	// ErrInvalidQuery некорректные параметры выборки
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrInvalidCursor курсор не разобран или получен для другой сортировки
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Query параметры выборки метрик. Пустые значения фильтров ничего не ограничивают
+type Query struct {
+	// Types допустимые типы метрик
+	Types []string
+	// Prefix начало имени метрики
+	Prefix string
+	// Glob шаблон имени в синтаксисе path.Match, например cpu_*
+	Glob string
+	// Regex регулярное выражение для имени
+	Regex string
+	// Sort поле сортировки name или type, с префиксом "-" по убыванию. По умолчанию name
+	Sort string
+	// Limit размер страницы, 0 - DefaultQueryLimit
+	Limit int
+	// Cursor курсор следующей страницы из предыдущего ответа
+	Cursor string
+}
+
+// QueryResult страница выборки. NextCursor пустой, если это последняя страница
+type QueryResult struct {
+	Metrics    []Metrics `json:"metrics"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// queryCursor содержимое курсора: ключ сортировки последней метрики страницы.
+// Следующая страница начинается после этого ключа, поэтому добавление и удаление метрик между запросами
+// не приводит к пропускам и повторам
+type queryCursor struct {
+	Sort string   `json:"s"`
+	Key  []string `json:"k"`
+}
+
+// QueryMetrics выборка из metrics по параметрам query
+func QueryMetrics(metrics []Metrics, query Query) (QueryResult, error) {
+	sortField, desc := strings.TrimPrefix(query.Sort, "-"), strings.HasPrefix(query.Sort, "-")
+	if sortField == "" {
+		sortField = SortByName
+	}
+	if sortField != SortByName && sortField != SortByType {
+		return QueryResult{}, fmt.Errorf("%w: unknown sort field %s", ErrInvalidQuery, query.Sort)
+	}
+	// в курсоре сортировка хранится в нормализованном виде, чтобы "" и "name" считались одной сортировкой
+	cursorSort := sortField
+	if desc {
+		cursorSort = "-" + sortField
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit < 0 || limit > MaxQueryLimit {
+		return QueryResult{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, MaxQueryLimit)
+	}
+
+	match, err := queryMatcher(query)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	var after []string
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil || cursor.Sort != cursorSort {
+			return QueryResult{}, ErrInvalidCursor
+		}
+		after = cursor.Key
+	}
+
+	type keyedMetric struct {
+		key    []string
+		metric Metrics
+	}
+	selected := make([]keyedMetric, 0)
+	for _, metric := range metrics {
+		if !match(metric) {
+			continue
+		}
+		key := querySortKey(metric, sortField)
+		if after != nil {
+			cmp := compareKeys(key, after)
+			if !desc && cmp <= 0 || desc && cmp >= 0 {
+				continue
+			}
+		}
+		selected = append(selected, keyedMetric{key: key, metric: metric})
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if desc {
+			return compareKeys(selected[i].key, selected[j].key) > 0
+		}
+		return compareKeys(selected[i].key, selected[j].key) < 0
+	})
+
+	result := QueryResult{Metrics: make([]Metrics, 0, limit)}
+	for i := 0; i < len(selected) && i < limit; i++ {
+		result.Metrics = append(result.Metrics, selected[i].metric)
+	}
+	if len(selected) > limit {
+		result.NextCursor = encodeCursor(queryCursor{Sort: cursorSort, Key: selected[limit-1].key})
+	}
+	return result, nil
+}
+
+// queryMatcher функция проверки метрики по фильтрам запроса
+func queryMatcher(query Query) (func(Metrics) bool, error) {
+	types := make(map[string]bool, len(query.Types))
+	for _, mType := range query.Types {
+		if mType != Gauge && mType != Counter && mType != Histogram {
+			return nil, fmt.Errorf("%w: unknown metric type %s", ErrInvalidQuery, mType)
+		}
+		types[mType] = true
+	}
+	if query.Glob != "" {
+		if _, err := path.Match(query.Glob, ""); err != nil {
+			return nil, fmt.Errorf("%w: glob %s", ErrInvalidQuery, err.Error())
+		}
+	}
+	var re *regexp.Regexp
+	if query.Regex != "" {
+		var err error
+		re, err = regexp.Compile(query.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: regex %s", ErrInvalidQuery, err.Error())
+		}
+	}
+
+	return func(metric Metrics) bool {
+		if len(types) > 0 && !types[metric.MType] {
+			return false
+		}
+		if !strings.HasPrefix(metric.ID, query.Prefix) {
+			return false
+		}
+		if query.Glob != "" {
+			if ok, _ := path.Match(query.Glob, metric.ID); !ok {
+				return false
+			}
+		}
+		return re == nil || re.MatchString(metric.ID)
+	}, nil
+}
+
+// querySortKey ключ сортировки метрики
+func querySortKey(metric Metrics, sortField string) []string {
+	if sortField == SortByType {
+		return []string{metric.MType, metric.ID, metric.Labels.String()}
+	}
+	return []string{metric.ID, metric.MType, metric.Labels.String()}
+}
+
+// compareKeys лексикографическое сравнение ключей сортировки
+func compareKeys(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func encodeCursor(cursor queryCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (queryCursor, error) {
+	var cursor queryCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queryTestMetrics набор метрик для проверки выборки
+func queryTestMetrics() []Metrics {
+	value := 1.0
+	delta := int64(1)
+	return []Metrics{
+		{ID: "cpu_user", MType: Gauge, Value: &value},
+		{ID: "cpu_system", MType: Gauge, Value: &value},
+		{ID: "cpu_user", Labels: Labels{"host": "b"}, MType: Gauge, Value: &value},
+		{ID: "requests", MType: Counter, Delta: &delta},
+		{ID: "mem_free", MType: Gauge, Value: &value},
+		{ID: "cpu_user", MType: Counter, Delta: &delta},
+	}
+}
+
+// seriesKeys ключи рядов результата для удобного сравнения
+func seriesKeys(metrics []Metrics) []string {
+	keys := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		keys = append(keys, metric.MType+":"+metric.SeriesKey())
+	}
+	return keys
+}
+
+func TestQueryMetrics(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{
+			name:  "all sorted by name",
+			query: Query{},
+			want: []string{"gauge:cpu_system", "counter:cpu_user", "gauge:cpu_user", `gauge:cpu_user{host="b"}`,
+				"gauge:mem_free", "counter:requests"},
+		},
+		{
+			name:  "filter by type and prefix",
+			query: Query{Types: []string{Gauge}, Prefix: "cpu_"},
+			want:  []string{"gauge:cpu_system", "gauge:cpu_user", `gauge:cpu_user{host="b"}`},
+		},
+		{
+			name:  "glob",
+			query: Query{Glob: "*_free"},
+			want:  []string{"gauge:mem_free"},
+		},
+		{
+			name:  "regex and descending sort",
+			query: Query{Regex: "^(mem|req)", Sort: "-name"},
+			want:  []string{"counter:requests", "gauge:mem_free"},
+		},
+		{
+			name:  "sort by type",
+			query: Query{Sort: "type", Prefix: "cpu_user"},
+			want:  []string{"counter:cpu_user", "gauge:cpu_user", `gauge:cpu_user{host="b"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := QueryMetrics(queryTestMetrics(), tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, seriesKeys(result.Metrics))
+			assert.Equal(t, "", result.NextCursor)
+		})
+	}
+}
+
+func TestQueryMetricsPagination(t *testing.T) {
+	metrics := queryTestMetrics()
+
+	result, err := QueryMetrics(metrics, Query{Limit: 4, Sort: "-name"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"counter:requests", "gauge:mem_free", `gauge:cpu_user{host="b"}`, "gauge:cpu_user"},
+		seriesKeys(result.Metrics))
+	require.NotEqual(t, "", result.NextCursor)
+
+	// между запросами появилась метрика до курсора - на следующей странице ее нет, повторов тоже нет
+	value := 2.0
+	metrics = append(metrics, Metrics{ID: "disk", MType: Gauge, Value: &value})
+	result, err = QueryMetrics(metrics, Query{Limit: 4, Sort: "-name", Cursor: result.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"counter:cpu_user", "gauge:cpu_system"}, seriesKeys(result.Metrics))
+	assert.Equal(t, "", result.NextCursor)
+}
+
+func TestQueryMetricsErrors(t *testing.T) {
+	first, err := QueryMetrics(queryTestMetrics(), Query{Limit: 1})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		query   Query
+		wantErr error
+	}{
+		{"unknown type", Query{Types: []string{"summary"}}, ErrInvalidQuery},
+		{"unknown sort", Query{Sort: "value"}, ErrInvalidQuery},
+		{"limit too big", Query{Limit: MaxQueryLimit + 1}, ErrInvalidQuery},
+		{"bad regex", Query{Regex: "("}, ErrInvalidQuery},
+		{"bad glob", Query{Glob: "["}, ErrInvalidQuery},
+		{"broken cursor", Query{Cursor: "!!!"}, ErrInvalidCursor},
+		{"cursor from other sort", Query{Sort: "type", Cursor: first.NextCursor}, ErrInvalidCursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := QueryMetrics(queryTestMetrics(), tt.query)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
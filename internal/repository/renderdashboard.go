@@ -0,0 +1,184 @@
+// Package repository содержит html дашборд со списком метрик
+package repository
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultDashboardRefresh период автообновления дашборда по умолчанию
+	DefaultDashboardRefresh = 10 * time.Second
+
+	// sparklinePoints сколько последних точек истории выводится в спарклайне
+	sparklinePoints = 60
+	// sparklineWidth и sparklineHeight размер спарклайна в пикселях
+	sparklineWidth  = 120
+	sparklineHeight = 24
+)
+
+//go:embed templates/dashboard.html
+var dashboardFS embed.FS
+
+// dashboardTemplate шаблон дашборда. html/template экранирует имена и метки, поэтому метрика с именем
+// вида <script> выводится текстом
+var dashboardTemplate = template.Must(template.ParseFS(dashboardFS, "templates/dashboard.html"))
+
+// DashboardOptions параметры вывода дашборда
+type DashboardOptions struct {
+	// Refresh период автообновления страницы, 0 - без автообновления
+	Refresh time.Duration
+}
+
+// dashboardPage данные шаблона дашборда
+type dashboardPage struct {
+	Groups          []dashboardGroup
+	Total           int
+	Refresh         int
+	SparklineWidth  int
+	SparklineHeight int
+}
+
+// dashboardGroup таблица метрик с общим префиксом имени
+type dashboardGroup struct {
+	Prefix string
+	Rows   []dashboardRow
+}
+
+// dashboardRow строка таблицы - один ряд метрики
+type dashboardRow struct {
+	Name   string
+	Labels string
+	Type   string
+	Value  string
+	// SortValue числовое значение для сортировки по колонке value, для histogram - число наблюдений
+	SortValue string
+	// Sparkline точки svg polyline по истории ряда, пусто если истории нет
+	Sparkline string
+}
+
+// RenderDashboard выводит в w html дашборд с метриками repo. Метрики сгруппированы по префиксу имени
+// и отсортированы, для рядов с историей выводится спарклайн. Поиск и сортировка по колонкам работают в браузере
+func RenderDashboard(w io.Writer, repo Repository, options DashboardOptions) error {
+	metrics := repo.ToMetrics()
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].Labels.String() < metrics[j].Labels.String()
+	})
+
+	page := dashboardPage{
+		Total:           len(metrics),
+		Refresh:         int(options.Refresh / time.Second),
+		SparklineWidth:  sparklineWidth,
+		SparklineHeight: sparklineHeight,
+	}
+	groups := make(map[string]*dashboardGroup)
+	for _, metric := range metrics {
+		prefix := metricPrefix(metric.ID)
+		group, ok := groups[prefix]
+		if !ok {
+			group = &dashboardGroup{Prefix: prefix}
+			groups[prefix] = group
+		}
+		group.Rows = append(group.Rows, dashboardMetricRow(repo, metric))
+	}
+	for _, group := range groups {
+		page.Groups = append(page.Groups, *group)
+	}
+	// метрики без префикса выводятся последней группой
+	sort.Slice(page.Groups, func(i, j int) bool {
+		if page.Groups[i].Prefix == "" || page.Groups[j].Prefix == "" {
+			return page.Groups[j].Prefix == ""
+		}
+		return page.Groups[i].Prefix < page.Groups[j].Prefix
+	})
+
+	return dashboardTemplate.Execute(w, page)
+}
+
+// metricPrefix префикс имени до первого разделителя _ . или :, пусто если разделителя нет
+func metricPrefix(name string) string {
+	index := strings.IndexAny(name, "_.:")
+	if index <= 0 {
+		return ""
+	}
+	return name[:index]
+}
+
+// dashboardMetricRow строка дашборда для метрики
+func dashboardMetricRow(repo Repository, metric Metrics) dashboardRow {
+	row := dashboardRow{
+		Name:   metric.ID,
+		Labels: metric.Labels.String(),
+		Type:   metric.MType,
+	}
+	switch metric.MType {
+	case Gauge:
+		row.Value = fmt.Sprintf("%.3f", *metric.Value)
+		row.SortValue = strconv.FormatFloat(*metric.Value, 'g', -1, 64)
+	case Counter:
+		row.Value = strconv.FormatInt(*metric.Delta, 10)
+		row.SortValue = row.Value
+	case Histogram:
+		row.Value = fmt.Sprintf("count=%d sum=%.3f buckets=[%s]", *metric.Count, *metric.Sum, bucketsString(metric.Buckets))
+		row.SortValue = strconv.FormatUint(*metric.Count, 10)
+		return row
+	}
+
+	samples, ok := repo.History(metric.ID, metric.MType, metric.Labels, time.Time{}, time.Time{})
+	if ok {
+		row.Sparkline = sparkline(samples)
+	}
+	return row
+}
+
+// sparkline точки svg polyline для последних sparklinePoints точек истории, пусто если точек меньше двух
+func sparkline(samples []Sample) string {
+	if len(samples) > sparklinePoints {
+		samples = samples[len(samples)-sparklinePoints:]
+	}
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		switch {
+		case sample.Value != nil:
+			values = append(values, *sample.Value)
+		case sample.Delta != nil:
+			values = append(values, float64(*sample.Delta))
+		}
+	}
+	if len(values) < 2 {
+		return ""
+	}
+	minValue, maxValue := values[0], values[0]
+	for _, value := range values {
+		if value < minValue {
+			minValue = value
+		}
+		if value > maxValue {
+			maxValue = value
+		}
+	}
+
+	points := make([]string, 0, len(values))
+	for i, value := range values {
+		x := float64(i) * sparklineWidth / float64(len(values)-1)
+		// постоянный ряд рисуется линией посередине
+		y := float64(sparklineHeight) / 2
+		if maxValue > minValue {
+			y = sparklineHeight - (value-minValue)/(maxValue-minValue)*sparklineHeight
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(points, " ")
+}
@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// renderDashboard вспомогательная функция вывода дашборда в строку
+func renderDashboard(t *testing.T, repo Repository, options DashboardOptions) string {
+	var page bytes.Buffer
+	require.NoError(t, RenderDashboard(&page, repo, options))
+	return page.String()
+}
+
+// TestRenderDashboard проверяем группировку по префиксу, сортировку и вывод всех типов метрик
+func TestRenderDashboard(t *testing.T) {
+	repo := NewRepository(&genconfig.GeneralConfig{})
+	repo.UpdateGauge("mem_free", 10)
+	repo.UpdateGauge("cpu_user", 1.5)
+	repo.UpdateCounter("PollCount", 5)
+	repo.UpdateGauge("cpu_system", 2.5)
+	require.NoError(t, repo.UpdateMetric(newHistogram("latency", 3, 0.6, Bucket{0.1, 1}, Bucket{0.5, 2})))
+
+	page := renderDashboard(t, repo, DashboardOptions{Refresh: 5 * time.Second})
+
+	// группы по префиксу в алфавитном порядке, метрики без префикса последними
+	cpu := strings.Index(page, "<h3>cpu</h3>")
+	mem := strings.Index(page, "<h3>mem</h3>")
+	other := strings.Index(page, "<h3>other</h3>")
+	assert.True(t, cpu >= 0 && cpu < mem && mem < other)
+
+	// внутри группы метрики отсортированы по имени
+	assert.True(t, strings.Index(page, "<td>cpu_system</td>") < strings.Index(page, "<td>cpu_user</td>"))
+	assert.True(t, strings.Index(page, "<td>PollCount</td>") < strings.Index(page, "<td>latency</td>"))
+
+	assert.Contains(t, page, `<td class="value" data-value="1.5">1.500</td>`)
+	assert.Contains(t, page, `<td class="value" data-value="5">5</td>`)
+	assert.Contains(t, page, `<td class="value" data-value="3">count=3 sum=0.600 buckets=[le=0.1:1,le=0.5:2]</td>`)
+	assert.Contains(t, page, "<span>5 series</span>")
+	assert.Contains(t, page, "var refresh =  5 ;")
+
+	// без истории спарклайнов нет
+	assert.NotContains(t, page, "<polyline")
+}
+
+// TestRenderDashboardEscaping проверяем что имена и метки метрик экранируются
+func TestRenderDashboardEscaping(t *testing.T) {
+	repo := NewRepository(&genconfig.GeneralConfig{})
+	value := 1.0
+	require.NoError(t, repo.UpdateMetric(Metrics{
+		ID:     "<script>alert(1)</script>",
+		Labels: Labels{"host": `"><img src=x>`},
+		MType:  Gauge,
+		Value:  &value,
+	}))
+
+	page := renderDashboard(t, repo, DashboardOptions{})
+	assert.NotContains(t, page, "<script>alert(1)</script>")
+	assert.NotContains(t, page, "<img src=x>")
+	assert.Contains(t, page, "<td>&lt;script&gt;alert(1)&lt;/script&gt;</td>")
+	assert.Contains(t, page, "var refresh =  0 ;")
+}
+
+// TestRenderDashboardSparkline проверяем спарклайны по истории и пустой дашборд
+func TestRenderDashboardSparkline(t *testing.T) {
+	repo := NewRepository(&genconfig.GeneralConfig{HistoryRetention: genconfig.Duration{Duration: time.Hour}})
+	assert.Contains(t, renderDashboard(t, repo, DashboardOptions{}), "<p>no metrics</p>")
+
+	for _, value := range []float64{1, 3, 2} {
+		repo.UpdateGauge("testGauge", value)
+	}
+	repo.UpdateGauge("singleGauge", 1)
+
+	page := renderDashboard(t, repo, DashboardOptions{})
+	assert.Contains(t, page, `<polyline points="0.0,24.0 60.0,0.0 120.0,12.0"/>`)
+	// по одной точке линию не построить
+	assert.Equal(t, 1, strings.Count(page, "<polyline"))
+}
+
+func TestSparkline(t *testing.T) {
+	value := 5.0
+	delta := int64(1)
+	tests := []struct {
+		name    string
+		samples []Sample
+		want    string
+	}{
+		{name: "empty", samples: nil, want: ""},
+		{name: "constant", samples: []Sample{{Value: &value}, {Value: &value}}, want: "0.0,12.0 120.0,12.0"},
+		{name: "counter", samples: []Sample{{Delta: &delta}, {Value: &value}}, want: "0.0,24.0 120.0,0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sparkline(tt.samples))
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Package repository содержит функционал по выводу метрик в текстовом формате Prometheus и OpenMetrics
+package repository
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// PrometheusContentType Content-Type текстового формата Prometheus
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// OpenMetricsContentType Content-Type формата OpenMetrics
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// promFamily семейство метрик Prometheus - ряды одного имени и типа, выводятся под одной строкой # TYPE.
+// id - исходное имя метрики, занявшей семейство
+type promFamily struct {
+	name   string
+	id     string
+	mType  string
+	series []Metrics
+}
+
+// RenderPrometheus вывод метрик в текстовом формате Prometheus, либо OpenMetrics если openMetrics == true.
+// Имена метрик и меток приводятся к допустимым в Prometheus. Если после этого ряд попадает в семейство
+// другого типа или другой метрики (a.b и a_b), ряд пропускается с записью в лог: у семейства может быть только
+// один тип, а ряды разных метрик с одинаковыми метками дали бы повторяющиеся ряды. Чтобы результат не зависел
+// от порядка metrics, семейство занимает метрика с меньшим исходным именем
+func RenderPrometheus(metrics []Metrics, openMetrics bool) string {
+	sorted := make([]Metrics, len(metrics))
+	copy(sorted, metrics)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].ID != sorted[j].ID {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].MType < sorted[j].MType
+	})
+
+	families := make(map[string]*promFamily)
+	for _, metric := range sorted {
+		name := promFamilyName(metric, openMetrics)
+		family, ok := families[name]
+		if !ok {
+			family = &promFamily{name: name, id: metric.ID, mType: metric.MType}
+			families[name] = family
+		}
+		if family.mType != metric.MType || family.id != metric.ID {
+			log.Info().Msgf("prometheus: ряд %s %s пропущен - имя %s уже занято метрикой %s %s",
+				metric.MType, metric.SeriesKey(), name, family.mType, family.id)
+			continue
+		}
+		family.series = append(family.series, metric)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		family := families[name]
+		sort.Slice(family.series, func(i, j int) bool {
+			return formatPromLabels(family.series[i].Labels, "") < formatPromLabels(family.series[j].Labels, "")
+		})
+
+		sb.WriteString("# TYPE " + family.name + " " + family.mType + "\n")
+		for _, metric := range family.series {
+			switch metric.MType {
+			case Gauge:
+				writePromSample(&sb, family.name, formatPromLabels(metric.Labels, ""), formatPromFloat(*metric.Value))
+			case Counter:
+				sampleName := family.name
+				if openMetrics {
+					sampleName += "_total"
+				}
+				writePromSample(&sb, sampleName, formatPromLabels(metric.Labels, ""), strconv.FormatInt(*metric.Delta, 10))
+			case Histogram:
+				for _, bucket := range metric.Buckets {
+					if math.IsInf(bucket.UpperBound, 1) {
+						continue
+					}
+					writePromSample(&sb, family.name+"_bucket",
+						formatPromLabels(metric.Labels, formatPromFloat(bucket.UpperBound)), strconv.FormatUint(bucket.Count, 10))
+				}
+				writePromSample(&sb, family.name+"_bucket", formatPromLabels(metric.Labels, "+Inf"), strconv.FormatUint(*metric.Count, 10))
+				writePromSample(&sb, family.name+"_sum", formatPromLabels(metric.Labels, ""), formatPromFloat(*metric.Sum))
+				writePromSample(&sb, family.name+"_count", formatPromLabels(metric.Labels, ""), strconv.FormatUint(*metric.Count, 10))
+			}
+		}
+	}
+	if openMetrics {
+		sb.WriteString("# EOF\n")
+	}
+	return sb.String()
+}
+
+// promFamilyName имя семейства для метрики. В OpenMetrics у counter суффикс _total есть только у значения,
+// поэтому из имени семейства он убирается
+func promFamilyName(metric Metrics, openMetrics bool) string {
+	name := SanitizePromName(metric.ID)
+	if openMetrics && metric.MType == Counter && name != "_total" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// writePromSample вывод одной строки значения
+func writePromSample(sb *strings.Builder, name, labels, value string) {
+	sb.WriteString(name)
+	sb.WriteString(labels)
+	sb.WriteString(" ")
+	sb.WriteString(value)
+	sb.WriteString("\n")
+}
+
+// formatPromLabels вывод меток в виде {k="v",...} с сортировкой по имени. Если le не пусто,
+// последней добавляется метка корзины гистограммы
+func formatPromLabels(labels Labels, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	sanitized := make(map[string]string, len(labels))
+	for key, value := range labels {
+		name := sanitizePromLabelName(key)
+		if name == "le" && le != "" {
+			continue
+		}
+		if _, ok := sanitized[name]; !ok {
+			keys = append(keys, name)
+		}
+		sanitized[name] = value
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys)+1)
+	for _, key := range keys {
+		pairs = append(pairs, key+`="`+escapePromLabelValue(sanitized[key])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// SanitizePromName приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*, недопустимые символы заменяются на _
+func SanitizePromName(name string) string {
+	return sanitizePromIdentifier(name, true)
+}
+
+// sanitizePromLabelName приводит имя метки к виду [a-zA-Z_][a-zA-Z0-9_]*
+func sanitizePromLabelName(name string) string {
+	return sanitizePromIdentifier(name, false)
+}
+
+// sanitizePromIdentifier замена недопустимых символов на _, имя начинающееся с цифры дополняется _ в начале
+func sanitizePromIdentifier(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColon:
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// escapePromLabelValue экранирование значения метки: обратный слеш, кавычка и перевод строки
+func escapePromLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatPromFloat вывод числа с плавающей точкой, включая специальные значения +Inf, -Inf и NaN
+func formatPromFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
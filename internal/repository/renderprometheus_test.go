@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderPrometheus(t *testing.T) {
+	counter := int64(100)
+	gauge := 110.5
+	labeledGauge := math.Inf(1)
+	count := uint64(10)
+	sum := 2.5
+	metrics := []Metrics{
+		{ID: "requests_total", MType: Counter, Delta: &counter},
+		{ID: "cpu.usage", Labels: Labels{"host-name": `agent "1"`}, MType: Gauge, Value: &labeledGauge},
+		{ID: "cpu.usage", MType: Gauge, Value: &gauge},
+		// после приведения имени попадает в семейство gauge и пропускается
+		{ID: "cpu_usage", MType: Counter, Delta: &counter},
+		// тот же тип, но другая метрика - иначе ряд без меток повторился бы в семействе
+		{ID: "cpu_usage", MType: Gauge, Value: &labeledGauge},
+		// в OpenMetrics requests_total попадает в семейство requests и пропускается
+		{ID: "requests", MType: Counter, Delta: &counter},
+		{ID: "latency", MType: Histogram, Count: &count, Sum: &sum,
+			Buckets: []Bucket{{UpperBound: 0.1, Count: 4}, {UpperBound: 1, Count: 9}}},
+		{ID: "1xx", MType: Gauge, Value: &gauge},
+	}
+
+	tests := []struct {
+		name        string
+		openMetrics bool
+		want        string
+	}{
+		{
+			"prometheus text format",
+			false,
+			`# TYPE _1xx gauge
+_1xx 110.5
+# TYPE cpu_usage gauge
+cpu_usage 110.5
+cpu_usage{host_name="agent \"1\""} +Inf
+# TYPE latency histogram
+latency_bucket{le="0.1"} 4
+latency_bucket{le="1"} 9
+latency_bucket{le="+Inf"} 10
+latency_sum 2.5
+latency_count 10
+# TYPE requests counter
+requests 100
+# TYPE requests_total counter
+requests_total 100
+`,
+		},
+		{
+			"openmetrics format",
+			true,
+			`# TYPE _1xx gauge
+_1xx 110.5
+# TYPE cpu_usage gauge
+cpu_usage 110.5
+cpu_usage{host_name="agent \"1\""} +Inf
+# TYPE latency histogram
+latency_bucket{le="0.1"} 4
+latency_bucket{le="1"} 9
+latency_bucket{le="+Inf"} 10
+latency_sum 2.5
+latency_count 10
+# TYPE requests counter
+requests_total 100
+# EOF
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, RenderPrometheus(metrics, tt.openMetrics))
+		})
+	}
+}
+
+func TestSanitizePromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"testGauge", "testGauge"},
+		{"http:requests_total", "http:requests_total"},
+		{"cpu.usage-percent", "cpu_usage_percent"},
+		{"9lives", "_9lives"},
+		{"метрика", "_______"},
+		{"", "_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, SanitizePromName(tt.name))
+		})
+	}
+}
@@ -2,62 +2,181 @@
 package repository
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/ncyellow/devops/internal/hash"
 )
 
 const (
-	Gauge   = "gauge"
-	Counter = "counter"
+	Gauge     = "gauge"
+	Counter   = "counter"
+	Histogram = "histogram"
 )
 
+// ErrInvalidMetric ошибка при пустом имени, неизвестном типе или отсутствии значения метрики
+var ErrInvalidMetric = errors.New("invalid metric")
+
+// Labels набор меток (измерений) метрики. Ряд метрики определяется именем и набором меток
+type Labels map[string]string
+
+// String каноническое представление меток, отсортированное по ключу: host="a",region="b"
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for key := range l {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", key, l[key]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Copy возвращает копию набора меток, чтобы репозиторий не зависел от map вызывающей стороны
+func (l Labels) Copy() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+	result := make(Labels, len(l))
+	for key, value := range l {
+		result[key] = value
+	}
+	return result
+}
+
+// SeriesKey уникальный ключ ряда метрики: имя без меток либо name{k="v",...}
+func SeriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s{%s}", name, labels)
+}
+
 // Metrics тип метрики для взаимодействия по сети и хранения на диске
 type Metrics struct {
 	// Имя метрики
 	ID string `json:"id"`
-	// Параметр, принимающий значение gauge или counter
+	// Набор меток метрики, вместе с именем определяет ряд
+	Labels Labels `json:"labels,omitempty"`
+	// Параметр, принимающий значение gauge, counter или histogram
 	MType string `json:"type"`
 	// Значение метрики в случае передачи counter
 	Delta *int64 `json:"delta,omitempty"`
 	// Значение метрики в случае передачи gauge
 	Value *float64 `json:"value,omitempty"`
+	// Корзины метрики в случае передачи histogram
+	Buckets []Bucket `json:"buckets,omitempty"`
+	// Число наблюдений в случае передачи histogram
+	Count *uint64 `json:"count,omitempty"`
+	// Сумма наблюдений в случае передачи histogram
+	Sum *float64 `json:"sum,omitempty"`
 	// Значение хеш-функции
 	Hash string `json:"hash,omitempty"`
+	// Ряд удален. Используется только в потоке изменений подписки, значения при этом не заполняются
+	Deleted bool `json:"deleted,omitempty"`
 }
 
-// CalcHash вычисление хеша с подписью метрики
+// SeriesKey уникальный ключ ряда метрики с учетом меток
+func (m *Metrics) SeriesKey() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// CalcHash вычисление хеша с подписью метрики.
+// Для метрик без меток формат подписи не меняется, метки подписываются вместе с именем
 func (m *Metrics) CalcHash(encodeFunc hash.EncodeFunc) string {
 	switch m.MType {
 	case Gauge:
-		return encodeFunc(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value))
+		return encodeFunc(fmt.Sprintf("%s:gauge:%f", m.SeriesKey(), *m.Value))
 	case Counter:
-		return encodeFunc(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta))
+		return encodeFunc(fmt.Sprintf("%s:counter:%d", m.SeriesKey(), *m.Delta))
+	case Histogram:
+		if m.Count == nil || m.Sum == nil {
+			return ""
+		}
+		return encodeFunc(fmt.Sprintf("%s:histogram:%d:%f:%s", m.SeriesKey(), *m.Count, *m.Sum, bucketsString(m.Buckets)))
 	default:
 		return ""
 	}
 }
 
+// ValidateMetric проверяет что у метрики задано имя, известный тип и значение, подходящее типу.
+// Ошибки оборачивают ErrInvalidMetric либо ErrInvalidHistogram
+func ValidateMetric(metric Metrics) error {
+	if metric.ID == "" {
+		return fmt.Errorf("%w: id is required", ErrInvalidMetric)
+	}
+	switch metric.MType {
+	case Gauge:
+		if metric.Value == nil {
+			return fmt.Errorf("%w: value is required for gauge", ErrInvalidMetric)
+		}
+	case Counter:
+		if metric.Delta == nil {
+			return fmt.Errorf("%w: delta is required for counter", ErrInvalidMetric)
+		}
+	case Histogram:
+		return validateHistogram(metric)
+	default:
+		return fmt.Errorf("%w: unknown metric type %s", ErrInvalidMetric, metric.MType)
+	}
+	return nil
+}
+
 // Repository содержит API для работы с метриками.
 // Хранение разделено на две сущности. Кеш в RAM - Repository. А PersistentStorage
 // представляет сохранение в долговременное хранилище файл или бд
 type Repository interface {
-	// UpdateGauge обновить значение метрики типа gauge
+	// UpdateGauge обновить значение метрики типа gauge без меток
 	UpdateGauge(name string, value float64)
-	// UpdateCounter обновить значение метрики типа counter
+	// UpdateCounter обновить значение метрики типа counter без меток
 	UpdateCounter(name string, value int64)
+	// AddGauge атомарно прибавляет delta к ряду gauge с метками labels, отсутствующий ряд считается нулевым
+	AddGauge(name string, labels Labels, delta float64)
 
-	// Gauge возвращает текущее значение метрики типа gauge
+	// Gauge возвращает текущее значение метрики типа gauge без меток
 	Gauge(name string) (val float64, ok bool)
-	// Counter возвращает текущее значение метрики типа counter
+	// Counter возвращает текущее значение метрики типа counter без меток
 	Counter(name string) (val int64, ok bool)
 
-	// Metric возвращает значение метрики по названию
-	Metric(name string, mType string) (val Metrics, ok bool)
+	// Metric возвращает значение метрики по названию и набору меток
+	Metric(name string, mType string, labels Labels) (val Metrics, ok bool)
+
+	// History возвращает историю значений ряда в интервале [from, to], нулевые границы не ограничивают интервал
+	History(name string, mType string, labels Labels, from, to time.Time) (samples []Sample, ok bool)
+
+	// Expire удаляет метрики, которые не обновлялись дольше своего TTL на момент now, и возвращает удаленные
+	Expire(now time.Time) []Metrics
+
+	// Delete удаляет ряд метрики по названию, типу и набору меток. Возвращает false если ряда нет
+	Delete(name string, mType string, labels Labels) bool
+
+	// ResetCounter обнуляет значение ряда counter, ряд при этом остается. Возвращает false если ряда нет
+	ResetCounter(name string, labels Labels) bool
+
+	// Subscribe подписка на изменения рядов метрик с именами names, пустой список - все метрики.
+	// Удаление ряда приходит как Metrics с Deleted. Подписку нужно закрыть через Close
+	Subscribe(names []string) *Subscription
 
 	// UpdateMetric обновляет данные в хранилище по значению Metrics
 	UpdateMetric(metrics Metrics) error
 
+	// UpdateMetrics записывает пачку метрик целиком: если хотя бы одну метрику записать нельзя, пачка
+	// не применяется. Возвращает nil, если пачка записана, иначе ошибки по индексам метрик пачки
+	UpdateMetrics(metrics []Metrics) []error
+
+	// SetCumulative записывает накопленное у источника значение counter или histogram: к ряду атомарно
+	// прибавляется приращение относительно прошлого значения источника, сброс у источника ряд не уменьшает
+	SetCumulative(metric Metrics) error
+
 	// FromMetrics загрузить данные в репозиторий из []Metrics
 	FromMetrics(metrics []Metrics)
 
@@ -33,3 +33,48 @@ func BenchmarkMetrics_CalcHash(b *testing.B) {
 		m.CalcHash(ef)
 	}
 }
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, "testGauge", SeriesKey("testGauge", nil))
+	assert.Equal(t, `testGauge{host="web1",region="eu"}`, SeriesKey("testGauge", Labels{"region": "eu", "host": "web1"}))
+
+	// Метки участвуют в подписи, метрика без меток подписывается как раньше
+	value := 1.5
+	metric := Metrics{ID: "testGauge", MType: Gauge, Value: &value}
+	encodeFunc := hash.CreateEncodeFunc("superKey")
+	plain := metric.CalcHash(encodeFunc)
+	assert.Equal(t, encodeFunc("testGauge:gauge:1.500000"), plain)
+
+	metric.Labels = Labels{"host": "web1"}
+	assert.NotEqual(t, plain, metric.CalcHash(encodeFunc))
+}
+
+func TestValidateMetric(t *testing.T) {
+	value := 1.5
+	delta := int64(3)
+	count := uint64(2)
+	tests := []struct {
+		name   string
+		metric Metrics
+		want   error
+	}{
+		{name: "gauge", metric: Metrics{ID: "testGauge", MType: Gauge, Value: &value}},
+		{name: "counter", metric: Metrics{ID: "testCounter", MType: Counter, Delta: &delta}},
+		{name: "histogram", metric: Metrics{ID: "testHistogram", MType: Histogram, Count: &count, Sum: &value}},
+		{name: "empty id", metric: Metrics{MType: Gauge, Value: &value}, want: ErrInvalidMetric},
+		{name: "unknown type", metric: Metrics{ID: "test", MType: "summary"}, want: ErrInvalidMetric},
+		{name: "gauge without value", metric: Metrics{ID: "testGauge", MType: Gauge, Delta: &delta}, want: ErrInvalidMetric},
+		{name: "counter without delta", metric: Metrics{ID: "testCounter", MType: Counter}, want: ErrInvalidMetric},
+		{name: "histogram without sum", metric: Metrics{ID: "testHistogram", MType: Histogram, Count: &count}, want: ErrInvalidHistogram},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMetric(tt.metric)
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+}
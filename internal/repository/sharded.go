@@ -0,0 +1,155 @@
+// Package repository содержит шардированную имплементацию Repository для хранения метрик в памяти
+package repository
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+)
+
+// Параметры 32-битного FNV-1a для распределения метрик по шардам
+const (
+	offset32 = 2166136261
+	prime32  = 16777619
+)
+
+// ShardedRepository репозиторий метрик, разбитый на шарды по хешу имени метрики, реализует интерфейс Repository.
+// Каждый шард - отдельный MapRepository со своими блокировками, поэтому запись метрик с разными именами
+// из разных агентов не упирается в общий мьютекс. Все ряды одного имени (с разными метками) живут в одном шарде
+type ShardedRepository struct {
+	shards   []*MapRepository
+	notifier *changeNotifier
+}
+
+// NewShardedRepository конструктор, shardsCount - число шардов, не меньше одного
+func NewShardedRepository(conf *genconfig.GeneralConfig, shardsCount int) *ShardedRepository {
+	if shardsCount < 1 {
+		shardsCount = 1
+	}
+	repo := ShardedRepository{
+		shards:   make([]*MapRepository, shardsCount),
+		notifier: newChangeNotifier(),
+	}
+	for i := range repo.shards {
+		repo.shards[i] = newMapRepository(conf)
+		// подписки общие на все шарды
+		repo.shards[i].notifier = repo.notifier
+	}
+	return &repo
+}
+
+// shard возвращает шард для метрики с именем name. Хеш FNV-1a считается на месте, без аллокации hash.Hash32
+func (s *ShardedRepository) shard(name string) *MapRepository {
+	return s.shards[s.shardIndex(name)]
+}
+
+// shardIndex номер шарда для метрики с именем name
+func (s *ShardedRepository) shardIndex(name string) int {
+	h := uint32(offset32)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= prime32
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+func (s *ShardedRepository) UpdateGauge(name string, value float64) {
+	s.shard(name).UpdateGauge(name, value)
+}
+
+func (s *ShardedRepository) UpdateCounter(name string, value int64) {
+	s.shard(name).UpdateCounter(name, value)
+}
+
+func (s *ShardedRepository) AddGauge(name string, labels Labels, delta float64) {
+	s.shard(name).AddGauge(name, labels, delta)
+}
+
+func (s *ShardedRepository) Gauge(name string) (val float64, ok bool) {
+	return s.shard(name).Gauge(name)
+}
+
+func (s *ShardedRepository) Counter(name string) (val int64, ok bool) {
+	return s.shard(name).Counter(name)
+}
+
+func (s *ShardedRepository) Metric(name string, mType string, labels Labels) (val Metrics, ok bool) {
+	return s.shard(name).Metric(name, mType, labels)
+}
+
+func (s *ShardedRepository) History(name string, mType string, labels Labels, from, to time.Time) (samples []Sample, ok bool) {
+	return s.shard(name).History(name, mType, labels, from, to)
+}
+
+func (s *ShardedRepository) UpdateMetric(metric Metrics) error {
+	return s.shard(metric.ID).UpdateMetric(metric)
+}
+
+func (s *ShardedRepository) Delete(name string, mType string, labels Labels) bool {
+	return s.shard(name).Delete(name, mType, labels)
+}
+
+func (s *ShardedRepository) ResetCounter(name string, labels Labels) bool {
+	return s.shard(name).ResetCounter(name, labels)
+}
+
+// Subscribe подписка на изменения рядов метрик во всех шардах
+func (s *ShardedRepository) Subscribe(names []string) *Subscription {
+	return s.notifier.subscribe(names)
+}
+
+// Expire удаляет устаревшие ряды во всех шардах и возвращает удаленные
+func (s *ShardedRepository) Expire(now time.Time) []Metrics {
+	expiredMetrics := make([]Metrics, 0)
+	for _, shard := range s.shards {
+		expiredMetrics = append(expiredMetrics, shard.Expire(now)...)
+	}
+	return expiredMetrics
+}
+
+// ToMetrics Конвертация данных всех шардов в []Metrics. Шарды блокируются по очереди,
+// поэтому выгрузка не останавливает запись во все остальные шарды
+func (s *ShardedRepository) ToMetrics() []Metrics {
+	parts := make([][]Metrics, len(s.shards))
+	totalCount := 0
+	for i, shard := range s.shards {
+		parts[i] = shard.ToMetrics()
+		totalCount += len(parts[i])
+	}
+	metrics := make([]Metrics, 0, totalCount)
+	for _, part := range parts {
+		metrics = append(metrics, part...)
+	}
+	return metrics
+}
+
+// FromMetrics - обновляет метрики в шардах по []Metrics
+func (s *ShardedRepository) FromMetrics(metrics []Metrics) {
+	for _, metric := range metrics {
+		s.shard(metric.ID).FromMetrics([]Metrics{metric})
+	}
+}
+
+// Clear - очищаем все шарды
+func (s *ShardedRepository) Clear() {
+	for _, shard := range s.shards {
+		shard.Clear()
+	}
+}
+
+// MarshalJSON - реализация интерфейса Marshaler
+func (s *ShardedRepository) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.ToMetrics())
+}
+
+// UnmarshalJSON - реализация интерфейса Unmarshaler
+func (s *ShardedRepository) UnmarshalJSON(data []byte) error {
+	var metrics []Metrics
+	err := json.Unmarshal(data, &metrics)
+	if err != nil {
+		return err
+	}
+	s.FromMetrics(metrics)
+	return nil
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewRepositorySharded проверяем выбор реализации репозитория по конфигурации
+func TestNewRepositorySharded(t *testing.T) {
+	t.Parallel()
+
+	_, ok := NewRepository(&genconfig.GeneralConfig{}).(*MapRepository)
+	assert.True(t, ok)
+
+	_, ok = NewRepository(&genconfig.GeneralConfig{RepositoryShards: 1}).(*MapRepository)
+	assert.True(t, ok)
+
+	repo, ok := NewRepository(&genconfig.GeneralConfig{RepositoryShards: 8}).(*ShardedRepository)
+	require.True(t, ok)
+	assert.Equal(t, 8, len(repo.shards))
+}
+
+// TestShardedRepository проверяем что шардированный репозиторий ведет себя как MapRepository
+func TestShardedRepository(t *testing.T) {
+	t.Parallel()
+
+	repo := NewShardedRepository(&genconfig.GeneralConfig{}, 4)
+	for i := 0; i < 20; i++ {
+		repo.UpdateGauge(fmt.Sprintf("gauge%d", i), float64(i))
+		repo.UpdateCounter(fmt.Sprintf("counter%d", i), int64(i))
+		repo.UpdateCounter(fmt.Sprintf("counter%d", i), int64(i))
+	}
+
+	val, ok := repo.Gauge("gauge7")
+	assert.True(t, ok)
+	assert.Equal(t, 7.0, val)
+
+	delta, ok := repo.Counter("counter7")
+	assert.True(t, ok)
+	assert.Equal(t, int64(14), delta)
+
+	_, ok = repo.Gauge("unknownGauge")
+	assert.False(t, ok)
+
+	// ряды одного имени с разными метками не пересекаются
+	value := 1.5
+	err := repo.UpdateMetric(Metrics{ID: "gauge7", Labels: Labels{"host": "agent1"}, MType: Gauge, Value: &value})
+	assert.NoError(t, err)
+	metric, ok := repo.Metric("gauge7", Gauge, Labels{"host": "agent1"})
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, *metric.Value)
+
+	metrics := repo.ToMetrics()
+	assert.Equal(t, 41, len(metrics))
+
+	// выгрузка и загрузка в другой репозиторий с другим числом шардов
+	data, err := repo.MarshalJSON()
+	require.NoError(t, err)
+	other := NewShardedRepository(&genconfig.GeneralConfig{}, 3)
+	require.NoError(t, other.UnmarshalJSON(data))
+	assert.ElementsMatch(t, metrics, other.ToMetrics())
+
+	repo.Clear()
+	assert.Equal(t, 0, len(repo.ToMetrics()))
+}
+
+// benchmarkUpdates параллельная запись метрик с разными именами, как при отправке /updates/ многими агентами.
+// Каждая сотая операция выгружает все метрики, как это делает сохранение в PersistentStorage
+func benchmarkUpdates(b *testing.B, repo Repository) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("metric%d", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			value := float64(i)
+			delta := int64(i)
+			repo.UpdateMetric(Metrics{ID: names[i%len(names)], MType: Gauge, Value: &value})
+			repo.UpdateMetric(Metrics{ID: names[i%len(names)], MType: Counter, Delta: &delta})
+			if i%100 == 0 {
+				repo.ToMetrics()
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMapRepository_UpdateMetric(b *testing.B) {
+	benchmarkUpdates(b, NewRepository(&genconfig.GeneralConfig{}))
+}
+
+func BenchmarkShardedRepository_UpdateMetric(b *testing.B) {
+	for _, shards := range []int{4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkUpdates(b, NewShardedRepository(&genconfig.GeneralConfig{}, shards))
+		})
+	}
+}
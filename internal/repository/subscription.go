@@ -0,0 +1,194 @@
+// Package repository содержит подписку на изменения метрик репозитория
+package repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSubscriptionClosed подписка закрыта через Close
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// Subscription подписка на изменения рядов метрик.
+// Подписчик не блокирует запись в репозиторий: изменения копятся в буфере, где для каждого ряда хранится только
+// последнее значение. Медленный клиент пропускает промежуточные значения, но всегда получает актуальное, а размер
+// буфера ограничен числом рядов, на которые он подписан
+type Subscription struct {
+	// names имена метрик подписки, пустой набор - все метрики
+	names    map[string]struct{}
+	notifier *changeNotifier
+
+	lock    sync.Mutex
+	pending map[string]Metrics
+	order   []string
+
+	// ready сигнал о новых изменениях, буфер 1 - сигналы не копятся
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// coalesced число изменений, замененных более свежими до того, как подписчик их забрал
+	coalesced uint64
+}
+
+// Ready канал, в который приходит сигнал после появления новых изменений. Изменения забираются через Pop
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done канал закрывается после Close
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Matches проверяет, относится ли метрика с именем name к подписке
+func (s *Subscription) Matches(name string) bool {
+	if len(s.names) == 0 {
+		return true
+	}
+	_, ok := s.names[name]
+	return ok
+}
+
+// Pop забирает накопленные изменения в порядке первого изменения ряда, nil если изменений нет
+func (s *Subscription) Pop() []Metrics {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.order) == 0 {
+		return nil
+	}
+	metrics := make([]Metrics, 0, len(s.order))
+	for _, key := range s.order {
+		metrics = append(metrics, s.pending[key])
+	}
+	s.pending = make(map[string]Metrics)
+	s.order = s.order[:0]
+	return metrics
+}
+
+// Next ждет изменений и забирает их. Возвращает ошибку контекста либо ErrSubscriptionClosed
+func (s *Subscription) Next(ctx context.Context) ([]Metrics, error) {
+	for {
+		if metrics := s.Pop(); metrics != nil {
+			return metrics, nil
+		}
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return nil, ErrSubscriptionClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Coalesced число изменений, которые подписчик пропустил из-за того, что не успевал их забирать
+func (s *Subscription) Coalesced() uint64 {
+	return atomic.LoadUint64(&s.coalesced)
+}
+
+// Close отписка от изменений, повторный вызов ничего не делает
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.notifier.unsubscribe(s)
+		close(s.done)
+	})
+}
+
+// push добавляет изменение в буфер подписки, более раннее значение того же ряда заменяется
+func (s *Subscription) push(metric Metrics) {
+	key := metric.MType + ":" + metric.SeriesKey()
+	s.lock.Lock()
+	if _, ok := s.pending[key]; ok {
+		atomic.AddUint64(&s.coalesced, 1)
+	} else {
+		s.order = append(s.order, key)
+	}
+	s.pending[key] = metric
+	s.lock.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// CurrentValues текущие значения метрик подписки sub, отсортированные по ряду, без подписи - как в потоке изменений.
+// Подписка создается до снимка, поэтому изменение между ними может прийти дважды, но не потеряется
+func CurrentValues(repo Repository, sub *Subscription) []Metrics {
+	metrics := make([]Metrics, 0)
+	for _, metric := range repo.ToMetrics() {
+		if sub.Matches(metric.ID) {
+			metric.Hash = ""
+			metrics = append(metrics, metric)
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].SeriesKey() != metrics[j].SeriesKey() {
+			return metrics[i].SeriesKey() < metrics[j].SeriesKey()
+		}
+		return metrics[i].MType < metrics[j].MType
+	})
+	return metrics
+}
+
+// changeNotifier список подписок репозитория. У ShardedRepository один список на все шарды
+type changeNotifier struct {
+	lock *sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// newChangeNotifier конструктор
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{
+		lock: &sync.RWMutex{},
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe создает подписку на метрики с именами names, пустой список - все метрики
+func (n *changeNotifier) subscribe(names []string) *Subscription {
+	sub := &Subscription{
+		names:    make(map[string]struct{}, len(names)),
+		notifier: n,
+		pending:  make(map[string]Metrics),
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	for _, name := range names {
+		sub.names[name] = struct{}{}
+	}
+
+	n.lock.Lock()
+	n.subs[sub] = struct{}{}
+	n.lock.Unlock()
+	return sub
+}
+
+// unsubscribe удаляет подписку из списка
+func (n *changeNotifier) unsubscribe(sub *Subscription) {
+	n.lock.Lock()
+	delete(n.subs, sub)
+	n.lock.Unlock()
+}
+
+// active есть ли подписчики. Позволяет не собирать Metrics при записи, когда изменения никому не нужны
+func (n *changeNotifier) active() bool {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return len(n.subs) > 0
+}
+
+// publish рассылает изменение всем подходящим подпискам. Не блокируется на медленных подписчиках
+func (n *changeNotifier) publish(metric Metrics) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for sub := range n.subs {
+		if sub.Matches(metric.ID) {
+			sub.push(metric)
+		}
+	}
+}
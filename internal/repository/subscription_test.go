@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSubscription проверяем фильтрацию по именам и схлопывание изменений одного ряда
+func TestSubscription(t *testing.T) {
+	tests := []struct {
+		name string
+		repo Repository
+	}{
+		{name: "map", repo: NewRepository(&genconfig.GeneralConfig{})},
+		{name: "sharded", repo: NewRepository(&genconfig.GeneralConfig{RepositoryShards: 4})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.repo
+			sub := repo.Subscribe([]string{"testGauge", "testCounter"})
+			defer sub.Close()
+			assert.Nil(t, sub.Pop())
+
+			repo.UpdateGauge("testGauge", 1)
+			repo.UpdateCounter("testCounter", 10)
+			repo.UpdateGauge("otherGauge", 5)
+			repo.UpdateGauge("testGauge", 2)
+			repo.UpdateCounter("testCounter", 10)
+
+			select {
+			case <-sub.Ready():
+			default:
+				t.Fatal("no ready signal")
+			}
+			metrics := sub.Pop()
+			require.Equal(t, 2, len(metrics))
+			assert.Equal(t, "testGauge", metrics[0].ID)
+			assert.Equal(t, 2.0, *metrics[0].Value)
+			assert.Equal(t, "testCounter", metrics[1].ID)
+			assert.Equal(t, int64(20), *metrics[1].Delta)
+			assert.Equal(t, uint64(2), sub.Coalesced())
+			assert.Nil(t, sub.Pop())
+
+			assert.True(t, repo.ResetCounter("testCounter", nil))
+			metrics, err := sub.Next(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, 1, len(metrics))
+			assert.Equal(t, int64(0), *metrics[0].Delta)
+
+			// после отписки изменения не приходят
+			sub.Close()
+			sub.Close()
+			repo.UpdateGauge("testGauge", 3)
+			assert.Nil(t, sub.Pop())
+			_, err = sub.Next(context.Background())
+			assert.ErrorIs(t, err, ErrSubscriptionClosed)
+		})
+	}
+}
+
+// TestSubscriptionAll проверяем подписку на все метрики, включая histogram
+func TestSubscriptionAll(t *testing.T) {
+	repo := NewRepository(&genconfig.GeneralConfig{})
+	sub := repo.Subscribe(nil)
+	defer sub.Close()
+
+	count := uint64(1)
+	sum := 0.5
+	err := repo.UpdateMetric(Metrics{ID: "latency", MType: Histogram, Buckets: []Bucket{{UpperBound: 1, Count: 1}},
+		Count: &count, Sum: &sum})
+	require.NoError(t, err)
+	repo.UpdateGauge("testGauge", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	metrics, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(metrics))
+	assert.Equal(t, Histogram, metrics[0].MType)
+	assert.Equal(t, uint64(1), *metrics[0].Count)
+
+	// без изменений Next ждет до отмены контекста
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = sub.Next(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// TestSubscriptionDelete проверяем что удаление ряда и удаление по TTL приходят подписчику событием Deleted
+func TestSubscriptionDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		repo Repository
+	}{
+		{name: "map", repo: NewRepository(&genconfig.GeneralConfig{MetricTTL: genconfig.Duration{Duration: time.Hour}})},
+		{name: "sharded", repo: NewRepository(&genconfig.GeneralConfig{MetricTTL: genconfig.Duration{Duration: time.Hour},
+			RepositoryShards: 4})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.repo
+			sub := repo.Subscribe(nil)
+			defer sub.Close()
+
+			value := 1.0
+			require.NoError(t, repo.UpdateMetric(Metrics{ID: "testGauge", Labels: Labels{"host": "web01"}, MType: Gauge, Value: &value}))
+			repo.UpdateCounter("testCounter", 1)
+			assert.Len(t, sub.Pop(), 2)
+
+			// ряд без меток не совпадает с рядом с метками, событие не отправляется
+			assert.False(t, repo.Delete("testGauge", Gauge, nil))
+			assert.Nil(t, sub.Pop())
+
+			// изменение и удаление ряда до чтения схлопываются в удаление
+			repo.UpdateGauge("otherGauge", 1)
+			require.NoError(t, repo.UpdateMetric(Metrics{ID: "testGauge", Labels: Labels{"host": "web01"}, MType: Gauge, Value: &value}))
+			assert.True(t, repo.Delete("testGauge", Gauge, Labels{"host": "web01"}))
+			metrics := sub.Pop()
+			require.Len(t, metrics, 2)
+			assert.Equal(t, "otherGauge", metrics[0].ID)
+			assert.Equal(t, Metrics{ID: "testGauge", Labels: Labels{"host": "web01"}, MType: Gauge, Deleted: true}, metrics[1])
+
+			expired := repo.Expire(time.Now().Add(2 * time.Hour))
+			assert.Len(t, expired, 2)
+			metrics = sub.Pop()
+			require.Len(t, metrics, 2)
+			for _, metric := range metrics {
+				assert.True(t, metric.Deleted, metric.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Package repository содержит функционал устаревания метрик по TTL
+package repository
+
+import (
+	"path"
+	"time"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+)
+
+const (
+	// minExpireInterval и maxExpireInterval границы периода проверки устаревших метрик
+	minExpireInterval = time.Second
+	maxExpireInterval = time.Minute
+)
+
+// metricTTL срок жизни метрики с именем name: TTL первого подходящего правила, иначе общий MetricTTL.
+// 0 - метрика не устаревает. Правила с некорректным шаблоном пропускаются
+func metricTTL(conf *genconfig.GeneralConfig, name string) time.Duration {
+	for _, rule := range conf.MetricTTLRules {
+		if ok, err := path.Match(rule.Pattern, name); err == nil && ok {
+			return rule.TTL.Duration
+		}
+	}
+	return conf.MetricTTL.Duration
+}
+
+// ExpireInterval период проверки устаревших метрик - половина минимального TTL в пределах от секунды до минуты.
+// 0 если TTL нигде не задан и проверять нечего
+func ExpireInterval(conf *genconfig.GeneralConfig) time.Duration {
+	minTTL := conf.MetricTTL.Duration
+	for _, rule := range conf.MetricTTLRules {
+		if rule.TTL.Duration > 0 && (minTTL <= 0 || rule.TTL.Duration < minTTL) {
+			minTTL = rule.TTL.Duration
+		}
+	}
+	if minTTL <= 0 {
+		return 0
+	}
+
+	interval := minTTL / 2
+	if interval < minExpireInterval {
+		return minExpireInterval
+	}
+	if interval > maxExpireInterval {
+		return maxExpireInterval
+	}
+	return interval
+}
+
+// expired проверяет истек ли срок жизни метрики name, последний раз обновленной в updated
+func expired(conf *genconfig.GeneralConfig, name string, updated, now time.Time) bool {
+	ttl := metricTTL(conf, name)
+	return ttl > 0 && now.Sub(updated) > ttl
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMapRepositoryExpire проверяем удаление метрик по общему TTL и по правилам для имен
+func TestMapRepositoryExpire(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	repo := NewRepository(&genconfig.GeneralConfig{
+		MetricTTL: genconfig.Duration{Duration: time.Hour},
+		MetricTTLRules: []genconfig.TTLRule{
+			{Pattern: "agent_*", TTL: genconfig.Duration{Duration: time.Minute}},
+			{Pattern: "static_*", TTL: genconfig.Duration{}},
+		},
+	})
+	repo.(*MapRepository).now = func() time.Time {
+		return now
+	}
+
+	repo.UpdateGauge("agent_cpu", 1)
+	repo.UpdateCounter("testCounter", 1)
+	repo.UpdateGauge("static_version", 1)
+	count := uint64(1)
+	sum := 0.5
+	assert.NoError(t, repo.UpdateMetric(Metrics{ID: "latency", MType: Histogram,
+		Buckets: []Bucket{{UpperBound: 1, Count: 1}}, Count: &count, Sum: &sum}))
+	value := 2.0
+	assert.NoError(t, repo.UpdateMetric(Metrics{ID: "agent_cpu", Labels: Labels{"host": "a"}, MType: Gauge, Value: &value}))
+
+	// ровно на границе TTL метрики еще живы
+	assert.Equal(t, 0, len(repo.Expire(now.Add(time.Minute))))
+
+	// через две минуты устарели только ряды agent_*
+	expired := repo.Expire(now.Add(2 * time.Minute))
+	assert.ElementsMatch(t, []Metrics{
+		{ID: "agent_cpu", MType: Gauge},
+		{ID: "agent_cpu", Labels: Labels{"host": "a"}, MType: Gauge},
+	}, expired)
+	_, ok := repo.Gauge("agent_cpu")
+	assert.False(t, ok)
+
+	// обновление продлевает жизнь метрики
+	now = now.Add(30 * time.Minute)
+	repo.UpdateCounter("testCounter", 1)
+
+	expired = repo.Expire(now.Add(40 * time.Minute))
+	assert.Equal(t, []Metrics{{ID: "latency", MType: Histogram}}, expired)
+
+	expired = repo.Expire(now.Add(2 * time.Hour))
+	assert.Equal(t, []Metrics{{ID: "testCounter", MType: Counter}}, expired)
+
+	// для static_* TTL выключен правилом
+	val, ok := repo.Gauge("static_version")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, val)
+}
+
+// TestShardedRepositoryExpire проверяем удаление метрик по TTL во всех шардах
+func TestShardedRepositoryExpire(t *testing.T) {
+	t.Parallel()
+
+	repo := NewShardedRepository(&genconfig.GeneralConfig{MetricTTL: genconfig.Duration{Duration: time.Minute}}, 4)
+	repo.UpdateGauge("testGauge", 1)
+	repo.UpdateCounter("testCounter", 1)
+
+	assert.Equal(t, 0, len(repo.Expire(time.Now())))
+	assert.Equal(t, 2, len(repo.Expire(time.Now().Add(time.Hour))))
+	assert.Equal(t, 0, len(repo.ToMetrics()))
+}
+
+func TestExpireInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		conf genconfig.GeneralConfig
+		want time.Duration
+	}{
+		{
+			"ttl disabled",
+			genconfig.GeneralConfig{},
+			0,
+		},
+		{
+			"global ttl",
+			genconfig.GeneralConfig{MetricTTL: genconfig.Duration{Duration: time.Minute}},
+			30 * time.Second,
+		},
+		{
+			"rule ttl is smaller",
+			genconfig.GeneralConfig{
+				MetricTTL:      genconfig.Duration{Duration: time.Minute},
+				MetricTTLRules: []genconfig.TTLRule{{Pattern: "*", TTL: genconfig.Duration{Duration: 10 * time.Second}}},
+			},
+			5 * time.Second,
+		},
+		{
+			"only rules",
+			genconfig.GeneralConfig{
+				MetricTTLRules: []genconfig.TTLRule{{Pattern: "*", TTL: genconfig.Duration{Duration: time.Hour}}},
+			},
+			time.Minute,
+		},
+		{
+			"too small ttl",
+			genconfig.GeneralConfig{MetricTTL: genconfig.Duration{Duration: time.Millisecond}},
+			time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ExpireInterval(&tt.conf))
+		})
+	}
+}
@@ -3,7 +3,9 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/ncyellow/devops/internal/genconfig"
 	"github.com/rs/zerolog/log"
@@ -17,6 +19,47 @@ type Config struct {
 	Restore       bool               `env:"RESTORE" json:"restore"`
 	DatabaseConn  string             `env:"DATABASE_DSN" json:"database_dsn"`
 	TrustedSubNet string             `env:"TRUSTED_SUBNET" json:"trusted_subnet"`
+	// TrustedProxies cidr сети прокси перед сервером. Только от них X-Real-IP считается адресом клиента
+	// для ограничения частоты запросов, пусто - клиент определяется по адресу соединения
+	TrustedProxies string `env:"TRUSTED_PROXIES" json:"trusted_proxies"`
+	// CryptoKeys дополнительные к CryptoKey приватные ключи - файлы или директории с ключами.
+	// При ротации здесь остаются старые ключи, пока их идентификаторы встречаются в сообщениях агентов
+	CryptoKeys []string `env:"CRYPTO_KEYS" envSeparator:"," json:"crypto_keys"`
+	// CryptoKeyPassword пароль зашифрованных приватных ключей PKCS#8, один для всех ключей.
+	// Задается только через окружение, чтобы не попадать в командную строку и файл конфигурации
+	CryptoKeyPassword string `env:"CRYPTO_KEY_PASSWORD" json:"-"`
+	// MaxBodySize ограничение сжатого и распакованного тела запроса с Content-Encoding и размера grpc сообщения,
+	// 0 - middlewares.DefaultMaxBodySize
+	MaxBodySize int64 `env:"MAX_BODY_SIZE" json:"max_body_size"`
+	// RateLimit ограничение записи метрик одним клиентом, запросов в секунду, 0 - без ограничения
+	RateLimit float64 `env:"RATE_LIMIT" json:"rate_limit"`
+	// RateBurst сколько запросов записи клиент может сделать подряд сверх RateLimit
+	RateBurst int `env:"RATE_BURST" json:"rate_burst"`
+	// TokensFile файл с токенами агентов и их правами, пустое значение выключает проверку токенов.
+	// Изменения файла применяются без перезапуска сервера
+	TokensFile string `env:"TOKENS_FILE" json:"tokens_file"`
+	// StreamOrigins Origin страниц, которым разрешено подключаться к /api/ws, кроме страниц самого сервера.
+	// Например https://grafana.local
+	StreamOrigins []string `env:"STREAM_ORIGINS" envSeparator:"," json:"stream_origins"`
+	// StatsDAddress адрес приема метрик StatsD по UDP и TCP, пусто - прием выключен.
+	// Прием без токенов и ограничения частоты, отправители ограничиваются только TrustedSubNet
+	StatsDAddress string `env:"STATSD_ADDRESS" json:"statsd_address"`
+	// StatsDFlushInterval интервал агрегации StatsD перед записью в репозиторий
+	StatsDFlushInterval genconfig.Duration `env:"STATSD_FLUSH_INTERVAL" json:"statsd_flush_interval"`
+	// GraphiteAddress адрес приема метрик Graphite plaintext по TCP, пусто - прием выключен.
+	// Прием без токенов и ограничения частоты, клиенты ограничиваются только TrustedSubNet
+	GraphiteAddress string `env:"GRAPHITE_ADDRESS" json:"graphite_address"`
+	// GraphiteRules правила преобразования путей Graphite в имена и метки, применяется первое подходящее
+	GraphiteRules []GraphiteRule `json:"graphite_rules"`
+}
+
+// GraphiteRule правило преобразования пути Graphite. Pattern - путь через точку, где * совпадает
+// с одним сегментом. В Name и значениях Labels $1, $2... заменяются на сегменты совпавшие с * по порядку.
+// Пример: {"pattern": "servers.*.cpu.*", "name": "cpu_$2", "labels": {"host": "$1"}}
+type GraphiteRule struct {
+	Pattern string            `json:"pattern"`
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels"`
 }
 
 func ReadConfig(fileName string) Config {
@@ -34,3 +77,26 @@ func ReadConfig(fileName string) Config {
 	}
 	return cfg
 }
+
+// CryptoKeyPaths все заданные приватные ключи: CryptoKey и CryptoKeys. Пустой список - расшифровка выключена
+func (c *Config) CryptoKeyPaths() []string {
+	var paths []string
+	for _, path := range append([]string{c.CryptoKey}, c.CryptoKeys...) {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// GoString вывод настроек через %#v для журнала запуска. Пароль приватных ключей скрыт:
+// тег json:"-" на форматирование не влияет
+func (c Config) GoString() string {
+	// config без методов, иначе %#v снова вызовет GoString
+	type config Config
+	safe := config(c)
+	if safe.CryptoKeyPassword != "" {
+		safe.CryptoKeyPassword = "***"
+	}
+	return fmt.Sprintf("%#v", safe)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -56,3 +57,26 @@ func TestReadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestCryptoKeyPaths(t *testing.T) {
+	conf := Config{}
+	assert.Nil(t, conf.CryptoKeyPaths())
+
+	conf.CryptoKeys = []string{" old.private", "", "keys/"}
+	assert.Equal(t, []string{"old.private", "keys/"}, conf.CryptoKeyPaths())
+
+	conf.CryptoKey = "new.private"
+	assert.Equal(t, []string{"new.private", "old.private", "keys/"}, conf.CryptoKeyPaths())
+}
+
+// TestGoString проверяем что пароль ключей не попадает в журнал запуска
+func TestGoString(t *testing.T) {
+	conf := Config{CryptoKeyPassword: "secret", StoreFile: "/tmp/metrics.json"}
+	out := fmt.Sprintf("%#v", conf)
+	assert.NotContains(t, out, "secret")
+	assert.Contains(t, out, `CryptoKeyPassword:"***"`)
+	assert.Contains(t, out, "/tmp/metrics.json")
+	assert.Equal(t, "secret", conf.CryptoKeyPassword)
+
+	assert.Contains(t, fmt.Sprintf("%#v", Config{}), `CryptoKeyPassword:""`)
+}
@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/ncyellow/devops/internal/crypto/tlsconfig"
 	"github.com/ncyellow/devops/internal/grpc/api"
 	"github.com/ncyellow/devops/internal/grpc/proto"
 	"github.com/ncyellow/devops/internal/repository"
@@ -14,6 +15,9 @@ import (
 	"github.com/ncyellow/devops/internal/server/storage"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	// регистрирует распаковку gzip для сообщений агента
+	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 // GRPCServer структура сервера
@@ -35,16 +39,68 @@ func (s *GRPCServer) RunServer() {
 	// Поднимаем текущие данные по метриками
 	saver.Load()
 
+	if statsdServer := startStatsD(s.Conf, repo, saver); statsdServer != nil {
+		defer statsdServer.Stop()
+	}
+	if graphiteServer := startGraphite(s.Conf, repo, saver); graphiteServer != nil {
+		defer graphiteServer.Stop()
+	}
+
 	listen, err := net.Listen("tcp", s.Conf.GRPCAddress)
 	if err != nil {
 		log.Fatal().Err(err)
 	}
 
-	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(middlewares.IPBlockInterceptor(s.Conf.TrustedSubNet)))
+	maxBodySize := s.Conf.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = middlewares.DefaultMaxBodySize
+	}
+	// ограничиваем только запись метрик, как и в http
+	limiter := middlewares.NewRateLimiter(s.Conf.RateLimit, s.Conf.RateBurst, s.Conf.TrustedProxies)
+	// как и в http, при ошибке чтения файла токенов отклоняем все вызовы, кроме Ping
+	auth, err := middlewares.NewAuthenticator(s.Conf.TokensFile)
+	if err != nil {
+		log.Error().Msgf("не удалось прочитать файл токенов %s", err.Error())
+	}
+	// права методов, остальные методы требуют read
+	scopes := map[string]middlewares.Scope{
+		"Ping":          middlewares.ScopeNone,
+		"AddMetric":     middlewares.ScopeIngest,
+		"StreamMetrics": middlewares.ScopeIngest,
+		"DeleteMetric":  middlewares.ScopeAdmin,
+		"ResetCounter":  middlewares.ScopeAdmin,
+	}
+	// Сжатые gzip сообщения агента распаковываются grpc, лимит MaxRecvMsgSize проверяется по распакованному размеру
+	options := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(maxBodySize)),
+		grpc.ChainUnaryInterceptor(
+			middlewares.ClientCertInterceptor,
+			middlewares.IPBlockInterceptor(s.Conf.TrustedSubNet),
+			middlewares.AuthInterceptor(auth, scopes),
+			middlewares.RateLimitInterceptor(limiter, "AddMetric"),
+		),
+		grpc.ChainStreamInterceptor(
+			middlewares.ClientCertStreamInterceptor,
+			middlewares.IPBlockStreamInterceptor(s.Conf.TrustedSubNet),
+			middlewares.AuthStreamInterceptor(auth, scopes),
+			middlewares.RateLimitStreamInterceptor(limiter, "StreamMetrics"),
+		),
+	}
+	if s.Conf.TLSCert != "" {
+		tlsConf, err := tlsconfig.Server(s.Conf.TLSCert, s.Conf.TLSKey, s.Conf.TLSCA)
+		if err != nil {
+			log.Fatal().Msgf("не удалось загрузить сертификат сервера %s", err.Error())
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+	grpcServer := grpc.NewServer(options...)
 	// регистрируем сервис
-	proto.RegisterMetricsServer(grpcServer, api.NewMetricServer(repo, s.Conf, saver))
+	metricsServer := api.NewMetricServer(repo, s.Conf, saver)
+	proto.RegisterMetricsServer(grpcServer, metricsServer)
 
 	defer func() {
+		// сначала завершаем потоки Watch, иначе GracefulStop будет ждать их бесконечно
+		metricsServer.Stop()
 		// гасим сервер через GracefulStop
 		grpcServer.GracefulStop()
 	}()
@@ -62,6 +118,7 @@ func (s *GRPCServer) RunServer() {
 	}()
 
 	go storage.RunStorageSaver(saver, s.Conf.StoreInterval.Duration)
+	go storage.RunMetricExpirer(repo, saver, repository.ExpireInterval(s.Conf.GeneralCfg()))
 
 	<-done
 	log.Info().Msg("Server Shutdown gracefully")
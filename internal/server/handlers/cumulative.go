@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// sourceMetric метрика из внешнего протокола (Prometheus, OTLP). cumulative - значение counter или histogram
+// накоплено у источника, и в репозиторий записывается только приращение относительно прошлого значения источника.
+// delta - значение gauge является приращением и прибавляется к значению ряда
+type sourceMetric struct {
+	repository.Metrics
+	cumulative bool
+	delta      bool
+}
+
+// updateSourceMetric записывает метрику внешнего протокола. Приращение накопленного значения и приращение gauge
+// считает репозиторий под блокировкой ряда, поэтому параллельные запросы с одним рядом не учитывают его дважды
+// и не теряют
+func (h *Handler) updateSourceMetric(metric sourceMetric) error {
+	if metric.cumulative {
+		return h.repo.SetCumulative(metric.Metrics)
+	}
+	if metric.delta {
+		h.repo.AddGauge(metric.ID, metric.Labels, *metric.Value)
+		return nil
+	}
+	return h.repo.UpdateMetric(metric.Metrics)
+}
@@ -2,11 +2,15 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ncyellow/devops/internal/crypto/rsa"
 	"github.com/ncyellow/devops/internal/hash"
@@ -24,8 +28,25 @@ var (
 	AnswerOK = []byte("ok")
 )
 
+// HistoryRequest запрос истории ряда метрики. Нулевые From и To не ограничивают интервал
+type HistoryRequest struct {
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Labels repository.Labels `json:"labels,omitempty"`
+	From   time.Time         `json:"from"`
+	To     time.Time         `json:"to"`
+}
+
+// HistoryResponse история ряда метрики
+type HistoryResponse struct {
+	ID      string              `json:"id"`
+	MType   string              `json:"type"`
+	Labels  repository.Labels   `json:"labels,omitempty"`
+	Samples []repository.Sample `json:"samples"`
+}
+
 // @Title DevOPS API
-// @Description Сервис сбора метрик типов Counter, Gauge
+// @Description Сервис сбора метрик типов Counter, Gauge, Histogram
 // @Version 1.0
 
 // @Contact.email ncyellow@yandex.ru
@@ -43,6 +64,10 @@ type Handler struct {
 	repo    repository.Repository
 	pStore  storage.PersistentStorage
 	decoder *rsa.Decoder
+	// limiter ограничение частоты запросов на запись метрик от одного клиента
+	limiter *middlewares.RateLimiter
+	// auth проверка токенов агентов
+	auth *middlewares.Authenticator
 }
 
 // NewRouter создает chi.NewRouter и описывает маршрутизацию
@@ -51,49 +76,143 @@ func NewRouter(repo repository.Repository, conf *config.Config, pStore storage.P
 	r.Use(middleware.Recoverer)
 	r.Use(middlewares.EncoderGZIP)
 	r.Use(middlewares.IPBlock(conf.TrustedSubNet))
-	r.Mount("/debug", middleware.Profiler())
+	r.Use(middlewares.ClientCert)
 
+	//! Без декодера сервер принимал бы незашифрованные пачки, поэтому заданные, но не загруженные ключи - ошибка запуска
 	var decoder *rsa.Decoder
-	if conf.CryptoKey != "" {
-		dec, err := rsa.NewDecoder(conf.CryptoKey)
+	if paths := conf.CryptoKeyPaths(); len(paths) > 0 {
+		dec, err := rsa.NewDecoderWithPassword([]byte(conf.CryptoKeyPassword), paths...)
 		if err != nil {
-			log.Info().Msgf("не корректный файл rsa приватного ключа %s", err.Error())
+			log.Fatal().Msgf("не удалось загрузить rsa приватные ключи %s", err.Error())
 		}
+		log.Info().Msgf("загружены rsa ключи %v", dec.KeyIDs())
 		decoder = dec
 	}
 
+	//! Если файл токенов не прочитан, проверка все равно включена и сервер отклоняет все запросы, кроме /ping
+	auth, err := middlewares.NewAuthenticator(conf.TokensFile)
+	if err != nil {
+		log.Error().Msgf("не удалось прочитать файл токенов %s", err.Error())
+	}
+
 	handler := &Handler{
 		Mux:     r,
 		conf:    conf,
 		repo:    repo,
 		pStore:  pStore,
 		decoder: decoder,
+		limiter: middlewares.NewRateLimiter(conf.RateLimit, conf.RateBurst, conf.TrustedProxies),
+		auth:    auth,
 	}
-	handler.Get("/", handler.List())
-	handler.Get("/value/{metricType}/{metricName}", handler.Value())
-	r.Post("/update/{metricType}/{metricName}/{metricValue}", handler.Update())
-	r.Post("/update/", handler.UpdateJSON())
-	r.Post("/value/", handler.ValueJSON())
-	r.Post("/updates/", handler.UpdateListJSON())
+	//! Токен проверяем до ограничения частоты, чтобы ключом ограничения был агент токена.
+	//! Ограничиваем только запись: каждая пачка приводит к сохранению хранилища.
+	//! Тело распаковываем только на маршрутах записи и только после проверки адреса, токена и частоты,
+	//! чтобы неизвестный клиент не мог заставить сервер распаковывать данные
+	ingest := r.With(auth.Require(middlewares.ScopeIngest), handler.limiter.Handler, middlewares.Decompress(conf.MaxBodySize))
+	read := r.With(auth.Require(middlewares.ScopeRead))
+	admin := r.With(auth.Require(middlewares.ScopeAdmin))
+
+	admin.Mount("/debug", middleware.Profiler())
+	read.Get("/", handler.List())
+	read.Get("/value/{metricType}/{metricName}", handler.Value())
+	admin.Delete("/value/{metricType}/{metricName}", handler.DeleteValue())
+	ingest.Post("/update/{metricType}/{metricName}/{metricValue}", handler.Update())
+	ingest.Post("/update/", handler.UpdateJSON())
+	read.Post("/value/", handler.ValueJSON())
+	ingest.Post("/updates/", handler.UpdateListJSON())
+	ingest.Post("/write", handler.InfluxWrite())
+	read.Post("/history/", handler.HistoryJSON())
+	ingest.Post("/api/v1/write", handler.RemoteWrite())
+	ingest.Post("/v1/metrics", handler.OTLPMetrics())
 	r.Get("/ping", handler.Ping())
+	read.Get("/metrics", handler.Metrics())
+	read.Get("/api/metrics", handler.QueryMetrics())
+	read.Get("/api/stream", handler.StreamSSE())
+	read.Get("/api/ws", handler.StreamWebSocket())
+	r.Route("/api/v2", handler.routeV2)
 
 	return handler
 }
 
-// List возвращает html произвольного формата со всеми метриками сервера
+// List возвращает html дашборд со всеми метриками сервера.
+// Параметр refresh задает период автообновления страницы в секундах, 0 выключает автообновление
 // @Tags Info
-// @Summary Возвращает html со списком метрик
-// @Description Просто генерим рандомного формата html с метриками
+// @Summary Возвращает html дашборд со списком метрик
+// @Description Метрики сгруппированы по префиксу имени, с поиском, сортировкой и спарклайнами по истории
 // @ID infoList
-// @Produce plain
+// @Produce html
+// @Param refresh query int false "период автообновления в секундах"
 // @Success 200 {string} string "html с метриками"
+// @Failure 400 {string} string "invalid refresh"
 // @Router / [get]
 func (h *Handler) List() http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("Content-Type", "text/html")
+		options := repository.DashboardOptions{Refresh: repository.DefaultDashboardRefresh}
+		if refresh := r.URL.Query().Get("refresh"); refresh != "" {
+			seconds, err := strconv.Atoi(refresh)
+			if err != nil || seconds < 0 {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("invalid refresh"))
+				return
+			}
+			options.Refresh = time.Duration(seconds) * time.Second
+		}
+
+		var page bytes.Buffer
+		if err := repository.RenderDashboard(&page, h.repo, options); err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("render error"))
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(page.Bytes())
+	}
+}
+
+// Metrics возвращает все метрики в текстовом формате Prometheus вместе с метриками использования ключей шифрования сервера.
+// Если клиент в заголовке Accept запрашивает application/openmetrics-text, ответ отдается в формате OpenMetrics
+// @Tags Info
+// @Summary Возвращает метрики для Prometheus
+// @Description Все метрики сервера в текстовом формате Prometheus или OpenMetrics
+// @ID infoMetrics
+// @Produce plain
+// @Success 200 {string} string "метрики в формате Prometheus"
+// @Router /metrics [get]
+func (h *Handler) Metrics() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		openMetrics := acceptsOpenMetrics(r.Header.Get("Accept"))
+		if openMetrics {
+			rw.Header().Set("Content-Type", repository.OpenMetricsContentType)
+		} else {
+			rw.Header().Set("Content-Type", repository.PrometheusContentType)
+		}
 		rw.WriteHeader(http.StatusOK)
-		rw.Write([]byte(repository.RenderHTML(h.repo.ToMetrics())))
+		metrics := append(h.repo.ToMetrics(), keyUsageMetrics(rsa.Usage())...)
+		rw.Write([]byte(repository.RenderPrometheus(metrics, openMetrics)))
+	}
+}
+
+// acceptsOpenMetrics проверяет что заголовок Accept разрешает формат OpenMetrics, то есть
+// application/openmetrics-text указан без q=0
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "application/openmetrics-text" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil || q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
 	}
+	return false
 }
 
 // Value возвращает значение конкретной метрики через GET
@@ -141,6 +260,90 @@ func (h *Handler) Value() http.HandlerFunc {
 	}
 }
 
+// errInvalidLabel параметр label не в виде имя=значение
+var errInvalidLabel = errors.New("invalid label, expected name=value")
+
+// labelsFromQuery метки ряда из повторяемого параметра label в виде имя=значение, nil - ряд без меток
+func labelsFromQuery(r *http.Request) (repository.Labels, error) {
+	values := r.URL.Query()["label"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	labels := make(repository.Labels, len(values))
+	for _, value := range values {
+		i := strings.Index(value, "=")
+		if i <= 0 {
+			return nil, errInvalidLabel
+		}
+		labels[value[:i]] = value[i+1:]
+	}
+	return labels, nil
+}
+
+// DeleteValue удаляет метрику через DELETE. С параметром reset=true ряд counter не удаляется, а обнуляется.
+// Ряд с метками задается параметрами label, например ?label=host=web01&label=dc=msk.
+// Удаленные ряды сразу удаляются и из хранилища, чтобы не вернуться после перезапуска
+// @Tags Storage
+// @Summary Удаление метрики или обнуление counter
+// @ID storageDelete
+// @Produce plain
+// @Param metricType path string true "Metric type"
+// @Param metricName path string true "Metric name"
+// @Param reset query bool false "обнулить counter вместо удаления"
+// @Param label query []string false "метка ряда в виде имя=значение"
+// @Success 200 {string} string "ok"
+// @Failure 400 {string} string "reset is supported only for counter"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "failed to save metrics"
+// @Router /value/{metricType}/{metricName} [delete]
+func (h *Handler) DeleteValue() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		metricType := chi.URLParam(r, "metricType")
+		metricName := chi.URLParam(r, "metricName")
+		labels, err := labelsFromQuery(r)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+
+		if r.URL.Query().Get("reset") == "true" {
+			if metricType != repository.Counter {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("reset is supported only for counter"))
+				return
+			}
+			if !h.repo.ResetCounter(metricName, labels) {
+				rw.WriteHeader(http.StatusNotFound)
+				rw.Write([]byte("not found"))
+				return
+			}
+			if err := h.pStore.Save(r.Context()); err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("failed to save metrics"))
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+			rw.Write(AnswerOK)
+			return
+		}
+
+		if !h.repo.Delete(metricName, metricType, labels) {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("not found"))
+			return
+		}
+		deleted := []repository.Metrics{{ID: metricName, MType: metricType, Labels: labels}}
+		if err := h.pStore.Delete(r.Context(), deleted); err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("failed to save metrics"))
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(AnswerOK)
+	}
+}
+
 // Update обновляет значение конкретной метрики в rest формате
 // @Tags Storage
 // @Summary обновляем состояние метрики через rest api
@@ -200,7 +403,7 @@ func (h *Handler) Update() http.HandlerFunc {
 // @Produce plain
 // @Param metric_data body Metrics true "Metric object"
 // @Success 200 {string} string "ok"
-// @Failure 400 {string} string "incorrect metric sign"
+// @Failure 400 {string} string "incorrect metric sign, incorrect histogram"
 // @Failure 500 {string} string "incorrect metric type, content type not support, invalid deserialization"
 // @Router /update/ [post]
 func (h *Handler) UpdateJSON() http.HandlerFunc {
@@ -235,6 +438,11 @@ func (h *Handler) UpdateJSON() http.HandlerFunc {
 		}
 
 		err = h.repo.UpdateMetric(metric)
+		if errors.Is(err, repository.ErrInvalidHistogram) {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("incorrect histogram"))
+			return
+		}
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte("incorrect metric type"))
@@ -250,13 +458,14 @@ func (h *Handler) UpdateJSON() http.HandlerFunc {
 // UpdateListJSON обновляет значение всех метрик переданных в json body
 // @Tags Storage
 // @Summary обновляем состояние всех метрик переданных  в json
-// @Description обязательность подписи как и UpdateJSON остается
+// @Description обязательность подписи как и UpdateJSON остается. Если на сервере задан crypto-key,
+// @Description тело должно быть зашифровано конвертом rsa+aes-gcm из пакета crypto/rsa
 // @ID storageUpdateListJSON
 // @Accept json
 // @Produce plain
 // @Param metric_data body []Metrics true "Metrics list object"
 // @Success 200 {string} string "ok"
-// @Failure 400 {string} string "incorrect metric sign"
+// @Failure 400 {string} string "incorrect metric sign, incorrect histogram, failed to decrypt body"
 // @Failure 500 {string} string "incorrect metric type, content type not support, invalid deserialization"
 // @Router /updates/ [post]
 func (h *Handler) UpdateListJSON() http.HandlerFunc {
@@ -275,12 +484,19 @@ func (h *Handler) UpdateListJSON() http.HandlerFunc {
 			return
 		}
 
-		//! Если задан декодер мы обязаны декодировать приватным ключом данные
+		//! Если задан декодер мы обязаны декодировать приватным ключом данные.
+		//! Ошибка расшифровки - ошибка клиента: чужой ключ, поврежденный или незашифрованный конверт
 		if h.decoder != nil {
-			reqBody, err = h.decoder.Decode(reqBody)
+			reqBody, err = h.decrypt(reqBody)
+			if errors.Is(err, middlewares.ErrBodyTooLarge) {
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				rw.Write([]byte(err.Error()))
+				return
+			}
 			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				rw.Write([]byte("invalid deserialization"))
+				log.Info().Msgf("не удалось расшифровать пачку метрик %s", err.Error())
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("failed to decrypt body"))
 				return
 			}
 		}
@@ -307,6 +523,11 @@ func (h *Handler) UpdateListJSON() http.HandlerFunc {
 
 		for _, metric := range metrics {
 			err = h.repo.UpdateMetric(metric)
+			if errors.Is(err, repository.ErrInvalidHistogram) {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("incorrect histogram"))
+				return
+			}
 			if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 				rw.Write([]byte("incorrect metric type"))
@@ -366,7 +587,7 @@ func (h *Handler) ValueJSON() http.HandlerFunc {
 		metricType := metric.MType
 		metricName := metric.ID
 
-		val, ok := h.repo.Metric(metricName, metricType)
+		val, ok := h.repo.Metric(metricName, metricType, metric.Labels)
 		if ok {
 			encodeFunc := hash.CreateEncodeFunc(h.conf.SecretKey)
 			val.Hash = val.CalcHash(encodeFunc)
@@ -387,6 +608,79 @@ func (h *Handler) ValueJSON() http.HandlerFunc {
 	}
 }
 
+// HistoryJSON возвращает историю значений метрики за интервал времени в виде json
+// @Tags Info
+// @Summary Возвращает историю значений метрики
+// @Description На вход json с именем, типом, метками метрики и интервалом from - to в RFC3339, на выход точки истории
+// @ID infoHistoryJSON
+// @Accept  json
+// @Produce json
+// @Param request body HistoryRequest true "History request"
+// @Success 200 {object} HistoryResponse
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "content type not support, Read data problem, invalid deserialization"
+// @Router /history/ [post]
+func (h *Handler) HistoryJSON() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("content type not support"))
+			return
+		}
+
+		reqBody, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Read data problem"))
+			return
+		}
+
+		request := HistoryRequest{}
+		err = json.Unmarshal(reqBody, &request)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("invalid deserialization"))
+			return
+		}
+
+		samples, ok := h.repo.History(request.ID, request.MType, request.Labels, request.From, request.To)
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("not found"))
+			return
+		}
+
+		result, err := json.Marshal(HistoryResponse{
+			ID:      request.ID,
+			MType:   request.MType,
+			Labels:  request.Labels,
+			Samples: samples,
+		})
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("invalid serialization"))
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(result)
+	}
+}
+
+// decrypt расшифровывает тело запроса. Каким ключом оно было зашифровано, учитывает декодер в rsa.Usage.
+// Агент сжимает тело до шифрования и передает кодировку в конверте, такое тело распаковывается
+// с тем же ограничением размера, что и в middleware Decompress
+func (h *Handler) decrypt(body []byte) ([]byte, error) {
+	plainText, info, err := h.decoder.DecodeKey(body)
+	if err != nil {
+		return nil, err
+	}
+	if info.Encoding == "" {
+		return plainText, nil
+	}
+	return middlewares.DecompressBody(bytes.NewReader(plainText), info.Encoding, h.conf.MaxBodySize)
+}
+
 // Ping возвращает состояние доступности базы данных
 // @Tags Info
 // @Summary Запрос состояния доступности базы данных
@@ -2,11 +2,15 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/ncyellow/devops/internal/genconfig"
 	"github.com/ncyellow/devops/internal/repository"
@@ -38,11 +42,7 @@ type HandlersSuite struct {
 // SetupSuite перед началом теста стартуем новый сервер httptest.Server делаем так, чтобы тестировать каждый
 // handler отдельно и не сливать все тесты в один
 func (suite *HandlersSuite) SetupTest() {
-	conf := config.Config{
-		GeneralConfig: genconfig.GeneralConfig{
-			CryptoKey: "unknown_rsa",
-		},
-	}
+	conf := config.Config{}
 	repo := repository.NewRepository(conf.GeneralCfg())
 	//! Это пустой вариант хранилища без состояние. Ошибок нет
 	pStore, _ := storage.NewFakeStorage()
@@ -143,33 +143,30 @@ func (suite *HandlersSuite) TestListHandler() {
 			},
 		},
 		{
-			name:        "list all metrics",
-			request:     "/",
+			name:        "list with invalid refresh",
+			request:     "/?refresh=fast",
 			requestType: "GET",
 			contentType: "text/plain",
 			body:        nil,
 			want: want{
-				statusCode: http.StatusOK,
-				body: `
-	<html>
-	<body>
-	<h1>All metrics</h1>
-	<h3>gauges</h3>
-	<ul>
-	  <li>testGauge : 100.000</li>
-
-	</ul>
-	<h3>counters</h3>
-	<ul>
-	  <li>testCounter : 100</li>
-
-	</ul>
-	</body>
-	</html>`,
+				statusCode: http.StatusBadRequest,
+				body:       "invalid refresh",
 			},
 		},
 	}
 	suite.runTableTests(testData)
+
+	resp, body := runTestRequest(suite.T(), suite.ts, "GET", "/", "text/plain", nil)
+	resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(suite.T(), "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(suite.T(), body, `<td>testGauge</td><td class="labels"></td><td>gauge</td><td class="value" data-value="100">100.000</td>`)
+	assert.Contains(suite.T(), body, `<td>testCounter</td><td class="labels"></td><td>counter</td><td class="value" data-value="100">100</td>`)
+	assert.Contains(suite.T(), body, "var refresh =  10 ;")
+
+	resp, body = runTestRequest(suite.T(), suite.ts, "GET", "/?refresh=0", "text/plain", nil)
+	resp.Body.Close()
+	assert.Contains(suite.T(), body, "var refresh =  0 ;")
 }
 
 //TestListHandler тестируем ValueHandler
@@ -483,6 +480,73 @@ func (suite *HandlersSuite) TestUpdateValuesJSONHandler() {
 				body:       `{"id":"jsonCounter","type":"counter","delta":123}`,
 			},
 		},
+		{
+			name:        "set gauges with labels",
+			request:     "/updates/",
+			requestType: "POST",
+			contentType: "application/json",
+			body: []byte(`[{"id":"labeledGauge","type":"gauge","value": 1,"labels":{"host":"agent1"}},
+							      {"id":"labeledGauge","type":"gauge","value": 2,"labels":{"host":"agent2"}}]`),
+			want: want{
+				statusCode: http.StatusOK,
+				body:       "ok",
+			},
+		},
+		{
+			name:        "get gauge with labels",
+			request:     "/value/",
+			requestType: "POST",
+			contentType: "application/json",
+			body:        []byte(`{"id":"labeledGauge","type":"gauge","labels":{"host":"agent2"}}`),
+			want: want{
+				statusCode: http.StatusOK,
+				body:       `{"id":"labeledGauge","labels":{"host":"agent2"},"type":"gauge","value":2}`,
+			},
+		},
+		{
+			name:        "get gauge without labels",
+			request:     "/value/",
+			requestType: "POST",
+			contentType: "application/json",
+			body:        []byte(`{"id":"labeledGauge","type":"gauge"}`),
+			want: want{
+				statusCode: http.StatusNotFound,
+				body:       `not found`,
+			},
+		},
+		{
+			name:        "set histogram with json",
+			request:     "/updates/",
+			requestType: "POST",
+			contentType: "application/json",
+			body:        []byte(`[{"id":"latency","type":"histogram","count":3,"sum":0.5,"buckets":[{"le":0.1,"count":1},{"le":1,"count":3}]}]`),
+			want: want{
+				statusCode: http.StatusOK,
+				body:       "ok",
+			},
+		},
+		{
+			name:        "set histogram with other buckets",
+			request:     "/update/",
+			requestType: "POST",
+			contentType: "application/json",
+			body:        []byte(`{"id":"latency","type":"histogram","count":1,"sum":0.5,"buckets":[{"le":0.5,"count":1}]}`),
+			want: want{
+				statusCode: http.StatusBadRequest,
+				body:       "incorrect histogram",
+			},
+		},
+		{
+			name:        "get histogram with json",
+			request:     "/value/",
+			requestType: "POST",
+			contentType: "application/json",
+			body:        []byte(`{"id":"latency","type":"histogram"}`),
+			want: want{
+				statusCode: http.StatusOK,
+				body:       `{"id":"latency","type":"histogram","buckets":[{"le":0.1,"count":1},{"le":1,"count":3}],"count":3,"sum":0.5}`,
+			},
+		},
 		{
 			name:        "/updates/ with invalid json",
 			request:     "/updates/",
@@ -699,3 +763,225 @@ func ExampleHandler_ValueJSON() {
 	// Output:
 	// status = 200, body = {"id":"jsonCounter","type":"counter","delta":100}
 }
+
+// TestHistoryJSONHandler проверяем выборку истории метрики через /history/
+func TestHistoryJSONHandler(t *testing.T) {
+	conf := config.Config{
+		GeneralConfig: genconfig.GeneralConfig{
+			HistoryRetention: genconfig.Duration{Duration: time.Hour},
+		},
+	}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	for _, value := range []string{"1", "2", "3"} {
+		resp, _ := runTestRequest(t, ts, "POST", "/update/gauge/testGauge/"+value, "text/plain", nil)
+		resp.Body.Close()
+	}
+
+	resp, body := runTestRequest(t, ts, "POST", "/history/", "application/json",
+		[]byte(`{"id":"testGauge","type":"gauge"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var history HistoryResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &history))
+	assert.Equal(t, "testGauge", history.ID)
+	require.Equal(t, 3, len(history.Samples))
+	assert.Equal(t, 3.0, *history.Samples[2].Value)
+
+	// Интервал в будущем - точек нет
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	resp, body = runTestRequest(t, ts, "POST", "/history/", "application/json",
+		[]byte(`{"id":"testGauge","type":"gauge","from":"`+future+`"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"id":"testGauge","type":"gauge","samples":[]}`, body)
+
+	resp, body = runTestRequest(t, ts, "POST", "/history/", "application/json",
+		[]byte(`{"id":"unknownGauge","type":"gauge"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "not found", body)
+}
+
+// TestMetricsHandler проверяем вывод метрик в формате Prometheus и выбор OpenMetrics по заголовку Accept
+func (suite *HandlersSuite) TestMetricsHandler() {
+	resp, _ := runTestRequest(suite.T(), suite.ts, "POST", "/update/counter/testCounter/100", "text/plain", nil)
+	resp.Body.Close()
+	resp, _ = runTestRequest(suite.T(), suite.ts, "POST", "/update/gauge/test.Gauge/1.5", "text/plain", nil)
+	resp.Body.Close()
+
+	acceptTests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "prometheus text format by default",
+			accept:      "",
+			contentType: repository.PrometheusContentType,
+			body:        "# TYPE testCounter counter\ntestCounter 100\n# TYPE test_Gauge gauge\ntest_Gauge 1.5\n",
+		},
+		{
+			name:        "openmetrics requested",
+			accept:      "application/openmetrics-text; version=1.0.0,text/plain;version=0.0.4;q=0.5",
+			contentType: repository.OpenMetricsContentType,
+			body:        "# TYPE testCounter counter\ntestCounter_total 100\n# TYPE test_Gauge gauge\ntest_Gauge 1.5\n# EOF\n",
+		},
+		{
+			name:        "openmetrics rejected with q=0",
+			accept:      "application/openmetrics-text;q=0,text/plain",
+			contentType: repository.PrometheusContentType,
+			body:        "# TYPE testCounter counter\ntestCounter 100\n# TYPE test_Gauge gauge\ntest_Gauge 1.5\n",
+		},
+	}
+	for _, tt := range acceptTests {
+		req, err := http.NewRequest("GET", suite.ts.URL+"/metrics", nil)
+		require.NoError(suite.T(), err)
+		req.Header.Set("Accept", tt.accept)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(suite.T(), err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(suite.T(), err)
+		resp.Body.Close()
+
+		assert.Equal(suite.T(), http.StatusOK, resp.StatusCode, tt.name)
+		assert.Equal(suite.T(), tt.contentType, resp.Header.Get("Content-Type"), tt.name)
+		assert.Equal(suite.T(), tt.body, string(body), tt.name)
+	}
+}
+
+// TestQueryMetricsHandler проверяем выборку метрик через /api/metrics с фильтрами и постраничной выдачей
+func (suite *HandlersSuite) TestQueryMetricsHandler() {
+	for _, path := range []string{"/update/counter/requests/5", "/update/gauge/cpu_user/1.5", "/update/gauge/cpu_system/2.5",
+		"/update/gauge/mem_free/100"} {
+		resp, _ := runTestRequest(suite.T(), suite.ts, "POST", path, "text/plain", nil)
+		resp.Body.Close()
+	}
+
+	resp, body := runTestRequest(suite.T(), suite.ts, "GET", "/api/metrics?type=gauge&prefix=cpu_&limit=1", "", nil)
+	resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(suite.T(), "application/json", resp.Header.Get("Content-Type"))
+
+	var page repository.QueryResult
+	require.NoError(suite.T(), json.Unmarshal([]byte(body), &page))
+	require.Equal(suite.T(), 1, len(page.Metrics))
+	assert.Equal(suite.T(), "cpu_system", page.Metrics[0].ID)
+	require.NotEqual(suite.T(), "", page.NextCursor)
+
+	resp, body = runTestRequest(suite.T(), suite.ts, "GET",
+		"/api/metrics?type=gauge&prefix=cpu_&limit=1&cursor="+page.NextCursor, "", nil)
+	resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	page = repository.QueryResult{}
+	require.NoError(suite.T(), json.Unmarshal([]byte(body), &page))
+	require.Equal(suite.T(), 1, len(page.Metrics))
+	assert.Equal(suite.T(), "cpu_user", page.Metrics[0].ID)
+	assert.Equal(suite.T(), 1.5, *page.Metrics[0].Value)
+	assert.Equal(suite.T(), "", page.NextCursor)
+
+	resp, body = runTestRequest(suite.T(), suite.ts, "GET", "/api/metrics?regex=^req&sort=-type", "", nil)
+	resp.Body.Close()
+	assert.Equal(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(suite.T(), `{"metrics":[{"id":"requests","type":"counter","delta":5}]}`, body)
+
+	suite.runTableTests([]tests{
+		{
+			name:        "invalid limit",
+			request:     "/api/metrics?limit=ten",
+			requestType: "GET",
+			want:        want{statusCode: http.StatusBadRequest, body: "invalid limit"},
+		},
+		{
+			name:        "unknown type",
+			request:     "/api/metrics?type=summary",
+			requestType: "GET",
+			want:        want{statusCode: http.StatusBadRequest, body: "invalid query: unknown metric type summary"},
+		},
+		{
+			name:        "broken cursor",
+			request:     "/api/metrics?cursor=broken",
+			requestType: "GET",
+			want:        want{statusCode: http.StatusBadRequest, body: "invalid cursor"},
+		},
+	})
+}
+
+// TestDeleteValueHandler проверяем удаление метрик и обнуление counter, изменения сразу попадают в файл хранилища
+func TestDeleteValueHandler(t *testing.T) {
+	file, err := os.CreateTemp(os.TempDir(), "delete*")
+	require.NoError(t, err)
+	fileName := file.Name()
+	file.Close()
+	defer os.Remove(fileName)
+
+	conf := config.Config{StoreFile: fileName}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, err := storage.NewFileStorage(&conf, repo)
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	for _, path := range []string{"/update/gauge/testGauge/100", "/update/counter/testCounter/100",
+		"/update/counter/otherCounter/5"} {
+		resp, _ := runTestRequest(t, ts, "POST", path, "text/plain", nil)
+		resp.Body.Close()
+	}
+	value := 1.0
+	require.NoError(t, repo.UpdateMetric(repository.Metrics{ID: "labeledGauge", MType: repository.Gauge,
+		Labels: repository.Labels{"host": "web01", "dc": "msk"}, Value: &value}))
+	require.NoError(t, pStore.Save(context.Background()))
+
+	sub := repo.Subscribe([]string{"labeledGauge"})
+	defer sub.Close()
+
+	deleteTests := []struct {
+		name       string
+		request    string
+		statusCode int
+		body       string
+	}{
+		{"delete gauge", "/value/gauge/testGauge", http.StatusOK, "ok"},
+		{"delete already deleted gauge", "/value/gauge/testGauge", http.StatusNotFound, "not found"},
+		{"delete with wrong type", "/value/gauge/testCounter", http.StatusNotFound, "not found"},
+		{"delete unknown type", "/value/summary/testCounter", http.StatusNotFound, "not found"},
+		{"reset counter", "/value/counter/testCounter?reset=true", http.StatusOK, "ok"},
+		{"reset gauge", "/value/gauge/testGauge?reset=true", http.StatusBadRequest, "reset is supported only for counter"},
+		{"reset unknown counter", "/value/counter/unknownCounter?reset=true", http.StatusNotFound, "not found"},
+		{"delete counter", "/value/counter/otherCounter", http.StatusOK, "ok"},
+		{"delete labeled gauge without labels", "/value/gauge/labeledGauge", http.StatusNotFound, "not found"},
+		{"delete labeled gauge with part of labels", "/value/gauge/labeledGauge?label=host=web01", http.StatusNotFound, "not found"},
+		{"invalid label", "/value/gauge/labeledGauge?label=host", http.StatusBadRequest, "invalid label, expected name=value"},
+		{"delete labeled gauge", "/value/gauge/labeledGauge?label=host=web01&label=dc=msk", http.StatusOK, "ok"},
+	}
+	for _, tt := range deleteTests {
+		resp, body := runTestRequest(t, ts, "DELETE", tt.request, "text/plain", nil)
+		resp.Body.Close()
+		assert.Equal(t, tt.statusCode, resp.StatusCode, tt.name)
+		assert.Equal(t, tt.body, body, tt.name)
+	}
+
+	resp, body := runTestRequest(t, ts, "GET", "/value/counter/testCounter", "text/plain", nil)
+	resp.Body.Close()
+	assert.Equal(t, "0", body)
+
+	// подписчики получают удаление ряда с метками
+	metrics := sub.Pop()
+	require.Equal(t, 1, len(metrics))
+	assert.True(t, metrics[0].Deleted)
+	assert.Equal(t, repository.Labels{"host": "web01", "dc": "msk"}, metrics[0].Labels)
+
+	// после перезапуска удаленные метрики не восстанавливаются, а counter остается обнуленным
+	newRepo := repository.NewRepository(conf.GeneralCfg())
+	storage.RestoreFromFile(fileName, newRepo)
+	metrics = newRepo.ToMetrics()
+	require.Equal(t, 1, len(metrics))
+	assert.Equal(t, "testCounter", metrics[0].ID)
+	assert.Equal(t, int64(0), *metrics[0].Delta)
+}
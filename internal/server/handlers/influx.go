@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/influx"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// InfluxWriteResponse результат приема пакета line protocol
+type InfluxWriteResponse struct {
+	// Accepted число сохраненных метрик
+	Accepted int `json:"accepted"`
+	// Errors ошибки по строкам, строки с ошибками пропускаются целиком
+	Errors []InfluxLineError `json:"errors,omitempty"`
+}
+
+// InfluxLineError ошибка разбора или сохранения строки
+type InfluxLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// InfluxWrite прием метрик в формате InfluxDB line protocol
+// Каждое поле строки становится метрикой measurement_field с тегами в качестве меток: целые поля (1i, 1u)
+// прибавляются к counter, как в /update/counter/, поля с плавающей точкой и булевы (1 или 0) записываются в gauge,
+// строковые поля пропускаются. Метка времени проверяется, но значение сохраняется со временем приема.
+// Ошибочные строки не прерывают обработку пакета, не сохраняются ни одним полем и возвращаются в ответе с номерами строк.
+// Если задан ключ подписи, в заголовке HashSHA256 ожидается подпись тела запроса
+// @Tags Update
+// @Summary Прием метрик в формате InfluxDB line protocol
+// @ID updateInflux
+// @Accept plain
+// @Produce json
+// @Success 200 {object} InfluxWriteResponse
+// @Failure 400 {object} InfluxWriteResponse "ни одна строка не принята"
+// @Failure 500 {string} string "failed to save metrics"
+// @Router /write [post]
+func (h *Handler) InfluxWrite() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		reqBody, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Read data problem"))
+			return
+		}
+
+		encodeFunc := hash.CreateEncodeFunc(h.conf.SecretKey)
+		if !hash.CheckSign(h.conf.SecretKey, r.Header.Get(HashHeader), encodeFunc(string(reqBody))) {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("incorrect metric sign"))
+			return
+		}
+
+		points, lineErrors := influx.Parse(reqBody)
+		response := InfluxWriteResponse{}
+		for _, lineError := range lineErrors {
+			response.Errors = append(response.Errors, InfluxLineError{Line: lineError.Line, Error: lineError.Err.Error()})
+		}
+		for _, point := range points {
+			metrics, err := influxMetrics(point)
+			if err == nil && len(metrics) == 0 {
+				err = errors.New("no numeric fields")
+			}
+			if err != nil {
+				response.Errors = append(response.Errors, InfluxLineError{Line: point.Line, Error: err.Error()})
+				continue
+			}
+			//! Поля строки записываются одной пачкой, чтобы строка с ошибкой не была сохранена частично
+			if errs := h.repo.UpdateMetrics(metrics); errs != nil {
+				for _, err := range errs {
+					if err != nil {
+						response.Errors = append(response.Errors, InfluxLineError{Line: point.Line, Error: err.Error()})
+					}
+				}
+				continue
+			}
+			response.Accepted += len(metrics)
+		}
+
+		if response.Accepted > 0 {
+			err = h.pStore.Save(r.Context())
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("failed to save metrics"))
+				return
+			}
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("invalid serialization"))
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if response.Accepted == 0 && len(response.Errors) > 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+		rw.Write(data)
+	}
+}
+
+// influxMetrics метрики по полям точки line protocol. Беззнаковое поле больше int64 - ошибка всей строки
+func influxMetrics(point influx.Point) ([]repository.Metrics, error) {
+	metrics := make([]repository.Metrics, 0, len(point.Fields))
+	for _, field := range point.Fields {
+		metric := repository.Metrics{
+			ID:     fmt.Sprintf("%s_%s", point.Measurement, field.Key),
+			Labels: point.Tags,
+		}
+		switch value := field.Value.(type) {
+		case int64:
+			metric.MType = repository.Counter
+			metric.Delta = &value
+		case uint64:
+			delta := int64(value)
+			if delta < 0 {
+				return nil, fmt.Errorf("invalid field: %s: value %d overflows int64", field.Key, value)
+			}
+			metric.MType = repository.Counter
+			metric.Delta = &delta
+		case float64:
+			metric.MType = repository.Gauge
+			metric.Value = &value
+		case bool:
+			gauge := 0.0
+			if value {
+				gauge = 1
+			}
+			metric.MType = repository.Gauge
+			metric.Value = &gauge
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
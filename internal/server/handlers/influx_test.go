@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+func TestInfluxWriteHandler(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	resp, body := runTestRequest(t, ts, "POST", "/write", "text/plain", []byte(`cpu,host=a usage=1.5,procs=3i,name="x"
+cpu,host=a usage=
+cpu,host=a procs=2i 1465839830100400200
+mem comment="only string"
+disk,host=a free=1.5,total=18446744073709551615u`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"accepted":3,"errors":[{"line":2,"error":"invalid field: usage=: empty value"},`+
+		`{"line":4,"error":"no numeric fields"},`+
+		`{"line":5,"error":"invalid field: total: value 18446744073709551615 overflows int64"}]}`, body)
+
+	// строка с ошибкой пропускается целиком, корректные поля этой строки не сохраняются
+	_, ok := repo.Metric("disk_free", repository.Gauge, repository.Labels{"host": "a"})
+	assert.False(t, ok)
+
+	gauge, ok := repo.Metric("cpu_usage", repository.Gauge, repository.Labels{"host": "a"})
+	require.True(t, ok)
+	assert.Equal(t, 1.5, *gauge.Value)
+
+	// целые поля прибавляются к counter
+	counter, ok := repo.Metric("cpu_procs", repository.Counter, repository.Labels{"host": "a"})
+	require.True(t, ok)
+	assert.Equal(t, int64(5), *counter.Delta)
+
+	// если ни одна строка не принята - 400
+	resp, body = runTestRequest(t, ts, "POST", "/write", "text/plain", []byte(`cpu`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, `{"accepted":0,"errors":[{"line":1,"error":"missing fields"}]}`, body)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"github.com/ncyellow/devops/internal/crypto/rsa"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// Метрики использования ключей шифрования сервера, по ним видно, какие ключи еще нужны агентам
+// и когда старый ключ можно удалить после ротации
+const (
+	// KeyDecryptsMetric counter расшифрованных сообщений с метками key_id и format
+	KeyDecryptsMetric = "devops_crypto_key_decrypts_total"
+	// KeyLastUsedMetric gauge времени последней расшифровки ключом в unix секундах с меткой key_id
+	KeyLastUsedMetric = "devops_crypto_key_last_used_seconds"
+)
+
+// keyUsageMetrics метрики использования ключей процесса сервера. Это метрики самого сервера, а не данные агентов,
+// поэтому они не записываются в репозиторий и отдаются только в /metrics
+func keyUsageMetrics(usage []rsa.KeyUsage) []repository.Metrics {
+	metrics := make([]repository.Metrics, 0, 2*len(usage))
+	lastUsed := make(map[string]int)
+	for _, key := range usage {
+		decrypts := key.Decrypts
+		metrics = append(metrics, repository.Metrics{
+			ID:     KeyDecryptsMetric,
+			MType:  repository.Counter,
+			Labels: repository.Labels{"key_id": key.KeyID, "format": string(key.Format)},
+			Delta:  &decrypts,
+		})
+
+		seconds := float64(key.LastUsed.Unix())
+		if i, ok := lastUsed[key.KeyID]; ok {
+			if seconds > *metrics[i].Value {
+				metrics[i].Value = &seconds
+			}
+			continue
+		}
+		lastUsed[key.KeyID] = len(metrics)
+		metrics = append(metrics, repository.Metrics{
+			ID:     KeyLastUsedMetric,
+			MType:  repository.Gauge,
+			Labels: repository.Labels{"key_id": key.KeyID},
+			Value:  &seconds,
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ncyellow/devops/internal/crypto/rsa"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// TestKeyUsageMetrics проверяем метрики использования ключей: время последнего использования - по всем форматам ключа
+func TestKeyUsageMetrics(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	metrics := keyUsageMetrics([]rsa.KeyUsage{
+		{KeyID: "0011223344556677", Format: rsa.FormatEnvelope, Decrypts: 2, LastUsed: now.Add(time.Minute)},
+		{KeyID: "0011223344556677", Format: rsa.FormatOAEP, Decrypts: 1, LastUsed: now},
+		{KeyID: "8899aabbccddeeff", Format: rsa.FormatEnvelope, Decrypts: 3, LastUsed: now},
+	})
+
+	want := "# TYPE devops_crypto_key_decrypts_total counter\n" +
+		"devops_crypto_key_decrypts_total{format=\"envelope\",key_id=\"0011223344556677\"} 2\n" +
+		"devops_crypto_key_decrypts_total{format=\"envelope\",key_id=\"8899aabbccddeeff\"} 3\n" +
+		"devops_crypto_key_decrypts_total{format=\"oaep\",key_id=\"0011223344556677\"} 1\n" +
+		"# TYPE devops_crypto_key_last_used_seconds gauge\n" +
+		"devops_crypto_key_last_used_seconds{key_id=\"0011223344556677\"} 1.66730406e+09\n" +
+		"devops_crypto_key_last_used_seconds{key_id=\"8899aabbccddeeff\"} 1.667304e+09\n"
+	assert.Equal(t, want, repository.RenderPrometheus(metrics, false))
+	assert.Empty(t, keyUsageMetrics(nil))
+}
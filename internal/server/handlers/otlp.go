@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/otlp"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// OTLPMetrics прием метрик по протоколу OpenTelemetry OTLP/HTTP в protobuf (application/x-protobuf) или JSON
+// (application/json) представлении. Gauge записывается в gauge, монотонный Sum в counter, немонотонный Sum
+// в gauge, Histogram в histogram. Метки ряда - атрибуты ресурса, дополненные атрибутами точки.
+// Накопленные (CUMULATIVE) значения пересчитываются репозиторием в приращения относительно прошлого значения источника.
+// Точки, которые не удалось записать, возвращаются в partial_success ответа.
+// Если задан ключ подписи, в заголовке HashSHA256 ожидается подпись тела запроса
+// @Tags Update
+// @Summary Прием метрик OpenTelemetry OTLP/HTTP
+// @ID updateOTLP
+// @Accept json
+// @Produce json
+// @Success 200
+// @Failure 400 {string} string "invalid deserialization"
+// @Failure 415 {string} string "content type not support"
+// @Failure 500 {string} string "failed to save metrics"
+// @Router /v1/metrics [post]
+func (h *Handler) OTLPMetrics() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		isJSON := strings.HasPrefix(contentType, "application/json")
+		if !isJSON && !strings.HasPrefix(contentType, "application/x-protobuf") {
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			rw.Write([]byte("content type not support"))
+			return
+		}
+		reqBody, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Read data problem"))
+			return
+		}
+
+		encodeFunc := hash.CreateEncodeFunc(h.conf.SecretKey)
+		if !hash.CheckSign(h.conf.SecretKey, r.Header.Get(HashHeader), encodeFunc(string(reqBody))) {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("incorrect metric sign"))
+			return
+		}
+
+		var request otlp.ExportMetricsServiceRequest
+		if isJSON {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(reqBody, &request)
+		} else {
+			err = proto.Unmarshal(reqBody, &request)
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("invalid deserialization"))
+			return
+		}
+
+		accepted, rejected, errorMessage := h.updateOTLPMetrics(&request)
+		if accepted > 0 {
+			err = h.pStore.Save(r.Context())
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("failed to save metrics"))
+				return
+			}
+		}
+
+		var response otlp.ExportMetricsServiceResponse
+		if rejected > 0 {
+			response.PartialSuccess = &otlp.ExportMetricsPartialSuccess{
+				RejectedDataPoints: rejected,
+				ErrorMessage:       errorMessage,
+			}
+		}
+		var data []byte
+		if isJSON {
+			data, err = protojson.Marshal(&response)
+			rw.Header().Set("Content-Type", "application/json")
+		} else {
+			data, err = proto.Marshal(&response)
+			rw.Header().Set("Content-Type", "application/x-protobuf")
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("invalid serialization"))
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+	}
+}
+
+// updateOTLPMetrics записывает точки запроса в репозиторий. Точки записываются по одной, чтобы накопленные
+// значения одного ряда в одном запросе пересчитывались от уже обновленного значения.
+// Возвращает число записанных и отклоненных точек и сообщение о первой ошибке
+func (h *Handler) updateOTLPMetrics(request *otlp.ExportMetricsServiceRequest) (accepted, rejected int64, errorMessage string) {
+	update := func(metric sourceMetric, err error) {
+		if err == nil {
+			err = h.updateSourceMetric(metric)
+		}
+		if err != nil {
+			rejected++
+			if errorMessage == "" {
+				errorMessage = fmt.Sprintf("%s: %s", metric.ID, err.Error())
+			}
+			return
+		}
+		accepted++
+	}
+
+	for _, resourceMetrics := range request.GetResourceMetrics() {
+		resourceLabels := otlpLabels(nil, resourceMetrics.GetResource().GetAttributes())
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				name := metric.GetName()
+				switch data := metric.GetData().(type) {
+				case *otlp.Metric_Gauge:
+					for _, point := range data.Gauge.GetDataPoints() {
+						value := otlpNumber(point)
+						update(sourceMetric{Metrics: repository.Metrics{ID: name, Labels: otlpLabels(resourceLabels, point.GetAttributes()),
+							MType: repository.Gauge, Value: &value}}, nil)
+					}
+				case *otlp.Metric_Sum:
+					for _, point := range data.Sum.GetDataPoints() {
+						update(otlpSum(name, otlpLabels(resourceLabels, point.GetAttributes()), data.Sum, point), nil)
+					}
+				case *otlp.Metric_Histogram:
+					for _, point := range data.Histogram.GetDataPoints() {
+						histogram, err := otlpHistogram(name, otlpLabels(resourceLabels, point.GetAttributes()), point)
+						update(sourceMetric{
+							Metrics:    histogram,
+							cumulative: data.Histogram.GetAggregationTemporality() != otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+						}, err)
+					}
+				}
+			}
+		}
+	}
+	return accepted, rejected, errorMessage
+}
+
+// otlpSum конвертация точки Sum. Монотонная сумма - counter, немонотонная (UpDownCounter) - gauge.
+// Для DELTA значение прибавляется к текущему, для CUMULATIVE заменяет его
+func otlpSum(name string, labels repository.Labels, sum *otlp.Sum, point *otlp.NumberDataPoint) sourceMetric {
+	value := otlpNumber(point)
+	isDelta := sum.GetAggregationTemporality() == otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	if sum.GetIsMonotonic() {
+		delta := int64(math.Round(value))
+		return sourceMetric{
+			Metrics:    repository.Metrics{ID: name, Labels: labels, MType: repository.Counter, Delta: &delta},
+			cumulative: !isDelta,
+		}
+	}
+	return sourceMetric{
+		Metrics: repository.Metrics{ID: name, Labels: labels, MType: repository.Gauge, Value: &value},
+		delta:   isDelta,
+	}
+}
+
+// otlpHistogram конвертация точки Histogram. В OTLP корзины не накопительные и последняя корзина +Inf,
+// в репозитории корзины накопительные, а +Inf равна count
+func otlpHistogram(name string, labels repository.Labels, point *otlp.HistogramDataPoint) (repository.Metrics, error) {
+	bounds := point.GetExplicitBounds()
+	counts := point.GetBucketCounts()
+	metric := repository.Metrics{ID: name, Labels: labels, MType: repository.Histogram}
+	if len(counts) > 0 && len(counts) != len(bounds)+1 {
+		return metric, fmt.Errorf("%w: %d bucket counts for %d bounds", repository.ErrInvalidHistogram, len(counts), len(bounds))
+	}
+
+	buckets := make([]repository.Bucket, len(bounds))
+	var running uint64
+	for i, bound := range bounds {
+		if len(counts) > 0 {
+			running += counts[i]
+		}
+		buckets[i] = repository.Bucket{UpperBound: bound, Count: running}
+	}
+	count := point.GetCount()
+	sum := point.GetSum()
+	metric.Buckets = buckets
+	metric.Count = &count
+	metric.Sum = &sum
+	return metric, nil
+}
+
+// otlpNumber значение точки, целые значения приводятся к float64
+func otlpNumber(point *otlp.NumberDataPoint) float64 {
+	if value, ok := point.GetValue().(*otlp.NumberDataPoint_AsInt); ok {
+		return float64(value.AsInt)
+	}
+	return point.GetAsDouble()
+}
+
+// otlpLabels метки из атрибутов attributes поверх base. Возвращает новый набор, base не меняется
+func otlpLabels(base repository.Labels, attributes []*otlp.KeyValue) repository.Labels {
+	if len(base)+len(attributes) == 0 {
+		return nil
+	}
+	labels := make(repository.Labels, len(base)+len(attributes))
+	for key, value := range base {
+		labels[key] = value
+	}
+	for _, attribute := range attributes {
+		labels[attribute.GetKey()] = otlpValueString(attribute.GetValue())
+	}
+	return labels
+}
+
+// otlpValueString строковое представление значения атрибута
+func otlpValueString(value *otlp.AnyValue) string {
+	switch v := value.GetValue().(type) {
+	case *otlp.AnyValue_StringValue:
+		return v.StringValue
+	case *otlp.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *otlp.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *otlp.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *otlp.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case *otlp.AnyValue_ArrayValue:
+		values := make([]string, 0, len(v.ArrayValue.GetValues()))
+		for _, item := range v.ArrayValue.GetValues() {
+			values = append(values, otlpValueString(item))
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	case *otlp.AnyValue_KvlistValue:
+		return "{" + otlpLabels(nil, v.KvlistValue.GetValues()).String() + "}"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ncyellow/devops/internal/otlp"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+// otlpRequestJSON запрос в JSON представлении OTLP, как его отправляет OpenTelemetry SDK
+const otlpRequestJSON = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "billing"}}]},
+    "scopeMetrics": [{
+      "scope": {"name": "app"},
+      "metrics": [
+        {"name": "queue_size", "gauge": {"dataPoints": [{"asInt": "12", "timeUnixNano": "1668000000000000000"}]}},
+        {"name": "requests", "sum": {"aggregationTemporality": 2, "isMonotonic": true,
+          "dataPoints": [{"asInt": "100", "attributes": [{"key": "code", "value": {"intValue": "200"}}]}]}},
+        {"name": "in_flight", "sum": {"aggregationTemporality": 1, "isMonotonic": false,
+          "dataPoints": [{"asDouble": 3}]}},
+        {"name": "latency", "histogram": {"aggregationTemporality": 1,
+          "dataPoints": [{"count": "5", "sum": 1.5, "bucketCounts": ["1", "3", "1"], "explicitBounds": [0.1, 1]}]}},
+        {"name": "summary", "summary": {"dataPoints": [{"count": "1"}]}}
+      ]
+    }]
+  }]
+}`
+
+func postOTLP(t *testing.T, ts *httptest.Server, contentType string, body []byte) (*http.Response, []byte) {
+	req, err := http.NewRequest("POST", ts.URL+"/v1/metrics", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, respBody
+}
+
+func TestOTLPMetricsHandlerJSON(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	resp, body := postOTLP(t, ts, "application/json", []byte(otlpRequestJSON))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "{}", string(body))
+
+	resource := repository.Labels{"service.name": "billing"}
+	gauge, ok := repo.Metric("queue_size", repository.Gauge, resource)
+	require.True(t, ok)
+	assert.Equal(t, 12.0, *gauge.Value)
+
+	inFlight, ok := repo.Metric("in_flight", repository.Gauge, resource)
+	require.True(t, ok)
+	assert.Equal(t, 3.0, *inFlight.Value)
+
+	counter, ok := repo.Metric("requests", repository.Counter, repository.Labels{"service.name": "billing", "code": "200"})
+	require.True(t, ok)
+	assert.Equal(t, int64(100), *counter.Delta)
+
+	histogram, ok := repo.Metric("latency", repository.Histogram, resource)
+	require.True(t, ok)
+	assert.Equal(t, uint64(5), *histogram.Count)
+	assert.Equal(t, []repository.Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: 1, Count: 4}}, histogram.Buckets)
+
+	// повторная отправка: накопленный counter не удваивается, а delta значения прибавляются
+	resp, _ = postOTLP(t, ts, "application/json", []byte(otlpRequestJSON))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	counter, _ = repo.Metric("requests", repository.Counter, repository.Labels{"service.name": "billing", "code": "200"})
+	assert.Equal(t, int64(100), *counter.Delta)
+	inFlight, _ = repo.Metric("in_flight", repository.Gauge, resource)
+	assert.Equal(t, 6.0, *inFlight.Value)
+	histogram, _ = repo.Metric("latency", repository.Histogram, resource)
+	assert.Equal(t, uint64(10), *histogram.Count)
+}
+
+func TestOTLPMetricsHandlerProtobuf(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	request := &otlp.ExportMetricsServiceRequest{
+		ResourceMetrics: []*otlp.ResourceMetrics{{
+			ScopeMetrics: []*otlp.ScopeMetrics{{
+				Metrics: []*otlp.Metric{
+					{Name: "temperature", Data: &otlp.Metric_Gauge{Gauge: &otlp.Gauge{
+						DataPoints: []*otlp.NumberDataPoint{{Value: &otlp.NumberDataPoint_AsDouble{AsDouble: 21.5}}},
+					}}},
+					// корзин больше чем должно быть - точка отклоняется
+					{Name: "broken", Data: &otlp.Metric_Histogram{Histogram: &otlp.Histogram{
+						DataPoints: []*otlp.HistogramDataPoint{{Count: 1, BucketCounts: []uint64{1, 0, 0}, ExplicitBounds: []float64{1}}},
+					}}},
+				},
+			}},
+		}},
+	}
+	data, err := proto.Marshal(request)
+	require.NoError(t, err)
+
+	resp, body := postOTLP(t, ts, "application/x-protobuf", data)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+
+	var response otlp.ExportMetricsServiceResponse
+	require.NoError(t, proto.Unmarshal(body, &response))
+	assert.Equal(t, int64(1), response.GetPartialSuccess().GetRejectedDataPoints())
+	assert.Contains(t, response.GetPartialSuccess().GetErrorMessage(), "broken")
+
+	gauge, ok := repo.Gauge("temperature")
+	assert.True(t, ok)
+	assert.Equal(t, 21.5, gauge)
+
+	resp, body = postOTLP(t, ts, "application/x-protobuf", []byte("garbage"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid deserialization", string(body))
+
+	resp, _ = postOTLP(t, ts, "text/plain", data)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
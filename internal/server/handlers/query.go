@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// QueryMetrics возвращает список метрик в JSON с фильтрацией, сортировкой и постраничной выдачей
+// Параметры запроса:
+// - type - тип метрики, можно указать несколько раз
+// - prefix, glob, regex - фильтры по имени метрики, синтаксис glob как у path.Match
+// - sort - name или type, префикс "-" задает сортировку по убыванию
+// - limit - размер страницы, по умолчанию repository.DefaultQueryLimit
+// - cursor - значение next_cursor из предыдущего ответа
+// @Tags Info
+// @Summary Возвращает список метрик в JSON
+// @ID infoQuery
+// @Produce json
+// @Param type query []string false "тип метрики"
+// @Param prefix query string false "префикс имени"
+// @Param glob query string false "шаблон имени"
+// @Param regex query string false "регулярное выражение для имени"
+// @Param sort query string false "поле сортировки"
+// @Param limit query int false "размер страницы"
+// @Param cursor query string false "курсор следующей страницы"
+// @Success 200 {object} repository.QueryResult
+// @Failure 400 {string} string "invalid query"
+// @Failure 500 {string} string "invalid serialization"
+// @Router /api/metrics [get]
+func (h *Handler) QueryMetrics() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		query, err := parseQuery(r)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+
+		result, err := repository.QueryMetrics(h.repo.ToMetrics(), query)
+		if err != nil {
+			if errors.Is(err, repository.ErrInvalidQuery) || errors.Is(err, repository.ErrInvalidCursor) {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte(err.Error()))
+				return
+			}
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+
+		body, err := json.Marshal(result)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("invalid serialization"))
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(body)
+	}
+}
+
+// errInvalidLimit параметр limit не число
+var errInvalidLimit = errors.New("invalid limit")
+
+// parseQuery параметры выборки из строки запроса
+func parseQuery(r *http.Request) (repository.Query, error) {
+	values := r.URL.Query()
+	query := repository.Query{
+		Types:  values["type"],
+		Prefix: values.Get("prefix"),
+		Glob:   values.Get("glob"),
+		Regex:  values.Get("regex"),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	if limit := values.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return query, errInvalidLimit
+		}
+		query.Limit = value
+	}
+	return query, nil
+}
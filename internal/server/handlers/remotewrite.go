@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/prompb"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// HashHeader заголовок с подписью тела запроса для протоколов, в которых нельзя подписать каждую метрику
+const HashHeader = "HashSHA256"
+
+// RemoteWrite прием метрик по протоколу Prometheus remote_write
+// Тело - сжатый snappy protobuf WriteRequest. Имя метрики берется из метки __name__, остальные метки сохраняются.
+// Ряды, которые в метаданных отмечены как COUNTER или имеют суффикс _total, сохраняются как counter,
+// к которому прибавляются приращения накопленного значения источника (сброс у источника counter не уменьшает),
+// остальные как gauge.
+// Если задан ключ подписи, в заголовке HashSHA256 ожидается подпись сжатого тела запроса
+// @Tags Update
+// @Summary Прием метрик Prometheus remote_write
+// @ID updateRemoteWrite
+// @Accept octet-stream
+// @Produce plain
+// @Success 204
+// @Failure 400 {string} string "incorrect metric sign"
+// @Failure 500 {string} string "failed to save metrics"
+// @Router /api/v1/write [post]
+func (h *Handler) RemoteWrite() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "snappy" {
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			rw.Write([]byte("content encoding not support"))
+			return
+		}
+		reqBody, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Read data problem"))
+			return
+		}
+
+		//! Подписать каждую метрику Prometheus не может, поэтому проверяем подпись всего тела
+		encodeFunc := hash.CreateEncodeFunc(h.conf.SecretKey)
+		if !hash.CheckSign(h.conf.SecretKey, r.Header.Get(HashHeader), encodeFunc(string(reqBody))) {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("incorrect metric sign"))
+			return
+		}
+
+		data, err := snappy.Decode(nil, reqBody)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("invalid snappy data"))
+			return
+		}
+		var writeRequest prompb.WriteRequest
+		if err = proto.Unmarshal(data, &writeRequest); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("invalid deserialization"))
+			return
+		}
+
+		for _, metric := range remoteWriteMetrics(&writeRequest) {
+			err = h.updateSourceMetric(metric)
+			if errors.Is(err, repository.ErrInvalidHistogram) {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte("incorrect histogram"))
+				return
+			}
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("incorrect metric type"))
+				return
+			}
+		}
+
+		err = h.pStore.Save(r.Context())
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("failed to save metrics"))
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// remoteWriteMetrics конвертация WriteRequest в метрики репозитория. Из каждого ряда берется последнее значение,
+// служебные значения NaN (stale маркеры Prometheus) пропускаются. Counter в Prometheus накопительный,
+// поэтому отмечается как cumulative
+func remoteWriteMetrics(writeRequest *prompb.WriteRequest) []sourceMetric {
+	familyTypes := make(map[string]prompb.MetricMetadata_MetricType)
+	for _, metadata := range writeRequest.GetMetadata() {
+		familyTypes[metadata.GetMetricFamilyName()] = metadata.GetType()
+	}
+
+	metrics := make([]sourceMetric, 0, len(writeRequest.GetTimeseries()))
+	for _, series := range writeRequest.GetTimeseries() {
+		var name string
+		var labels repository.Labels
+		for _, label := range series.GetLabels() {
+			if label.GetName() == "__name__" {
+				name = label.GetValue()
+				continue
+			}
+			if labels == nil {
+				labels = make(repository.Labels)
+			}
+			labels[label.GetName()] = label.GetValue()
+		}
+
+		samples := series.GetSamples()
+		if name == "" || len(samples) == 0 {
+			continue
+		}
+		last := samples[0]
+		for _, sample := range samples[1:] {
+			if sample.GetTimestamp() >= last.GetTimestamp() {
+				last = sample
+			}
+		}
+		if math.IsNaN(last.GetValue()) {
+			continue
+		}
+
+		if !remoteWriteIsCounter(name, familyTypes) {
+			value := last.GetValue()
+			metrics = append(metrics, sourceMetric{Metrics: repository.Metrics{ID: name, Labels: labels, MType: repository.Gauge, Value: &value}})
+			continue
+		}
+
+		delta := int64(math.Round(last.GetValue()))
+		metrics = append(metrics, sourceMetric{
+			Metrics:    repository.Metrics{ID: name, Labels: labels, MType: repository.Counter, Delta: &delta},
+			cumulative: true,
+		})
+	}
+	return metrics
+}
+
+// remoteWriteIsCounter определяет является ли ряд name счетчиком. Семейство ищется в метаданных по имени ряда,
+// а для OpenMetrics и по имени без суффикса _total. Если метаданных нет, счетчиком считается ряд с суффиксом _total
+func remoteWriteIsCounter(name string, familyTypes map[string]prompb.MetricMetadata_MetricType) bool {
+	if mType, ok := familyTypes[name]; ok {
+		return mType == prompb.MetricMetadata_COUNTER
+	}
+	if !strings.HasSuffix(name, "_total") {
+		return false
+	}
+	if mType, ok := familyTypes[strings.TrimSuffix(name, "_total")]; ok {
+		return mType == prompb.MetricMetadata_COUNTER
+	}
+	return true
+}
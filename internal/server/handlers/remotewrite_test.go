@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/prompb"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+// encodeWriteRequest сериализация и сжатие WriteRequest так же, как это делает Prometheus
+func encodeWriteRequest(t *testing.T, req *prompb.WriteRequest) []byte {
+	data, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return snappy.Encode(nil, data)
+}
+
+// postRemoteWrite отправка данных remote_write с необязательной подписью
+func postRemoteWrite(t *testing.T, ts *httptest.Server, body []byte, sign string) (int, string) {
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/write", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	if sign != "" {
+		req.Header.Set(HashHeader, sign)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(respBody)
+}
+
+// series ряд remote_write с одним значением
+func series(value float64, timestamp int64, labels ...string) *prompb.TimeSeries {
+	result := &prompb.TimeSeries{Samples: []*prompb.Sample{{Value: value, Timestamp: timestamp}}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		result.Labels = append(result.Labels, &prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	return result
+}
+
+func TestRemoteWriteHandler(t *testing.T) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	body := encodeWriteRequest(t, &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			series(0.5, 1000, "__name__", "node_load1", "instance", "host:9100"),
+			series(100, 1000, "__name__", "http_requests_total", "code", "200"),
+			series(7, 1000, "__name__", "process_restarts"),
+			// ряд без имени пропускается
+			series(1, 1000, "job", "node"),
+		},
+		Metadata: []*prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "process_restarts"},
+		},
+	})
+	status, _ := postRemoteWrite(t, ts, body, "")
+	assert.Equal(t, http.StatusNoContent, status)
+
+	gauge, ok := repo.Metric("node_load1", repository.Gauge, repository.Labels{"instance": "host:9100"})
+	require.True(t, ok)
+	assert.Equal(t, 0.5, *gauge.Value)
+
+	counter, ok := repo.Metric("http_requests_total", repository.Counter, repository.Labels{"code": "200"})
+	require.True(t, ok)
+	assert.Equal(t, int64(100), *counter.Delta)
+
+	restarts, ok := repo.Metric("process_restarts", repository.Counter, nil)
+	require.True(t, ok)
+	assert.Equal(t, int64(7), *restarts.Delta)
+	assert.Equal(t, 3, len(repo.ToMetrics()))
+
+	// counter хранит накопленное значение источника, а не сумму отправок. Берется самое свежее значение ряда
+	counterSeries := series(150, 2000, "__name__", "http_requests_total", "code", "200")
+	counterSeries.Samples = append(counterSeries.Samples, &prompb.Sample{Value: 120, Timestamp: 1500})
+	body = encodeWriteRequest(t, &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{counterSeries}})
+	status, _ = postRemoteWrite(t, ts, body, "")
+	assert.Equal(t, http.StatusNoContent, status)
+
+	counter, ok = repo.Metric("http_requests_total", repository.Counter, repository.Labels{"code": "200"})
+	require.True(t, ok)
+	assert.Equal(t, int64(150), *counter.Delta)
+
+	status, body2 := postRemoteWrite(t, ts, []byte("not snappy"), "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid snappy data", body2)
+}
+
+func TestRemoteWriteHandlerSign(t *testing.T) {
+	conf := config.Config{
+		GeneralConfig: genconfig.GeneralConfig{
+			SecretKey: "secret",
+		},
+	}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	body := encodeWriteRequest(t, &prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{series(0.5, 1000, "__name__", "node_load1")},
+	})
+
+	status, respBody := postRemoteWrite(t, ts, body, "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "incorrect metric sign", respBody)
+	assert.Equal(t, 0, len(repo.ToMetrics()))
+
+	status, _ = postRemoteWrite(t, ts, body, hash.CreateEncodeFunc("secret")(string(body)))
+	assert.Equal(t, http.StatusNoContent, status)
+	_, ok := repo.Gauge("node_load1")
+	assert.True(t, ok)
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+const (
+	// streamHeartbeat период комментария-пинга в SSE, чтобы прокси не закрывали простаивающее соединение
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout за это время клиент SSE или WebSocket должен принять сообщение, иначе соединение закрывается
+	streamWriteTimeout = 10 * time.Second
+)
+
+// errOriginNotAllowed Origin WebSocket запроса не совпадает с адресом сервера и не входит в StreamOrigins
+var errOriginNotAllowed = errors.New("websocket origin not allowed")
+
+type connKey struct{}
+
+// ConnContext - http.Server.ConnContext, сохраняет соединение в контексте запроса.
+// По нему StreamSSE закрывает соединение клиента, который не принимает события
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// writeWithTimeout выполняет запись write и закрывает соединение conn, если она не завершилась за timeout.
+// У http.ResponseWriter нет дедлайна записи, без этого клиент, переставший читать, навсегда занимает обработчик.
+// Без соединения в контексте запись выполняется без ограничения
+func writeWithTimeout(conn net.Conn, timeout time.Duration, write func() error) error {
+	if conn == nil {
+		return write()
+	}
+	timer := time.AfterFunc(timeout, func() {
+		conn.Close()
+	})
+	defer timer.Stop()
+	return write()
+}
+
+// StreamSSE поток изменений метрик в формате Server-Sent Events.
+// Параметр name задает имена метрик и может повторяться, без него передаются все метрики.
+// Сначала передаются текущие значения, затем каждое изменение событием metric с Metrics в JSON.
+// Удаление ряда передается тем же событием с "deleted": true и без значений.
+// Медленный клиент не тормозит запись: пока он не успевает читать, для ряда сохраняется только последнее значение
+// @Tags Info
+// @Summary Поток изменений метрик через SSE
+// @ID infoStreamSSE
+// @Produce text/event-stream
+// @Param name query []string false "имя метрики"
+// @Success 200 {string} string "поток событий metric"
+// @Failure 500 {string} string "streaming not supported"
+// @Router /api/stream [get]
+func (h *Handler) StreamSSE() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("streaming not supported"))
+			return
+		}
+
+		sub := h.repo.Subscribe(r.URL.Query()["name"])
+		defer sub.Close()
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("Connection", "keep-alive")
+		rw.WriteHeader(http.StatusOK)
+
+		conn, _ := r.Context().Value(connKey{}).(net.Conn)
+		send := func(write func() error) error {
+			return writeWithTimeout(conn, streamWriteTimeout, func() error {
+				if err := write(); err != nil {
+					return err
+				}
+				flusher.Flush()
+				return nil
+			})
+		}
+
+		if err := send(func() error { return writeSSE(rw, repository.CurrentValues(h.repo, sub)) }); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			var err error
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				err = send(func() error {
+					_, err := io.WriteString(rw, ": ping\n\n")
+					return err
+				})
+			case <-sub.Ready():
+				err = send(func() error { return writeSSE(rw, sub.Pop()) })
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeSSE записывает метрики событиями metric
+func writeSSE(w io.Writer, metrics []repository.Metrics) error {
+	for _, metric := range metrics {
+		data, err := json.Marshal(metric)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: metric\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamWebSocket поток изменений метрик через WebSocket, каждое сообщение - Metrics в JSON.
+// Фильтр и порядок передачи такие же, как у StreamSSE. Клиент, который не принял сообщение
+// за streamWriteTimeout, отключается. Соединения из браузера принимаются только с Origin сервера
+// или из списка StreamOrigins, чтобы чужая страница не читала метрики от имени пользователя
+// @Tags Info
+// @Summary Поток изменений метрик через WebSocket
+// @ID infoStreamWebSocket
+// @Param name query []string false "имя метрики"
+// @Success 101 {string} string "switching protocols"
+// @Router /api/ws [get]
+func (h *Handler) StreamWebSocket() http.HandlerFunc {
+	server := websocket.Server{Handler: h.serveWebSocket, Handshake: h.checkOrigin}
+	return server.ServeHTTP
+}
+
+// checkOrigin Handshake WebSocket сервера. Запрос без Origin - не из браузера и принимается.
+// Иначе хост Origin должен совпадать с Host запроса либо Origin должен быть в StreamOrigins
+func (h *Handler) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return nil
+	}
+	config.Origin = origin
+	if strings.EqualFold(origin.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range h.conf.StreamOrigins {
+		if sameOrigin(origin, strings.TrimSpace(allowed)) {
+			return nil
+		}
+	}
+	return errOriginNotAllowed
+}
+
+// sameOrigin совпадают ли схема и хост origin с разрешенным origin allowed, например https://grafana.local
+func sameOrigin(origin *url.URL, allowed string) bool {
+	u, err := url.Parse(allowed)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, origin.Scheme) && strings.EqualFold(u.Host, origin.Host)
+}
+
+// serveWebSocket обработка одного WebSocket соединения
+func (h *Handler) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	sub := h.repo.Subscribe(ws.Request().URL.Query()["name"])
+	defer sub.Close()
+
+	// входящие сообщения не ожидаются, чтение нужно только чтобы узнать о закрытии соединения клиентом
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		cancel()
+	}()
+
+	if err := sendWebSocket(ws, repository.CurrentValues(h.repo, sub)); err != nil {
+		return
+	}
+	for {
+		metrics, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if err := sendWebSocket(ws, metrics); err != nil {
+			return
+		}
+	}
+}
+
+// sendWebSocket отправляет метрики отдельными сообщениями
+func sendWebSocket(ws *websocket.Conn, metrics []repository.Metrics) error {
+	for _, metric := range metrics {
+		ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := websocket.JSON.Send(ws, metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+// newStreamTestServer сервер с одной метрикой testGauge = 1
+func newStreamTestServer(t *testing.T) (*httptest.Server, repository.Repository) {
+	conf := config.Config{}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	repo.UpdateGauge("testGauge", 1)
+	return httptest.NewServer(NewRouter(repo, &conf, pStore)), repo
+}
+
+// readSSEMetric читает из потока следующее событие metric
+func readSSEMetric(t *testing.T, reader *bufio.Reader) repository.Metrics {
+	var metric repository.Metrics
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, "data: ") {
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &metric))
+			return metric
+		}
+	}
+}
+
+// TestStreamSSE проверяем что SSE поток передает текущие значения и затем изменения только нужных метрик
+func TestStreamSSE(t *testing.T) {
+	ts, repo := newStreamTestServer(t)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/stream?name=testGauge&name=testCounter", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+
+	reader := bufio.NewReader(resp.Body)
+	metric := readSSEMetric(t, reader)
+	assert.Equal(t, "testGauge", metric.ID)
+	assert.Equal(t, 1.0, *metric.Value)
+
+	repo.UpdateGauge("otherGauge", 10)
+	repo.UpdateCounter("testCounter", 5)
+	metric = readSSEMetric(t, reader)
+	assert.Equal(t, "testCounter", metric.ID)
+	assert.Equal(t, int64(5), *metric.Delta)
+}
+
+// TestStreamWebSocket проверяем что WebSocket поток передает текущие значения и затем изменения
+func TestStreamWebSocket(t *testing.T) {
+	ts, repo := newStreamTestServer(t)
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/ws?name=testGauge", "", ts.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var metric repository.Metrics
+	require.NoError(t, websocket.JSON.Receive(ws, &metric))
+	assert.Equal(t, "testGauge", metric.ID)
+	assert.Equal(t, 1.0, *metric.Value)
+
+	repo.UpdateGauge("otherGauge", 10)
+	repo.UpdateGauge("testGauge", 2)
+	require.NoError(t, websocket.JSON.Receive(ws, &metric))
+	assert.Equal(t, "testGauge", metric.ID)
+	assert.Equal(t, 2.0, *metric.Value)
+}
+
+// TestStreamWebSocketOrigin проверяем что WebSocket принимает Origin сервера, разрешенные Origin и клиентов без Origin
+func TestStreamWebSocketOrigin(t *testing.T) {
+	conf := config.Config{StreamOrigins: []string{"https://grafana.local"}}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws"
+
+	tests := []struct {
+		name    string
+		origin  string
+		wantErr bool
+	}{
+		{name: "origin сервера", origin: ts.URL},
+		{name: "разрешенный origin", origin: "https://grafana.local"},
+		{name: "другая схема", origin: "http://grafana.local", wantErr: true},
+		{name: "чужой origin", origin: "https://evil.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, err := websocket.Dial(url, "", tt.origin)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			ws.Close()
+		})
+	}
+
+	// клиент не из браузера Origin не передает
+	host := strings.TrimPrefix(ts.URL, "http://")
+	conn, err := net.Dial("tcp", host)
+	require.NoError(t, err)
+	req := "GET /api/ws HTTP/1.1\r\nHost: " + host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	_, err = conn.Write([]byte(req))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+}
+
+// TestWriteWithTimeout проверяем что соединение закрывается, если клиент не принимает данные
+func TestWriteWithTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	//! запись в net.Pipe блокируется, пока другая сторона не прочитает данные
+	done := make(chan error, 1)
+	go func() {
+		done <- writeWithTimeout(server, 50*time.Millisecond, func() error {
+			_, err := server.Write([]byte("data"))
+			return err
+		})
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("запись не прервана")
+	}
+
+	// без соединения запись выполняется как есть
+	assert.NoError(t, writeWithTimeout(nil, time.Millisecond, func() error { return nil }))
+}
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/ncyellow/devops/internal/apierror"
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/middlewares"
+)
+
+// UpdateResult ответ /api/v2/updates - число примененных метрик
+type UpdateResult struct {
+	Updated int `json:"updated"`
+}
+
+// routeV2 маршруты /api/v2. В отличие от первой версии все ошибки отдаются в формате problem+json (RFC 7807):
+// - 400 запрос или тело не разобраны, 415 тело не json
+// - 422 метрики не прошли проверку, в errors ошибки каждой метрики
+// - 404 метрика или маршрут не найдены, 405 метод не поддерживается
+// - 401 токен не передан или неизвестен, 403 у токена нет нужного права
+// - 429 клиент превысил ограничение частоты записи
+// - 500 ошибка хранилища или сервера
+func (h *Handler) routeV2(r chi.Router) {
+	r.NotFound(func(rw http.ResponseWriter, r *http.Request) {
+		apierror.NewProblem(http.StatusNotFound, apierror.CodeNotFound, "route not found").Write(rw, r)
+	})
+	r.MethodNotAllowed(func(rw http.ResponseWriter, r *http.Request) {
+		apierror.NewProblem(http.StatusMethodNotAllowed, apierror.CodeInvalidRequest, "method not allowed").Write(rw, r)
+	})
+	ingest := r.With(h.requireV2(middlewares.ScopeIngest), h.rateLimitV2, middlewares.Decompress(h.conf.MaxBodySize))
+	read := r.With(h.requireV2(middlewares.ScopeRead))
+	admin := r.With(h.requireV2(middlewares.ScopeAdmin))
+	ingest.Post("/update", h.UpdateV2())
+	ingest.Post("/updates", h.UpdateListV2())
+	read.Post("/value", h.ValueV2())
+	read.Get("/value/{metricType}/{metricName}", h.GetValueV2())
+	admin.Delete("/value/{metricType}/{metricName}", h.DeleteValueV2())
+	read.Get("/metrics", h.QueryMetricsV2())
+}
+
+// UpdateV2 обновляет метрику из json body и возвращает ее новое значение
+// @Tags Storage
+// @Summary обновление метрики, версия 2
+// @Description подпись проверяется как в UpdateJSON, ошибки в формате problem+json
+// @ID storageUpdateV2
+// @Accept json
+// @Produce json
+// @Param metric_data body Metrics true "Metric object"
+// @Success 200 {object} Metrics
+// @Failure 400 {object} apierror.Problem
+// @Failure 415 {object} apierror.Problem
+// @Failure 422 {object} apierror.Problem
+// @Failure 500 {object} apierror.Problem
+// @Router /api/v2/update [post]
+func (h *Handler) UpdateV2() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var metric repository.Metrics
+		if problem := h.readJSON(r, false, &metric); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+
+		if _, problem := h.applyMetrics([]repository.Metrics{metric}); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+		if err := h.pStore.Save(r.Context()); err != nil {
+			apierror.NewProblem(http.StatusInternalServerError, apierror.CodeStorage, "failed to save metrics").Write(rw, r)
+			return
+		}
+		h.writeMetric(rw, r, metric.ID, metric.MType, metric.Labels)
+	}
+}
+
+// UpdateListV2 обновляет все метрики из json body.
+// Сначала проверяются все метрики, и если хотя бы одна некорректна, ничего не применяется, а в ответе 422
+// перечислены ошибки каждой метрики. Несовпадение корзин гистограммы с уже сохраненными выясняется только при
+// применении, такие метрики тоже перечисляются в ответе 422, а остальные метрики пачки сохраняются
+// @Tags Storage
+// @Summary обновление списка метрик, версия 2
+// @Description подпись проверяется как в UpdateListJSON, ошибки в формате problem+json с ошибками каждой метрики
+// @ID storageUpdateListV2
+// @Accept json
+// @Produce json
+// @Param metric_data body []Metrics true "Metrics list object"
+// @Success 200 {object} UpdateResult
+// @Failure 400 {object} apierror.Problem
+// @Failure 415 {object} apierror.Problem
+// @Failure 422 {object} apierror.Problem
+// @Failure 500 {object} apierror.Problem
+// @Router /api/v2/updates [post]
+func (h *Handler) UpdateListV2() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var metrics []repository.Metrics
+		if problem := h.readJSON(r, true, &metrics); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+
+		updated, problem := h.applyMetrics(metrics)
+		if updated > 0 {
+			if err := h.pStore.Save(r.Context()); err != nil {
+				apierror.NewProblem(http.StatusInternalServerError, apierror.CodeStorage, "failed to save metrics").Write(rw, r)
+				return
+			}
+		}
+		if problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+		writeJSON(rw, r, UpdateResult{Updated: updated})
+	}
+}
+
+// ValueV2 возвращает значение метрики, параметры которой переданы в json body
+// @Tags Info
+// @Summary Возвращает состояние метрики в формате json, версия 2
+// @ID infoValueV2
+// @Accept json
+// @Produce json
+// @Param ID body string true "Metric name"
+// @Param MType body string true "Metric type"
+// @Success 200 {object} Metrics
+// @Failure 400 {object} apierror.Problem
+// @Failure 404 {object} apierror.Problem
+// @Failure 415 {object} apierror.Problem
+// @Router /api/v2/value [post]
+func (h *Handler) ValueV2() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var metric repository.Metrics
+		if problem := h.readJSON(r, false, &metric); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+		if problem := checkMetricType(metric.MType); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+		h.writeMetric(rw, r, metric.ID, metric.MType, metric.Labels)
+	}
+}
+
+// GetValueV2 возвращает значение метрики в json, тип и имя передаются в url
+// @Tags Info
+// @Summary Возвращает состояние метрики в формате json, версия 2
+// @ID infoGetValueV2
+// @Produce json
+// @Param metricType path string true "Metric type"
+// @Param metricName path string true "Metric name"
+// @Success 200 {object} Metrics
+// @Failure 400 {object} apierror.Problem
+// @Failure 404 {object} apierror.Problem
+// @Router /api/v2/value/{metricType}/{metricName} [get]
+func (h *Handler) GetValueV2() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		metricType := chi.URLParam(r, "metricType")
+		if problem := checkMetricType(metricType); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+		h.writeMetric(rw, r, chi.URLParam(r, "metricName"), metricType, nil)
+	}
+}
+
+// DeleteValueV2 удаляет метрику, с параметром reset=true обнуляет counter. Поведение как у DeleteValue
+// @Tags Storage
+// @Summary Удаление метрики или обнуление counter, версия 2
+// @ID storageDeleteV2
+// @Produce json
+// @Param metricType path string true "Metric type"
+// @Param metricName path string true "Metric name"
+// @Param reset query bool false "обнулить counter вместо удаления"
+// @Param label query []string false "метка ряда в виде имя=значение"
+// @Success 204
+// @Failure 400 {object} apierror.Problem
+// @Failure 404 {object} apierror.Problem
+// @Failure 500 {object} apierror.Problem
+// @Router /api/v2/value/{metricType}/{metricName} [delete]
+func (h *Handler) DeleteValueV2() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		metricType := chi.URLParam(r, "metricType")
+		metricName := chi.URLParam(r, "metricName")
+		if problem := checkMetricType(metricType); problem != nil {
+			problem.Write(rw, r)
+			return
+		}
+		labels, err := labelsFromQuery(r)
+		if err != nil {
+			apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error()).Write(rw, r)
+			return
+		}
+
+		if r.URL.Query().Get("reset") == "true" {
+			if metricType != repository.Counter {
+				apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidRequest,
+					"reset is supported only for counter").Write(rw, r)
+				return
+			}
+			if !h.repo.ResetCounter(metricName, labels) {
+				apierror.NewProblem(http.StatusNotFound, apierror.CodeNotFound, "metric not found").Write(rw, r)
+				return
+			}
+			err = h.pStore.Save(r.Context())
+		} else {
+			if !h.repo.Delete(metricName, metricType, labels) {
+				apierror.NewProblem(http.StatusNotFound, apierror.CodeNotFound, "metric not found").Write(rw, r)
+				return
+			}
+			err = h.pStore.Delete(r.Context(), []repository.Metrics{{ID: metricName, MType: metricType, Labels: labels}})
+		}
+		if err != nil {
+			apierror.NewProblem(http.StatusInternalServerError, apierror.CodeStorage, "failed to save metrics").Write(rw, r)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// QueryMetricsV2 выборка метрик с параметрами как у QueryMetrics, ошибки в формате problem+json
+// @Tags Info
+// @Summary Возвращает список метрик в JSON, версия 2
+// @ID infoQueryV2
+// @Produce json
+// @Param type query []string false "тип метрики"
+// @Param prefix query string false "префикс имени"
+// @Param glob query string false "шаблон имени"
+// @Param regex query string false "регулярное выражение для имени"
+// @Param sort query string false "поле сортировки"
+// @Param limit query int false "размер страницы"
+// @Param cursor query string false "курсор следующей страницы"
+// @Success 200 {object} repository.QueryResult
+// @Failure 400 {object} apierror.Problem
+// @Router /api/v2/metrics [get]
+func (h *Handler) QueryMetricsV2() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		query, err := parseQuery(r)
+		if err != nil {
+			apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error()).Write(rw, r)
+			return
+		}
+		result, err := repository.QueryMetrics(h.repo.ToMetrics(), query)
+		if errors.Is(err, repository.ErrInvalidQuery) || errors.Is(err, repository.ErrInvalidCursor) {
+			apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error()).Write(rw, r)
+			return
+		}
+		if err != nil {
+			apierror.NewProblem(http.StatusInternalServerError, apierror.CodeInternal, err.Error()).Write(rw, r)
+			return
+		}
+		writeJSON(rw, r, result)
+	}
+}
+
+// requireV2 проверка токена как у middlewares.Authenticator, но с ответами 401 и 403 в формате problem+json
+func (h *Handler) requireV2(scope middlewares.Scope) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r, status, err := h.auth.AuthorizeRequest(r, scope)
+			if err != nil {
+				code := apierror.CodeUnauthorized
+				if status == http.StatusForbidden {
+					code = apierror.CodeForbidden
+				}
+				rw.Header().Set("WWW-Authenticate", middlewares.WWWAuthenticate(scope, err))
+				apierror.NewProblem(status, code, err.Error()).Write(rw, r)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// rateLimitV2 ограничение частоты запросов как у middlewares.RateLimiter, но с ответом 429 в формате problem+json
+func (h *Handler) rateLimitV2(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if ok, wait := h.limiter.Allow(h.limiter.RequestKey(r)); !ok {
+			rw.Header().Set("Retry-After", middlewares.RetryAfter(wait))
+			apierror.NewProblem(http.StatusTooManyRequests, apierror.CodeRateLimited, "too many requests").Write(rw, r)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// readJSON читает json тело запроса в value. Если decrypt и задан декодер, тело сначала расшифровывается
+func (h *Handler) readJSON(r *http.Request, decrypt bool, value interface{}) *apierror.Problem {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return apierror.NewProblem(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType,
+			"content type must be application/json")
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		return apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidBody, "failed to read body")
+	}
+	if decrypt && h.decoder != nil {
+		body, err = h.decrypt(body)
+		if errors.Is(err, middlewares.ErrBodyTooLarge) {
+			return apierror.NewProblem(http.StatusRequestEntityTooLarge, apierror.CodeInvalidBody, err.Error())
+		}
+		if err != nil {
+			return apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidBody, "failed to decrypt body")
+		}
+	}
+	if err := json.Unmarshal(body, value); err != nil {
+		return apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidBody, "invalid json: "+err.Error())
+	}
+	return nil
+}
+
+// applyMetrics проверяет и применяет метрики, возвращает число примененных метрик и ошибку 422 с ошибками метрик
+func (h *Handler) applyMetrics(metrics []repository.Metrics) (int, *apierror.Problem) {
+	if errs := apierror.CheckMetrics(h.conf.SecretKey, metrics); errs != nil {
+		return 0, apierror.NewProblem(http.StatusUnprocessableEntity, apierror.CodeInvalidMetrics,
+			fmt.Sprintf("%d of %d metrics are invalid, nothing was updated", len(errs), len(metrics))).WithErrors(errs)
+	}
+
+	var errs []apierror.MetricError
+	for i, metric := range metrics {
+		if err := h.repo.UpdateMetric(metric); err != nil {
+			errs = append(errs, apierror.NewMetricError(i, metric, err))
+		}
+	}
+	updated := len(metrics) - len(errs)
+	if errs != nil {
+		return updated, apierror.NewProblem(http.StatusUnprocessableEntity, apierror.CodeInvalidMetrics,
+			fmt.Sprintf("%d of %d metrics were rejected, the rest were updated", len(errs), len(metrics))).WithErrors(errs)
+	}
+	return updated, nil
+}
+
+// writeMetric отправляет подписанное значение метрики либо 404
+func (h *Handler) writeMetric(rw http.ResponseWriter, r *http.Request, name, mType string, labels repository.Labels) {
+	metric, ok := h.repo.Metric(name, mType, labels)
+	if !ok {
+		apierror.NewProblem(http.StatusNotFound, apierror.CodeNotFound, "metric not found").Write(rw, r)
+		return
+	}
+	metric.Hash = metric.CalcHash(hash.CreateEncodeFunc(h.conf.SecretKey))
+	writeJSON(rw, r, metric)
+}
+
+// writeJSON отправляет value в json
+func writeJSON(rw http.ResponseWriter, r *http.Request, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		apierror.NewProblem(http.StatusInternalServerError, apierror.CodeInternal, "invalid serialization").Write(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// checkMetricType ошибка 400 для неизвестного типа метрики
+func checkMetricType(mType string) *apierror.Problem {
+	switch mType {
+	case repository.Gauge, repository.Counter, repository.Histogram:
+		return nil
+	}
+	return apierror.NewProblem(http.StatusBadRequest, apierror.CodeInvalidRequest, "unknown metric type "+mType)
+}
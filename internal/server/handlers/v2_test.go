@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/apierror"
+	"github.com/ncyellow/devops/internal/hash"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+// runProblemRequest выполняет запрос и разбирает ответ problem+json
+func runProblemRequest(t *testing.T, ts *httptest.Server, method, path, contentType string, body []byte) (*http.Response, apierror.Problem) {
+	resp, respBody := runTestRequest(t, ts, method, path, contentType, body)
+	resp.Body.Close()
+	assert.Equal(t, apierror.ProblemContentType, resp.Header.Get("Content-Type"), path)
+	var problem apierror.Problem
+	require.NoError(t, json.Unmarshal([]byte(respBody), &problem), respBody)
+	return resp, problem
+}
+
+// TestAPIV2Errors проверяем коды и формат ошибок /api/v2
+func TestAPIV2Errors(t *testing.T) {
+	conf := config.Config{}
+	conf.SecretKey = "secret"
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		statusCode  int
+		code        apierror.Code
+	}{
+		{"not json", "POST", "/api/v2/update", "text/plain", `{}`, http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType},
+		{"broken json", "POST", "/api/v2/update", "application/json", `{"id":`, http.StatusBadRequest, apierror.CodeInvalidBody},
+		{"unknown type", "POST", "/api/v2/update", "application/json", `{"id":"test","type":"summary"}`, http.StatusUnprocessableEntity, apierror.CodeInvalidMetrics},
+		{"gauge without value", "POST", "/api/v2/update", "application/json", `{"id":"test","type":"gauge"}`, http.StatusUnprocessableEntity, apierror.CodeInvalidMetrics},
+		{"wrong sign", "POST", "/api/v2/update", "application/json", `{"id":"test","type":"gauge","value":1,"hash":"bad"}`, http.StatusUnprocessableEntity, apierror.CodeInvalidMetrics},
+		{"value not found", "POST", "/api/v2/value", "application/json; charset=utf-8", `{"id":"test","type":"gauge"}`, http.StatusNotFound, apierror.CodeNotFound},
+		{"value unknown type", "GET", "/api/v2/value/summary/test", "", "", http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"delete not found", "DELETE", "/api/v2/value/gauge/test", "", "", http.StatusNotFound, apierror.CodeNotFound},
+		{"reset gauge", "DELETE", "/api/v2/value/gauge/test?reset=true", "", "", http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"delete invalid label", "DELETE", "/api/v2/value/gauge/test?label==web01", "", "", http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"invalid limit", "GET", "/api/v2/metrics?limit=ten", "", "", http.StatusBadRequest, apierror.CodeInvalidRequest},
+		{"unknown route", "GET", "/api/v2/unknown", "", "", http.StatusNotFound, apierror.CodeNotFound},
+		{"wrong method", "GET", "/api/v2/update", "", "", http.StatusMethodNotAllowed, apierror.CodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, problem := runProblemRequest(t, ts, tt.method, tt.path, tt.contentType, []byte(tt.body))
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.statusCode, problem.Status)
+			assert.Equal(t, tt.code, problem.Code)
+			assert.Equal(t, tt.code.TypeURI(), problem.Type)
+			assert.Equal(t, http.StatusText(tt.statusCode), problem.Title)
+			assert.Equal(t, strings.Split(tt.path, "?")[0], problem.Instance)
+		})
+	}
+}
+
+// TestAPIV2Updates проверяем обновление пачки: ошибки каждой метрики и то, что некорректная пачка не применяется
+func TestAPIV2Updates(t *testing.T) {
+	conf := config.Config{}
+	conf.SecretKey = "secret"
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	encodeFunc := hash.CreateEncodeFunc(conf.SecretKey)
+	value := 1.5
+	delta := int64(7)
+	gauge := repository.Metrics{ID: "testGauge", MType: repository.Gauge, Value: &value}
+	gauge.Hash = gauge.CalcHash(encodeFunc)
+	counter := repository.Metrics{ID: "testCounter", MType: repository.Counter, Delta: &delta}
+	counter.Hash = counter.CalcHash(encodeFunc)
+
+	// вторая метрика без подписи, третья без значения - пачка отклоняется целиком
+	body, _ := json.Marshal([]repository.Metrics{gauge, {ID: "testCounter", MType: repository.Counter, Delta: &delta},
+		{ID: "testGauge", MType: repository.Gauge}})
+	resp, problem := runProblemRequest(t, ts, "POST", "/api/v2/updates", "application/json", body)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Len(t, problem.Errors, 2)
+	assert.Equal(t, apierror.MetricError{Index: 1, ID: "testCounter", MType: repository.Counter,
+		Code: apierror.CodeInvalidSign, Detail: "incorrect metric sign"}, problem.Errors[0])
+	assert.Equal(t, 2, problem.Errors[1].Index)
+	assert.Equal(t, apierror.CodeInvalidMetric, problem.Errors[1].Code)
+	_, ok := repo.Gauge("testGauge")
+	assert.False(t, ok)
+
+	body, _ = json.Marshal([]repository.Metrics{gauge, counter})
+	resp, respBody := runTestRequest(t, ts, "POST", "/api/v2/updates", "application/json", body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"updated":2}`, respBody)
+
+	body, _ = json.Marshal(counter)
+	resp, respBody = runTestRequest(t, ts, "POST", "/api/v2/update", "application/json", body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var updated repository.Metrics
+	require.NoError(t, json.Unmarshal([]byte(respBody), &updated))
+	assert.Equal(t, int64(14), *updated.Delta)
+	assert.Equal(t, updated.CalcHash(encodeFunc), updated.Hash)
+
+	resp, respBody = runTestRequest(t, ts, "GET", "/api/v2/value/gauge/testGauge", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, respBody, `"value":1.5`)
+
+	resp, _ = runTestRequest(t, ts, "DELETE", "/api/v2/value/counter/testCounter?reset=true", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	val, _ := repo.Counter("testCounter")
+	assert.Equal(t, int64(0), val)
+}
+
+// TestRateLimit проверяем ограничение частоты записи: 429 в первой версии и problem+json во второй
+func TestRateLimit(t *testing.T) {
+	conf := config.Config{RateLimit: 0.001, RateBurst: 1}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	resp, _ := runTestRequest(t, ts, "POST", "/update/gauge/testGauge/1", "text/plain", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := runTestRequest(t, ts, "POST", "/update/gauge/testGauge/2", "text/plain", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "too many requests", body)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	resp, problem := runProblemRequest(t, ts, "POST", "/api/v2/updates", "application/json", []byte(`[]`))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, apierror.CodeRateLimited, problem.Code)
+
+	// чтение не ограничивается
+	resp, body = runTestRequest(t, ts, "GET", "/value/gauge/testGauge", "text/plain", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1.000", body)
+}
+
+func TestTokens(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, ioutil.WriteFile(tokensFile, []byte(`{"tokens": [
+		{"token": "agent-token", "agent": "agent1", "scopes": ["ingest"]},
+		{"token": "reader-token", "agent": "dashboard", "scopes": ["read"]}
+	]}`), 0600))
+	conf := config.Config{TokensFile: tokensFile}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	pStore, _ := storage.NewFakeStorage()
+	ts := httptest.NewServer(NewRouter(repo, &conf, pStore))
+	defer ts.Close()
+
+	request := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(`[]`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "ping without token", method: "GET", path: "/ping", status: http.StatusOK},
+		{name: "update without token", method: "POST", path: "/update/gauge/testGauge/1", status: http.StatusUnauthorized},
+		{name: "update with unknown token", method: "POST", path: "/update/gauge/testGauge/1", token: "other", status: http.StatusUnauthorized},
+		{name: "update with ingest token", method: "POST", path: "/update/gauge/testGauge/1", token: "agent-token", status: http.StatusOK},
+		{name: "update with read token", method: "POST", path: "/update/gauge/testGauge/2", token: "reader-token", status: http.StatusForbidden},
+		{name: "value with ingest token", method: "GET", path: "/value/gauge/testGauge", token: "agent-token", status: http.StatusForbidden},
+		{name: "value with read token", method: "GET", path: "/value/gauge/testGauge", token: "reader-token", status: http.StatusOK},
+		{name: "delete with read token", method: "DELETE", path: "/value/gauge/testGauge", token: "reader-token", status: http.StatusForbidden},
+		{name: "profiler with read token", method: "GET", path: "/debug/pprof/", token: "reader-token", status: http.StatusForbidden},
+		{name: "v2 updates with ingest token", method: "POST", path: "/api/v2/updates", token: "agent-token", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, request(tt.method, tt.path, tt.token).StatusCode)
+		})
+	}
+
+	// сжатое тело распаковывается только после проверки токена: без токена 401, с токеном поврежденные данные - 400
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "agent-token": http.StatusBadRequest} {
+		req, err := http.NewRequest("POST", ts.URL+"/updates/", strings.NewReader("not gzip"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, token)
+	}
+
+	// v2 отвечает problem+json
+	resp, problem := runProblemRequest(t, ts, "GET", "/api/v2/metrics", "application/json", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, apierror.CodeUnauthorized, problem.Code)
+	assert.Equal(t, `Bearer realm="devops"`, resp.Header.Get("WWW-Authenticate"))
+}
@@ -4,11 +4,13 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/ncyellow/devops/internal/crypto/tlsconfig"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/ncyellow/devops/internal/server/config"
 	"github.com/ncyellow/devops/internal/server/handlers"
@@ -34,9 +36,28 @@ func (s *HTTPServer) RunServer() {
 	// Поднимаем текущие данные по метриками
 	saver.Load()
 
+	if statsdServer := startStatsD(s.Conf, repo, saver); statsdServer != nil {
+		defer statsdServer.Stop()
+	}
+	if graphiteServer := startGraphite(s.Conf, repo, saver); graphiteServer != nil {
+		defer graphiteServer.Stop()
+	}
+
+	// Контекст запросов отменяется при Shutdown, иначе открытые потоки SSE и WebSocket не дадут серверу завершиться
+	baseCtx, cancelStreams := context.WithCancel(context.Background())
 	srv := http.Server{
-		Addr:    s.Conf.Address,
-		Handler: handlers.NewRouter(repo, s.Conf, saver),
+		Addr:        s.Conf.Address,
+		Handler:     handlers.NewRouter(repo, s.Conf, saver),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+		ConnContext: handlers.ConnContext,
+	}
+	srv.RegisterOnShutdown(cancelStreams)
+	if s.Conf.TLSCert != "" {
+		tlsConf, err := tlsconfig.Server(s.Conf.TLSCert, s.Conf.TLSKey, s.Conf.TLSCA)
+		if err != nil {
+			log.Fatal().Msgf("не удалось загрузить сертификат сервера %s", err.Error())
+		}
+		srv.TLSConfig = tlsConf
 	}
 
 	done := make(chan os.Signal, 1)
@@ -61,12 +82,20 @@ func (s *HTTPServer) RunServer() {
 	}()
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			// сертификат уже загружен в TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Error().Msgf("listen: %s", err)
 		}
 	}()
 
 	go storage.RunStorageSaver(saver, s.Conf.StoreInterval.Duration)
+	go storage.RunMetricExpirer(repo, saver, repository.ExpireInterval(s.Conf.GeneralCfg()))
 
 	<-idleConnsClosed
 	log.Info().Msg("Server Shutdown gracefully")
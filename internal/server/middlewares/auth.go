@@ -0,0 +1,395 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/ncyellow/devops/internal/apierror"
+)
+
+// Scope право доступа токена
+type Scope string
+
+const (
+	// ScopeIngest запись метрик
+	ScopeIngest Scope = "ingest"
+	// ScopeRead чтение метрик
+	ScopeRead Scope = "read"
+	// ScopeAdmin удаление и сброс метрик, профилирование. Включает ingest и read
+	ScopeAdmin Scope = "admin"
+	// ScopeNone доступ без токена
+	ScopeNone Scope = ""
+)
+
+// tokensReloadInterval как часто проверяется изменение файла токенов
+const tokensReloadInterval = 5 * time.Second
+
+var (
+	// ErrUnauthenticated токен не передан, неизвестен или отозван
+	ErrUnauthenticated = errors.New("invalid or missing token")
+	// ErrForbidden у токена нет нужного права
+	ErrForbidden = errors.New("insufficient scope")
+)
+
+// TokenConfig описание токена в файле токенов. Токен задается открытым текстом в Token либо sha256 хешем
+// в hex в SHA256, чтобы файл не содержал самих токенов. Certificate - имя клиента из сертификата взаимного tls,
+// такой клиент без токена получает права Scopes этой записи. Revoked отзывает токен и сертификат без удаления записи
+type TokenConfig struct {
+	Token       string  `json:"token,omitempty"`
+	SHA256      string  `json:"sha256,omitempty"`
+	Certificate string  `json:"certificate,omitempty"`
+	Agent       string  `json:"agent"`
+	Scopes      []Scope `json:"scopes"`
+	Revoked     bool    `json:"revoked,omitempty"`
+}
+
+// TokensFile формат файла токенов
+type TokensFile struct {
+	Tokens []TokenConfig `json:"tokens"`
+}
+
+// Identity агент, которому выдан токен, и его права
+type Identity struct {
+	Agent  string
+	Scopes []Scope
+}
+
+// HasScope есть ли у агента право scope. Право admin включает все остальные
+func (i Identity) HasScope(scope Scope) bool {
+	if scope == ScopeNone {
+		return true
+	}
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// WithIdentity контекст с агентом, прошедшим проверку токена
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext агент, прошедший проверку токена. false если проверка выключена или не проводилась
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// Authenticator проверка bearer токенов и сертификатов клиентов по файлу токенов.
+// Изменения файла подхватываются без перезапуска, так что отзыв токена одного агента не затрагивает остальных
+type Authenticator struct {
+	fileName string
+	now      func() time.Time
+
+	lock      *sync.RWMutex
+	tokens    map[[sha256.Size]byte]Identity
+	certs     map[string]Identity
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewAuthenticator - конструктор. Пустой fileName выключает проверку токенов.
+// Если файл не прочитан, ошибка возвращается, но проверка остается включенной и не пропускает ни один токен,
+// пока файл не будет исправлен
+func NewAuthenticator(fileName string) (*Authenticator, error) {
+	a := &Authenticator{
+		fileName: fileName,
+		now:      time.Now,
+		lock:     &sync.RWMutex{},
+		tokens:   make(map[[sha256.Size]byte]Identity),
+		certs:    make(map[string]Identity),
+	}
+	if fileName == "" {
+		return a, nil
+	}
+	a.lastCheck = a.now()
+	return a, a.Reload()
+}
+
+// Enabled включена ли проверка токенов
+func (a *Authenticator) Enabled() bool {
+	return a.fileName != ""
+}
+
+// Reload перечитывает файл токенов. При ошибке остаются прежние токены
+func (a *Authenticator) Reload() error {
+	info, err := os.Stat(a.fileName)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(a.fileName)
+	if err != nil {
+		return err
+	}
+	tokens, certs, err := parseTokens(data)
+	if err != nil {
+		return fmt.Errorf("tokens file %s: %w", a.fileName, err)
+	}
+
+	a.lock.Lock()
+	a.tokens = tokens
+	a.certs = certs
+	a.modTime = info.ModTime()
+	a.lock.Unlock()
+	return nil
+}
+
+// parseTokens разбирает файл токенов в словари sha256 токена - агент и имя из сертификата - агент
+func parseTokens(data []byte) (map[[sha256.Size]byte]Identity, map[string]Identity, error) {
+	var file TokensFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, err
+	}
+	tokens := make(map[[sha256.Size]byte]Identity, len(file.Tokens))
+	certs := make(map[string]Identity)
+	for i, token := range file.Tokens {
+		if token.Agent == "" {
+			return nil, nil, fmt.Errorf("token %d: agent is required", i)
+		}
+		for _, scope := range token.Scopes {
+			if scope != ScopeIngest && scope != ScopeRead && scope != ScopeAdmin {
+				return nil, nil, fmt.Errorf("token %d: unknown scope %q", i, scope)
+			}
+		}
+		var sum [sha256.Size]byte
+		hasToken := true
+		switch {
+		case token.Token != "":
+			sum = sha256.Sum256([]byte(token.Token))
+		case token.SHA256 != "":
+			decoded, err := hex.DecodeString(token.SHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, nil, fmt.Errorf("token %d: invalid sha256", i)
+			}
+			copy(sum[:], decoded)
+		case token.Certificate != "":
+			hasToken = false
+		default:
+			return nil, nil, fmt.Errorf("token %d: token, sha256 or certificate is required", i)
+		}
+		if token.Revoked {
+			continue
+		}
+		identity := Identity{Agent: token.Agent, Scopes: token.Scopes}
+		if hasToken {
+			tokens[sum] = identity
+		}
+		if token.Certificate != "" {
+			certs[token.Certificate] = identity
+		}
+	}
+	return tokens, certs, nil
+}
+
+// reloadIfChanged перечитывает файл токенов, если он изменился. Файл проверяется не чаще tokensReloadInterval
+func (a *Authenticator) reloadIfChanged() {
+	now := a.now()
+	a.lock.Lock()
+	if now.Sub(a.lastCheck) < tokensReloadInterval {
+		a.lock.Unlock()
+		return
+	}
+	a.lastCheck = now
+	modTime := a.modTime
+	a.lock.Unlock()
+
+	info, err := os.Stat(a.fileName)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := a.Reload(); err != nil {
+		log.Error().Msgf("не удалось перечитать файл токенов %s", err.Error())
+	}
+}
+
+// Authenticate агент по токену token
+func (a *Authenticator) Authenticate(token string) (Identity, bool) {
+	a.reloadIfChanged()
+	//! Ищем по sha256 токена - в словаре нет самих токенов, а время поиска не зависит от совпадения префикса
+	sum := sha256.Sum256([]byte(token))
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	identity, ok := a.tokens[sum]
+	return identity, ok
+}
+
+// AuthenticateClient агент по имени клиента name из проверенного сертификата
+func (a *Authenticator) AuthenticateClient(name string) (Identity, bool) {
+	a.reloadIfChanged()
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	identity, ok := a.certs[name]
+	return identity, ok
+}
+
+// Authorize проверяет токен из значения заголовка Authorization в виде "Bearer <token>" и право scope.
+// Ошибки ErrUnauthenticated и ErrForbidden
+func (a *Authenticator) Authorize(authorization string, scope Scope) (Identity, error) {
+	const prefix = "bearer "
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return Identity{}, ErrUnauthenticated
+	}
+	identity, ok := a.Authenticate(strings.TrimSpace(authorization[len(prefix):]))
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	if !identity.HasScope(scope) {
+		return identity, ErrForbidden
+	}
+	return identity, nil
+}
+
+// authorize проверяет токен authorization, а если он не передан - сертификат клиента из контекста ctx
+func (a *Authenticator) authorize(ctx context.Context, authorization string, scope Scope) (Identity, error) {
+	name, ok := ClientNameFromContext(ctx)
+	if authorization != "" || !ok {
+		return a.Authorize(authorization, scope)
+	}
+	identity, ok := a.AuthenticateClient(name)
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	if !identity.HasScope(scope) {
+		return identity, ErrForbidden
+	}
+	return identity, nil
+}
+
+// AuthorizeRequest проверяет токен либо сертификат клиента http запроса.
+// Возвращает запрос с агентом в контексте либо http статус ошибки
+func (a *Authenticator) AuthorizeRequest(r *http.Request, scope Scope) (*http.Request, int, error) {
+	if !a.Enabled() || scope == ScopeNone {
+		return r, http.StatusOK, nil
+	}
+	identity, err := a.authorize(r.Context(), r.Header.Get("Authorization"), scope)
+	if err != nil {
+		log.Info().Msgf("запрос %s %s клиента %s отклонен: %s", r.Method, r.URL.Path, rejectedClient(r.Context(), hostOnly(r.RemoteAddr)), err.Error())
+	}
+	if errors.Is(err, ErrUnauthenticated) {
+		return r, http.StatusUnauthorized, err
+	}
+	if err != nil {
+		return r, http.StatusForbidden, err
+	}
+	return r.WithContext(WithIdentity(r.Context(), identity)), http.StatusOK, nil
+}
+
+// rejectedClient описание клиента для журнала отклоненных запросов: адрес соединения peerIP и имя
+// из проверенного сертификата. Заголовки и метадата клиента не используются - их можно подделать
+func rejectedClient(ctx context.Context, peerIP string) string {
+	if name, ok := ClientNameFromContext(ctx); ok {
+		return fmt.Sprintf("%s (сертификат %s)", peerIP, name)
+	}
+	return peerIP
+}
+
+// WWWAuthenticate значение заголовка WWW-Authenticate для ответа с ошибкой проверки токена
+func WWWAuthenticate(scope Scope, err error) string {
+	if errors.Is(err, ErrForbidden) {
+		return fmt.Sprintf(`Bearer realm="devops", error="insufficient_scope", scope="%s"`, scope)
+	}
+	return `Bearer realm="devops"`
+}
+
+// Require middleware для http сервера, пропускает запросы с токеном, у которого есть право scope.
+// Без токена или с неизвестным токеном 401, без нужного права 403
+func (a *Authenticator) Require(scope Scope) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, code, err := a.AuthorizeRequest(r, scope)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", WWWAuthenticate(scope, err))
+				w.WriteHeader(code)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorizeContext проверяет токен из метадаты authorization либо сертификат клиента grpc запроса
+func (a *Authenticator) authorizeContext(ctx context.Context, scope Scope) (context.Context, error) {
+	if !a.Enabled() || scope == ScopeNone {
+		return ctx, nil
+	}
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	identity, err := a.authorize(ctx, authorization, scope)
+	if err != nil {
+		log.Info().Msgf("вызов клиента %s отклонен: %s", rejectedClient(ctx, PeerAddress(ctx)), err.Error())
+	}
+	if errors.Is(err, ErrUnauthenticated) {
+		return ctx, apierror.Status(codes.Unauthenticated, apierror.CodeUnauthorized, err.Error())
+	}
+	if err != nil {
+		return ctx, apierror.Status(codes.PermissionDenied, apierror.CodeForbidden, err.Error())
+	}
+	return WithIdentity(ctx, identity), nil
+}
+
+// methodScope право, нужное для метода fullMethod. Методы не из scopes требуют read
+func methodScope(scopes map[string]Scope, fullMethod string) Scope {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	if scope, ok := scopes[method]; ok {
+		return scope
+	}
+	return ScopeRead
+}
+
+// AuthInterceptor - unaryInterceptor для grpc сервера. scopes - права для методов по короткому имени,
+// например {"AddMetric": ScopeIngest}. Остальные методы требуют read, ScopeNone - метод доступен без токена
+func AuthInterceptor(auth *Authenticator, scopes map[string]Scope) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := auth.authorizeContext(ctx, methodScope(scopes, info.FullMethod))
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// identityStream поток с дополненным контекстом: агент токена или имя клиента из сертификата
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s identityStream) Context() context.Context {
+	return s.ctx
+}
+
+// AuthStreamInterceptor - streamInterceptor для grpc сервера, права как в AuthInterceptor
+func AuthStreamInterceptor(auth *Authenticator, scopes map[string]Scope) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := auth.authorizeContext(ss.Context(), methodScope(scopes, info.FullMethod))
+		if err != nil {
+			return err
+		}
+		return handler(srv, identityStream{ServerStream: ss, ctx: ctx})
+	}
+}
@@ -0,0 +1,239 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// writeTokensFile создает файл токенов во временной директории теста
+func writeTokensFile(t *testing.T, content string) string {
+	fileName := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, ioutil.WriteFile(fileName, []byte(content), 0600))
+	return fileName
+}
+
+func testTokens(t *testing.T) string {
+	sum := sha256.Sum256([]byte("reader-token"))
+	return writeTokensFile(t, `{"tokens": [
+		{"token": "ingest-token", "agent": "agent1", "scopes": ["ingest"]},
+		{"sha256": "`+hex.EncodeToString(sum[:])+`", "agent": "dashboard", "scopes": ["read"]},
+		{"token": "admin-token", "agent": "ops", "scopes": ["admin"]},
+		{"token": "revoked-token", "agent": "agent2", "scopes": ["ingest"], "revoked": true}
+	]}`)
+}
+
+func TestAuthenticatorAuthorize(t *testing.T) {
+	auth, err := NewAuthenticator(testTokens(t))
+	require.NoError(t, err)
+	assert.True(t, auth.Enabled())
+
+	tests := []struct {
+		name          string
+		authorization string
+		scope         Scope
+		agent         string
+		err           error
+	}{
+		{name: "ingest", authorization: "Bearer ingest-token", scope: ScopeIngest, agent: "agent1"},
+		{name: "case insensitive scheme", authorization: "bearer ingest-token", scope: ScopeIngest, agent: "agent1"},
+		{name: "token by sha256", authorization: "Bearer reader-token", scope: ScopeRead, agent: "dashboard"},
+		{name: "admin has all scopes", authorization: "Bearer admin-token", scope: ScopeIngest, agent: "ops"},
+		{name: "missing scope", authorization: "Bearer ingest-token", scope: ScopeRead, agent: "agent1", err: ErrForbidden},
+		{name: "revoked", authorization: "Bearer revoked-token", scope: ScopeIngest, err: ErrUnauthenticated},
+		{name: "unknown", authorization: "Bearer other-token", scope: ScopeIngest, err: ErrUnauthenticated},
+		{name: "empty", authorization: "", scope: ScopeRead, err: ErrUnauthenticated},
+		{name: "basic scheme", authorization: "Basic ingest-token", scope: ScopeIngest, err: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := auth.Authorize(tt.authorization, tt.scope)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.agent, identity.Agent)
+		})
+	}
+}
+
+func TestAuthenticatorInvalidFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "invalid json", content: `{"tokens": [`},
+		{name: "unknown scope", content: `{"tokens": [{"token": "t", "agent": "a", "scopes": ["write"]}]}`},
+		{name: "missing agent", content: `{"tokens": [{"token": "t", "scopes": ["read"]}]}`},
+		{name: "missing token", content: `{"tokens": [{"agent": "a", "scopes": ["read"]}]}`},
+		{name: "invalid sha256", content: `{"tokens": [{"sha256": "abc", "agent": "a", "scopes": ["read"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := NewAuthenticator(writeTokensFile(t, tt.content))
+			assert.Error(t, err)
+			// без токенов проверка не пропускает никого
+			assert.True(t, auth.Enabled())
+			_, err = auth.Authorize("Bearer t", ScopeRead)
+			assert.ErrorIs(t, err, ErrUnauthenticated)
+		})
+	}
+
+	auth, err := NewAuthenticator("")
+	assert.NoError(t, err)
+	assert.False(t, auth.Enabled())
+}
+
+func TestAuthenticatorReload(t *testing.T) {
+	fileName := testTokens(t)
+	auth, err := NewAuthenticator(fileName)
+	require.NoError(t, err)
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+
+	_, err = auth.Authorize("Bearer ingest-token", ScopeIngest)
+	assert.NoError(t, err)
+
+	// отзываем токен agent1, остальные токены продолжают работать
+	require.NoError(t, ioutil.WriteFile(fileName, []byte(`{"tokens": [
+		{"token": "ingest-token", "agent": "agent1", "scopes": ["ingest"], "revoked": true},
+		{"token": "admin-token", "agent": "ops", "scopes": ["admin"]}
+	]}`), 0600))
+	modTime := now.Add(time.Second)
+	require.NoError(t, os.Chtimes(fileName, modTime, modTime))
+
+	// файл проверяется не чаще tokensReloadInterval
+	_, err = auth.Authorize("Bearer ingest-token", ScopeIngest)
+	assert.NoError(t, err)
+
+	now = now.Add(tokensReloadInterval)
+	_, err = auth.Authorize("Bearer ingest-token", ScopeIngest)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+	_, err = auth.Authorize("Bearer admin-token", ScopeIngest)
+	assert.NoError(t, err)
+
+	// некорректный файл не сбрасывает загруженные токены
+	require.NoError(t, ioutil.WriteFile(fileName, []byte(`{"tokens": [`), 0600))
+	modTime = modTime.Add(time.Second)
+	require.NoError(t, os.Chtimes(fileName, modTime, modTime))
+	now = now.Add(tokensReloadInterval)
+	_, err = auth.Authorize("Bearer admin-token", ScopeIngest)
+	assert.NoError(t, err)
+}
+
+func TestAuthenticatorRequire(t *testing.T) {
+	auth, err := NewAuthenticator(testTokens(t))
+	require.NoError(t, err)
+
+	var key string
+	handler := auth.Require(ScopeIngest)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ := IdentityFromContext(r.Context())
+		key = RequestKey(r, nil)
+		w.Write([]byte(identity.Agent))
+	}))
+
+	request := func(authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/updates/", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		r.Header.Set("X-Real-IP", "10.9.9.9")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("Bearer ingest-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "agent1", w.Body.String())
+	// ограничение частоты считается по агенту токена, а не по заголовкам клиента
+	assert.Equal(t, "token:agent1", key)
+
+	w = request("")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="devops"`, w.Header().Get("WWW-Authenticate"))
+
+	w = request("Bearer reader-token")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+
+	// выключенная проверка пропускает все запросы
+	disabled, _ := NewAuthenticator("")
+	w = httptest.NewRecorder()
+	disabled.Require(ScopeAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAuthInterceptors(t *testing.T) {
+	auth, err := NewAuthenticator(testTokens(t))
+	require.NoError(t, err)
+	scopes := map[string]Scope{
+		"Ping":          ScopeNone,
+		"AddMetric":     ScopeIngest,
+		"StreamMetrics": ScopeIngest,
+	}
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	unary := AuthInterceptor(auth, scopes)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return ContextKey(ctx, nil), nil
+	}
+	info := func(method string) *grpc.UnaryServerInfo {
+		return &grpc.UnaryServerInfo{FullMethod: "/devops.Metrics/" + method}
+	}
+
+	resp, err := unary(withToken("ingest-token"), nil, info("AddMetric"), handler)
+	assert.NoError(t, err)
+	assert.Equal(t, "token:agent1", resp)
+
+	_, err = unary(withToken("ingest-token"), nil, info("GetMetric"), handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = unary(context.Background(), nil, info("GetMetric"), handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = unary(context.Background(), nil, info("Ping"), handler)
+	assert.NoError(t, err)
+
+	stream := AuthStreamInterceptor(auth, scopes)
+	streamInfo := &grpc.StreamServerInfo{FullMethod: "/devops.Metrics/StreamMetrics"}
+	var agent string
+	err = stream(nil, testServerStream{ctx: withToken("admin-token")}, streamInfo, func(srv interface{}, ss grpc.ServerStream) error {
+		identity, _ := IdentityFromContext(ss.Context())
+		agent = identity.Agent
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ops", agent)
+
+	err = stream(nil, testServerStream{ctx: withToken("revoked-token")}, streamInfo, func(srv interface{}, ss grpc.ServerStream) error {
+		return nil
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestRejectedClient(t *testing.T) {
+	// в журнал попадает адрес соединения и имя из проверенного сертификата, X-Real-IP клиента не учитывается
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Real-IP", "1.2.3.4")
+	assert.Equal(t, "10.0.0.1", rejectedClient(r.Context(), hostOnly(r.RemoteAddr)))
+
+	ctx := WithClientName(context.Background(), "agent1")
+	assert.Equal(t, "10.0.0.1 (сертификат agent1)", rejectedClient(ctx, "10.0.0.1"))
+}
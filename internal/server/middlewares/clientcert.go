@@ -0,0 +1,62 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/ncyellow/devops/internal/crypto/tlsconfig"
+)
+
+type clientNameKey struct{}
+
+// WithClientName контекст с именем клиента из проверенного сертификата
+func WithClientName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientNameKey{}, name)
+}
+
+// ClientNameFromContext имя клиента из проверенного сертификата взаимного tls.
+// false если соединение без tls или клиент не предъявил сертификат
+func ClientNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(clientNameKey{}).(string)
+	return name, ok
+}
+
+// ClientCert middleware для http сервера, добавляет в контекст запроса имя клиента из проверенного сертификата
+func ClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := tlsconfig.ClientName(r.TLS); ok {
+			r = r.WithContext(WithClientName(r.Context(), name))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientNameContext контекст grpc вызова с именем клиента из сертификата соединения
+func clientNameContext(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ctx
+	}
+	if name, ok := tlsconfig.ClientName(&info.State); ok {
+		return WithClientName(ctx, name)
+	}
+	return ctx
+}
+
+// ClientCertInterceptor - unaryInterceptor для grpc сервера, добавляет в контекст имя клиента из сертификата
+func ClientCertInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(clientNameContext(ctx), req)
+}
+
+// ClientCertStreamInterceptor - streamInterceptor для grpc сервера, добавляет в контекст имя клиента из сертификата
+func ClientCertStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, identityStream{ServerStream: ss, ctx: clientNameContext(ss.Context())})
+}
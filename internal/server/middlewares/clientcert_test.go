@@ -0,0 +1,91 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// testCertsDir тестовые сертификаты сервера и агента
+const testCertsDir = "../../crypto/tlsconfig/test_data/"
+
+// verifiedState состояние tls соединения с проверенным сертификатом клиента agent1
+func verifiedState(t *testing.T) tls.ConnectionState {
+	data, err := ioutil.ReadFile(testCertsDir + "client.pem")
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestClientCert(t *testing.T) {
+	handler := ClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := ClientNameFromContext(r.Context())
+		w.Write([]byte(name))
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "", w.Body.String())
+
+	state := verifiedState(t)
+	r.TLS = &state
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "agent1", w.Body.String())
+	assert.Equal(t, "cert:agent1", RequestKey(r.WithContext(WithClientName(r.Context(), "agent1")), nil))
+
+	// непроверенный сертификат не дает имени клиента
+	r.TLS = &tls.ConnectionState{PeerCertificates: state.PeerCertificates}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "", w.Body.String())
+}
+
+func TestClientCertInterceptors(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: verifiedState(t)}})
+
+	resp, err := ClientCertInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return ContextKey(ctx, nil), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "cert:agent1", resp)
+
+	// сертификат проверяется по файлу токенов, если токен не передан
+	auth, err := NewAuthenticator(writeTokensFile(t, `{"tokens": [
+		{"certificate": "agent1", "agent": "agent1", "scopes": ["ingest"]}
+	]}`))
+	require.NoError(t, err)
+	var agent string
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		identity, _ := IdentityFromContext(ss.Context())
+		agent = identity.Agent
+		return nil
+	}
+	chain := func(ctx context.Context, method string) error {
+		return ClientCertStreamInterceptor(nil, testServerStream{ctx: ctx}, &grpc.StreamServerInfo{},
+			func(srv interface{}, ss grpc.ServerStream) error {
+				return AuthStreamInterceptor(auth, map[string]Scope{"StreamMetrics": ScopeIngest})(srv, ss,
+					&grpc.StreamServerInfo{FullMethod: "/devops.Metrics/" + method}, handler)
+			})
+	}
+	assert.NoError(t, chain(ctx, "StreamMetrics"))
+	assert.Equal(t, "agent1", agent)
+	assert.Equal(t, codes.PermissionDenied, status.Code(chain(ctx, "Watch")))
+	assert.Equal(t, codes.Unauthenticated, status.Code(chain(context.Background(), "StreamMetrics")))
+}
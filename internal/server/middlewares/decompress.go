@@ -0,0 +1,146 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxBodySize ограничение размера тела запроса после распаковки по умолчанию
+const DefaultMaxBodySize = 10 << 20
+
+var (
+	// ErrBodyTooLarge тело запроса больше допустимого размера
+	ErrBodyTooLarge = errors.New("request body too large")
+	// ErrUnsupportedEncoding неизвестное значение Content-Encoding
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// Decompress middleware распаковки тела запроса с Content-Encoding gzip или zstd.
+// Тело распаковывается целиком до вызова обработчика, поэтому обработчики читают обычное тело и не знают о сжатии.
+// Чтобы сжатый запрос небольшого размера не занял всю память (zip-бомба), и сжатое, и распакованное тело
+// ограничены maxSize байт, при превышении клиент получает 413. Несжатые запросы не ограничиваются.
+// Поврежденные данные - 400. Остальные кодировки передаются обработчику как есть,
+// например remote write Prometheus сам распаковывает snappy
+func Decompress(maxSize int64) func(next http.Handler) http.Handler {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			if !isCompressed(encoding) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := DecompressBody(r.Body, encoding, maxSize)
+			r.Body.Close()
+			switch {
+			case errors.Is(err, ErrBodyTooLarge):
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte(err.Error()))
+				return
+			case err != nil:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid compressed body"))
+				return
+			}
+
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = int64(len(body))
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isCompressed кодировка, которую распаковывает Decompress
+func isCompressed(encoding string) bool {
+	return encoding == "gzip" || encoding == "x-gzip" || encoding == "zstd"
+}
+
+// DecompressBody распаковывает body в кодировке encoding. Сжатые и распакованные данные ограничены maxSize байт,
+// 0 - DefaultMaxBodySize
+func DecompressBody(body io.Reader, encoding string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	compressed := &limitedReader{reader: body, left: maxSize}
+	var reader io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(compressed)
+		if err != nil {
+			return nil, compressed.wrap(err)
+		}
+		defer gz.Close()
+		reader = gz
+	case "zstd":
+		//! WithDecoderMaxMemory не дает декодеру выделить под окно больше maxSize, даже если так указано в заголовке кадра.
+		//! Окно zstd не бывает меньше MinWindowSize, поэтому меньший лимит отклонял бы любые данные
+		maxMemory := uint64(maxSize)
+		if maxMemory < zstd.MinWindowSize {
+			maxMemory = zstd.MinWindowSize
+		}
+		zr, err := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxMemory))
+		if err != nil {
+			return nil, compressed.wrap(err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+	data, err := ioutil.ReadAll(&limitedReader{reader: reader, left: maxSize})
+	if err != nil {
+		return nil, compressed.wrap(err)
+	}
+	return data, nil
+}
+
+// limitedReader в отличие от io.LimitReader возвращает ErrBodyTooLarge, если данных больше left,
+// а не молча обрезает их
+type limitedReader struct {
+	reader   io.Reader
+	left     int64
+	exceeded bool
+}
+
+// wrap ошибка распаковки err. Декодер может вернуть вместо ErrBodyTooLarge свою ошибку обрыва данных,
+// поэтому превышение лимита сжатыми данными проверяется по флагу. Вызывается для читателя сжатых данных
+func (l *limitedReader) wrap(err error) error {
+	if l.exceeded {
+		return ErrBodyTooLarge
+	}
+	// zstd отклоняет кадры, окно или размер которых больше лимита памяти декодера
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return ErrBodyTooLarge
+	}
+	return err
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// проверяем, есть ли данные сверх лимита
+		var probe [1]byte
+		n, err := l.reader.Read(probe[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.reader.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte) []byte {
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer zw.Close()
+	return zw.EncodeAll(data, nil)
+}
+
+// TestDecompress проверяем распаковку тела запроса и ограничение размера
+func TestDecompress(t *testing.T) {
+	body := []byte(`[{"id":"testGauge","type":"gauge","value":1.5}]`)
+	bomb := bytes.Repeat([]byte("0"), 1024)
+	random := make([]byte, 256)
+	for i := range random {
+		random[i] = byte(i*7 + i/3)
+	}
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		statusCode int
+		want       string
+	}{
+		{"without encoding", "", body, http.StatusOK, string(body)},
+		{"identity", "identity", body, http.StatusOK, string(body)},
+		{"gzip", "gzip", gzipData(t, body), http.StatusOK, string(body)},
+		{"zstd", "zstd", zstdData(t, body), http.StatusOK, string(body)},
+		{"other encoding", "snappy", body, http.StatusOK, string(body)},
+		{"broken gzip", "gzip", body, http.StatusBadRequest, "invalid compressed body"},
+		{"broken zstd", "zstd", body, http.StatusBadRequest, "invalid compressed body"},
+		{"gzip bomb", "gzip", gzipData(t, bomb), http.StatusRequestEntityTooLarge, "request body too large"},
+		{"zstd bomb", "zstd", zstdData(t, bomb), http.StatusRequestEntityTooLarge, "request body too large"},
+		{"large compressed body", "gzip", gzipData(t, bytes.Repeat(random, 4)), http.StatusRequestEntityTooLarge, "request body too large"},
+	}
+
+	handler := Decompress(512)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// после распаковки обработчик видит обычное тело
+		assert.NotContains(t, []string{"GZIP", "ZSTD"}, r.Header.Get("Content-Encoding"))
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Write(data)
+	}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/updates/", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", strings.ToUpper(tt.encoding))
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.statusCode, rw.Code)
+			assert.Equal(t, tt.want, rw.Body.String())
+		})
+	}
+}
+
+func TestDecompressBodyUnsupported(t *testing.T) {
+	_, err := DecompressBody(bytes.NewReader([]byte("data")), "br", 512)
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
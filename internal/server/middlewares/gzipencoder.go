@@ -22,7 +22,7 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 func EncoderGZIP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// проверяем, что клиент поддерживает gzip-сжатие
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || isStream(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -40,3 +40,9 @@ func EncoderGZIP(next http.Handler) http.Handler {
 		next.ServeHTTP(gzipWriter{ResponseWriter: w, Writer: gz}, r)
 	})
 }
+
+// isStream потоковые запросы SSE и WebSocket не сжимаем: gzipWriter не поддерживает Flush и Hijack
+func isStream(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
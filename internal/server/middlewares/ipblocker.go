@@ -18,20 +18,21 @@ type IPBlocker struct {
 
 // NewIPBlocker - конструктор проверяет корректность cidr. Иначе блок по ip не работает
 func NewIPBlocker(cidr string) *IPBlocker {
+	return &IPBlocker{
+		cidr: parseCIDR(cidr),
+	}
+}
+
+// parseCIDR сеть cidr, nil - если cidr пустой или некорректный
+func parseCIDR(cidr string) *net.IPNet {
 	if cidr == "" {
-		return &IPBlocker{
-			cidr: nil,
-		}
+		return nil
 	}
 	_, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
-		return &IPBlocker{
-			cidr: nil,
-		}
-	}
-	return &IPBlocker{
-		cidr: ipNet,
+		return nil
 	}
+	return ipNet
 }
 
 // IsAllowIP - проверяет разрешен ли realIP если нет будет false
@@ -46,6 +47,18 @@ func (b *IPBlocker) IsAllowIP(realIP string) bool {
 	return b.cidr.Contains(clientIP)
 }
 
+// AllowAddr - проверяет адрес соединения addr. В отличие от IsAllowIP адрес берется из самого соединения,
+// а не из заголовка клиента, поэтому подходит для приема без http: адрес, который не удалось разобрать, не разрешен
+func (b *IPBlocker) AllowAddr(addr net.Addr) bool {
+	if b.cidr == nil {
+		return true
+	}
+	if addr == nil {
+		return false
+	}
+	return b.cidr.Contains(net.ParseIP(hostOnly(addr.String())))
+}
+
 // Handler обработчик для подготовки middleware для фильтрации IP адресов
 func (b *IPBlocker) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -70,27 +83,45 @@ func IPBlock(cidr string) func(next http.Handler) http.Handler {
 	return blocker.Handler
 }
 
-// unaryInterceptor - обработчик для подготовки unaryInterceptor для grpc сервера
-func (b *IPBlocker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+// checkMetadata - проверка X-Real-IP из метадаты grpc запроса
+func (b *IPBlocker) checkMetadata(ctx context.Context) error {
 	if b.cidr == nil {
-		return handler(ctx, req)
+		return nil
 	}
-	var realIP string
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
 		values := md.Get("X-Real-IP")
-		if len(values) > 0 {
-			realIP = values[0]
-			// Итого если в наличии есть параметр метадаты. И он не подходит, то PermissionDenied иначе - ок
-			if !b.IsAllowIP(realIP) {
-				return nil, status.Error(codes.PermissionDenied, "incorrect X-Real-IP")
-			}
+		// Итого если в наличии есть параметр метадаты. И он не подходит, то PermissionDenied иначе - ок
+		if len(values) > 0 && !b.IsAllowIP(values[0]) {
+			return status.Error(codes.PermissionDenied, "incorrect X-Real-IP")
 		}
 	}
+	return nil
+}
+
+// unaryInterceptor - обработчик для подготовки unaryInterceptor для grpc сервера
+func (b *IPBlocker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := b.checkMetadata(ctx); err != nil {
+		return nil, err
+	}
 	return handler(ctx, req)
 }
 
+// streamInterceptor - обработчик для подготовки streamInterceptor для grpc сервера
+func (b *IPBlocker) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := b.checkMetadata(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
 // IPBlockInterceptor - unaryInterceptor для grpc сервера по блокировке IP
 func IPBlockInterceptor(cidr string) grpc.UnaryServerInterceptor {
 	blocker := NewIPBlocker(cidr)
 	return blocker.unaryInterceptor
 }
+
+// IPBlockStreamInterceptor - streamInterceptor для grpc сервера по блокировке IP
+func IPBlockStreamInterceptor(cidr string) grpc.StreamServerInterceptor {
+	blocker := NewIPBlocker(cidr)
+	return blocker.streamInterceptor
+}
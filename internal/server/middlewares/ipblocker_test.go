@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,6 +10,10 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // getLocalCIDR возвращает CIDR текущей сети
@@ -121,3 +126,55 @@ func TestIPBlock(t *testing.T) {
 		assert.Equal(t, w.Body.String(), test.expectedResponse)
 	}
 }
+
+// testServerStream grpc.ServerStream с заданным контекстом
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// TestIPBlockStreamInterceptor проверяем блокировку потоковых вызовов по X-Real-IP из метадаты
+func TestIPBlockStreamInterceptor(t *testing.T) {
+	interceptor := IPBlockStreamInterceptor("192.168.1.0/24")
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		return nil
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"without metadata", context.Background(), codes.OK},
+		{"allowed ip", metadata.NewIncomingContext(context.Background(), metadata.Pairs("X-Real-IP", "192.168.1.10")), codes.OK},
+		{"blocked ip", metadata.NewIncomingContext(context.Background(), metadata.Pairs("X-Real-IP", "10.0.0.1")), codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		err := interceptor(nil, testServerStream{ctx: tt.ctx}, &grpc.StreamServerInfo{}, handler)
+		assert.Equal(t, tt.code, status.Code(err), tt.name)
+	}
+}
+
+func TestAllowAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		cidr string
+		addr net.Addr
+		want bool
+	}{
+		{name: "без сети", cidr: "", addr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8125}, want: true},
+		{name: "udp из сети", cidr: "10.0.0.0/8", addr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 8125}, want: true},
+		{name: "tcp из сети", cidr: "10.0.0.0/8", addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 2003}, want: true},
+		{name: "не из сети", cidr: "10.0.0.0/8", addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 2003}, want: false},
+		{name: "адрес неизвестен", cidr: "10.0.0.0/8", addr: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, NewIPBlocker(tt.cidr).AllowAddr(tt.addr))
+		})
+	}
+}
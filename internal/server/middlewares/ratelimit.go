@@ -0,0 +1,248 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/ncyellow/devops/internal/apierror"
+)
+
+const (
+	// rateLimitPruneInterval как часто удаляются корзины клиентов, которые давно не присылали запросов
+	rateLimitPruneInterval = time.Minute
+)
+
+// tokenBucket корзина токенов клиента. Токены восстанавливаются со скоростью rate в секунду до burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter ограничение частоты запросов клиента алгоритмом token bucket.
+// Клиент определяется агентом, прошедшим проверку токена, затем именем из проверенного сертификата клиента,
+// иначе IP адресом соединения. Заголовкам клиента не доверяем: меняя их на каждый запрос, клиент обходил бы ограничение
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+	// trustedProxies сеть прокси, от которых принимается X-Real-IP
+	trustedProxies *net.IPNet
+
+	lock      *sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// NewRateLimiter - конструктор, rate - число запросов в секунду, burst - сколько запросов можно сделать подряд.
+// При rate <= 0 ограничение выключено, burst < 1 считается равным 1. trustedProxies - cidr сети прокси,
+// за которыми находятся агенты: только от них адрес клиента берется из X-Real-IP. Пусто - X-Real-IP не учитывается
+func NewRateLimiter(rate float64, burst int, trustedProxies string) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:           rate,
+		burst:          float64(burst),
+		now:            time.Now,
+		trustedProxies: parseCIDR(trustedProxies),
+		lock:           &sync.Mutex{},
+		buckets:        make(map[string]*tokenBucket),
+	}
+}
+
+// Enabled включено ли ограничение
+func (l *RateLimiter) Enabled() bool {
+	return l.rate > 0
+}
+
+// Allow забирает токен клиента key. Если токенов нет, возвращает false и время до появления следующего токена
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+	now := l.now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune удаляет корзины, которые успели заполниться полностью - они не отличаются от новых.
+// Так число корзин ограничено активными клиентами. Вызывается под блокировкой
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RequestKey ключ клиента http запроса: агент токена, имя из проверенного сертификата, иначе IP адрес соединения.
+// X-Real-IP учитывается, только если соединение пришло из сети прокси trustedProxies
+func RequestKey(r *http.Request, trustedProxies *net.IPNet) string {
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		return "token:" + identity.Agent
+	}
+	if name, ok := ClientNameFromContext(r.Context()); ok {
+		return "cert:" + name
+	}
+	return "ip:" + clientIP(hostOnly(r.RemoteAddr), r.Header.Get("X-Real-IP"), trustedProxies)
+}
+
+// ContextKey ключ клиента grpc запроса: агент токена, имя из проверенного сертификата, иначе адрес соединения.
+// Метадата X-Real-IP учитывается, только если соединение пришло из сети прокси trustedProxies
+func ContextKey(ctx context.Context, trustedProxies *net.IPNet) string {
+	if identity, ok := IdentityFromContext(ctx); ok {
+		return "token:" + identity.Agent
+	}
+	if name, ok := ClientNameFromContext(ctx); ok {
+		return "cert:" + name
+	}
+	var realIP string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("X-Real-IP"); len(values) > 0 {
+			realIP = values[0]
+		}
+	}
+	return "ip:" + clientIP(PeerAddress(ctx), realIP, trustedProxies)
+}
+
+// RequestKey ключ клиента http запроса с учетом доверенных прокси ограничителя
+func (l *RateLimiter) RequestKey(r *http.Request) string {
+	return RequestKey(r, l.trustedProxies)
+}
+
+// ContextKey ключ клиента grpc запроса с учетом доверенных прокси ограничителя
+func (l *RateLimiter) ContextKey(ctx context.Context) string {
+	return ContextKey(ctx, l.trustedProxies)
+}
+
+// clientIP адрес клиента: realIP от доверенного прокси, иначе адрес соединения peerIP
+func clientIP(peerIP string, realIP string, trustedProxies *net.IPNet) string {
+	if realIP != "" && trustedProxies != nil && trustedProxies.Contains(net.ParseIP(peerIP)) {
+		return realIP
+	}
+	return peerIP
+}
+
+// PeerAddress IP адрес соединения grpc запроса без порта, пусто - адрес неизвестен
+func PeerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return hostOnly(p.Addr.String())
+	}
+	return ""
+}
+
+// hostOnly адрес без порта
+func hostOnly(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// RetryAfter значение заголовка Retry-After в целых секундах, не меньше 1
+func RetryAfter(wait time.Duration) string {
+	return fmt.Sprintf("%d", int(math.Ceil(math.Max(wait.Seconds(), 1))))
+}
+
+// Handler middleware для http сервера, при превышении ограничения 429 с заголовком Retry-After
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.Allow(l.RequestKey(r)); !ok {
+			w.Header().Set("Retry-After", RetryAfter(wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("too many requests"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkContext ошибка ResourceExhausted, если клиент запроса исчерпал ограничение
+func (l *RateLimiter) checkContext(ctx context.Context) error {
+	if ok, wait := l.Allow(l.ContextKey(ctx)); !ok {
+		return apierror.Status(codes.ResourceExhausted, apierror.CodeRateLimited,
+			fmt.Sprintf("too many requests, retry after %s", wait.Round(time.Millisecond)))
+	}
+	return nil
+}
+
+// limitedMethod ограничивается ли метод fullMethod, пустой список methods - все методы
+func limitedMethod(methods []string, fullMethod string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if strings.HasSuffix(fullMethod, "/"+method) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitInterceptor - unaryInterceptor для grpc сервера, ограничивает вызовы методов methods (короткие имена,
+// например AddMetric), пустой список - все методы
+func RateLimitInterceptor(limiter *RateLimiter, methods ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if limitedMethod(methods, info.FullMethod) {
+			if err := limiter.checkContext(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// rateLimitedStream поток, в котором каждое сообщение клиента расходует токен
+type rateLimitedStream struct {
+	grpc.ServerStream
+	limiter *RateLimiter
+}
+
+func (s *rateLimitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.limiter.checkContext(s.Context())
+}
+
+// RateLimitStreamInterceptor - streamInterceptor для grpc сервера. В потоках методов methods ограничивается
+// каждое сообщение клиента, а не открытие потока: агент отправляет все пачки в один долгоживущий поток
+func RateLimitStreamInterceptor(limiter *RateLimiter, methods ...string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !limiter.Enabled() || !limitedMethod(methods, info.FullMethod) {
+			return handler(srv, ss)
+		}
+		return handler(srv, &rateLimitedStream{ServerStream: ss, limiter: limiter})
+	}
+}
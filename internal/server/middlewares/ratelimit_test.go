@@ -0,0 +1,149 @@
+package middlewares
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// newTestRateLimiter ограничитель с управляемым временем
+func newTestRateLimiter(rate float64, burst int) (*RateLimiter, *time.Time) {
+	limiter := NewRateLimiter(rate, burst, "10.1.0.0/16")
+	now := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter, now := newTestRateLimiter(2, 3)
+
+	// сначала доступен весь burst, затем клиент ждет восстановления токена
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("agent:1")
+		assert.True(t, ok)
+	}
+	ok, wait := limiter.Allow("agent:1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// у другого клиента своя корзина
+	ok, _ = limiter.Allow("agent:2")
+	assert.True(t, ok)
+
+	*now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.Allow("agent:1")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("agent:1")
+	assert.False(t, ok)
+
+	// заполнившиеся корзины удаляются
+	*now = now.Add(2 * rateLimitPruneInterval)
+	ok, _ = limiter.Allow("agent:3")
+	assert.True(t, ok)
+	assert.Len(t, limiter.buckets, 1)
+
+	// нулевой rate выключает ограничение
+	disabled := NewRateLimiter(0, 0, "")
+	for i := 0; i < 100; i++ {
+		ok, _ = disabled.Allow("agent:1")
+		assert.True(t, ok)
+	}
+}
+
+func TestRateLimiterHandler(t *testing.T) {
+	limiter, _ := newTestRateLimiter(0.5, 1)
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	request := func(realIP, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/updates/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Agent-ID", realIP)
+		if realIP != "" {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("", "10.0.0.1:5000").Code)
+	// тот же IP с другого порта - тот же клиент
+	w := request("", "10.0.0.1:5001")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "too many requests", w.Body.String())
+
+	// заголовки клиента вне сети прокси не меняют ключ ограничения
+	assert.Equal(t, http.StatusTooManyRequests, request("192.168.1.1", "10.0.0.1:5002").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("192.168.1.2", "10.0.0.1:5003").Code)
+
+	// агенты за доверенным прокси ограничиваются отдельно по X-Real-IP
+	assert.Equal(t, http.StatusOK, request("192.168.1.1", "10.1.0.1:5002").Code)
+	assert.Equal(t, http.StatusOK, request("192.168.1.2", "10.1.0.1:5003").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("192.168.1.1", "10.1.0.1:5004").Code)
+}
+
+func TestContextKey(t *testing.T) {
+	peerCtx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}})
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/24")
+	assert.Equal(t, "ip:10.0.0.2", ContextKey(peerCtx, proxies))
+	realIPCtx := metadata.NewIncomingContext(peerCtx, metadata.Pairs("X-Real-IP", "192.168.1.10", "x-agent-id", "agent1"))
+	assert.Equal(t, "ip:192.168.1.10", ContextKey(realIPCtx, proxies))
+	// без доверенных прокси метадата клиента не учитывается
+	assert.Equal(t, "ip:10.0.0.2", ContextKey(realIPCtx, nil))
+}
+
+// testRecvStream поток, из которого всегда успешно читается сообщение
+type testRecvStream struct {
+	testServerStream
+}
+
+func (s testRecvStream) RecvMsg(m interface{}) error {
+	return nil
+}
+
+func TestRateLimitInterceptors(t *testing.T) {
+	limiter, _ := newTestRateLimiter(1, 1)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}})
+
+	unary := RateLimitInterceptor(limiter, "AddMetric")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	addMetric := &grpc.UnaryServerInfo{FullMethod: "/devops.Metrics/AddMetric"}
+	_, err := unary(ctx, nil, addMetric, handler)
+	assert.NoError(t, err)
+	_, err = unary(ctx, nil, addMetric, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// методы чтения не ограничиваются
+	_, err = unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/devops.Metrics/GetMetric"}, handler)
+	assert.NoError(t, err)
+
+	// в потоке ограничивается каждое сообщение
+	limiter, _ = newTestRateLimiter(1, 2)
+	stream := RateLimitStreamInterceptor(limiter, "StreamMetrics")
+	var errs []error
+	err = stream(nil, testRecvStream{testServerStream{ctx: ctx}}, &grpc.StreamServerInfo{FullMethod: "/devops.Metrics/StreamMetrics"},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			for i := 0; i < 3; i++ {
+				errs = append(errs, ss.RecvMsg(nil))
+			}
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.Equal(t, codes.ResourceExhausted, status.Code(errs[2]))
+}
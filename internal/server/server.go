@@ -5,7 +5,15 @@
 // server.RunServer()
 package server
 
-import "github.com/ncyellow/devops/internal/server/config"
+import (
+	"github.com/rs/zerolog/log"
+
+	"github.com/ncyellow/devops/internal/graphite"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/config"
+	"github.com/ncyellow/devops/internal/server/storage"
+	"github.com/ncyellow/devops/internal/statsd"
+)
 
 // Server интерфейс сервера
 type Server interface {
@@ -24,3 +32,31 @@ func CreateServer(conf *config.Config) Server {
 		Conf: conf,
 	}
 }
+
+// startStatsD запускает прием метрик StatsD, если задан StatsDAddress.
+// Возвращает nil если прием выключен или порт не удалось открыть
+func startStatsD(conf *config.Config, repo repository.Repository, pStore storage.PersistentStorage) *statsd.Server {
+	if conf.StatsDAddress == "" {
+		return nil
+	}
+	statsdServer := statsd.NewServer(conf.StatsDAddress, conf.StatsDFlushInterval.Duration, conf.TrustedSubNet, repo, pStore)
+	if err := statsdServer.Start(); err != nil {
+		log.Error().Msgf("statsd listen: %s", err)
+		return nil
+	}
+	return statsdServer
+}
+
+// startGraphite запускает прием метрик Graphite, если задан GraphiteAddress.
+// Возвращает nil если прием выключен или порт не удалось открыть
+func startGraphite(conf *config.Config, repo repository.Repository, pStore storage.PersistentStorage) *graphite.Server {
+	if conf.GraphiteAddress == "" {
+		return nil
+	}
+	graphiteServer := graphite.NewServer(conf.GraphiteAddress, conf.GraphiteRules, conf.TrustedSubNet, repo, pStore)
+	if err := graphiteServer.Start(); err != nil {
+		log.Error().Msgf("graphite listen: %s", err)
+		return nil
+	}
+	return graphiteServer
+}
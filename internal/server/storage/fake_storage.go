@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+
+	"github.com/ncyellow/devops/internal/repository"
 )
 
 // FakeStorage Пустая реализация хранилища - если нет ни файла ни базы, реализует интерфейс PersistentStorage
@@ -28,3 +30,7 @@ func (m *FakeStorage) Load() error {
 func (m *FakeStorage) Save(context.Context) error {
 	return nil
 }
+
+func (m *FakeStorage) Delete(context.Context, []repository.Metrics) error {
+	return nil
+}
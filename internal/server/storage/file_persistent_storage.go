@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"os"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 
@@ -15,6 +16,8 @@ import (
 type FileStorageSaver struct {
 	conf *config.Config
 	repo repository.Repository
+	// lock сериализует запись файла, чтобы более старый снимок не перезаписал снимок без удаленных метрик
+	lock sync.Mutex
 }
 
 // NewFileStorage конструктор хранилища на основе файла, явно не используется, только через фабрику
@@ -36,6 +39,15 @@ func (m *FileStorageSaver) Load() error {
 }
 
 func (m *FileStorageSaver) Save(context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return SaveToFile(m.conf.StoreFile, m.repo)
+}
+
+// Delete файл всегда содержит полный снимок репозитория, поэтому достаточно перезаписать его без удаленных метрик
+func (m *FileStorageSaver) Delete(context.Context, []repository.Metrics) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	return SaveToFile(m.conf.StoreFile, m.repo)
 }
 
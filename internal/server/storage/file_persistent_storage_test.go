@@ -1,15 +1,18 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 
+	"github.com/ncyellow/devops/internal/genconfig"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/ncyellow/devops/internal/server/config"
 	"github.com/rs/zerolog/log"
 
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,7 +23,8 @@ func TestSaveRestoreFromFile(t *testing.T) {
 	cfg := config.Config{}
 	repo := repository.NewRepository(cfg.GeneralCfg())
 
-	data := []byte(`[{"id":"testGaugeMetric","type":"gauge","value":100},{"id":"testCounterMetric","type":"counter","delta":120}]`)
+	data := []byte(`[{"id":"testGaugeMetric","type":"gauge","value":100},{"id":"testCounterMetric","type":"counter","delta":120},
+		{"id":"testHistogramMetric","type":"histogram","count":2,"sum":1.5,"buckets":[{"le":1,"count":1}]}]`)
 	err := json.Unmarshal(data, &repo)
 	assert.NoError(t, err)
 
@@ -42,9 +46,14 @@ func TestSaveRestoreFromFile(t *testing.T) {
 	newRepo := repository.NewRepository(cfg.GeneralCfg())
 	RestoreFromFile(fileName, newRepo)
 
-	// Так как перегружен Stringer, который возвращает нам html они должны быть одинаковые
+	// Дашборд выводит все метрики отсортированными, поэтому для одинаковых репозиториев html одинаковый
 	// Второй вариант сравнить их json представление
-	assert.Equal(t, repository.RenderHTML(repo.ToMetrics()), repository.RenderHTML(newRepo.ToMetrics()))
+	var page, newPage bytes.Buffer
+	assert.NoError(t, repository.RenderDashboard(&page, repo, repository.DashboardOptions{}))
+	assert.NoError(t, repository.RenderDashboard(&newPage, newRepo, repository.DashboardOptions{}))
+	assert.Equal(t, page.String(), newPage.String())
+	_, ok := newRepo.Metric("testHistogramMetric", repository.Histogram, nil)
+	assert.True(t, ok)
 
 }
 
@@ -71,3 +80,35 @@ func TestNewFileStorage(t *testing.T) {
 	assert.Nil(t, storage.Load())
 	assert.Nil(t, storage.Save(context.Background()))
 }
+
+// TestExpireMetricsFile проверяем что устаревшие метрики удаляются из файла и не возвращаются после перезапуска
+func TestExpireMetricsFile(t *testing.T) {
+	file, err := os.CreateTemp(os.TempDir(), "expire*")
+	assert.NoError(t, err)
+	fileName := file.Name()
+	file.Close()
+	defer os.Remove(fileName)
+
+	conf := config.Config{StoreFile: fileName}
+	conf.MetricTTL = genconfig.Duration{Duration: time.Minute}
+	repo := repository.NewRepository(conf.GeneralCfg())
+	store, err := NewFileStorage(&conf, repo)
+	assert.NoError(t, err)
+
+	repo.UpdateGauge("testGauge", 100)
+	assert.NoError(t, store.Save(context.Background()))
+
+	// метрика еще не устарела
+	assert.NoError(t, ExpireMetrics(context.Background(), repo, store, time.Now()))
+	_, ok := repo.Gauge("testGauge")
+	assert.True(t, ok)
+
+	assert.NoError(t, ExpireMetrics(context.Background(), repo, store, time.Now().Add(time.Hour)))
+	_, ok = repo.Gauge("testGauge")
+	assert.False(t, ok)
+
+	// после перезапуска метрика не восстанавливается
+	newRepo := repository.NewRepository(conf.GeneralCfg())
+	RestoreFromFile(fileName, newRepo)
+	assert.Equal(t, 0, len(newRepo.ToMetrics()))
+}
@@ -1,6 +1,10 @@
 package storage
 
-import "context"
+import (
+	"context"
+
+	"github.com/ncyellow/devops/internal/repository"
+)
 
 // PersistentStorage интерфейс хранилища, для загрузки и сохранения данных
 type PersistentStorage interface {
@@ -8,6 +12,9 @@ type PersistentStorage interface {
 	Save(ctx context.Context) error
 	// Load загрузка данных из хранилища
 	Load() error
+	// Delete удаление метрик из хранилища, чтобы удаленные из репозитория метрики не вернулись при Load.
+	// У метрик используются только имя, метки и тип
+	Delete(ctx context.Context, metrics []repository.Metrics) error
 	// Ping проверка доступности хранилища, возвращает ошибку в случае отсутствия коннекта
 	Ping() error
 	// Close вызывается при окончании работы для закрытия коннектов и закрытия файлов
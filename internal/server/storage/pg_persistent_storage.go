@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/driftprogramming/pgxpoolmock"
@@ -13,6 +15,35 @@ import (
 	"github.com/ncyellow/devops/internal/server/config"
 )
 
+// RunMetricExpirer удаляет устаревшие по TTL метрики из repo и из pStore по таймеру с интервалом interval
+func RunMetricExpirer(repo repository.Repository, pStore PersistentStorage, interval time.Duration) {
+	if interval == 0 {
+		//! TTL не задан, метрики не устаревают
+		return
+	}
+
+	tickerExpire := time.NewTicker(interval)
+	defer tickerExpire.Stop()
+
+	for {
+		<-tickerExpire.C
+		if err := ExpireMetrics(context.Background(), repo, pStore, time.Now()); err != nil {
+			log.Info().Msgf("не удалось удалить устаревшие метрики из хранилища - %s", err.Error())
+		}
+	}
+}
+
+// ExpireMetrics удаляет устаревшие на момент now метрики из repo и сразу из pStore,
+// чтобы они не восстановились после перезапуска
+func ExpireMetrics(ctx context.Context, repo repository.Repository, pStore PersistentStorage, now time.Time) error {
+	expired := repo.Expire(now)
+	if len(expired) == 0 {
+		return nil
+	}
+	log.Info().Msgf("удалено устаревших метрик - %d", len(expired))
+	return pStore.Delete(ctx, expired)
+}
+
 // RunStorageSaver запускает сохранение данных pStore по таймеру с интервалом interval
 func RunStorageSaver(pStore PersistentStorage, interval time.Duration) {
 	if interval == 0 {
@@ -36,6 +67,9 @@ type PgPersistentStorage struct {
 	conf *config.Config
 	pool pgxpoolmock.PgxPool
 	repo repository.Repository
+	// lock сериализует Save и Delete. Снимок репозитория берется под ней, поэтому Save со снимком,
+	// сделанным до удаления ряда, не запишет ряд обратно после Delete
+	lock sync.Mutex
 }
 
 // NewPgStorage конструктор хранилища на основе postgresql, явно не используется, только через фабрику
@@ -66,7 +100,7 @@ func (p *PgPersistentStorage) Load() error {
 	metrics := make([]repository.Metrics, 0)
 
 	//! Загружаем counter метрики
-	counterRows, err := p.pool.Query(context.Background(), `select "metric_name", "value" FROM "counters"`)
+	counterRows, err := p.pool.Query(context.Background(), `select "metric_name", "labels", "value" FROM "counters"`)
 
 	if err != nil {
 		return err
@@ -75,25 +109,31 @@ func (p *PgPersistentStorage) Load() error {
 	defer counterRows.Close()
 	for counterRows.Next() {
 		var metricName string
+		var labels string
 		var delta int64
-		err = counterRows.Scan(&metricName, &delta)
+		err = counterRows.Scan(&metricName, &labels, &delta)
+		if err != nil {
+			return err
+		}
+		metricLabels, err := decodeLabels(labels)
 		if err != nil {
 			return err
 		}
 
 		metrics = append(metrics, repository.Metrics{
-			ID:    metricName,
-			MType: repository.Counter,
-			Delta: &delta,
+			ID:     metricName,
+			Labels: metricLabels,
+			MType:  repository.Counter,
+			Delta:  &delta,
 		})
 	}
 
-	if counterRows.Err() != nil {
+	if err = counterRows.Err(); err != nil {
 		return err
 	}
 
 	//! Загружаем gauge метрики
-	gaugeRows, err := p.pool.Query(context.Background(), `select "metric_name", "value" FROM "gauges"`)
+	gaugeRows, err := p.pool.Query(context.Background(), `select "metric_name", "labels", "value" FROM "gauges"`)
 
 	if err != nil {
 		return err
@@ -102,20 +142,68 @@ func (p *PgPersistentStorage) Load() error {
 
 	for gaugeRows.Next() {
 		var metricName string
+		var labels string
 		var value float64
-		err = gaugeRows.Scan(&metricName, &value)
+		err = gaugeRows.Scan(&metricName, &labels, &value)
+		if err != nil {
+			return err
+		}
+		metricLabels, err := decodeLabels(labels)
 		if err != nil {
 			return err
 		}
 
 		metrics = append(metrics, repository.Metrics{
-			ID:    metricName,
-			MType: repository.Gauge,
-			Value: &value,
+			ID:     metricName,
+			Labels: metricLabels,
+			MType:  repository.Gauge,
+			Value:  &value,
 		})
 	}
 
-	if gaugeRows.Err() != nil {
+	if err = gaugeRows.Err(); err != nil {
+		return err
+	}
+
+	//! Загружаем histogram метрики
+	histogramRows, err := p.pool.Query(context.Background(), `select "metric_name", "labels", "count", "sum", "buckets" FROM "histograms"`)
+
+	if err != nil {
+		return err
+	}
+	defer histogramRows.Close()
+
+	for histogramRows.Next() {
+		var metricName string
+		var labels string
+		var count int64
+		var sum float64
+		var buckets string
+		err = histogramRows.Scan(&metricName, &labels, &count, &sum, &buckets)
+		if err != nil {
+			return err
+		}
+		metricLabels, err := decodeLabels(labels)
+		if err != nil {
+			return err
+		}
+		var metricBuckets []repository.Bucket
+		if err = json.Unmarshal([]byte(buckets), &metricBuckets); err != nil {
+			return err
+		}
+
+		histogramCount := uint64(count)
+		metrics = append(metrics, repository.Metrics{
+			ID:      metricName,
+			Labels:  metricLabels,
+			MType:   repository.Histogram,
+			Buckets: metricBuckets,
+			Count:   &histogramCount,
+			Sum:     &sum,
+		})
+	}
+
+	if err = histogramRows.Err(); err != nil {
 		return err
 	}
 
@@ -124,6 +212,8 @@ func (p *PgPersistentStorage) Load() error {
 }
 
 func (p *PgPersistentStorage) Save(ctx context.Context) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 
 	metrics := p.repo.ToMetrics()
 	if len(metrics) == 0 {
@@ -136,9 +226,9 @@ func (p *PgPersistentStorage) Save(ctx context.Context) error {
 	}
 
 	desc, err := tx.Prepare(ctx, repository.Gauge, `
-	INSERT INTO "gauges"("metric_name", "value")
-	VALUES ($1, $2)
-	ON CONFLICT ("metric_name") 
+	INSERT INTO "gauges"("metric_name", "labels", "value")
+	VALUES ($1, $2, $3)
+	ON CONFLICT ("metric_name", "labels") 
 	DO 
    	UPDATE SET value = EXCLUDED.value
 	`)
@@ -149,9 +239,9 @@ func (p *PgPersistentStorage) Save(ctx context.Context) error {
 	}
 
 	desc, err = tx.Prepare(ctx, repository.Counter, `
-	INSERT INTO "counters"("metric_name", "value")
-	VALUES ($1, $2)
-	ON CONFLICT ("metric_name") 
+	INSERT INTO "counters"("metric_name", "labels", "value")
+	VALUES ($1, $2, $3)
+	ON CONFLICT ("metric_name", "labels") 
 	DO 
    	UPDATE SET value = EXCLUDED.value
 	`)
@@ -161,13 +251,26 @@ func (p *PgPersistentStorage) Save(ctx context.Context) error {
 		return err
 	}
 
+	desc, err = tx.Prepare(ctx, repository.Histogram, `
+	INSERT INTO "histograms"("metric_name", "labels", "count", "sum", "buckets")
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT ("metric_name", "labels") 
+	DO 
+   	UPDATE SET count = EXCLUDED.count, sum = EXCLUDED.sum, buckets = EXCLUDED.buckets
+	`)
+
+	if err != nil {
+		log.Info().Msgf("cant create prepare stmt - %s", desc.Name)
+		return err
+	}
+
 	// Я бы, конечно, так не делал. Лучше уж делать truncate и через COPY писать все разом. Но раз упражнение
 	// требует prepare stmt + транзакцию то ок. Но мы так получим дикие проблемы с VACUUM. В таблице будет оч много
 	// мертвых кортежей
 	for _, value := range metrics {
 		switch value.MType {
 		case repository.Gauge:
-			tag, err := tx.Exec(ctx, repository.Gauge, value.ID, *value.Value)
+			tag, err := tx.Exec(ctx, repository.Gauge, value.ID, encodeLabels(value.Labels), *value.Value)
 
 			if err != nil || !tag.Insert() {
 				log.Info().Msgf("insert gauges failed - %s", err.Error())
@@ -177,7 +280,7 @@ func (p *PgPersistentStorage) Save(ctx context.Context) error {
 				return err
 			}
 		case repository.Counter:
-			tag, err := tx.Exec(ctx, repository.Counter, value.ID, *value.Delta)
+			tag, err := tx.Exec(ctx, repository.Counter, value.ID, encodeLabels(value.Labels), *value.Delta)
 
 			if err != nil || !tag.Insert() {
 				log.Info().Msgf("insert counters failed - %s", err.Error())
@@ -186,6 +289,21 @@ func (p *PgPersistentStorage) Save(ctx context.Context) error {
 				}
 				return err
 			}
+		case repository.Histogram:
+			buckets, err := json.Marshal(value.Buckets)
+			if err != nil {
+				return err
+			}
+			tag, err := tx.Exec(ctx, repository.Histogram, value.ID, encodeLabels(value.Labels),
+				int64(*value.Count), *value.Sum, string(buckets))
+
+			if err != nil || !tag.Insert() {
+				log.Info().Msgf("insert histograms failed - %s", err.Error())
+				if err = tx.Rollback(ctx); err != nil {
+					log.Info().Msgf("update drivers: unable to rollback - %s", err.Error())
+				}
+				return err
+			}
 		}
 	}
 
@@ -196,15 +314,66 @@ func (p *PgPersistentStorage) Save(ctx context.Context) error {
 	return nil
 }
 
+func (p *PgPersistentStorage) Delete(ctx context.Context, metrics []repository.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range metrics {
+		table, ok := metricTables[value.MType]
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM "`+table+`" WHERE "metric_name" = $1 AND "labels" = $2`,
+			value.ID, encodeLabels(value.Labels))
+		if err != nil {
+			log.Info().Msgf("delete %s failed - %s", table, err.Error())
+			if err := tx.Rollback(ctx); err != nil {
+				log.Info().Msgf("delete metrics: unable to rollback - %s", err.Error())
+			}
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Info().Msgf("delete metrics: unable to commit - %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// metricTables таблицы хранения метрик по типам
+var metricTables = map[string]string{
+	repository.Gauge:     "gauges",
+	repository.Counter:   "counters",
+	repository.Histogram: "histograms",
+}
+
 // init инициализация базы данных. Надо бы будет оформить через migrate, но пока так
 func (p *PgPersistentStorage) init() {
 
 	// Создаем нужные таблицы если их нет и индекс для уникальности имени метрики в таблице
+	// Метки храним как json текст: json.Marshal сортирует ключи, поэтому представление каноническое и годится
+	// для уникального индекса. Старые таблицы без меток дополняем колонкой и пересоздаем индекс
 	queries := []string{
-		`CREATE TABLE IF NOT EXISTS "counters"("@counters" bigserial, "metric_name" text NOT NULL, "value" bigint)`,
-		`CREATE UNIQUE INDEX IF NOT EXISTS "icounters-metric_name" ON "counters" USING btree ("metric_name")`,
-		`CREATE TABLE IF NOT EXISTS "gauges"("@gauges" bigserial,"metric_name" text NOT NULL,"value" double precision)`,
-		`CREATE UNIQUE INDEX IF NOT EXISTS "igauges-metric_name" ON "gauges" USING btree ("metric_name")`,
+		`CREATE TABLE IF NOT EXISTS "counters"("@counters" bigserial, "metric_name" text NOT NULL, "labels" text NOT NULL DEFAULT '{}', "value" bigint)`,
+		`ALTER TABLE "counters" ADD COLUMN IF NOT EXISTS "labels" text NOT NULL DEFAULT '{}'`,
+		`DROP INDEX IF EXISTS "icounters-metric_name"`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "icounters-metric_name-labels" ON "counters" USING btree ("metric_name", "labels")`,
+		`CREATE TABLE IF NOT EXISTS "gauges"("@gauges" bigserial,"metric_name" text NOT NULL, "labels" text NOT NULL DEFAULT '{}', "value" double precision)`,
+		`ALTER TABLE "gauges" ADD COLUMN IF NOT EXISTS "labels" text NOT NULL DEFAULT '{}'`,
+		`DROP INDEX IF EXISTS "igauges-metric_name"`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "igauges-metric_name-labels" ON "gauges" USING btree ("metric_name", "labels")`,
+		// Корзины гистограммы храним json массивом, набор корзин у каждого ряда свой
+		`CREATE TABLE IF NOT EXISTS "histograms"("@histograms" bigserial, "metric_name" text NOT NULL, "labels" text NOT NULL DEFAULT '{}', "count" bigint, "sum" double precision, "buckets" text NOT NULL DEFAULT '[]')`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "ihistograms-metric_name-labels" ON "histograms" USING btree ("metric_name", "labels")`,
 	}
 
 	for _, query := range queries {
@@ -214,3 +383,27 @@ func (p *PgPersistentStorage) init() {
 		}
 	}
 }
+
+// encodeLabels представление меток для хранения в базе. Пустой набор меток хранится как '{}'
+func encodeLabels(labels repository.Labels) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// decodeLabels разбор меток прочитанных из базы
+func decodeLabels(data string) (repository.Labels, error) {
+	if data == "" || data == "{}" {
+		return nil, nil
+	}
+	var labels repository.Labels
+	if err := json.Unmarshal([]byte(data), &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
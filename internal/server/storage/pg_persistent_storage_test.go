@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/driftprogramming/pgxpoolmock"
 	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/ncyellow/devops/internal/repository"
 	"github.com/ncyellow/devops/internal/server/config"
 	"github.com/stretchr/testify/assert"
@@ -69,28 +73,46 @@ func (suite *PgStorageSuite) TestPing() {
 // Repository
 func (suite *PgStorageSuite) TestLoad() {
 
-	counterColumns := []string{"metric_name", "value"}
+	counterColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsCounter := pgxpoolmock.NewRows(counterColumns).
-		AddRow("testCounter", int64(100)).
-		AddRow("minCounter", int64(10)).
+		AddRow("testCounter", "{}", int64(100)).
+		AddRow("minCounter", "{}", int64(10)).
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "counters"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
 		Return(pgxRowsCounter, nil)
 
-	gaugeColumns := []string{"metric_name", "value"}
+	gaugeColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsGauge := pgxpoolmock.NewRows(gaugeColumns).
-		AddRow("testGauge", 110.5).
-		AddRow("maxGauge", 11.5).
+		AddRow("testGauge", "{}", 110.5).
+		AddRow("testGauge", `{"host":"agent1"}`, 11.5).
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "gauges"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "gauges"`, gomock.Any()).
 		Return(pgxRowsGauge, nil)
+
+	histogramColumns := []string{"metric_name", "labels", "count", "sum", "buckets"}
+	pgxRowsHistogram := pgxpoolmock.NewRows(histogramColumns).
+		AddRow("latency", "{}", int64(10), 2.5, `[{"le":0.1,"count":4},{"le":1,"count":9}]`).
+		ToPgxRows()
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "count", "sum", "buckets" FROM "histograms"`, gomock.Any()).
+		Return(pgxRowsHistogram, nil)
 	err := suite.saver.Load()
 	assert.NoError(suite.T(), err)
 
-	// Должно быть 4 метрики в репозитории 2 gauge + 2 counter
-	assert.Equal(suite.T(), len(suite.repo.ToMetrics()), 4)
+	// Должно быть 5 метрик в репозитории 2 gauge + 2 counter + 1 histogram
+	assert.Equal(suite.T(), len(suite.repo.ToMetrics()), 5)
+
+	histogram, ok := suite.repo.Metric("latency", repository.Histogram, nil)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), uint64(10), *histogram.Count)
+	assert.Equal(suite.T(), []repository.Bucket{{UpperBound: 0.1, Count: 4}, {UpperBound: 1, Count: 9}}, histogram.Buckets)
+
+	// Ряды с одинаковым именем, но разными метками не перезаписывают друг друга
+	val, ok := suite.repo.Metric("testGauge", repository.Gauge, repository.Labels{"host": "agent1"})
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 11.5, *val.Value)
 
 	// Убираем метрики чтобы каждый тест начинался с чистыми метриками
 	suite.repo.Clear()
@@ -100,22 +122,22 @@ func (suite *PgStorageSuite) TestLoad() {
 // В результате такой ошибки метрики не будут прочитаны
 func (suite *PgStorageSuite) TestCounterFailedLoad() {
 
-	counterColumns := []string{"metric_name", "value"}
+	counterColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsCounter := pgxpoolmock.NewRows(counterColumns).
-		AddRow("testCounter", 100).
-		AddRow("minCounter", 10).
+		AddRow("testCounter", "{}", 100).
+		AddRow("minCounter", "{}", 10).
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "counters"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
 		Return(pgxRowsCounter, nil)
 
-	gaugeColumns := []string{"metric_name", "value"}
+	gaugeColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsGauge := pgxpoolmock.NewRows(gaugeColumns).
-		AddRow("testGauge", 110.5).
-		AddRow("maxGauge", 11.5).
+		AddRow("testGauge", "{}", 110.5).
+		AddRow("maxGauge", "{}", 11.5).
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "gauges"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "gauges"`, gomock.Any()).
 		Return(pgxRowsGauge, nil)
 	err := suite.saver.Load()
 
@@ -133,22 +155,22 @@ func (suite *PgStorageSuite) TestCounterFailedLoad() {
 // В результате такой ошибки метрики не будут прочитаны
 func (suite *PgStorageSuite) TestGaugeFailedLoad() {
 
-	counterColumns := []string{"metric_name", "value"}
+	counterColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsCounter := pgxpoolmock.NewRows(counterColumns).
-		AddRow("testCounter", int64(100)).
-		AddRow("minCounter", int64(10)).
+		AddRow("testCounter", "{}", int64(100)).
+		AddRow("minCounter", "{}", int64(10)).
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "counters"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
 		Return(pgxRowsCounter, nil)
 
-	gaugeColumns := []string{"metric_name", "value"}
+	gaugeColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsGauge := pgxpoolmock.NewRows(gaugeColumns).
-		AddRow("testGauge", "test").
-		AddRow("maxGauge", "test").
+		AddRow("testGauge", "{}", "test").
+		AddRow("maxGauge", "{}", "test").
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "gauges"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "gauges"`, gomock.Any()).
 		Return(pgxRowsGauge, nil)
 	err := suite.saver.Load()
 
@@ -165,16 +187,16 @@ func (suite *PgStorageSuite) TestGaugeFailedLoad() {
 // TestGaugeQueryFailedLoad проверка кейса когда запрос gauge метрик падает с ошибкой. Метрики будут пустые
 func (suite *PgStorageSuite) TestGaugeQueryFailedLoad() {
 
-	counterColumns := []string{"metric_name", "value"}
+	counterColumns := []string{"metric_name", "labels", "value"}
 	pgxRowsCounter := pgxpoolmock.NewRows(counterColumns).
-		AddRow("testCounter", int64(100)).
-		AddRow("minCounter", int64(10)).
+		AddRow("testCounter", "{}", int64(100)).
+		AddRow("minCounter", "{}", int64(10)).
 		ToPgxRows()
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "counters"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
 		Return(pgxRowsCounter, nil)
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "gauges"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "gauges"`, gomock.Any()).
 		Return(nil, errors.New("some error"))
 	err := suite.saver.Load()
 
@@ -191,7 +213,7 @@ func (suite *PgStorageSuite) TestGaugeQueryFailedLoad() {
 // TestCounterQueryFailedLoad проверка кейса когда запрос counter метрик падает с ошибкой. Метрики будут пустые
 func (suite *PgStorageSuite) TestCounterQueryFailedLoad() {
 
-	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "value" FROM "counters"`, gomock.Any()).
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
 		Return(nil, errors.New("some error"))
 
 	err := suite.saver.Load()
@@ -205,3 +227,198 @@ func (suite *PgStorageSuite) TestCounterQueryFailedLoad() {
 	// Убираем метрики чтобы каждый тест начинался с чистыми метриками
 	suite.repo.Clear()
 }
+
+// TestHistogramQueryFailedLoad проверка кейса когда запрос histogram метрик падает с ошибкой. Метрики будут пустые
+func (suite *PgStorageSuite) TestHistogramQueryFailedLoad() {
+	counterColumns := []string{"metric_name", "labels", "value"}
+	pgxRowsCounter := pgxpoolmock.NewRows(counterColumns).
+		AddRow("testCounter", "{}", int64(100)).
+		ToPgxRows()
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
+		Return(pgxRowsCounter, nil)
+
+	gaugeColumns := []string{"metric_name", "labels", "value"}
+	pgxRowsGauge := pgxpoolmock.NewRows(gaugeColumns).
+		AddRow("testGauge", "{}", 110.5).
+		ToPgxRows()
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "gauges"`, gomock.Any()).
+		Return(pgxRowsGauge, nil)
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "count", "sum", "buckets" FROM "histograms"`, gomock.Any()).
+		Return(nil, errors.New("some error"))
+
+	err := suite.saver.Load()
+	// Будет ошибка, так как упал запрос за метриками histogram
+	assert.Error(suite.T(), err)
+	// список метрик пустой так как выпала ошибка
+	assert.Equal(suite.T(), len(suite.repo.ToMetrics()), 0)
+
+	// Убираем метрики чтобы каждый тест начинался с чистыми метриками
+	suite.repo.Clear()
+}
+
+// TestHistogramRowsFailedLoad проверка кейса когда чтение строк histogram прерывается ошибкой. Метрики будут пустые
+func (suite *PgStorageSuite) TestHistogramRowsFailedLoad() {
+	counterColumns := []string{"metric_name", "labels", "value"}
+	pgxRowsCounter := pgxpoolmock.NewRows(counterColumns).
+		AddRow("testCounter", "{}", int64(100)).
+		ToPgxRows()
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "counters"`, gomock.Any()).
+		Return(pgxRowsCounter, nil)
+
+	gaugeColumns := []string{"metric_name", "labels", "value"}
+	pgxRowsGauge := pgxpoolmock.NewRows(gaugeColumns).
+		AddRow("testGauge", "{}", 110.5).
+		ToPgxRows()
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "value" FROM "gauges"`, gomock.Any()).
+		Return(pgxRowsGauge, nil)
+
+	histogramColumns := []string{"metric_name", "labels", "count", "sum", "buckets"}
+	pgxRowsHistogram := pgxpoolmock.NewRows(histogramColumns).
+		AddRow("testHistogram", "{}", int64(2), 0.5, `[{"le":1,"count":2}]`).
+		RowError(1, errors.New("connection lost")).
+		ToPgxRows()
+
+	suite.mockPool.EXPECT().Query(gomock.Any(), `select "metric_name", "labels", "count", "sum", "buckets" FROM "histograms"`, gomock.Any()).
+		Return(pgxRowsHistogram, nil)
+
+	err := suite.saver.Load()
+	// Ошибка чтения строк возвращается, а не теряется
+	assert.EqualError(suite.T(), err, "connection lost")
+	assert.Equal(suite.T(), len(suite.repo.ToMetrics()), 0)
+
+	suite.repo.Clear()
+}
+
+// fakeTx транзакция, запоминающая запросы. pgxpoolmock не содержит мока транзакции
+type fakeTx struct {
+	pgx.Tx
+	execErr    error
+	queries    []string
+	args       [][]interface{}
+	committed  bool
+	rolledBack bool
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	tx.queries = append(tx.queries, sql)
+	tx.args = append(tx.args, arguments)
+	return pgconn.CommandTag("DELETE 1"), tx.execErr
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) error {
+	tx.committed = true
+	return nil
+}
+
+func (tx *fakeTx) Rollback(ctx context.Context) error {
+	tx.rolledBack = true
+	return nil
+}
+
+// TestDelete проверка удаления метрик. Пустой список не открывает транзакцию, ошибка транзакции возвращается
+func (suite *PgStorageSuite) TestDelete() {
+	err := suite.saver.Delete(context.Background(), nil)
+	assert.NoError(suite.T(), err)
+
+	suite.mockPool.EXPECT().Begin(gomock.Any()).Return(nil, errors.New("some error"))
+	err = suite.saver.Delete(context.Background(), []repository.Metrics{{ID: "testGauge", MType: repository.Gauge}})
+	assert.Error(suite.T(), err)
+}
+
+// TestDeleteSuccess удаление каждой метрики из таблицы ее типа по имени и меткам одной транзакцией.
+// Метрики неизвестного типа пропускаются
+func (suite *PgStorageSuite) TestDeleteSuccess() {
+	tx := &fakeTx{}
+	suite.mockPool.EXPECT().Begin(gomock.Any()).Return(tx, nil)
+	err := suite.saver.Delete(context.Background(), []repository.Metrics{
+		{ID: "testGauge", MType: repository.Gauge, Labels: repository.Labels{"host": "web01"}},
+		{ID: "testCounter", MType: repository.Counter},
+		{ID: "unknown", MType: "unknown"},
+	})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{
+		`DELETE FROM "gauges" WHERE "metric_name" = $1 AND "labels" = $2`,
+		`DELETE FROM "counters" WHERE "metric_name" = $1 AND "labels" = $2`,
+	}, tx.queries)
+	assert.Equal(suite.T(), []interface{}{"testGauge", encodeLabels(repository.Labels{"host": "web01"})}, tx.args[0])
+	assert.Equal(suite.T(), []interface{}{"testCounter", encodeLabels(nil)}, tx.args[1])
+	assert.True(suite.T(), tx.committed)
+	assert.False(suite.T(), tx.rolledBack)
+}
+
+// TestDeleteExecFailed ошибка запроса откатывает транзакцию и возвращается
+func (suite *PgStorageSuite) TestDeleteExecFailed() {
+	tx := &fakeTx{execErr: errors.New("delete failed")}
+	suite.mockPool.EXPECT().Begin(gomock.Any()).Return(tx, nil)
+	err := suite.saver.Delete(context.Background(), []repository.Metrics{
+		{ID: "testGauge", MType: repository.Gauge},
+		{ID: "testCounter", MType: repository.Counter},
+	})
+	assert.EqualError(suite.T(), err, "delete failed")
+	assert.Len(suite.T(), tx.queries, 1)
+	assert.True(suite.T(), tx.rolledBack)
+	assert.False(suite.T(), tx.committed)
+}
+
+// blockingTx транзакция сохранения, которая не фиксируется до закрытия release
+type blockingTx struct {
+	fakeTx
+	started chan struct{}
+	release chan struct{}
+}
+
+func (tx *blockingTx) Prepare(ctx context.Context, name, sql string) (*pgconn.StatementDescription, error) {
+	return &pgconn.StatementDescription{Name: name}, nil
+}
+
+func (tx *blockingTx) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag("INSERT 0 1"), nil
+}
+
+func (tx *blockingTx) Commit(ctx context.Context) error {
+	close(tx.started)
+	<-tx.release
+	tx.committed = true
+	return nil
+}
+
+// TestSaveDeleteSerialized удаление ждет завершения идущего сохранения, иначе сохранение со старым снимком
+// записало бы удаленный ряд обратно
+func (suite *PgStorageSuite) TestSaveDeleteSerialized() {
+	suite.repo.UpdateGauge("testGauge", 1)
+	saveTx := &blockingTx{started: make(chan struct{}), release: make(chan struct{})}
+	deleteTx := &fakeTx{}
+	gomock.InOrder(
+		suite.mockPool.EXPECT().Begin(gomock.Any()).Return(saveTx, nil),
+		suite.mockPool.EXPECT().Begin(gomock.Any()).DoAndReturn(func(context.Context) (pgx.Tx, error) {
+			assert.True(suite.T(), saveTx.committed)
+			return deleteTx, nil
+		}),
+	)
+
+	saved := make(chan error, 1)
+	go func() {
+		saved <- suite.saver.Save(context.Background())
+	}()
+	<-saveTx.started
+
+	deleted := make(chan error, 1)
+	go func() {
+		deleted <- suite.saver.Delete(context.Background(), []repository.Metrics{{ID: "testGauge", MType: repository.Gauge}})
+	}()
+	select {
+	case <-deleted:
+		suite.T().Fatal("delete finished before save commit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(saveTx.release)
+	assert.NoError(suite.T(), <-saved)
+	assert.NoError(suite.T(), <-deleted)
+	assert.True(suite.T(), deleteTx.committed)
+}
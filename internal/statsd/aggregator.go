@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"math"
+	"sync"
+
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// DefaultTimerBuckets границы корзин гистограммы для таймеров в миллисекундах
+var DefaultTimerBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// gaugeValue накопленное значение gauge за интервал
+type gaugeValue struct {
+	value float64
+	// set true если за интервал было абсолютное значение, иначе value - изменение текущего значения
+	set bool
+}
+
+// timerValue накопленные наблюдения таймера за интервал
+type timerValue struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// series ключ ряда с именем и метками
+type series struct {
+	name   string
+	labels repository.Labels
+}
+
+// Aggregator накапливает значения StatsD до Flush. Counter суммируется с учетом sample rate,
+// gauge хранит последнее значение, таймеры собираются в гистограмму, set считает уникальные значения
+type Aggregator struct {
+	mu       sync.Mutex
+	bounds   []float64
+	series   map[string]series
+	counters map[string]float64
+	gauges   map[string]gaugeValue
+	timers   map[string]*timerValue
+	sets     map[string]map[string]struct{}
+}
+
+// NewAggregator конструктор, bounds - границы корзин таймеров по возрастанию, nil - DefaultTimerBuckets
+func NewAggregator(bounds []float64) *Aggregator {
+	if bounds == nil {
+		bounds = DefaultTimerBuckets
+	}
+	agg := Aggregator{bounds: bounds}
+	agg.reset()
+	return &agg
+}
+
+// reset очистка накопленных значений, вызывается под блокировкой
+func (a *Aggregator) reset() {
+	a.series = make(map[string]series)
+	a.counters = make(map[string]float64)
+	a.gauges = make(map[string]gaugeValue)
+	a.timers = make(map[string]*timerValue)
+	a.sets = make(map[string]map[string]struct{})
+}
+
+// Add добавляет значение к накопленным за интервал
+func (a *Aggregator) Add(sample Sample) {
+	key := repository.SeriesKey(sample.Name, sample.Labels)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.series[key] = series{name: sample.Name, labels: sample.Labels}
+
+	switch sample.Type {
+	case TypeCounter:
+		a.counters[key] += sample.Value / sample.SampleRate
+	case TypeGauge:
+		gauge := a.gauges[key]
+		if sample.Relative {
+			gauge.value += sample.Value
+		} else {
+			gauge = gaugeValue{value: sample.Value, set: true}
+		}
+		a.gauges[key] = gauge
+	case TypeTimer, TypeHist:
+		timer, ok := a.timers[key]
+		if !ok {
+			timer = &timerValue{buckets: make([]uint64, len(a.bounds))}
+			a.timers[key] = timer
+		}
+		// при sample rate 0.1 одно значение представляет десять наблюдений
+		weight := uint64(math.Round(1 / sample.SampleRate))
+		for i, bound := range a.bounds {
+			if sample.Value <= bound {
+				timer.buckets[i] += weight
+			}
+		}
+		timer.count += weight
+		timer.sum += sample.Value * float64(weight)
+	case TypeSet:
+		set, ok := a.sets[key]
+		if !ok {
+			set = make(map[string]struct{})
+			a.sets[key] = set
+		}
+		set[sample.Raw] = struct{}{}
+	}
+}
+
+// Flush возвращает накопленные за интервал метрики и начинает новый интервал.
+// Относительные gauge возвращаются отдельно в deltas, их Value - изменение за интервал, которое прибавляется
+// к текущему значению ряда через Repository.AddGauge под блокировкой ряда
+func (a *Aggregator) Flush() (metrics []repository.Metrics, deltas []repository.Metrics) {
+	a.mu.Lock()
+	seriesList, counters, gauges, timers, sets := a.series, a.counters, a.gauges, a.timers, a.sets
+	a.reset()
+	a.mu.Unlock()
+
+	metrics = make([]repository.Metrics, 0, len(seriesList))
+	for key, total := range counters {
+		delta := int64(math.Round(total))
+		s := seriesList[key]
+		metrics = append(metrics, repository.Metrics{ID: s.name, Labels: s.labels, MType: repository.Counter, Delta: &delta})
+	}
+	for key, gauge := range gauges {
+		s := seriesList[key]
+		value := gauge.value
+		metric := repository.Metrics{ID: s.name, Labels: s.labels, MType: repository.Gauge, Value: &value}
+		if gauge.set {
+			metrics = append(metrics, metric)
+		} else {
+			deltas = append(deltas, metric)
+		}
+	}
+	for key, timer := range timers {
+		s := seriesList[key]
+		buckets := make([]repository.Bucket, len(a.bounds))
+		for i, bound := range a.bounds {
+			buckets[i] = repository.Bucket{UpperBound: bound, Count: timer.buckets[i]}
+		}
+		count, sum := timer.count, timer.sum
+		metrics = append(metrics, repository.Metrics{ID: s.name, Labels: s.labels, MType: repository.Histogram,
+			Buckets: buckets, Count: &count, Sum: &sum})
+	}
+	for key, set := range sets {
+		s := seriesList[key]
+		value := float64(len(set))
+		metrics = append(metrics, repository.Metrics{ID: s.name, Labels: s.labels, MType: repository.Gauge, Value: &value})
+	}
+	return metrics, deltas
+}
@@ -0,0 +1,67 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+func TestAggregator(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	repo.UpdateGauge("temperature", 20)
+
+	agg := NewAggregator([]float64{100, 500})
+	for _, line := range []string{
+		"requests:1|c",
+		"requests:1|c|@0.5",
+		"temperature:-2|g",
+		"temperature:+0.5|g",
+		"pressure:1|g",
+		"pressure:3|g",
+		"response_time:50|ms",
+		"response_time:320|ms|@0.5",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	} {
+		sample, err := ParseLine(line)
+		require.NoError(t, err)
+		agg.Add(sample)
+	}
+
+	metrics, deltas := agg.Flush()
+	byName := make(map[string]repository.Metrics)
+	for _, metric := range metrics {
+		byName[metric.ID] = metric
+	}
+	require.Equal(t, 4, len(byName))
+
+	// 1 + 1/0.5
+	assert.Equal(t, int64(3), *byName["requests"].Delta)
+	// относительные изменения возвращаются отдельно и прибавляются к значению в репозитории
+	require.Equal(t, 1, len(deltas))
+	assert.Equal(t, "temperature", deltas[0].ID)
+	assert.Equal(t, -1.5, *deltas[0].Value)
+	repo.AddGauge(deltas[0].ID, deltas[0].Labels, *deltas[0].Value)
+	val, ok := repo.Gauge("temperature")
+	assert.True(t, ok)
+	assert.Equal(t, 18.5, val)
+	// для абсолютного gauge берется последнее значение
+	assert.Equal(t, 3.0, *byName["pressure"].Value)
+	assert.Equal(t, 2.0, *byName["users"].Value)
+
+	timer := byName["response_time"]
+	assert.Equal(t, repository.Histogram, timer.MType)
+	assert.Equal(t, uint64(3), *timer.Count)
+	assert.Equal(t, 690.0, *timer.Sum)
+	assert.Equal(t, []repository.Bucket{{UpperBound: 100, Count: 1}, {UpperBound: 500, Count: 3}}, timer.Buckets)
+
+	// после Flush начинается новый интервал
+	metrics, deltas = agg.Flush()
+	assert.Equal(t, 0, len(metrics))
+	assert.Equal(t, 0, len(deltas))
+}
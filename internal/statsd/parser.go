@@ -0,0 +1,124 @@
+// Package statsd содержит прием метрик по протоколу StatsD: разбор строк name:value|type[|@rate][|#tags],
+// агрегацию за интервал и запись в репозиторий
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+// Типы метрик StatsD
+const (
+	TypeCounter = "c"
+	TypeGauge   = "g"
+	TypeTimer   = "ms"
+	TypeHist    = "h"
+	TypeSet     = "s"
+)
+
+// ErrInvalidLine строка не соответствует формату StatsD
+var ErrInvalidLine = errors.New("invalid statsd line")
+
+// Sample одно значение из пакета StatsD
+type Sample struct {
+	Name string
+	// Labels метки в формате DogStatsD |#key:value,key2:value2
+	Labels repository.Labels
+	Type   string
+	Value  float64
+	// Raw исходное значение, нужно для set, где считаются уникальные строки
+	Raw string
+	// Relative gauge со знаком + или - изменяет текущее значение, а не перезаписывает его
+	Relative bool
+	// SampleRate доля отправленных значений, 1 - отправлены все
+	SampleRate float64
+}
+
+// ParseLine разбор одной строки StatsD
+func ParseLine(line string) (Sample, error) {
+	sample := Sample{SampleRate: 1}
+
+	// двоеточие ищем до первого |, так как в тегах тоже есть двоеточия
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return sample, fmt.Errorf("%w: %s", ErrInvalidLine, line)
+	}
+	colon := strings.LastIndex(line[:pipe], ":")
+	if colon <= 0 {
+		return sample, fmt.Errorf("%w: %s", ErrInvalidLine, line)
+	}
+	sample.Name = line[:colon]
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return sample, fmt.Errorf("%w: %s", ErrInvalidLine, line)
+	}
+	sample.Raw = parts[0]
+	sample.Type = parts[1]
+
+	switch sample.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHist:
+		value, err := strconv.ParseFloat(sample.Raw, 64)
+		if err != nil {
+			return sample, fmt.Errorf("%w: incorrect value %s", ErrInvalidLine, sample.Raw)
+		}
+		sample.Value = value
+		sample.Relative = sample.Type == TypeGauge && (sample.Raw[0] == '+' || sample.Raw[0] == '-')
+	case TypeSet:
+	default:
+		return sample, fmt.Errorf("%w: unknown type %s", ErrInvalidLine, sample.Type)
+	}
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return sample, fmt.Errorf("%w: incorrect sample rate %s", ErrInvalidLine, part)
+			}
+			sample.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			sample.Labels = parseTags(part[1:])
+		}
+	}
+	return sample, nil
+}
+
+// parseTags разбор тегов DogStatsD key:value,key2:value2. Тег без значения становится меткой с пустым значением
+func parseTags(tags string) repository.Labels {
+	labels := make(repository.Labels)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// ParsePacket разбор пакета из нескольких строк. Ошибочные строки пропускаются и возвращаются списком ошибок
+func ParsePacket(packet []byte) ([]Sample, []error) {
+	samples := make([]Sample, 0)
+	errs := make([]error, 0)
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sample, err := ParseLine(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, errs
+}
@@ -0,0 +1,73 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/repository"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Sample
+		wantErr bool
+	}{
+		{
+			name: "counter",
+			line: "requests:1|c",
+			want: Sample{Name: "requests", Type: TypeCounter, Value: 1, Raw: "1", SampleRate: 1},
+		},
+		{
+			name: "counter with sample rate and tags",
+			line: "requests:2|c|@0.5|#host:a,canary",
+			want: Sample{Name: "requests", Type: TypeCounter, Value: 2, Raw: "2", SampleRate: 0.5,
+				Labels: repository.Labels{"host": "a", "canary": ""}},
+		},
+		{
+			name: "gauge",
+			line: "temperature:12.5|g",
+			want: Sample{Name: "temperature", Type: TypeGauge, Value: 12.5, Raw: "12.5", SampleRate: 1},
+		},
+		{
+			name: "relative gauge",
+			line: "temperature:-2|g",
+			want: Sample{Name: "temperature", Type: TypeGauge, Value: -2, Raw: "-2", Relative: true, SampleRate: 1},
+		},
+		{
+			name: "timer",
+			line: "response_time:320|ms",
+			want: Sample{Name: "response_time", Type: TypeTimer, Value: 320, Raw: "320", SampleRate: 1},
+		},
+		{
+			name: "set",
+			line: "users:alice|s",
+			want: Sample{Name: "users", Type: TypeSet, Raw: "alice", SampleRate: 1},
+		},
+		{name: "without type", line: "requests:1", wantErr: true},
+		{name: "without name", line: ":1|c", wantErr: true},
+		{name: "unknown type", line: "requests:1|x", wantErr: true},
+		{name: "incorrect value", line: "requests:abc|c", wantErr: true},
+		{name: "incorrect sample rate", line: "requests:1|c|@2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sample, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, sample)
+		})
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	samples, errs := ParsePacket([]byte("a:1|c\nbroken\n\nb:2|g\n"))
+	assert.Equal(t, 2, len(samples))
+	assert.Equal(t, 1, len(errs))
+}
@@ -0,0 +1,205 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/middlewares"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+const (
+	// DefaultFlushInterval интервал агрегации по умолчанию, как у StatsD
+	DefaultFlushInterval = 10 * time.Second
+	// maxPacketSize максимальный размер UDP пакета
+	maxPacketSize = 65535
+)
+
+// Server прием StatsD по UDP и TCP на одном адресе. По TCP строки разделяются переводом строки.
+// Накопленные значения раз в flushInterval записываются в repo через UpdateMetric и сохраняются в pStore,
+// так же как это делают http обработчики. Протокол StatsD не передает токенов, поэтому прием не проверяет
+// токены и не ограничивает частоту. Доступ ограничивается только сетью trustedSubNet по адресу отправителя,
+// без нее порт нужно открывать только в доверенной сети
+type Server struct {
+	address       string
+	flushInterval time.Duration
+	repo          repository.Repository
+	pStore        storage.PersistentStorage
+	aggregator    *Aggregator
+	// blocker пакеты и соединения не из trustedSubNet отбрасываются
+	blocker *middlewares.IPBlocker
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewServer конструктор, flushInterval <= 0 - DefaultFlushInterval. trustedSubNet - cidr разрешенных отправителей,
+// пусто - без ограничения
+func NewServer(address string, flushInterval time.Duration, trustedSubNet string, repo repository.Repository,
+	pStore storage.PersistentStorage) *Server {
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	return &Server{
+		address:       address,
+		flushInterval: flushInterval,
+		repo:          repo,
+		pStore:        pStore,
+		aggregator:    NewAggregator(nil),
+		blocker:       middlewares.NewIPBlocker(trustedSubNet),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start открывает UDP и TCP порты и запускает прием и сброс метрик в фоне
+func (s *Server) Start() error {
+	udpConn, err := net.ListenPacket("udp", s.address)
+	if err != nil {
+		return err
+	}
+	// если порт был выбран автоматически, TCP слушаем на том же порту
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+	s.udpConn = udpConn
+	s.tcpListener = tcpListener
+
+	s.wg.Add(3)
+	go s.serveUDP()
+	go s.serveTCP()
+	go s.runFlusher()
+	return nil
+}
+
+// Addr адрес на котором принимаются метрики, доступен после Start
+func (s *Server) Addr() net.Addr {
+	return s.udpConn.LocalAddr()
+}
+
+// Stop закрывает порты, дожидается завершения приема и сбрасывает накопленные метрики
+func (s *Server) Stop() {
+	close(s.done)
+	s.udpConn.Close()
+	s.tcpListener.Close()
+	s.wg.Wait()
+	s.Flush(context.Background())
+}
+
+// Flush записывает накопленные метрики в репозиторий и хранилище
+func (s *Server) Flush(ctx context.Context) {
+	metrics, deltas := s.aggregator.Flush()
+	if len(metrics) == 0 && len(deltas) == 0 {
+		return
+	}
+	for _, metric := range deltas {
+		s.repo.AddGauge(metric.ID, metric.Labels, *metric.Value)
+	}
+	for _, metric := range metrics {
+		if err := s.repo.UpdateMetric(metric); err != nil {
+			log.Info().Msgf("statsd: не удалось обновить метрику %s - %s", metric.SeriesKey(), err.Error())
+		}
+	}
+	if err := s.pStore.Save(ctx); err != nil {
+		log.Info().Msgf("statsd: не удалось сохранить метрики - %s", err.Error())
+	}
+}
+
+// handle разбор пакета и накопление значений
+func (s *Server) handle(packet []byte) {
+	samples, errs := ParsePacket(packet)
+	for _, err := range errs {
+		log.Debug().Msgf("statsd: %s", err.Error())
+	}
+	for _, sample := range samples {
+		s.aggregator.Add(sample)
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Info().Msgf("statsd: ошибка чтения udp - %s", err.Error())
+			continue
+		}
+		if !s.blocker.AllowAddr(addr) {
+			log.Debug().Msgf("statsd: пакет от %s не из доверенной сети отброшен", addr)
+			continue
+		}
+		s.handle(buf[:n])
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	var connections sync.WaitGroup
+	defer connections.Wait()
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Info().Msgf("statsd: ошибка tcp соединения - %s", err.Error())
+			continue
+		}
+		if !s.blocker.AllowAddr(conn.RemoteAddr()) {
+			log.Info().Msgf("statsd: соединение от %s не из доверенной сети закрыто", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn построчное чтение tcp соединения до его закрытия или остановки сервера
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handle(scanner.Bytes())
+	}
+}
+
+func (s *Server) runFlusher() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush(context.Background())
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncyellow/devops/internal/genconfig"
+	"github.com/ncyellow/devops/internal/repository"
+	"github.com/ncyellow/devops/internal/server/storage"
+)
+
+func TestServer(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	repo.UpdateGauge("tcp_queue", 10)
+	pStore, _ := storage.NewFakeStorage()
+
+	server := NewServer("127.0.0.1:0", time.Hour, "", repo, pStore)
+	require.NoError(t, server.Start())
+
+	udpConn, err := net.Dial("udp", server.Addr().String())
+	require.NoError(t, err)
+	_, err = udpConn.Write([]byte("udp_requests:2|c\nudp_temperature:12.5|g"))
+	require.NoError(t, err)
+	udpConn.Close()
+
+	tcpConn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	_, err = tcpConn.Write([]byte("tcp_requests:1|c\ntcp_requests:1|c\ntcp_queue:+3|g\n"))
+	require.NoError(t, err)
+	tcpConn.Close()
+
+	// до сброса значения только накапливаются
+	_, ok := repo.Counter("udp_requests")
+	assert.False(t, ok)
+
+	// ждем пока пакеты будут разобраны, Stop сбрасывает накопленное в репозиторий
+	assert.Eventually(t, func() bool {
+		server.aggregator.mu.Lock()
+		defer server.aggregator.mu.Unlock()
+		return len(server.aggregator.series) == 4 && server.aggregator.counters["tcp_requests"] == 2
+	}, time.Second, 10*time.Millisecond)
+	server.Stop()
+
+	val, ok := repo.Counter("udp_requests")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), val)
+
+	gauge, ok := repo.Gauge("udp_temperature")
+	assert.True(t, ok)
+	assert.Equal(t, 12.5, gauge)
+
+	val, ok = repo.Counter("tcp_requests")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), val)
+
+	// относительный gauge прибавляется к значению в репозитории
+	gauge, ok = repo.Gauge("tcp_queue")
+	assert.True(t, ok)
+	assert.Equal(t, 13.0, gauge)
+}
+
+// TestServerTrustedSubNet проверяем что пакеты и соединения не из доверенной сети отбрасываются
+func TestServerTrustedSubNet(t *testing.T) {
+	repo := repository.NewRepository(&genconfig.GeneralConfig{})
+	pStore, _ := storage.NewFakeStorage()
+
+	server := NewServer("127.0.0.1:0", time.Hour, "10.0.0.0/8", repo, pStore)
+	require.NoError(t, server.Start())
+
+	udpConn, err := net.Dial("udp", server.Addr().String())
+	require.NoError(t, err)
+	_, err = udpConn.Write([]byte("udp_requests:2|c"))
+	require.NoError(t, err)
+	udpConn.Close()
+
+	tcpConn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	_, err = tcpConn.Write([]byte("tcp_requests:1|c\n"))
+	require.NoError(t, err)
+	// сервер закрывает соединение не из доверенной сети, не читая его
+	tcpConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = tcpConn.Read(make([]byte, 1))
+	var netErr net.Error
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "соединение не закрыто сервером")
+	tcpConn.Close()
+
+	server.Stop()
+	assert.Equal(t, 0, len(repo.ToMetrics()))
+}